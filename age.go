@@ -0,0 +1,58 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ageSuffix marks source files encrypted with age.
+const ageSuffix = ".age"
+
+var (
+	ageBinary       = flag.String("age-binary", "age", "Path to the age binary used to decrypt .age source files.")
+	ageIdentityFile = flag.String("age-identity-file", "", "Identity file .age source files are decrypted with. The decrypted file is written to the target path without the .age suffix.")
+)
+
+// ageDecrypt decrypts the content of a source file with age, holding the plaintext only in
+// memory.
+func ageDecrypt(filePath string, content []byte) ([]byte, error) {
+	if *ageIdentityFile == "" {
+		return nil, fmt.Errorf("%v is age encrypted but no --age-identity-file was given", filePath)
+	}
+	cmd := exec.Command(*ageBinary, "--decrypt", "--identity", *ageIdentityFile)
+	cmd.Stdin = bytes.NewReader(content)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("age failed to decrypt %v: %v: %s", filePath, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
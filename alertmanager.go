@@ -0,0 +1,105 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	amtoolPath       = flag.String("alertmanager-amtool", "amtool", "Path to the amtool binary rendered Alertmanager config is checked with, using `amtool check-config` and `amtool config routes test`. Required to validate Alertmanager config.")
+	amRouteTestSpecs stringList
+)
+
+func init() {
+	flag.Var(&amRouteTestSpecs, "alertmanager-route-test", "Routing test run against rendered Alertmanager config, as labels and the expected receivers, e.g. \"severity=critical,team=db=>pager|db-slack\". May be repeated.")
+}
+
+// parseRouteTest splits a route test into the labels, as amtool arguments, and the expected
+// receivers.
+func parseRouteTest(spec string) (labels []string, receivers string, err error) {
+	parts := strings.SplitN(spec, "=>", 2)
+	if len(parts) != 2 {
+		return nil, "", fmt.Errorf("route test %q must be labels=>receivers", spec)
+	}
+	for _, pair := range strings.Split(parts[0], ",") {
+		pair = strings.TrimSpace(pair)
+		if !strings.Contains(pair, "=") {
+			return nil, "", fmt.Errorf("route test %q has an invalid label %q", spec, pair)
+		}
+		labels = append(labels, pair)
+	}
+	if strings.TrimSpace(parts[1]) == "" {
+		return nil, "", fmt.Errorf("route test %q expects no receivers", spec)
+	}
+	return labels, strings.Join(strings.Split(parts[1], "|"), ","), nil
+}
+
+// checkRouteTests parses the --alertmanager-route-test flags up front, so that a mistake in
+// one fails at startup rather than every validation.
+func checkRouteTests() error {
+	for _, spec := range amRouteTestSpecs {
+		if _, _, err := parseRouteTest(spec); err != nil {
+			return fmt.Errorf("invalid --alertmanager-route-test: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateAlertmanagerConfig checks the config with amtool, which loads it the way
+// Alertmanager does, and runs any route tests against its routing tree. The rendered files
+// are staged together in dir so templates resolve relative to the config.
+func validateAlertmanagerConfig(file renderedFile, dir string) error {
+	amtool, err := exec.LookPath(*amtoolPath)
+	if err != nil {
+		return fmt.Errorf("--alertmanager-amtool is needed to validate Alertmanager config: %v", err)
+	}
+	configFile := path.Join(dir, file.name)
+
+	out, err := exec.Command(amtool, "check-config", configFile).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("amtool check-config failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	log.Debugf("amtool check-config: %s", out)
+
+	for _, spec := range amRouteTestSpecs {
+		labels, receivers, err := parseRouteTest(spec)
+		if err != nil {
+			return err
+		}
+		args := append([]string{"config", "routes", "test", "--config.file=" + configFile, "--verify.receivers=" + receivers}, labels...)
+		out, err := exec.Command(amtool, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("route test %q failed: %v: %s", spec, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
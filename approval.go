@@ -0,0 +1,217 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	requireApproval   = flag.Bool("require-approval", false, "Hold rendered changes, including the first run, until they are approved by a POST to /approve with the hash GET /approve lists for them, or through --approval-file, before writing them and reloading. Only applies to the watch command.")
+	approvalTokenFile = flag.String("approval-token-file", "", "File holding a bearer token that POSTs to /approve must carry. /approve is disabled when unset, unless --oidc-issuer-url is.")
+	approvalFile      = flag.String("approval-file", "", "File whose creation approves the staged changes. It is removed once the approval has been taken.")
+)
+
+// errAwaitingApproval is returned by a pipeline run whose changes have been staged for approval.
+var errAwaitingApproval = errors.New("changes are awaiting approval")
+
+// stagedChange is a validated render held until it is approved.
+type stagedChange struct {
+	Pipeline string    `json:"pipeline"`
+	Hash     string    `json:"hash"`
+	Files    []string  `json:"files"`
+	Since    time.Time `json:"since"`
+}
+
+// approvalGate holds each pipeline's rendered changes until they are approved. An approval
+// covers the render that was staged, if the files change in the meantime the new render has to
+// be approved in turn.
+type approvalGate struct {
+	mu       sync.Mutex
+	staged   map[string]*stagedChange
+	approved map[string]string
+	notify   map[string]chan struct{}
+}
+
+// approvals is the gate used by the watch command, nil when --require-approval isn't set.
+var approvals *approvalGate
+
+func newApprovalGate() *approvalGate {
+	return &approvalGate{
+		staged:   map[string]*stagedChange{},
+		approved: map[string]string{},
+		notify:   map[string]chan struct{}{},
+	}
+}
+
+// approvedChannel returns the channel signalled when the pipeline's staged changes are
+// approved. A nil gate returns a nil channel, which is never signalled.
+func (g *approvalGate) approvedChannel(pipeline string) <-chan struct{} {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.notify[pipeline] == nil {
+		g.notify[pipeline] = make(chan struct{}, 1)
+	}
+	return g.notify[pipeline]
+}
+
+// check reports whether the rendered files may be written, staging them when they haven't
+// been approved yet. A nil gate lets everything through.
+func (g *approvalGate) check(logger *log.Entry, pipeline string, rendered []renderedFile) bool {
+	if g == nil {
+		return true
+	}
+	hash := renderHash(rendered)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.approved[pipeline] == hash {
+		delete(g.approved, pipeline)
+		delete(g.staged, pipeline)
+		return true
+	}
+	delete(g.approved, pipeline)
+	if staged := g.staged[pipeline]; staged != nil && staged.Hash == hash {
+		return false
+	}
+
+	staged := &stagedChange{Pipeline: pipeline, Hash: hash, Files: []string{}, Since: time.Now()}
+	for _, file := range rendered {
+		staged.Files = append(staged.Files, file.source)
+	}
+	g.staged[pipeline] = staged
+	logger.WithField("hash", hash).Infof("Staged %d files, waiting for approval", len(rendered))
+	return false
+}
+
+// approve approves the staged changes with the given hashes, returning them. Every hash has
+// to match a staged render, as a render staged since the approver looked isn't covered by
+// their approval, otherwise nothing is approved.
+func (g *approvalGate) approve(by string, hashes []string) ([]*stagedChange, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	approving := map[string]bool{}
+	for _, hash := range hashes {
+		found := false
+		for _, staged := range g.staged {
+			found = found || staged.Hash == hash
+		}
+		if !found {
+			return nil, fmt.Errorf("%v isn't staged, the staged changes have moved on", hash)
+		}
+		approving[hash] = true
+	}
+
+	approved := []*stagedChange{}
+	for pipeline, staged := range g.staged {
+		if !approving[staged.Hash] {
+			continue
+		}
+		g.approved[pipeline] = staged.Hash
+		approved = append(approved, staged)
+		log.WithField("pipeline", pipeline).WithField("hash", staged.Hash).Infof("Changes approved by %v", by)
+		audit.record(auditEntry{Action: "approve", Pipeline: pipeline, User: by, NewHash: staged.Hash, Result: resultString(nil)})
+		if notify := g.notify[pipeline]; notify != nil {
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+	sort.Slice(approved, func(i, j int) bool { return approved[i].Pipeline < approved[j].Pipeline })
+	return approved, nil
+}
+
+func (g *approvalGate) pending() []*stagedChange {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	pending := []*stagedChange{}
+	for _, staged := range g.staged {
+		pending = append(pending, staged)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Pipeline < pending[j].Pipeline })
+	return pending
+}
+
+// approvalHandler lists the staged changes on GET and approves them on POST, which names
+// the hash of each staged change it approves.
+func (g *approvalGate) approvalHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		changes := []*stagedChange{}
+		switch r.Method {
+		case http.MethodGet:
+			changes = g.pending()
+		case http.MethodPost:
+			r.ParseForm()
+			hashes := r.Form["hash"]
+			if len(hashes) == 0 {
+				http.Error(w, "hash is required, GET /approve lists the staged changes", http.StatusBadRequest)
+				return
+			}
+			var err error
+			if changes, err = g.approve(requester(r), hashes); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(changes)
+	})
+}
+
+// watchApprovalFile approves the staged changes whenever path is created, removing it again.
+func (g *approvalGate) watchApprovalFile(path string) {
+	for range time.Tick(time.Second) {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		hashes := []string{}
+		for _, staged := range g.pending() {
+			hashes = append(hashes, staged.Hash)
+		}
+		if len(hashes) > 0 {
+			g.approve(path, hashes)
+		}
+		if err := os.Remove(path); err != nil {
+			log.WithField("file", path).WithError(err).Error("Error removing approval file")
+		}
+	}
+}
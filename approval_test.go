@@ -0,0 +1,171 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stageTestChanges stages a render for each pipeline, returning their hashes by pipeline.
+func stageTestChanges(t *testing.T, gate *approvalGate, pipelines ...string) map[string]string {
+	hashes := map[string]string{}
+	for _, pipeline := range pipelines {
+		rendered := []renderedFile{{source: "/config/" + pipeline + ".yml", name: pipeline + ".yml", content: []byte(pipeline)}}
+		if gate.check(log.NewEntry(log.StandardLogger()), pipeline, rendered) {
+			t.Fatalf("%v's unapproved changes were let through", pipeline)
+		}
+		hashes[pipeline] = renderHash(rendered)
+	}
+	return hashes
+}
+
+func TestApprove(t *testing.T) {
+	tests := []struct {
+		name string
+		// approving names the pipelines whose staged hashes are approved, stale a hash
+		// that was never staged
+		approving []string
+		approved  []string
+		refused   bool
+	}{
+		{"one", []string{"east"}, []string{"east"}, false},
+		{"several", []string{"west", "east"}, []string{"east", "west"}, false},
+		{"stale", []string{"stale"}, nil, true},
+		{"stale among current", []string{"east", "stale"}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gate := newApprovalGate()
+			hashes := stageTestChanges(t, gate, "east", "west")
+			hashes["stale"] = "0000"
+			approving := []string{}
+			for _, pipeline := range test.approving {
+				approving = append(approving, hashes[pipeline])
+			}
+
+			approved, err := gate.approve("alice", approving)
+			if test.refused {
+				if err == nil {
+					t.Fatal("expected approving a hash that isn't staged to be refused")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, change := range approved {
+				got = append(got, change.Pipeline)
+			}
+			if strings.Join(got, ",") != strings.Join(test.approved, ",") {
+				t.Errorf("approved %v, want %v", got, test.approved)
+			}
+			if len(gate.approved) != len(test.approved) {
+				t.Errorf("%d pipelines recorded as approved, want %d", len(gate.approved), len(test.approved))
+			}
+		})
+	}
+}
+
+func TestApprovalCoversStagedRender(t *testing.T) {
+	gate := newApprovalGate()
+	logger := log.NewEntry(log.StandardLogger())
+	approvedCh := gate.approvedChannel("east")
+	hashes := stageTestChanges(t, gate, "east")
+	if _, err := gate.approve("alice", []string{hashes["east"]}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-approvedCh:
+	default:
+		t.Error("expected the approval to be signalled to the pipeline")
+	}
+
+	changed := []renderedFile{{source: "/config/east.yml", name: "east.yml", content: []byte("changed")}}
+	if gate.check(logger, "east", changed) {
+		t.Fatal("a render that changed since the approval was let through")
+	}
+	if len(gate.pending()) != 1 || gate.pending()[0].Hash != renderHash(changed) {
+		t.Fatalf("pending %+v, want the changed render staged", gate.pending())
+	}
+	if _, err := gate.approve("alice", []string{hashes["east"]}); err == nil {
+		t.Error("expected the earlier render's hash to be refused once the staged changes moved on")
+	}
+	if _, err := gate.approve("alice", []string{renderHash(changed)}); err != nil {
+		t.Fatal(err)
+	}
+	if !gate.check(logger, "east", changed) {
+		t.Fatal("the approved render was held")
+	}
+	if len(gate.pending()) != 0 {
+		t.Errorf("pending %+v after the approved render was let through", gate.pending())
+	}
+}
+
+func TestApprovalHandler(t *testing.T) {
+	gate := newApprovalGate()
+	hashes := stageTestChanges(t, gate, "east")
+	handler := gate.approvalHandler()
+
+	tests := []struct {
+		name   string
+		method string
+		hashes []string
+		status int
+	}{
+		{"list", http.MethodGet, nil, http.StatusOK},
+		{"no hash", http.MethodPost, nil, http.StatusBadRequest},
+		{"stale hash", http.MethodPost, []string{"0000"}, http.StatusConflict},
+		{"staged hash", http.MethodPost, []string{hashes["east"]}, http.StatusOK},
+		{"other method", http.MethodDelete, nil, http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			form := url.Values{"hash": test.hashes}
+			req := httptest.NewRequest(test.method, "/approve", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Fatalf("status %v, want %v: %s", rec.Code, test.status, rec.Body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			changes := []*stagedChange{}
+			if err := json.NewDecoder(rec.Body).Decode(&changes); err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) != 1 || changes[0].Hash != hashes["east"] {
+				t.Errorf("replied with %+v, want the staged change", changes)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var auditLogPath = flag.String("audit-log", "", "File that a JSON line is appended to for every change event, rendered file, validation result and reload sent, for reconstructing the history of the config. Disabled when unset.")
+
+// audit is the process wide audit log, nil when disabled.
+var audit *auditLog
+
+// auditEntry is a single line of the audit log. Fields that don't apply to the action are omitted.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Pipeline string    `json:"pipeline,omitempty"`
+	RunID    string    `json:"run_id,omitempty"`
+	File     string    `json:"file,omitempty"`
+	OldHash  string    `json:"old_hash,omitempty"`
+	NewHash  string    `json:"new_hash,omitempty"`
+	Step     string    `json:"step,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	Signal   string    `json:"signal,omitempty"`
+	User     string    `json:"user,omitempty"`
+	// Secret is a secret reference, never its value
+	Secret     string `json:"secret,omitempty"`
+	Cached     bool   `json:"cached,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Result     string `json:"result,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// auditLog appends entries to a JSON lines file. The file is only ever appended to and is
+// synced after each entry so the trail survives a crash.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+
+	// hashes holds the last rendered hash of each file, keyed by pipeline and file name
+	hashes map[string]string
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file, hashes: map[string]string{}}, nil
+}
+
+// record appends an entry, doing nothing when the audit log is disabled.
+func (a *auditLog) record(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.WithError(err).Error("Error encoding audit entry")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.WithError(err).Error("Error writing audit log")
+		return
+	}
+	if err := a.file.Sync(); err != nil {
+		log.WithError(err).Error("Error syncing audit log")
+	}
+}
+
+// rendered records the files of a run whose content changed since they were last rendered.
+func (a *auditLog) rendered(pipeline string, runID string, files []renderedFile) {
+	if a == nil {
+		return
+	}
+	for _, file := range files {
+		sum := sha256.Sum256(file.content)
+		hash := hex.EncodeToString(sum[:])
+		key := pipeline + "/" + file.name
+
+		a.mu.Lock()
+		old := a.hashes[key]
+		a.hashes[key] = hash
+		a.mu.Unlock()
+		if old == hash {
+			continue
+		}
+		a.record(auditEntry{Action: "render", Pipeline: pipeline, RunID: runID, File: file.name, OldHash: old, NewHash: hash})
+	}
+}
+
+// errorString returns the message of err, or an empty string for a nil error.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// resultString describes the outcome of an action for the audit log.
+func resultString(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "ok"
+}
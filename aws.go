@@ -0,0 +1,424 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	awsRegion                = flag.String("aws-region", firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"), "AWS region of the AWS services used, such as secret stores and S3 sources. Defaults to AWS_REGION.")
+	awsSecretsManagerEnabled = flag.Bool("aws-secrets-manager", false, "Resolve ${aws-sm:secret-id#key} references in source files from AWS Secrets Manager. The key picks a field of JSON secrets.")
+)
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// awsCredentials are the keys requests to AWS are signed with.
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	SessionToken    string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// awsClient calls AWS JSON APIs with credentials found the way the AWS SDKs find them:
+// environment variables, a web identity token (IRSA), the ECS or EKS Pod Identity container
+// endpoint, or the EC2 instance metadata service.
+type awsClient struct {
+	region string
+	client *http.Client
+	// metadata talks to link local credential endpoints, bypassing any proxy
+	metadata *http.Client
+
+	mu          sync.Mutex
+	credentials *awsCredentials
+}
+
+func newAWSClient() (*awsClient, error) {
+	if *awsRegion == "" {
+		return nil, fmt.Errorf("--aws-region or AWS_REGION is needed")
+	}
+	return &awsClient{region: *awsRegion, client: reloadClient, metadata: newMetadataClient()}, nil
+}
+
+// currentCredentials returns cached credentials, fetching new ones shortly before they expire.
+func (a *awsClient) currentCredentials() (*awsCredentials, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.credentials != nil && (a.credentials.Expiration.IsZero() || time.Until(a.credentials.Expiration) > 5*time.Minute) {
+		return a.credentials, nil
+	}
+	credentials, err := a.fetchCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("no AWS credentials: %v", err)
+	}
+	a.credentials = credentials
+	return credentials, nil
+}
+
+func (a *awsClient) fetchCredentials() (*awsCredentials, error) {
+	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+		return &awsCredentials{AccessKeyID: key, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); tokenFile != "" {
+		return a.assumeRoleWithWebIdentity(tokenFile, os.Getenv("AWS_ROLE_ARN"))
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return a.containerCredentials("http://169.254.170.2" + uri)
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		return a.containerCredentials(uri)
+	}
+	return a.instanceCredentials()
+}
+
+func (a *awsClient) assumeRoleWithWebIdentity(tokenFile string, roleARN string) (*awsCredentials, error) {
+	token, err := readSecretFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {"prom-config-watcher"},
+		"WebIdentityToken": {token},
+	}
+	body, err := a.get(a.client, fmt.Sprintf("https://sts.%v.amazonaws.com/?%v", a.region, query.Encode()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("assuming role with web identity: %v", err)
+	}
+	result := struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}{}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("decoding STS response: %v", err)
+	}
+	c := result.Credentials
+	return &awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expiration: c.Expiration}, nil
+}
+
+func (a *awsClient) containerCredentials(uri string) (*awsCredentials, error) {
+	headers := map[string]string{}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		headers["Authorization"] = token
+	}
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		token, err := readSecretFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		headers["Authorization"] = token
+	}
+	body, err := a.get(a.metadata, uri, headers)
+	if err != nil {
+		return nil, fmt.Errorf("container credentials: %v", err)
+	}
+	credentials := &awsCredentials{}
+	return credentials, json.Unmarshal(body, credentials)
+}
+
+// instanceCredentials reads the instance role's credentials with IMDSv2.
+func (a *awsClient) instanceCredentials() (*awsCredentials, error) {
+	const imds = "http://169.254.169.254/latest"
+	req, err := http.NewRequest(http.MethodPut, imds+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	resp, err := a.metadata.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata: %v", err)
+	}
+	token, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	headers := map[string]string{"X-aws-ec2-metadata-token": string(token)}
+
+	role, err := a.get(a.metadata, imds+"/meta-data/iam/security-credentials/", headers)
+	if err != nil {
+		return nil, fmt.Errorf("instance role: %v", err)
+	}
+	body, err := a.get(a.metadata, imds+"/meta-data/iam/security-credentials/"+strings.TrimSpace(string(role)), headers)
+	if err != nil {
+		return nil, fmt.Errorf("instance credentials: %v", err)
+	}
+	credentials := &awsCredentials{}
+	return credentials, json.Unmarshal(body, credentials)
+}
+
+func (a *awsClient) get(client *http.Client, uri string, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("status %v: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// call makes a request to an AWS JSON 1.1 API such as secretsmanager.GetSecretValue, decoding
+// the response into out.
+func (a *awsClient) call(service string, target string, input interface{}, out interface{}) error {
+	credentials, err := a.currentCredentials()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://%v.%v.amazonaws.com/", service, a.region), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	signAWSRequest(req, body, credentials, a.region, service, time.Now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		failure := struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}{}
+		json.Unmarshal(respBody, &failure)
+		return fmt.Errorf("%v returned status %v: %v %v", target, resp.StatusCode, failure.Type, failure.Message)
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// rest makes a signed request to an AWS REST or query API such as S3, returning the response
+// body. query is sent as given, encoded with awsURIEncode.
+func (a *awsClient) rest(method string, service string, endpoint string, query map[string]string, body []byte) ([]byte, error) {
+	credentials, err := a.currentCredentials()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = awsQuery(query)
+	req.Header.Set("X-Amz-Content-Sha256", sha256Hex(body))
+	signAWSRequest(req, body, credentials, a.region, service, time.Now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSourceSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(respBody) > maxSourceSize {
+		return nil, fmt.Errorf("response larger than %v bytes", maxSourceSize)
+	}
+	if resp.StatusCode/100 != 2 {
+		failure := struct {
+			Code    string
+			Message string
+		}{}
+		xml.Unmarshal(respBody, &failure)
+		return nil, &awsStatusError{service: service, status: resp.StatusCode, message: strings.TrimSpace(failure.Code + " " + failure.Message)}
+	}
+	return respBody, nil
+}
+
+// awsStatusError is a failed response from a REST API.
+type awsStatusError struct {
+	service string
+	status  int
+	message string
+}
+
+func (e *awsStatusError) Error() string {
+	return fmt.Sprintf("%v returned status %v: %v", e.service, e.status, e.message)
+}
+
+// awsQuery encodes query parameters the way Signature Version 4 expects, sorted and with
+// spaces as %20.
+func awsQuery(query map[string]string) string {
+	names := []string{}
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := []string{}
+	for _, name := range names {
+		pairs = append(pairs, awsURIEncode(name, true)+"="+awsURIEncode(query[name], true))
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode escapes everything but unreserved characters and, for paths, slashes.
+func awsURIEncode(s string, encodeSlash bool) string {
+	encoded := &strings.Builder{}
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+// signAWSRequest adds a Signature Version 4 Authorization header to req.
+func signAWSRequest(req *http.Request, body []byte, credentials *awsCredentials, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%v:%v\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{req.Method, path, strings.Replace(req.URL.Query().Encode(), "+", "%20", -1), canonicalHeaders.String(), signedHeaders, sha256Hex(body)}, "\n")
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := []byte("AWS4" + credentials.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsSecretsManager resolves ${aws-sm:secret-id#key} references. The key selects a field of
+// secrets stored as JSON, without it the whole secret string is used.
+type awsSecretsManager struct {
+	aws *awsClient
+}
+
+func (s *awsSecretsManager) resolve(ref string) (secretValue, error) {
+	id, key := ref, ""
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		id, key = ref[:i], ref[i+1:]
+	}
+	out := struct {
+		SecretString string `json:"SecretString"`
+	}{}
+	if err := s.aws.call("secretsmanager", "secretsmanager.GetSecretValue", map[string]string{"SecretId": id}, &out); err != nil {
+		return secretValue{}, err
+	}
+	if key == "" {
+		return secretValue{value: out.SecretString}, nil
+	}
+	return jsonField(out.SecretString, key)
+}
+
+// jsonField picks key from a secret stored as a JSON object.
+func jsonField(secret string, key string) (secretValue, error) {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return secretValue{}, fmt.Errorf("secret is not a JSON object, so has no key %q", key)
+	}
+	value, found := fields[key]
+	if !found {
+		return secretValue{}, fmt.Errorf("secret has no key %q", key)
+	}
+	if s, isString := value.(string); isString {
+		return secretValue{value: s}, nil
+	}
+	encoded, _ := json.Marshal(value)
+	return secretValue{value: string(encoded)}, nil
+}
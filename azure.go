@@ -0,0 +1,220 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	azureKeyVaultEnabled = flag.Bool("azure-key-vault", false, "Resolve ${azkv:vault/secret#key} references in source files from Azure Key Vault, using the managed or workload identity of the pod. Append /version to the secret to pin a version.")
+	azureClientID        = flag.String("azure-client-id", os.Getenv("AZURE_CLIENT_ID"), "Client id of the user assigned managed identity to use. Defaults to AZURE_CLIENT_ID.")
+)
+
+// azureClient gets access tokens for Azure resources, with AKS workload identity when its
+// federated token is mounted and the instance metadata service's managed identity otherwise.
+type azureClient struct {
+	client   *http.Client
+	metadata *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]azureToken
+}
+
+type azureToken struct {
+	token   string
+	expires time.Time
+}
+
+func newAzureClient() *azureClient {
+	return &azureClient{client: reloadClient, metadata: newMetadataClient(), tokens: map[string]azureToken{}}
+}
+
+// accessToken returns a cached token for resource, fetching a new one shortly before it expires.
+func (a *azureClient) accessToken(resource string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cached, found := a.tokens[resource]; found && time.Until(cached.expires) > 5*time.Minute {
+		return cached.token, nil
+	}
+	var req *http.Request
+	var err error
+	client := a.metadata
+	if tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); tokenFile != "" {
+		req, err = a.workloadIdentityRequest(tokenFile, resource)
+		client = a.client
+	} else {
+		req, err = a.managedIdentityRequest(resource)
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("getting Azure access token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("getting Azure access token returned status %v: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	token := struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("decoding Azure access token: %v", err)
+	}
+	seconds, _ := token.ExpiresIn.Int64()
+	a.tokens[resource] = azureToken{token: token.AccessToken, expires: time.Now().Add(time.Duration(seconds) * time.Second)}
+	return token.AccessToken, nil
+}
+
+// workloadIdentityRequest exchanges the federated service account token for an access token.
+func (a *azureClient) workloadIdentityRequest(tokenFile string, resource string) (*http.Request, error) {
+	assertion, err := readSecretFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	authority := os.Getenv("AZURE_AUTHORITY_HOST")
+	if authority == "" {
+		authority = "https://login.microsoftonline.com/"
+	}
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {*azureClientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {assertion},
+		"scope":                 {strings.TrimSuffix(resource, "/") + "/.default"},
+	}
+	endpoint := fmt.Sprintf("%v/%v/oauth2/v2.0/token", strings.TrimSuffix(authority, "/"), os.Getenv("AZURE_TENANT_ID"))
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+func (a *azureClient) managedIdentityRequest(resource string) (*http.Request, error) {
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {resource}}
+	if *azureClientID != "" {
+		query.Set("client_id", *azureClientID)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	return req, nil
+}
+
+// do sends a request authorized for resource, decoding the JSON response into out, or storing
+// it as is when out is a *[]byte.
+func (a *azureClient) do(req *http.Request, resource string, out interface{}) error {
+	token, err := a.accessToken(resource)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxSourceSize+1))
+	if len(body) > maxSourceSize {
+		return fmt.Errorf("%v response larger than %v bytes", req.URL.Host, maxSourceSize)
+	}
+	if resp.StatusCode/100 != 2 {
+		failure := struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}{}
+		if json.Unmarshal(body, &failure) != nil {
+			// storage services answer in XML
+			storageFailure := struct{ Message string }{}
+			xml.Unmarshal(body, &storageFailure)
+			failure.Error.Message = strings.TrimSpace(storageFailure.Message)
+		}
+		return fmt.Errorf("%v returned status %v: %v", req.URL.Host, resp.StatusCode, failure.Error.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	// storage services answer in XML and blobs are returned as they are
+	if raw, isRaw := out.(*[]byte); isRaw {
+		*raw = body
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// azureKeyVault resolves ${azkv:vault/secret/version#key} references.
+type azureKeyVault struct {
+	azure *azureClient
+}
+
+func (k *azureKeyVault) resolve(ref string) (secretValue, error) {
+	path, key := ref, ""
+	if i := strings.LastIndex(path, "#"); i >= 0 {
+		path, key = path[:i], path[i+1:]
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return secretValue{}, fmt.Errorf("expected vault/secret or vault/secret/version")
+	}
+	vault := parts[0]
+	if !strings.Contains(vault, ".") {
+		vault += ".vault.azure.net"
+	}
+	endpoint := fmt.Sprintf("https://%v/secrets/%v", vault, strings.Join(parts[1:], "/"))
+	req, err := http.NewRequest(http.MethodGet, endpoint+"?api-version=7.4", nil)
+	if err != nil {
+		return secretValue{}, err
+	}
+	out := struct {
+		Value string `json:"value"`
+	}{}
+	if err := k.azure.do(req, "https://vault.azure.net", &out); err != nil {
+		return secretValue{}, err
+	}
+	if key == "" {
+		return secretValue{value: out.Value}, nil
+	}
+	return jsonField(out.Value, key)
+}
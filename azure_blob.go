@@ -0,0 +1,165 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// azureStorageResource is the resource access tokens for Azure Storage are requested for.
+const azureStorageResource = "https://storage.azure.com/"
+
+var (
+	azureBlobSource         = flag.String("azure-blob-source", "", "Azure Blob Storage container and prefix, as account/container/prefix or a container url, whose blobs are synced into --azure-blob-source-dir using the managed or workload identity of the pod.")
+	azureBlobSourceDir      = flag.String("azure-blob-source-dir", "/var/lib/prom-config-watcher/azure-blob", "Directory the blobs of --azure-blob-source are written to, named after the prefix.")
+	azureBlobSourceInterval = flag.Duration("azure-blob-source-interval", time.Minute, "How often --azure-blob-source is listed for changed blobs.")
+)
+
+// azureBlobSync mirrors the blobs under a prefix, downloading only those whose ETag has
+// changed.
+type azureBlobSync struct {
+	azure *azureClient
+	// container is the container url
+	container string
+	prefix    string
+	// etags are the ETags of the blobs written, by file name
+	etags  map[string]string
+	mirror *sourceMirror
+}
+
+func configureAzureBlobSource() error {
+	if *azureBlobSource == "" {
+		return nil
+	}
+	container, prefix, err := parseAzureBlobSource(*azureBlobSource)
+	if err != nil {
+		return err
+	}
+	b := &azureBlobSync{azure: newAzureClient(), container: container, prefix: prefix, etags: map[string]string{}}
+	if b.mirror, err = addMirror("azure-blob", container+"/"+prefix, *azureBlobSourceDir, *azureBlobSourceInterval, b.fetch); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseAzureBlobSource splits a source into the container url and the prefix.
+func parseAzureBlobSource(spec string) (string, string, error) {
+	if !strings.Contains(spec, "://") {
+		parts := strings.SplitN(spec, "/", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return "", "", fmt.Errorf("invalid --azure-blob-source %q, expected account/container/prefix", spec)
+		}
+		spec = fmt.Sprintf("https://%v.blob.core.windows.net/%v", parts[0], parts[1])
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid --azure-blob-source %q: %v", spec, err)
+	}
+	// emulators such as Azurite address the account in the path
+	path := strings.TrimPrefix(u.Path, "/")
+	offset := 0
+	if !strings.Contains(u.Host, ".blob.") {
+		offset = strings.Index(path, "/") + 1
+	}
+	parts := strings.SplitN(path[offset:], "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("--azure-blob-source %q has no container", spec)
+	}
+	prefix := ""
+	if len(parts) == 2 {
+		prefix = parts[1]
+	}
+	return fmt.Sprintf("%v://%v/%v%v", u.Scheme, u.Host, path[:offset], parts[0]), prefix, nil
+}
+
+// fetch lists the prefix and downloads the blobs with a new ETag.
+func (b *azureBlobSync) fetch() (bool, error) {
+	files := map[string][]byte{}
+	etags := map[string]string{}
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {b.prefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		var body []byte
+		if err := b.request(b.container+"?"+query.Encode(), &body); err != nil {
+			return false, fmt.Errorf("listing %v/%v: %v", b.container, b.prefix, err)
+		}
+		page := struct {
+			Blobs []struct {
+				Name string
+				Etag string `xml:"Properties>Etag"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string
+		}{}
+		if err := xml.Unmarshal(body, &page); err != nil {
+			return false, err
+		}
+		for _, blob := range page.Blobs {
+			name := strings.TrimLeft(strings.TrimPrefix(blob.Name, b.prefix), "/")
+			if name == "" || strings.HasSuffix(name, "/") {
+				continue
+			}
+			etags[name] = blob.Etag
+			if _, err := os.Stat(filepath.Join(b.mirror.dir, filepath.FromSlash(name))); err == nil && b.etags[name] == blob.Etag {
+				files[name] = nil
+				continue
+			}
+			var content []byte
+			if err := b.request(b.container+"/"+(&url.URL{Path: blob.Name}).EscapedPath(), &content); err != nil {
+				return false, fmt.Errorf("fetching %v/%v: %v", b.container, blob.Name, err)
+			}
+			files[name] = content
+		}
+		if page.NextMarker == "" {
+			break
+		}
+		marker = page.NextMarker
+	}
+	changed, err := mirrorFiles(b.mirror.dir, files)
+	if err == nil {
+		b.etags = etags
+	}
+	return changed, err
+}
+
+func (b *azureBlobSync) request(endpoint string, body *[]byte) error {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	// bearer tokens need a version from 2017-11-09 on
+	req.Header.Set("x-ms-version", "2021-08-06")
+	return b.azure.do(req, azureStorageResource, body)
+}
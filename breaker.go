@@ -0,0 +1,134 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	breakerThreshold     = flag.Int("breaker-threshold", 0, "Consecutive reload failures after which reloads stop and Prometheus is only probed until it recovers. 0 disables the circuit breaker.")
+	breakerProbeInterval = flag.Duration("breaker-probe-interval", time.Minute, "How often Prometheus is probed while the circuit breaker is open.")
+	breakerWebhookURL    = flag.String("breaker-webhook-url", "", "Url to POST a JSON alert to when the circuit breaker opens or closes.")
+)
+
+// circuitBreaker tracks consecutive reload failures. Once open, reloads are held back and
+// Prometheus is probed on a slow cadence until it responds again.
+type circuitBreaker struct {
+	threshold   int
+	consecutive int
+	open        bool
+	openedAt    time.Time
+	lastErr     error
+}
+
+// breakerAlert is the payload sent to the breaker webhook.
+type breakerAlert struct {
+	State       string    `json:"state"`
+	URL         string    `json:"url"`
+	Failures    int       `json:"consecutive_failures"`
+	Error       string    `json:"error,omitempty"`
+	OpenedAt    time.Time `json:"opened_at"`
+	Timestamp   time.Time `json:"timestamp"`
+	Description string    `json:"description"`
+}
+
+// failure records a failed reload, returning true if it caused the breaker to open.
+func (b *circuitBreaker) failure(err error) bool {
+	b.consecutive++
+	b.lastErr = err
+	if b.open || b.threshold <= 0 || b.consecutive < b.threshold {
+		return false
+	}
+	b.open = true
+	b.openedAt = time.Now()
+	return true
+}
+
+// success records a successful reload or probe, returning true if the breaker was open.
+func (b *circuitBreaker) success() bool {
+	wasOpen := b.open
+	b.consecutive = 0
+	b.open = false
+	b.lastErr = nil
+	return wasOpen
+}
+
+func (b *circuitBreaker) alert(url string) {
+	if *breakerWebhookURL == "" {
+		return
+	}
+
+	alert := breakerAlert{
+		State:     "closed",
+		URL:       url,
+		Failures:  b.consecutive,
+		OpenedAt:  b.openedAt,
+		Timestamp: time.Now(),
+	}
+	if b.open {
+		alert.State = "open"
+		alert.Description = fmt.Sprintf("Reloads to %v have failed %d times in a row, reloads are suspended until it recovers", url, b.consecutive)
+	} else {
+		alert.Description = fmt.Sprintf("Reloads to %v have recovered", url)
+	}
+	if b.lastErr != nil {
+		alert.Error = b.lastErr.Error()
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		log.WithError(err).Error("Error encoding circuit breaker alert")
+		return
+	}
+	resp, err := reloadClient.Post(*breakerWebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.WithError(err).Error("Error sending circuit breaker alert")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Errorf("Circuit breaker webhook returned status %v", resp.StatusCode)
+	}
+}
+
+// probeHealthy checks that the service behind a reload step responds to health checks, or for
+// a signal step without any that its process is running.
+func probeHealthy(step *reloadStep) error {
+	if step.checksProcess() {
+		return processRunning(step.process, step.pidFile)
+	}
+	endpoints, err := step.healthURLs()
+	if err != nil {
+		return err
+	}
+	return checkEndpoint(endpoints[0], step.credentials)
+}
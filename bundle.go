@@ -0,0 +1,171 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var unpackBundles = flag.Bool("unpack-bundles", false, "Unpack .tar.gz, .tgz and .zip files in the watch path and render the files in them in their place, as if they were a directory. Off by default, archives are then processed like any other file.")
+
+// isBundle reports whether name is an archive that is unpacked rather than rendered.
+func isBundle(name string) bool {
+	name = strings.ToLower(name)
+	return *unpackBundles && (strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz") || strings.HasSuffix(name, ".zip"))
+}
+
+// processBundle unpacks a bundle to a scratch directory and renders that. The rendered
+// files' sources are given as paths inside the bundle.
+func processBundle(logger *log.Entry, source sourceFile, expandVars bool, rendered []renderedFile) ([]renderedFile, error) {
+	srcPath := source.path
+	fileLogger := logger.WithField("file", srcPath)
+	files, err := readBundle(srcPath, source.content)
+	if err != nil {
+		fileLogger.WithError(err).Error("Error unpacking bundle")
+		return rendered, fmt.Errorf("%v: %v", srcPath, err)
+	}
+	scratch, err := ioutil.TempDir("", "prom-config-watcher-bundle-")
+	if err != nil {
+		fileLogger.WithError(err).Error("Error unpacking bundle")
+		return rendered, fmt.Errorf("%v: %v", srcPath, err)
+	}
+	defer os.RemoveAll(scratch)
+	if _, err := mirrorFiles(scratch, files); err != nil {
+		fileLogger.WithError(err).Error("Error unpacking bundle")
+		return rendered, fmt.Errorf("%v: %v", srcPath, err)
+	}
+	fileLogger.Debugf("Unpacked %v files from bundle", len(files))
+	unpacked := len(rendered)
+	rendered, err = processConfigChanges(logger, scratch, expandVars, rendered)
+	for i := unpacked; i < len(rendered); i++ {
+		if rel, err := filepath.Rel(scratch, rendered[i].source); err == nil {
+			rendered[i].source = path.Join(srcPath, filepath.ToSlash(rel))
+		}
+	}
+	if err != nil {
+		return rendered, fmt.Errorf("%v: %v", srcPath, err)
+	}
+	return rendered, nil
+}
+
+// readBundle reads the regular files of a bundle by their path within it.
+func readBundle(srcPath string, content []byte) (map[string][]byte, error) {
+	if len(content) > maxSourceSize {
+		return nil, fmt.Errorf("larger than %v bytes", maxSourceSize)
+	}
+	if strings.HasSuffix(strings.ToLower(srcPath), ".zip") {
+		return unzip(content)
+	}
+	return untarGzip(content)
+}
+
+// bundleFiles collects the files of a bundle, refusing paths that would land outside it and
+// more than maxSourceSize bytes in total, which is all a bundle can expand to.
+type bundleFiles struct {
+	files map[string][]byte
+	total int64
+}
+
+func (b *bundleFiles) add(name string, content io.Reader) error {
+	clean := path.Clean(strings.TrimPrefix(name, "./"))
+	if !safeRelativePath(clean) {
+		return fmt.Errorf("refusing to unpack %q", name)
+	}
+	if _, ok := b.files[clean]; ok {
+		return fmt.Errorf("%q is in the bundle twice", clean)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(content, maxSourceSize-b.total+1))
+	if err != nil {
+		return err
+	}
+	if b.total += int64(len(data)); b.total > maxSourceSize {
+		return fmt.Errorf("unpacks to more than %v bytes", maxSourceSize)
+	}
+	b.files[clean] = data
+	return nil
+}
+
+// untarGzip reads the regular files of a gzipped tarball. Links and other entries are
+// skipped.
+func untarGzip(content []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	bundle := &bundleFiles{files: map[string][]byte{}}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return bundle.files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := bundle.add(header.Name, archive); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// unzip reads the regular files of a zip archive.
+func unzip(content []byte) (map[string][]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+	bundle := &bundleFiles{files: map[string][]byte{}}
+	for _, file := range archive.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", file.Name, err)
+		}
+		err = bundle.add(file.Name, reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bundle.files, nil
+}
@@ -0,0 +1,152 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// busAttempts is how many times publishing an event is tried before it is dropped.
+	busAttempts = 3
+	// busQueue is how many events wait to be published before new ones are dropped.
+	busQueue = 100
+)
+
+// busEvent is published to the event bus for every applied config generation.
+type busEvent struct {
+	ID                 string    `json:"id"`
+	Type               string    `json:"type"`
+	Host               string    `json:"host"`
+	Time               time.Time `json:"time"`
+	Generation         string    `json:"generation"`
+	PreviousGeneration string    `json:"previous_generation,omitempty"`
+	// Files are the changed files, relative to their watch path, unless All is set
+	Files []string `json:"files"`
+	All   bool     `json:"all"`
+	Runs  []string `json:"runs"`
+}
+
+// busPublisher delivers events to a message bus.
+type busPublisher interface {
+	name() string
+	publish(event *busEvent, payload []byte) error
+}
+
+// eventBus publishes an event for every applied config generation from its own goroutine, so
+// an unavailable bus doesn't hold up reloads.
+type eventBus struct {
+	publishers []busPublisher
+	queue      chan *busEvent
+	// previous is the generation last applied
+	previous string
+}
+
+// configureEventBus builds the publishers from flags, returning nil when there are none.
+func configureEventBus() (*eventBus, error) {
+	b := &eventBus{queue: make(chan *busEvent, busQueue)}
+	nats, err := configureNATS()
+	if err != nil {
+		return nil, err
+	}
+	if nats != nil {
+		b.publishers = append(b.publishers, nats)
+	}
+	kafka, err := configureKafka()
+	if err != nil {
+		return nil, err
+	}
+	if kafka != nil {
+		b.publishers = append(b.publishers, kafka)
+	}
+	if len(b.publishers) == 0 {
+		return nil, nil
+	}
+	go b.send()
+	return b, nil
+}
+
+// reloadFinished queues an event when a reload applied a new generation. Reloads that failed,
+// or only re-applied the current generation, aren't published.
+func (b *eventBus) reloadFinished(changes changeSet, err error) {
+	if err != nil || changes.generation == "" || changes.generation == b.previous {
+		return
+	}
+	host, _ := os.Hostname()
+	event := &busEvent{
+		ID:                 newRunID(),
+		Type:               "config_applied",
+		Host:               host,
+		Time:               time.Now().UTC(),
+		Generation:         changes.generation,
+		PreviousGeneration: b.previous,
+		Files:              changes.state().Files,
+		All:                changes.all,
+		Runs:               append([]string{}, changes.runs...),
+	}
+	sort.Strings(event.Runs)
+	b.previous = changes.generation
+	select {
+	case b.queue <- event:
+	default:
+		log.WithField("generation", event.Generation).Error("Event bus queue is full, dropping event")
+	}
+}
+
+func (b *eventBus) send() {
+	for event := range b.queue {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.WithError(err).Error("Error encoding event")
+			continue
+		}
+		for _, publisher := range b.publishers {
+			b.publish(publisher, event, payload)
+		}
+	}
+}
+
+// publish tries a publisher a few times, backing off between attempts.
+func (b *eventBus) publish(publisher busPublisher, event *busEvent, payload []byte) {
+	logger := log.WithField("generation", event.Generation)
+	for attempt := 1; ; attempt++ {
+		err := publisher.publish(event, payload)
+		if err == nil {
+			logger.Debugf("Published event to %v", publisher.name())
+			return
+		}
+		if attempt == busAttempts {
+			logger.WithError(err).Errorf("Error publishing event to %v, dropping it", publisher.name())
+			return
+		}
+		logger.WithError(err).Warnf("Error publishing event to %v, retrying", publisher.name())
+		time.Sleep(time.Second << uint(attempt-1))
+	}
+}
@@ -0,0 +1,99 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// busTriggerRetryInterval is how long to wait before subscribing again after a failure.
+const busTriggerRetryInterval = 10 * time.Second
+
+// busTrigger is a message bus subscription whose messages force a re-render.
+type busTrigger interface {
+	name() string
+	// subscribe delivers the payload of every message until the subscription fails
+	subscribe(messages chan<- string) error
+}
+
+// startBusTriggers subscribes to the subjects and channels set up by flags, turning their
+// messages into trigger requests for the watch loop.
+func startBusTriggers(requests chan<- triggerRequest) error {
+	triggers := []busTrigger{}
+	nats, err := configureNATSTrigger()
+	if err != nil {
+		return err
+	}
+	if nats != nil {
+		triggers = append(triggers, nats)
+	}
+	redis, err := configureRedisTrigger()
+	if err != nil {
+		return err
+	}
+	if redis != nil {
+		triggers = append(triggers, redis)
+	}
+	for _, trigger := range triggers {
+		go listenForTriggers(trigger, requests)
+	}
+	return nil
+}
+
+// listenForTriggers keeps a subscription up, subscribing again after failures.
+func listenForTriggers(trigger busTrigger, requests chan<- triggerRequest) {
+	messages := make(chan string)
+	go func() {
+		for payload := range messages {
+			busTriggered(trigger.name(), payload, requests)
+		}
+	}()
+	for {
+		err := trigger.subscribe(messages)
+		log.WithError(err).Errorf("Subscription to %v failed, subscribing again in %v", trigger.name(), busTriggerRetryInterval)
+		time.Sleep(busTriggerRetryInterval)
+	}
+}
+
+// busTriggered syncs every source straight away and re-renders the pipeline a message names,
+// or all of them. Messages that don't name a pipeline re-render all of them too, so
+// publishers can send whatever payload they like.
+func busTriggered(source string, payload string, requests chan<- triggerRequest) {
+	for _, m := range mirrors {
+		m.requestSync()
+	}
+	request := triggerRequest{pipeline: strings.TrimSpace(payload), reply: make(chan error, 1)}
+	requests <- request
+	if err := <-request.reply; err != nil {
+		log.Debugf("Message from %v doesn't name a pipeline, triggering all of them", source)
+		request = triggerRequest{reply: make(chan error, 1)}
+		requests <- request
+		<-request.reply
+	}
+	audit.record(auditEntry{Action: "bus-trigger", Pipeline: request.pipeline, URL: source, Result: "ok"})
+}
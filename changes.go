@@ -0,0 +1,169 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// changeSet collects the files changed since the last reload. all is set when the
+// individual files aren't known, such as on the initial run.
+type changeSet struct {
+	all   bool
+	files map[string]bool
+
+	// rollouts are the traced processing runs that produced the changes
+	rollouts []trace.SpanContext
+
+	// runs are the IDs of the processing runs that produced the changes
+	runs []string
+
+	// generation is the hash of the rendered config the changes resulted in
+	generation string
+
+	// since is when the earliest of the changes was seen
+	since time.Time
+}
+
+// add records a change to name, stored relative to the watch path.
+func (c *changeSet) add(watchPath string, name string) {
+	if c.files == nil {
+		c.files = map[string]bool{}
+	}
+	c.files[relativeName(watchPath, name)] = true
+	if c.since.IsZero() {
+		c.since = time.Now()
+	}
+}
+
+func (c *changeSet) merge(other changeSet) {
+	c.all = c.all || other.all
+	c.rollouts = append(c.rollouts, other.rollouts...)
+	c.runs = append(c.runs, other.runs...)
+	if other.generation != "" {
+		c.generation = other.generation
+	}
+	if c.since.IsZero() || (!other.since.IsZero() && other.since.Before(c.since)) {
+		c.since = other.since
+	}
+	for name := range other.files {
+		if c.files == nil {
+			c.files = map[string]bool{}
+		}
+		c.files[name] = true
+	}
+}
+
+// changeSetState is a changeSet as shown in state dumps.
+type changeSetState struct {
+	All        bool      `json:"all"`
+	Files      []string  `json:"files"`
+	Generation string    `json:"generation,omitempty"`
+	Since      time.Time `json:"since,omitempty"`
+}
+
+func (c *changeSet) state() changeSetState {
+	state := changeSetState{All: c.all, Files: []string{}, Generation: c.generation, Since: c.since}
+	for name := range c.files {
+		state.Files = append(state.Files, name)
+	}
+	sort.Strings(state.Files)
+	return state
+}
+
+func (c *changeSet) empty() bool {
+	return !c.all && len(c.files) == 0
+}
+
+// matches reports whether any change in the set matches one of the globs. An empty glob
+// list matches everything.
+func (c *changeSet) matches(globs []string) bool {
+	if c.all || len(globs) == 0 {
+		return !c.empty()
+	}
+	for name := range c.files {
+		if matchesGlobs(name, globs) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesUnclaimed reports whether any change in the set matches none of the claimed glob
+// lists, for a step without globs of its own that leaves the other steps' files to them.
+func (c *changeSet) matchesUnclaimed(claimed [][]string) bool {
+	if c.all {
+		return !c.empty()
+	}
+	for name := range c.files {
+		unclaimed := true
+		for _, globs := range claimed {
+			if matchesGlobs(name, globs) {
+				unclaimed = false
+				break
+			}
+		}
+		if unclaimed {
+			return true
+		}
+	}
+	return false
+}
+
+func relativeName(watchPath string, name string) string {
+	rel, err := filepath.Rel(watchPath, name)
+	if err != nil || strings.HasPrefix(rel, "../") {
+		return name
+	}
+	return rel
+}
+
+// matchesGlobs checks a file name, relative to the watch path, against globs which may
+// match either the full relative name or just the base name.
+func matchesGlobs(rel string, globs []string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	// kubernetes volume updates swap the ..data symlink, which doesn't tell us which
+	// of the projected files changed
+	if strings.HasPrefix(rel, "..") {
+		return true
+	}
+
+	for _, glob := range globs {
+		if matched, _ := filepath.Match(glob, rel); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(glob, filepath.Base(rel)); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,406 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// exit codes of run-once and the commands that validate
+const (
+	exitOK           = 0
+	exitInvalid      = 1
+	exitReloadFailed = 2
+)
+
+// exit codes of the diff command, following diff(1)
+const (
+	exitDiffers   = 1
+	exitDiffError = 2
+)
+
+var (
+	renderOut         = flag.String("out", "", "Directory the render command writes to, required by it. Rendering into a --target-path is only allowed for config that passes validation.")
+	initialRunOnly    = flag.Bool("initial-run-only", false, "Only do the initial processing run and reload, then exit rather than watching. Same as --once.")
+	once              = flag.Bool("once", false, "Same as the run-once command: process the config, reload and exit with 0 on success, 1 if the config was invalid or couldn't be written and 2 if the reload failed.")
+	outputFormat      = flag.String("output", "text", "Output format of the render, validate and diff commands, text or json.")
+	diffPrometheusURL = flag.String("diff-prometheus-url", "", "Base url of a Prometheus whose running config the diff command also compares against, e.g. http://localhost:9090. "+
+		"Prometheus reports its config with defaults filled in, so expect differences beyond your own changes.")
+	diffPrometheusFile = flag.String("diff-prometheus-file", "prometheus.yml", "Rendered file compared against the running config of --diff-prometheus-url.")
+	noReload           = flag.Bool("no-reload", false, "Don't reload any services after processing in run-once, for rendering config in an init container before the services start.")
+)
+
+// command is a mode the binary runs in, chosen by the first argument.
+type command struct {
+	name        string
+	description string
+	run         func() int
+	// args describes the positional arguments the command takes, if any
+	args string
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"watch", "Process the config whenever it changes and reload the services using it. The default.", runWatch, ""},
+		{"run-once", "Process the config, reload the services using it and exit with 0 on success, 1 if the config wasn't applied or 2 if the reload failed.", runOnce, ""},
+		{"render", "Render the config to --out without reloading anything. It is only validated when --out is a target path.", runRender, ""},
+		{"validate", "Render the config in memory and validate it.", runValidate, ""},
+		{"diff", "Render the config in memory and show how it differs from --target-path, exiting with 0 when nothing would change, 1 when something would and 2 on errors.", runDiff, ""},
+		{"manifest", "Print the hashes of the files in --watch-path that a --signature-mode signature is made over.", runManifest, ""},
+		{"decrypt-state", "Print state the watcher wrote encrypted, such as a --state-dump-file, using the --state-encryption-* flags.", runDecryptState, "file"},
+		{"completion", "Print a completion script for bash, zsh or fish.", runCompletion, "bash|zsh|fish"},
+	}
+	flag.Usage = usage
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %v [command] [flags]\n\nCommands:\n", path.Base(os.Args[0]))
+	for _, cmd := range commands {
+		name := cmd.name
+		if cmd.args != "" {
+			name += " <" + cmd.args + ">"
+		}
+		fmt.Fprintf(out, "  %-10v %v\n", name, cmd.description)
+	}
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nEvery flag can also be set by an environment variable named after it, such as %v for\n"+
+		"--watch-path, with one value per line for repeatable flags. Flags on the command line take\n"+
+		"precedence over the environment, which takes precedence over settings in --config.\n", envName("watch-path"))
+}
+
+// parseCommandLine picks the command from the first argument, defaulting to watch when the
+// arguments start with a flag, and parses the flags that follow.
+func parseCommandLine(args []string) (*command, error) {
+	name := "watch"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		return nil, fmt.Errorf("unknown command %q", name)
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, err
+	}
+	if flag.NArg() > 0 && cmd.args == "" {
+		return nil, fmt.Errorf("unexpected arguments: %v", strings.Join(flag.Args(), " "))
+	}
+	if err := applyEnvironment(); err != nil {
+		return nil, err
+	}
+	if *outputFormat != "text" && *outputFormat != "json" {
+		return nil, fmt.Errorf("unknown output format %q", *outputFormat)
+	}
+	if *skipInitialRun && *initialRunOnly {
+		return nil, fmt.Errorf("--skip-initial-run and --initial-run-only can't be used together")
+	}
+	if (*once || *initialRunOnly) && cmd.name == "watch" {
+		return findCommand("run-once"), nil
+	}
+	return cmd, nil
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// runOnce applies the config a single time, for init containers and CI.
+func runOnce() int {
+	steps, flushTraces := setupWatcher()
+	defer flushTraces()
+	pipelines, err := configuredPipelines(steps)
+	if err != nil {
+		log.Fatalf("Invalid pipeline: %v", err)
+	}
+	createTargets(pipelines)
+	harden(pipelines)
+	syncMirrors()
+	preflight(pipelines, steps)
+
+	ctx, span := tracer.Start(context.Background(), "config rollout")
+	for _, pipe := range pipelines {
+		if _, err = pipe.process(ctx, newRunID()); err != nil {
+			break
+		}
+	}
+	endSpan(span, err)
+	if err != nil {
+		log.WithError(err).Error("Config was not applied")
+		return exitInvalid
+	}
+	if *noReload {
+		log.Info("Config applied, not reloading as --no-reload is set")
+		return exitOK
+	}
+	if _, err := runSteps(ctx, steps, changeSet{all: true}); err != nil {
+		log.WithError(err).Error("Reload failed")
+		return exitReloadFailed
+	}
+	if *dryRun {
+		log.Info("Dry run complete, nothing was written or reloaded")
+		return exitOK
+	}
+	log.Info("Config applied and reloaded")
+	return exitOK
+}
+
+// commandPipelines returns the pipelines for the commands that only render.
+func commandPipelines() []*pipeline {
+	steps, err := configuredSteps()
+	if err != nil {
+		log.Fatalf("Invalid reload step: %v", err)
+	}
+	if err := configureSecrets(); err != nil {
+		log.Fatalf("Unable to configure secret stores: %v", err)
+	}
+	if err := checkRouteTests(); err != nil {
+		log.Fatal(err)
+	}
+	pipelines, err := configuredPipelines(steps)
+	if err != nil {
+		log.Fatalf("Invalid pipeline: %v", err)
+	}
+	return pipelines
+}
+
+// pipelineResult is the outcome of a command for one pipeline, printed with --output=json.
+type pipelineResult struct {
+	Pipeline string     `json:"pipeline"`
+	Output   string     `json:"output,omitempty"`
+	Files    []string   `json:"files"`
+	Valid    *bool      `json:"valid,omitempty"`
+	Diffs    []fileDiff `json:"diffs,omitempty"`
+	Errors   []string   `json:"errors,omitempty"`
+}
+
+// fileDiff is a rendered file that differs from the current config.
+type fileDiff struct {
+	File    string `json:"file"`
+	Against string `json:"against"`
+	Diff    string `json:"diff"`
+}
+
+func newPipelineResult(pipe *pipeline, rendered []renderedFile) *pipelineResult {
+	result := &pipelineResult{Pipeline: pipe.name, Files: []string{}}
+	for _, file := range rendered {
+		result.Files = append(result.Files, file.source)
+	}
+	return result
+}
+
+// printResults writes the results as JSON when --output=json is set, the commands having
+// printed text as they went otherwise.
+func printResults(results []*pipelineResult, code int) {
+	if *outputFormat != "json" {
+		return
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(struct {
+		Results  []*pipelineResult `json:"results"`
+		ExitCode int               `json:"exit_code"`
+	}{results, code})
+}
+
+// printText prints command output in the text format.
+func printText(format string, args ...interface{}) {
+	if *outputFormat == "text" {
+		fmt.Printf(format, args...)
+	}
+}
+
+func runRender() int {
+	if *renderOut == "" {
+		log.Fatal("render needs --out, the directory to write the rendered config to")
+	}
+	pipelines := commandPipelines()
+	results := []*pipelineResult{}
+	code := exitOK
+	for _, pipe := range pipelines {
+		out := *renderOut
+		if len(pipelines) > 1 {
+			out = path.Join(out, pipe.name)
+		}
+		logger := pipe.logger(newRunID())
+		rendered, err := processConfigChanges(logger, pipe.watchPath, pipe.expandVars, nil)
+		result := newPipelineResult(pipe, rendered)
+		result.Output = out
+		results = append(results, result)
+		// a target path is served to the running services, so it only takes valid config
+		if err == nil && intoTargetPath(out, pipelines) {
+			err = validateFiles(logger, pipe.targetPath, rendered, pipe.validators)
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			printText("%v: rendering failed: %v\n", pipe.name, err)
+			code = exitInvalid
+			continue
+		}
+		target := &targetSink{dir: out}
+		if *dryRun {
+			planSinks(logger, []sink{target}, rendered)
+			continue
+		}
+		if err := target.write(logger, rendered); err != nil {
+			log.WithError(err).Error("Error writing rendered config")
+			result.Errors = append(result.Errors, err.Error())
+			code = exitInvalid
+			continue
+		}
+		printText("Rendered %d files from %v to %v\n", len(rendered), pipe.name, out)
+	}
+	printResults(results, code)
+	return code
+}
+
+// intoTargetPath reports whether out is one of the pipelines' target paths or inside one.
+func intoTargetPath(out string, pipelines []*pipeline) bool {
+	out, _ = filepath.Abs(out)
+	for _, pipe := range pipelines {
+		target, _ := filepath.Abs(pipe.targetPath)
+		if within(out, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func runValidate() int {
+	code := exitOK
+	results := []*pipelineResult{}
+	for _, pipe := range commandPipelines() {
+		logger := pipe.logger(newRunID())
+		rendered, err := processConfigChanges(logger, pipe.watchPath, pipe.expandVars, nil)
+		result := newPipelineResult(pipe, rendered)
+		results = append(results, result)
+		if err == nil {
+			err = validateFiles(logger, pipe.targetPath, rendered, pipe.validators)
+		}
+		valid := err == nil
+		result.Valid = &valid
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			printText("%v: validation failed: %v\n", pipe.name, err)
+			code = exitInvalid
+			continue
+		}
+		printText("%v: %d files are valid\n", pipe.name, len(rendered))
+	}
+	printResults(results, code)
+	return code
+}
+
+func runDiff() int {
+	code := exitOK
+	results := []*pipelineResult{}
+	for _, pipe := range commandPipelines() {
+		rendered, err := processConfigChanges(pipe.logger(newRunID()), pipe.watchPath, pipe.expandVars, nil)
+		result := newPipelineResult(pipe, rendered)
+		results = append(results, result)
+		failed := func(err error) {
+			log.WithError(err).Error("Unable to compare config")
+			result.Errors = append(result.Errors, err.Error())
+			code = exitDiffError
+		}
+		if err != nil {
+			failed(err)
+			continue
+		}
+		differs := func(file renderedFile, against string, current []byte) {
+			diff := unifiedDiff(against, file.source, current, file.content)
+			if diff == "" {
+				return
+			}
+			printText("%v", diff)
+			result.Diffs = append(result.Diffs, fileDiff{File: file.source, Against: against, Diff: diff})
+			if code == exitOK {
+				code = exitDiffers
+			}
+		}
+
+		for _, file := range rendered {
+			targetFile := path.Join(pipe.targetPath, file.name)
+			current, err := ioutil.ReadFile(targetFile)
+			if err != nil && !os.IsNotExist(err) {
+				failed(err)
+				continue
+			}
+			differs(file, targetFile, current)
+
+			if *diffPrometheusURL == "" || file.name != *diffPrometheusFile {
+				continue
+			}
+			running, err := runningPrometheusConfig(*diffPrometheusURL)
+			if err != nil {
+				failed(fmt.Errorf("fetching the running Prometheus config: %v", err))
+				continue
+			}
+			differs(file, *diffPrometheusURL+" (running)", running)
+		}
+	}
+	printResults(results, code)
+	return code
+}
+
+// runningPrometheusConfig fetches the config Prometheus has loaded from its status API.
+func runningPrometheusConfig(baseURL string) ([]byte, error) {
+	resp, err := reloadClient.Get(strings.TrimSuffix(baseURL, "/") + "/api/v1/status/config")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status API returned %v", resp.StatusCode)
+	}
+	status := struct {
+		Data struct {
+			YAML string `json:"yaml"`
+		} `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("decoding status API response: %v", err)
+	}
+	return []byte(status.Data.YAML), nil
+}
@@ -0,0 +1,177 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// pathFlagSuffixes identify the flags that take a file or directory, completed as paths.
+var pathFlagSuffixes = []string{"-file", "-path", "-log", "-dir", "-binary"}
+
+type completionFlag struct {
+	name        string
+	description string
+	boolean     bool
+	path        bool
+}
+
+// completionFlags lists the flags with the first sentence of their usage as the description.
+func completionFlags() []completionFlag {
+	flags := []completionFlag{}
+	flag.VisitAll(func(f *flag.Flag) {
+		c := completionFlag{name: f.Name, description: f.Usage}
+		if i := strings.Index(c.description, ". "); i >= 0 {
+			c.description = c.description[:i]
+		}
+		c.description = strings.TrimSuffix(c.description, ".")
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			c.boolean = true
+		}
+		for _, suffix := range pathFlagSuffixes {
+			c.path = c.path || strings.HasSuffix(f.Name, suffix)
+		}
+		c.path = c.path || f.Name == "config" || f.Name == "out"
+		flags = append(flags, c)
+	})
+	return flags
+}
+
+func runCompletion() int {
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "completion needs the shell: bash, zsh or fish")
+		return exitInvalid
+	}
+	program := path.Base(os.Args[0])
+	switch flag.Arg(0) {
+	case "bash":
+		fmt.Print(bashCompletion(program))
+	case "zsh":
+		fmt.Print(zshCompletion(program))
+	case "fish":
+		fmt.Print(fishCompletion(program))
+	default:
+		fmt.Fprintf(os.Stderr, "unsupported shell %q, expected bash, zsh or fish\n", flag.Arg(0))
+		return exitInvalid
+	}
+	return exitOK
+}
+
+func commandNames() []string {
+	names := []string{}
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	return names
+}
+
+func bashCompletion(program string) string {
+	function := "_" + strings.Replace(program, "-", "_", -1)
+	all, paths, values := []string{}, []string{}, []string{}
+	for _, f := range completionFlags() {
+		all = append(all, "--"+f.name)
+		switch {
+		case f.path:
+			paths = append(paths, "--"+f.name)
+		case !f.boolean:
+			values = append(values, "--"+f.name)
+		}
+	}
+
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "# bash completion for %v\n", program)
+	fmt.Fprintf(out, "%v() {\n", function)
+	fmt.Fprintln(out, `	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"`)
+	fmt.Fprintln(out, `	case "$prev" in`)
+	fmt.Fprintf(out, "\t%v)\n\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n\t\treturn ;;\n", strings.Join(paths, "|"))
+	fmt.Fprintf(out, "\t%v)\n\t\treturn ;;\n", strings.Join(values, "|"))
+	fmt.Fprintln(out, "\tcompletion)")
+	fmt.Fprintln(out, "\t\tCOMPREPLY=($(compgen -W \"bash zsh fish\" -- \"$cur\"))")
+	fmt.Fprintln(out, "\t\treturn ;;")
+	fmt.Fprintln(out, "\tesac")
+	fmt.Fprintln(out, `	if [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then`)
+	fmt.Fprintf(out, "\t\tCOMPREPLY=($(compgen -W \"%v\" -- \"$cur\"))\n", strings.Join(commandNames(), " "))
+	fmt.Fprintln(out, "\t\treturn")
+	fmt.Fprintln(out, "\tfi")
+	fmt.Fprintf(out, "\tCOMPREPLY=($(compgen -W \"%v\" -- \"$cur\"))\n", strings.Join(all, " "))
+	fmt.Fprintln(out, "}")
+	fmt.Fprintf(out, "complete -F %v %v\n", function, program)
+	return out.String()
+}
+
+func zshCompletion(program string) string {
+	escape := strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]", ":", "\\:")
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "#compdef %v\n\n", program)
+	fmt.Fprintln(out, "local -a commands")
+	fmt.Fprintln(out, "commands=(")
+	for _, cmd := range commands {
+		description := cmd.description
+		if i := strings.Index(description, ". "); i >= 0 {
+			description = description[:i]
+		}
+		fmt.Fprintf(out, "\t'%v:%v'\n", cmd.name, strings.Replace(strings.TrimSuffix(description, "."), "'", "'\\''", -1))
+	}
+	fmt.Fprintln(out, ")")
+	fmt.Fprintln(out, "_arguments \\")
+	fmt.Fprintln(out, "\t'1: :{_describe command commands}' \\")
+	for _, f := range completionFlags() {
+		spec := fmt.Sprintf("--%v[%v]", f.name, escape.Replace(f.description))
+		switch {
+		case f.path:
+			spec += ": :_files"
+		case !f.boolean:
+			spec += ": : "
+		}
+		fmt.Fprintf(out, "\t'%v' \\\n", spec)
+	}
+	fmt.Fprintln(out, "\t'2:shell:(bash zsh fish)'")
+	return out.String()
+}
+
+func fishCompletion(program string) string {
+	escape := strings.NewReplacer("'", "\\'")
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "# fish completion for %v\n", program)
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "complete -c %v -n __fish_use_subcommand -f -a %v -d '%v'\n", program, cmd.name, escape.Replace(cmd.description))
+	}
+	fmt.Fprintf(out, "complete -c %v -n '__fish_seen_subcommand_from completion' -f -a 'bash zsh fish'\n", program)
+	for _, f := range completionFlags() {
+		options := ""
+		switch {
+		case f.path:
+			options = " -r -F"
+		case !f.boolean:
+			options = " -r -f"
+		}
+		fmt.Fprintf(out, "complete -c %v -l %v%v -d '%v'\n", program, f.name, options, escape.Replace(f.description))
+	}
+	return out.String()
+}
@@ -0,0 +1,214 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var configFile = flag.String("config", "", "YAML file configuring the watcher: settings for any flag, pipelines and notifiers. Flags given on the command line or in the environment override its settings. Changes to the file, or SIGHUP, are applied without a restart.")
+
+// watcherConfig is the watcher's own config file.
+type watcherConfig struct {
+	// Settings holds values for flags, by flag name. Lists set repeatable flags.
+	Settings map[string]interface{} `yaml:"settings"`
+
+	// Pipelines replace the single pipeline described by --watch-path and --target-path
+	Pipelines []pipelineConfig `yaml:"pipelines"`
+
+	// Notifiers are the reload steps, each with the keys of --notify
+	Notifiers []map[string]interface{} `yaml:"notifiers"`
+}
+
+// pipelineConfig describes a source path, how it is processed and validated and where the
+// results are written.
+type pipelineConfig struct {
+	Name       string   `yaml:"name"`
+	WatchPath  string   `yaml:"watch_path"`
+	TargetPath string   `yaml:"target_path"`
+	ExpandVars *bool    `yaml:"expand_vars"`
+	ReloadOn   []string `yaml:"reload_on"`
+	// Validators are the presets whose validators run on this pipeline, rather than those of
+	// every notifier
+	Validators []string `yaml:"validators"`
+	// RemoteSinks also delivers the files to the ruler, Alertmanager and Grafana APIs, the
+	// object store, the SSH hosts and the HTTP SD endpoint set up by flags
+	RemoteSinks bool `yaml:"remote_sinks"`
+	// UploadURL is the object store prefix the files are uploaded to when RemoteSinks is set,
+	// by default the pipeline's name below --upload-url
+	UploadURL string `yaml:"upload_url"`
+}
+
+// loadedConfig is the parsed --config file, nil when none was given.
+var loadedConfig *watcherConfig
+
+func loadConfig(path string) (*watcherConfig, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &watcherConfig{}
+	if err := yaml.UnmarshalStrict(contents, config); err != nil {
+		return nil, fmt.Errorf("parsing %v: %v", path, err)
+	}
+	names := map[string]bool{}
+	for i, p := range config.Pipelines {
+		if p.Name == "" {
+			return nil, fmt.Errorf("pipeline %d has no name", i+1)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("pipeline %v is defined more than once", p.Name)
+		}
+		names[p.Name] = true
+		if p.WatchPath == "" || p.TargetPath == "" {
+			return nil, fmt.Errorf("pipeline %v needs a watch_path and target_path", p.Name)
+		}
+	}
+	return config, nil
+}
+
+// applySettings sets the flags named in the config file, leaving alone those given on the
+// command line or in the environment.
+func (c *watcherConfig) applySettings() error {
+	names := []string{}
+	for name := range c.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		if name == "config" || explicitFlags[name] {
+			continue
+		}
+		values := []interface{}{c.Settings[name]}
+		if list, isList := c.Settings[name].([]interface{}); isList {
+			values = list
+		}
+		// repeatable flags are replaced rather than appended to when the file is reloaded
+		if list, isList := flag.Lookup(name).Value.(*stringList); isList {
+			*list = nil
+		}
+		for _, value := range values {
+			if err := flag.Lookup(name).Value.Set(fmt.Sprint(value)); err != nil {
+				return fmt.Errorf("invalid setting %v: %v", name, err)
+			}
+		}
+		fileSettings[name] = true
+	}
+	return nil
+}
+
+// configuredSteps builds the reload steps from --notify, or from the config file's
+// notifiers when no --notify flags are given.
+func configuredSteps() ([]*reloadStep, error) {
+	if len(notifySpecs) > 0 || loadedConfig == nil || len(loadedConfig.Notifiers) == 0 {
+		return parseReloadSteps(notifySpecs, *prometheusUrl)
+	}
+
+	steps := []*reloadStep{}
+	for i, notifier := range loadedConfig.Notifiers {
+		keys := []string{}
+		for key := range notifier {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := [][2]string{}
+		for _, key := range keys {
+			value := fmt.Sprint(notifier[key])
+			if list, isList := notifier[key].([]interface{}); isList {
+				items := []string{}
+				for _, item := range list {
+					items = append(items, fmt.Sprint(item))
+				}
+				value = strings.Join(items, "|")
+			}
+			pairs = append(pairs, [2]string{key, value})
+		}
+		step, err := newReloadStep(fmt.Sprintf("notifier %d", i+1), pairs)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// configuredPipelines returns the config file's pipelines, or the pipeline described by
+// flags when there are none.
+func configuredPipelines(steps []*reloadStep) ([]*pipeline, error) {
+	if loadedConfig == nil || len(loadedConfig.Pipelines) == 0 {
+		return []*pipeline{defaultPipeline(steps, *targetPath)}, nil
+	}
+
+	pipelines := []*pipeline{}
+	for _, c := range loadedConfig.Pipelines {
+		upload := ""
+		if c.RemoteSinks {
+			upload = c.UploadURL
+			if upload == "" && *uploadURL != "" {
+				upload = strings.TrimSuffix(*uploadURL, "/") + "/" + c.Name
+			}
+		}
+		if err := checkUploadURL(upload); err != nil {
+			return nil, fmt.Errorf("pipeline %v: %v", c.Name, err)
+		}
+		p := &pipeline{
+			name:       c.Name,
+			watchPath:  c.WatchPath,
+			targetPath: c.TargetPath,
+			expandVars: *expandVars,
+			reloadOn:   c.ReloadOn,
+			validators: stepValidators(steps),
+			sinks:      configureSinks(c.TargetPath, c.RemoteSinks, upload, c.Name),
+		}
+		if c.ExpandVars != nil {
+			p.expandVars = *c.ExpandVars
+		}
+		if len(c.Validators) > 0 {
+			presetSteps := []*reloadStep{}
+			for _, name := range c.Validators {
+				preset, err := lookupPreset(name)
+				if err != nil {
+					return nil, fmt.Errorf("pipeline %v: %v", c.Name, err)
+				}
+				step := &reloadStep{}
+				preset.apply(step)
+				presetSteps = append(presetSteps, step)
+			}
+			p.validators = stepValidators(presetSteps)
+		}
+		pipelines = append(pipelines, p)
+	}
+	return pipelines, nil
+}
@@ -0,0 +1,271 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// configReloadDelay collects the several events written by editors and ConfigMap updates into
+// a single reload of the config file.
+const configReloadDelay = time.Second
+
+// watchConfigFile signals whenever the config file changes or SIGHUP is received. The file's
+// directory is watched so that files replaced by rename, as editors and ConfigMap volumes do,
+// are still picked up.
+func watchConfigFile(path string) <-chan struct{} {
+	reloads := make(chan struct{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	var events <-chan fsnotify.Event
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(path))
+		events = watcher.Events
+	}
+	if err != nil {
+		log.WithField("file", path).WithError(err).Warn("Unable to watch the config file, send SIGHUP to reload it")
+	}
+
+	go func() {
+		var delay <-chan time.Time
+		for {
+			select {
+			case <-sigs:
+				log.Info("Received SIGHUP, reloading the config file")
+				delay = time.After(0)
+			case event := <-events:
+				name := filepath.Base(event.Name)
+				if name == filepath.Base(path) || name == "..data" {
+					delay = time.After(configReloadDelay)
+				}
+			case <-delay:
+				delay = nil
+				select {
+				case reloads <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return reloads
+}
+
+// pipelineLoops are the running pipelines, by name.
+type pipelineLoops struct {
+	reloads   *reloader
+	listeners []func(rendered []renderedFile, err error)
+	loops     map[string]*pipelineLoop
+}
+
+func (p *pipelineLoops) start(pipe *pipeline, skipInitialRun bool) error {
+	loop := &pipelineLoop{pipe: pipe, reloads: p.reloads, listeners: p.listeners, skipInitialRun: skipInitialRun}
+	expectProcessed(pipe)
+	if err := loop.start(); err != nil {
+		return err
+	}
+	p.loops[pipe.name] = loop
+	return nil
+}
+
+// force runs every pipeline straight away with a full reload.
+func (p *pipelineLoops) force() {
+	for _, loop := range p.loops {
+		loop.force()
+	}
+}
+
+// forceSources forces the pipelines watching any of sources, e.g. the files using a secret
+// that has changed.
+func (p *pipelineLoops) forceSources(sources []string) {
+	for _, loop := range p.loops {
+		watchPath := filepath.Clean(loop.pipe.watchPath)
+		for _, source := range sources {
+			source = filepath.Clean(source)
+			if source == watchPath || strings.HasPrefix(source, watchPath+string(filepath.Separator)) {
+				log.Infof("Secrets used by %v have changed, processing and reloading pipeline %v", source, loop.pipe.name)
+				loop.force()
+				break
+			}
+		}
+	}
+}
+
+// forceWithin forces the pipelines watching dir or a path inside it, e.g. a checkout that has
+// moved to a new commit, and those watching a directory dir is inside, whose watches don't see
+// changes below their top level.
+func (p *pipelineLoops) forceWithin(dir string, reason string) {
+	for _, loop := range p.loops {
+		watchPath, dir := filepath.Clean(loop.pipe.watchPath), filepath.Clean(dir)
+		if within(watchPath, dir) || within(dir, watchPath) {
+			log.Infof("%v, processing and reloading pipeline %v", reason, loop.pipe.name)
+			loop.force()
+		}
+	}
+}
+
+// pipelinesWithin returns the pipelines watching dir or a path inside it.
+func (p *pipelineLoops) pipelinesWithin(dir string) []*pipeline {
+	dir, _ = filepath.Abs(dir)
+	pipelines := []*pipeline{}
+	for _, loop := range p.loops {
+		if within(filepath.Clean(loop.pipe.watchPath), dir) {
+			pipelines = append(pipelines, loop.pipe)
+		}
+	}
+	return pipelines
+}
+
+// stop stops every loop, returning a channel closed once they have all finished their
+// current runs.
+func (p *pipelineLoops) stop() <-chan struct{} {
+	stopped := make(chan struct{})
+	for _, loop := range p.loops {
+		loop.close()
+	}
+	go func() {
+		for _, loop := range p.loops {
+			<-loop.stopped
+		}
+		close(stopped)
+	}()
+	return stopped
+}
+
+// apply brings the running loops in line with pipelines, updating those whose watch path is
+// unchanged and replacing the rest.
+func (p *pipelineLoops) apply(pipelines []*pipeline) error {
+	wanted := map[string]*pipeline{}
+	for _, pipe := range pipelines {
+		wanted[pipe.name] = pipe
+	}
+	// loops that are replaced or removed have stopped before any loop starts, so that two
+	// loops never write the same target at once
+	closed := []*pipelineLoop{}
+	for name, loop := range p.loops {
+		pipe := wanted[name]
+		if pipe != nil && pipe.watchPath == loop.pipe.watchPath {
+			continue
+		}
+		if pipe == nil {
+			log.Infof("Stopping pipeline %v", name)
+			forgetProcessed(name)
+		}
+		loop.close()
+		closed = append(closed, loop)
+		delete(p.loops, name)
+	}
+	for _, loop := range closed {
+		<-loop.stopped
+	}
+
+	for _, pipe := range pipelines {
+		if loop, running := p.loops[pipe.name]; running {
+			log.Infof("Updating pipeline %v", pipe.name)
+			loop.update(pipe)
+			continue
+		}
+		log.Infof("Starting pipeline %v watching %v", pipe.name, pipe.watchPath)
+		if err := p.start(pipe, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadConfigFile applies a changed config file to the running watcher. Pipelines and
+// notifiers take effect straight away, settings read only at startup, such as the listen
+// address or logging, need a restart. An invalid file is logged and the running config kept.
+func reloadConfigFile(loops *pipelineLoops) {
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.WithError(err).Error("Invalid config file, keeping the running config")
+		configReloads.WithLabelValues(runResult(err)).Inc()
+		return
+	}
+	if reflect.DeepEqual(config, loadedConfig) {
+		log.Debug("Config file is unchanged")
+		return
+	}
+
+	err = applyConfigFile(config, loops)
+	configReloads.WithLabelValues(runResult(err)).Inc()
+	if err != nil {
+		log.WithError(err).Error("Failed to apply the config file")
+		return
+	}
+	log.Infof("Applied config file %v", *configFile)
+}
+
+// applyConfigFile checks the config file's settings, notifiers and pipelines before any of
+// them take effect. The settings are applied to the flags to build the rest from, and rolled
+// back if anything is rejected.
+func applyConfigFile(config *watcherConfig, loops *pipelineLoops) error {
+	previous, settings := loadedConfig, snapshotSettings()
+	loadedConfig = config
+	err := config.applySettings()
+	var steps []*reloadStep
+	if err == nil {
+		steps, err = configuredSteps()
+	}
+	if err == nil {
+		err = checkStepCredentials(steps)
+	}
+	if err == nil {
+		err = checkRouteTests()
+	}
+	var pipelines []*pipeline
+	if err == nil {
+		pipelines, err = configuredPipelines(steps)
+	}
+	if err == nil {
+		err = checkReadOnlySources(pipelines)
+	}
+	for _, pipe := range pipelines {
+		if err == nil {
+			err = ensureDir(pipe.targetPath)
+		}
+		if err == nil {
+			err = lockTarget(pipe.targetPath)
+		}
+	}
+	if err != nil {
+		loadedConfig = previous
+		settings.restore()
+		return err
+	}
+	loops.reloads.setSteps(steps)
+	return loops.apply(pipelines)
+}
@@ -0,0 +1,86 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// renderHash is a deterministic hash over a set of rendered files, independent of the order
+// they were rendered in.
+func renderHash(files []renderedFile) string {
+	sorted := make([]renderedFile, len(files))
+	copy(sorted, files)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+
+	hash := sha256.New()
+	for _, file := range sorted {
+		fmt.Fprintf(hash, "%s\x00%d\x00", file.name, len(file.content))
+		hash.Write(file.content)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// configGenerations tracks the hash of the last rendered and the last successfully reloaded
+// config, so replicas, and the watcher and the service it reloads, can be compared.
+type configGenerations struct {
+	mu          sync.Mutex
+	Rendered    string    `json:"rendered"`
+	Applied     string    `json:"applied"`
+	LastApplied time.Time `json:"last_applied"`
+}
+
+var generations = &configGenerations{}
+
+func (g *configGenerations) rendered(hash string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if hash == g.Rendered {
+		return
+	}
+	g.Rendered = hash
+	configHash.DeletePartialMatch(map[string]string{"state": "rendered"})
+	configHash.WithLabelValues("rendered", hash).Set(1)
+}
+
+func (g *configGenerations) applied(hash string) {
+	if hash == "" {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	log.WithField("hash", hash).Info("Reloaded config generation")
+	g.Applied = hash
+	g.LastApplied = time.Now().UTC()
+	configHash.DeletePartialMatch(map[string]string{"state": "applied"})
+	configHash.WithLabelValues("applied", hash).Set(1)
+}
@@ -0,0 +1,113 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	consulAddress   = flag.String("consul-address", consulDefaultAddress(), "Address of the Consul agent. Defaults to CONSUL_HTTP_ADDR.")
+	consulTokenFile = flag.String("consul-token-file", "", "File holding the ACL token sent to Consul.")
+	consulWait      = flag.Duration("consul-wait", 5*time.Minute, "How long blocking queries to Consul wait for a change before returning.")
+)
+
+func consulDefaultAddress() string {
+	address := os.Getenv("CONSUL_HTTP_ADDR")
+	if address == "" {
+		return "http://127.0.0.1:8500"
+	}
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return address
+}
+
+// consulClient makes blocking queries to the Consul HTTP API.
+type consulClient struct {
+	address string
+	client  *http.Client
+}
+
+func newConsulClient() *consulClient {
+	// blocking queries are held open for up to the wait plus a sixteenth of jitter
+	return &consulClient{address: strings.TrimSuffix(*consulAddress, "/"), client: newHTTPClient(*consulWait + *consulWait/16 + *reloadTimeout)}
+}
+
+// get makes a blocking query, returning once the result's index is past index or the wait is
+// over. A 404 is returned as a nil body, as Consul answers for an empty KV prefix.
+func (c *consulClient) get(path string, query url.Values, index uint64) ([]byte, uint64, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(consulWait.Seconds())))
+	}
+	req, err := http.NewRequest(http.MethodGet, c.address+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if *consulTokenFile != "" {
+		token, err := readSecretFile(*consulTokenFile)
+		if err != nil {
+			return nil, 0, err
+		}
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSourceSize+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(body) > maxSourceSize {
+		return nil, 0, fmt.Errorf("consul response larger than %v bytes", maxSourceSize)
+	}
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, newIndex, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, 0, fmt.Errorf("consul returned status %v: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	// the index going backwards means the state was restored, start over
+	if newIndex < index {
+		newIndex = 0
+	}
+	return body, newIndex, nil
+}
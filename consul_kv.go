@@ -0,0 +1,101 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	consulKVSource        = flag.String("consul-kv-source", "", "Consul KV prefix whose keys are written as files to --consul-kv-source-dir, named after the prefix. Changes are picked up straight away with blocking queries.")
+	consulKVSourceDir     = flag.String("consul-kv-source-dir", "/var/lib/prom-config-watcher/consul-kv", "Directory the keys of --consul-kv-source are written to.")
+	consulKVRetryInterval = flag.Duration("consul-kv-retry-interval", 10*time.Second, "How long to wait before querying --consul-kv-source again after a failure.")
+)
+
+// consulKVSync mirrors the keys under a prefix.
+type consulKVSync struct {
+	consul *consulClient
+	prefix string
+	// index is the index of the keys written, 0 before the first query
+	index  uint64
+	mirror *sourceMirror
+}
+
+func configureConsulKVSource() error {
+	if *consulKVSource == "" {
+		return nil
+	}
+	c := &consulKVSync{consul: newConsulClient(), prefix: strings.TrimPrefix(*consulKVSource, "/")}
+	// each fetch is a blocking query, so the next starts as soon as one returns and the
+	// interval only paces retries after failures
+	mirror, err := addMirror("consul-kv", "consul kv "+c.prefix, *consulKVSourceDir, *consulKVRetryInterval, c.fetch)
+	if err != nil {
+		return err
+	}
+	c.mirror = mirror
+	return nil
+}
+
+// fetch waits for the keys to change, then writes them out.
+func (c *consulKVSync) fetch() (bool, error) {
+	body, index, err := c.consul.get("/v1/kv/"+c.prefix, url.Values{"recurse": {"true"}}, c.index)
+	if err != nil {
+		return false, fmt.Errorf("reading consul kv %v: %v", c.prefix, err)
+	}
+	if index != 0 && index == c.index {
+		return false, nil
+	}
+	pairs := []struct {
+		Key   string
+		Value []byte
+	}{}
+	if body != nil {
+		if err := json.Unmarshal(body, &pairs); err != nil {
+			return false, err
+		}
+	}
+	files := map[string][]byte{}
+	for _, pair := range pairs {
+		name := strings.TrimLeft(strings.TrimPrefix(pair.Key, c.prefix), "/")
+		// keys ending in / are folders
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		if pair.Value == nil {
+			pair.Value = []byte{}
+		}
+		files[name] = pair.Value
+	}
+	changed, err := mirrorFiles(c.mirror.dir, files)
+	if err == nil {
+		c.index = index
+	}
+	return changed, err
+}
@@ -0,0 +1,209 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	consulSDDir         = flag.String("consul-sd-dir", "", "Directory file_sd target lists generated from the Consul catalog are written to, one <service>.json per service, for Prometheus setups that only allow file based discovery. A relative directory is below --target-path. Disabled when empty.")
+	consulSDServices    = flag.String("consul-sd-services", "", "Comma separated services written to --consul-sd-dir, all services in the catalog when empty.")
+	consulSDTags        = flag.String("consul-sd-tags", "", "Comma separated tags a service instance must all have to be written to --consul-sd-dir.")
+	consulSDDatacenter  = flag.String("consul-sd-datacenter", "", "Datacenter whose catalog is read, the agent's own when empty.")
+	consulSDPassingOnly = flag.Bool("consul-sd-passing-only", false, "Only write service instances whose health checks are all passing.")
+	consulSDInterval    = flag.Duration("consul-sd-interval", 30*time.Second, "How often the Consul catalog is read for --consul-sd-dir.")
+)
+
+// invalidLabelChars are replaced in label names built from service metadata, as Prometheus's
+// consul_sd does.
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// consulSD writes the instances of Consul services as file_sd target lists.
+type consulSD struct {
+	consul   *consulClient
+	services []string
+	tags     []string
+	mirror   *sourceMirror
+}
+
+// consulServiceEntry is the part of a /v1/health/service entry the target lists are built
+// from.
+type consulServiceEntry struct {
+	Node struct {
+		Node       string
+		Address    string
+		Datacenter string
+		Meta       map[string]string
+	}
+	Service struct {
+		ID      string
+		Service string
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+	}
+}
+
+func configureConsulSD() error {
+	if *consulSDDir == "" {
+		return nil
+	}
+	dir := *consulSDDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(*targetPath, dir)
+	}
+	c := &consulSD{consul: newConsulClient(), services: splitList(*consulSDServices), tags: splitList(*consulSDTags)}
+	mirror, err := addMirror("consul-sd", "consul catalog", dir, *consulSDInterval, c.fetch)
+	if err != nil {
+		return err
+	}
+	c.mirror = mirror
+	return nil
+}
+
+// fetch reads every service and writes its target list, removing the lists of services that
+// have gone.
+func (c *consulSD) fetch() (bool, error) {
+	services := c.services
+	if len(services) == 0 {
+		body, _, err := c.consul.get("/v1/catalog/services", c.query(), 0)
+		if err != nil {
+			return false, fmt.Errorf("listing consul services: %v", err)
+		}
+		catalog := map[string][]string{}
+		if err := json.Unmarshal(body, &catalog); err != nil {
+			return false, err
+		}
+		for service, tags := range catalog {
+			if hasTags(tags, c.tags) {
+				services = append(services, service)
+			}
+		}
+	}
+	files := map[string][]byte{}
+	for _, service := range services {
+		if strings.ContainsAny(service, `/\`) || !safeRelativePath(service+".json") {
+			return false, fmt.Errorf("consul service %q can't be used as a file name", service)
+		}
+		groups, err := c.targets(service)
+		if err != nil {
+			return false, err
+		}
+		list, err := json.MarshalIndent(groups, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		files[service+".json"] = append(list, '\n')
+	}
+	return mirrorFiles(c.mirror.dir, files)
+}
+
+func (c *consulSD) query() url.Values {
+	query := url.Values{}
+	if *consulSDDatacenter != "" {
+		query.Set("dc", *consulSDDatacenter)
+	}
+	return query
+}
+
+// targets returns a group for every instance of a service, labelled as Prometheus's consul_sd
+// does so relabelling written for it carries over.
+func (c *consulSD) targets(service string) ([]fileSDGroup, error) {
+	query := c.query()
+	if *consulSDPassingOnly {
+		query.Set("passing", "true")
+	}
+	body, _, err := c.consul.get("/v1/health/service/"+url.PathEscape(service), query, 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading consul service %v: %v", service, err)
+	}
+	entries := []consulServiceEntry{}
+	if body != nil {
+		if err := json.Unmarshal(body, &entries); err != nil {
+			return nil, err
+		}
+	}
+	groups := []fileSDGroup{}
+	for _, entry := range entries {
+		if !hasTags(entry.Service.Tags, c.tags) {
+			continue
+		}
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		labels := map[string]string{
+			"__meta_consul_service":         entry.Service.Service,
+			"__meta_consul_service_id":      entry.Service.ID,
+			"__meta_consul_service_address": entry.Service.Address,
+			"__meta_consul_service_port":    strconv.Itoa(entry.Service.Port),
+			"__meta_consul_node":            entry.Node.Node,
+			"__meta_consul_address":         entry.Node.Address,
+			"__meta_consul_dc":              entry.Node.Datacenter,
+			// surrounded by commas so relabelling can match whole tags
+			"__meta_consul_tags": "," + strings.Join(entry.Service.Tags, ",") + ",",
+		}
+		for key, value := range entry.Service.Meta {
+			labels["__meta_consul_service_metadata_"+invalidLabelChars.ReplaceAllString(key, "_")] = value
+		}
+		for key, value := range entry.Node.Meta {
+			labels["__meta_consul_metadata_"+invalidLabelChars.ReplaceAllString(key, "_")] = value
+		}
+		groups = append(groups, fileSDGroup{Targets: []string{net.JoinHostPort(address, strconv.Itoa(entry.Service.Port))}, Labels: labels})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Labels["__meta_consul_service_id"]+groups[i].Labels["__meta_consul_node"] < groups[j].Labels["__meta_consul_service_id"]+groups[j].Labels["__meta_consul_node"]
+	})
+	return groups, nil
+}
+
+// hasTags reports whether tags include every wanted tag.
+func hasTags(tags []string, wanted []string) bool {
+	for _, want := range wanted {
+		found := false
+		for _, tag := range tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var (
+	keyringEnabled   = flag.Bool("keyring", false, "Enable ${keyring:service/account} references to secrets in the OS keyring, read with secret-tool on Linux and security on macOS. Notifiers can use them as credentials=keyring:service/account.")
+	credentialHelper = flag.String("credential-helper", "", "Command run to fetch secrets for ${helper:name} references, given the name as its last argument and printing the secret. Notifiers can use them as credentials=helper:name.")
+)
+
+// credentialTimeout limits how long the keyring or a credential helper may take.
+const credentialTimeout = 30 * time.Second
+
+// stepCredentials are the credentials sent with a step's reload and health check requests,
+// resolved from a secret store each time so they never appear in flags or the environment.
+type stepCredentials struct {
+	// auth is bearer, or basic for a user:password secret
+	auth   string
+	scheme string
+	ref    string
+}
+
+func parseStepCredentials(auth string, ref string) (*stepCredentials, error) {
+	if auth == "" {
+		auth = "bearer"
+	}
+	if auth != "bearer" && auth != "basic" {
+		return nil, fmt.Errorf("auth must be bearer or basic, got %q", auth)
+	}
+	if ref == "" {
+		return nil, fmt.Errorf("auth=%v needs credentials", auth)
+	}
+	kv := strings.SplitN(ref, ":", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return nil, fmt.Errorf("credentials %q should be a secret reference such as keyring:service/account", ref)
+	}
+	return &stepCredentials{auth: auth, scheme: kv[0], ref: kv[1]}, nil
+}
+
+// checkStepCredentials confirms the stores the steps' credentials come from are configured.
+func checkStepCredentials(steps []*reloadStep) error {
+	for _, step := range steps {
+		if step.credentials != nil && secretResolvers[step.credentials.scheme] == nil {
+			return fmt.Errorf("step %v takes credentials from %v, which isn't configured", step.name, step.credentials.scheme)
+		}
+	}
+	return nil
+}
+
+// apply adds the credentials to req.
+func (c *stepCredentials) apply(req *http.Request) error {
+	if c == nil {
+		return nil
+	}
+	secret, err := resolveSecret(c.scheme, c.ref, "")
+	if err != nil {
+		return fmt.Errorf("reading credentials: %v", err)
+	}
+	if c.auth == "basic" {
+		kv := strings.SplitN(secret, ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("basic auth credentials %v:%v should be user:password", c.scheme, c.ref)
+		}
+		req.SetBasicAuth(kv[0], kv[1])
+		return nil
+	}
+	req.Header.Set("Authorization", "Bearer "+secret)
+	return nil
+}
+
+// runCredentialCommand runs a command that prints a secret.
+func runCredentialCommand(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), credentialTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%v: %v", err, msg)
+		}
+		return "", err
+	}
+	secret := strings.TrimSpace(stdout.String())
+	if secret == "" {
+		return "", fmt.Errorf("%v printed nothing", name)
+	}
+	return secret, nil
+}
+
+// osKeyring reads generic passwords from the OS keyring, by service/account.
+type osKeyring struct{}
+
+func (osKeyring) resolve(ref string) (secretValue, error) {
+	i := strings.LastIndex(ref, "/")
+	if i <= 0 || i == len(ref)-1 {
+		return secretValue{}, fmt.Errorf("keyring reference %q should be service/account", ref)
+	}
+	service, account := ref[:i], ref[i+1:]
+	var secret string
+	var err error
+	switch runtime.GOOS {
+	case "darwin":
+		secret, err = runCredentialCommand("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	case "windows":
+		return secretValue{}, fmt.Errorf("the Windows credential manager isn't supported, use --credential-helper")
+	default:
+		// the Secret Service, as used by GNOME Keyring and KWallet
+		secret, err = runCredentialCommand("secret-tool", "lookup", "service", service, "account", account)
+	}
+	if err != nil {
+		return secretValue{}, err
+	}
+	return secretValue{value: secret}, nil
+}
+
+// credentialHelperCommand fetches secrets by running --credential-helper.
+type credentialHelperCommand struct {
+	args []string
+}
+
+func (h *credentialHelperCommand) resolve(ref string) (secretValue, error) {
+	secret, err := runCredentialCommand(h.args[0], append(h.args[1:], ref)...)
+	if err != nil {
+		return secretValue{}, err
+	}
+	return secretValue{value: secret}, nil
+}
@@ -0,0 +1,158 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	dnsSDRecords  stringList
+	dnsSDDir      = flag.String("dns-sd-dir", "/var/lib/prom-config-watcher/dns-sd", "Directory the file_sd target lists resolved from --dns-sd-record are written to. Pipelines watching it, or a directory it is inside, are re-rendered and reloaded when the members of a record change.")
+	dnsSDInterval = flag.Duration("dns-sd-interval", 30*time.Second, "How often the --dns-sd-record names are resolved.")
+	dnsSDResolver = flag.String("dns-sd-resolver", "", "DNS server, as host:port, the --dns-sd-record names are resolved with instead of the system resolver.")
+)
+
+func init() {
+	flag.Var(&dnsSDRecords, "dns-sd-record", "SRV record resolved into a file_sd target list in --dns-sd-dir, as name or file=name to choose the file name, which defaults to the name followed by .json. May be repeated.")
+}
+
+// dnsSDRecord is an SRV record and the file its targets are written to.
+type dnsSDRecord struct {
+	file string
+	name string
+}
+
+// dnsSD resolves SRV records into target lists.
+type dnsSD struct {
+	records  []dnsSDRecord
+	resolver *net.Resolver
+	mirror   *sourceMirror
+}
+
+func configureDNSSD() error {
+	if len(dnsSDRecords) == 0 {
+		return nil
+	}
+	d := &dnsSD{resolver: net.DefaultResolver}
+	files := map[string]bool{}
+	for _, spec := range dnsSDRecords {
+		record := dnsSDRecord{name: spec}
+		if i := strings.Index(spec, "="); i >= 0 {
+			record.file, record.name = spec[:i], spec[i+1:]
+		}
+		record.name = strings.TrimSuffix(strings.TrimSpace(record.name), ".")
+		if record.name == "" {
+			return fmt.Errorf("--dns-sd-record %q has no name", spec)
+		}
+		if record.file == "" {
+			record.file = record.name + ".json"
+		}
+		if strings.Contains(record.file, "/") || !safeRelativePath(record.file) {
+			return fmt.Errorf("--dns-sd-record %q can't be written to %q", spec, record.file)
+		}
+		if files[record.file] {
+			return fmt.Errorf("more than one --dns-sd-record is written to %v", record.file)
+		}
+		files[record.file] = true
+		d.records = append(d.records, record)
+	}
+	if *dnsSDResolver != "" {
+		if _, _, err := net.SplitHostPort(*dnsSDResolver); err != nil {
+			return fmt.Errorf("--dns-sd-resolver %q isn't of the form host:port", *dnsSDResolver)
+		}
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, *dnsSDResolver)
+			},
+		}
+	}
+	mirror, err := addMirror("dns-sd", "--dns-sd-record", *dnsSDDir, *dnsSDInterval, d.fetch)
+	if err != nil {
+		return err
+	}
+	d.mirror = mirror
+	return nil
+}
+
+// fetch resolves every record, only writing the lists when all of them resolved so a
+// failing lookup doesn't drop targets.
+func (d *dnsSD) fetch() (bool, error) {
+	files := map[string][]byte{}
+	for _, record := range d.records {
+		groups, err := d.resolve(record.name)
+		if err != nil {
+			return false, err
+		}
+		list, err := json.MarshalIndent(groups, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		files[record.file] = append(list, '\n')
+	}
+	return mirrorFiles(d.mirror.dir, files)
+}
+
+// resolve returns a group for every target of a record, labelled as Prometheus's dns_sd
+// does. A name that doesn't exist has no targets.
+func (d *dnsSD) resolve(name string) ([]fileSDGroup, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *reloadTimeout)
+	defer cancel()
+	groups := []fileSDGroup{}
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", name)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return groups, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resolving %v: %v", name, err)
+	}
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		port := strconv.Itoa(int(record.Port))
+		groups = append(groups, fileSDGroup{
+			Targets: []string{net.JoinHostPort(target, port)},
+			Labels: map[string]string{
+				"__meta_dns_name":                name,
+				"__meta_dns_srv_record_target":   record.Target,
+				"__meta_dns_srv_record_port":     port,
+				"__meta_dns_srv_record_priority": strconv.Itoa(int(record.Priority)),
+				"__meta_dns_srv_record_weight":   strconv.Itoa(int(record.Weight)),
+			},
+		})
+	}
+	// lookups return records in a random order within a priority
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Targets[0] < groups[j].Targets[0] })
+	return groups, nil
+}
@@ -0,0 +1,67 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var dryRun = flag.Bool("dry-run", false, "Run the full pipeline but write nothing and reload nothing, logging the files that would be written and the services that would be reloaded instead.")
+
+// planSinks logs what writeSinks would do with the rendered files.
+func planSinks(logger *log.Entry, sinks []sink, files []renderedFile) error {
+	for _, s := range sinks {
+		selected := selectFiles(s, files)
+		target, local := s.(*targetSink)
+		if !local {
+			logger.Infof("Dry run: would send %d files to %v", len(selected), s.name())
+			continue
+		}
+		for _, file := range selected {
+			if len(target.exclude) > 0 && matchesGlobs(file.name, target.exclude) {
+				continue
+			}
+			targetFile := path.Join(target.dir, file.name)
+			current, err := ioutil.ReadFile(targetFile)
+			switch {
+			case os.IsNotExist(err):
+				logger.WithField("file", targetFile).Info("Dry run: would create file")
+			case err != nil:
+				logger.WithField("file", targetFile).WithError(err).Error("Unable to read current file")
+			case !bytes.Equal(current, file.content):
+				logger.WithField("file", targetFile).Info("Dry run: would update file")
+			default:
+				logger.WithField("file", targetFile).Debug("Dry run: file is unchanged")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etcdWatchTimeout is how long a watch waits for a change before the keys are read again.
+const etcdWatchTimeout = 5 * time.Minute
+
+var (
+	etcdEndpoints     = flag.String("etcd-endpoints", "http://127.0.0.1:2379", "Comma separated etcd endpoints, tried in turn.")
+	etcdSource        = flag.String("etcd-source", "", "etcd key prefix whose keys are written as files to --etcd-source-dir, named after the prefix. Changes are picked up straight away with a watch.")
+	etcdSourceDir     = flag.String("etcd-source-dir", "/var/lib/prom-config-watcher/etcd", "Directory the keys of --etcd-source are written to.")
+	etcdRetryInterval = flag.Duration("etcd-retry-interval", 10*time.Second, "How long to wait before reading --etcd-source again after a failure.")
+	etcdUsername      = flag.String("etcd-username", "", "User to authenticate to etcd as.")
+	etcdPasswordFile  = flag.String("etcd-password-file", "", "File holding the password of --etcd-username.")
+	etcdCAFile        = flag.String("etcd-ca-file", "", "CA certificates the etcd server certificate is verified with, instead of the system roots.")
+	etcdCertFile      = flag.String("etcd-cert-file", "", "Client certificate presented to etcd.")
+	etcdKeyFile       = flag.String("etcd-key-file", "", "Key of --etcd-cert-file.")
+)
+
+// etcdSync mirrors the keys under a prefix through etcd's JSON gateway.
+type etcdSync struct {
+	endpoints []string
+	client    *http.Client
+	prefix    string
+	// revision is the revision of the keys written, 0 before the first read
+	revision int64
+	mirror   *sourceMirror
+}
+
+// etcdKeyValue is a key in a range response or watch event. Keys and values are base64
+// encoded, which []byte decodes.
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// etcdHeader carries the revision, sent as a string as 64 bit integers are in JSON mapped
+// protobufs.
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+func configureEtcdSource() error {
+	if *etcdSource == "" {
+		return nil
+	}
+	client := newHTTPClient(0)
+	if *etcdCAFile != "" || *etcdCertFile != "" {
+		tlsConfig, err := clientTLSConfig(*etcdCAFile, *etcdCertFile, *etcdKeyFile)
+		if err != nil {
+			return fmt.Errorf("etcd: %v", err)
+		}
+		client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+	}
+	e := &etcdSync{client: client, prefix: *etcdSource}
+	for _, endpoint := range strings.Split(*etcdEndpoints, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			e.endpoints = append(e.endpoints, strings.TrimSuffix(endpoint, "/"))
+		}
+	}
+	if len(e.endpoints) == 0 {
+		return fmt.Errorf("--etcd-endpoints is empty")
+	}
+	mirror, err := addMirror("etcd", "etcd "+e.prefix, *etcdSourceDir, *etcdRetryInterval, e.fetch)
+	if err != nil {
+		return err
+	}
+	e.mirror = mirror
+	return nil
+}
+
+// rangeEnd is the end of the range of keys starting with prefix.
+func rangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// every key
+	return []byte{0}
+}
+
+// fetch waits for a key under the prefix to change, then reads and writes out every key.
+func (e *etcdSync) fetch() (bool, error) {
+	var lastErr error
+	for _, endpoint := range e.endpoints {
+		changed, err := e.fetchFrom(endpoint)
+		if err == nil {
+			return changed, nil
+		}
+		lastErr = fmt.Errorf("%v: %v", endpoint, err)
+	}
+	return false, lastErr
+}
+
+func (e *etcdSync) fetchFrom(endpoint string) (bool, error) {
+	token, err := e.authenticate(endpoint)
+	if err != nil {
+		return false, err
+	}
+	if e.revision > 0 {
+		if err := e.watch(endpoint, token); err != nil {
+			return false, err
+		}
+	}
+	response := struct {
+		Header etcdHeader     `json:"header"`
+		KVs    []etcdKeyValue `json:"kvs"`
+	}{}
+	if err := e.post(context.Background(), endpoint, "/v3/kv/range", token, map[string][]byte{"key": []byte(e.prefix), "range_end": rangeEnd(e.prefix)}, &response); err != nil {
+		return false, err
+	}
+	revision, _ := strconv.ParseInt(response.Header.Revision, 10, 64)
+	if revision == e.revision {
+		return false, nil
+	}
+	files := map[string][]byte{}
+	for _, kv := range response.KVs {
+		name := strings.TrimLeft(strings.TrimPrefix(string(kv.Key), e.prefix), "/")
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		if kv.Value == nil {
+			kv.Value = []byte{}
+		}
+		files[name] = kv.Value
+	}
+	changed, err := mirrorFiles(e.mirror.dir, files)
+	if err == nil {
+		e.revision = revision
+	}
+	return changed, err
+}
+
+// watch waits for a change to the prefix after the revision written, or the watch timeout.
+func (e *etcdSync) watch(endpoint string, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdWatchTimeout)
+	defer cancel()
+	request := map[string]interface{}{"create_request": map[string]interface{}{
+		"key":            []byte(e.prefix),
+		"range_end":      rangeEnd(e.prefix),
+		"start_revision": strconv.FormatInt(e.revision+1, 10),
+	}}
+	resp, err := e.send(ctx, endpoint, "/v3/watch", token, request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		message := struct {
+			Result struct {
+				Events          []json.RawMessage `json:"events"`
+				CompactRevision string            `json:"compact_revision"`
+				Canceled        bool              `json:"canceled"`
+			} `json:"result"`
+		}{}
+		if err := decoder.Decode(&message); err != nil {
+			if ctx.Err() != nil {
+				// nothing changed, read the keys anyway in case a change was missed
+				return nil
+			}
+			return fmt.Errorf("watching: %v", err)
+		}
+		// events or a compacted revision both mean the keys need reading again
+		if len(message.Result.Events) > 0 || message.Result.Canceled || message.Result.CompactRevision != "" {
+			return nil
+		}
+	}
+}
+
+// authenticate returns a token for --etcd-username, or nothing without one.
+func (e *etcdSync) authenticate(endpoint string) (string, error) {
+	if *etcdUsername == "" {
+		return "", nil
+	}
+	password, err := readSecretFile(*etcdPasswordFile)
+	if err != nil {
+		return "", err
+	}
+	response := struct {
+		Token string `json:"token"`
+	}{}
+	if err := e.post(context.Background(), endpoint, "/v3/auth/authenticate", "", map[string]string{"name": *etcdUsername, "password": password}, &response); err != nil {
+		return "", fmt.Errorf("authenticating: %v", err)
+	}
+	return response.Token, nil
+}
+
+func (e *etcdSync) post(ctx context.Context, endpoint string, path string, token string, request interface{}, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, *reloadTimeout)
+	defer cancel()
+	resp, err := e.send(ctx, endpoint, path, token, request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSourceSize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxSourceSize {
+		return fmt.Errorf("etcd response larger than %v bytes", maxSourceSize)
+	}
+	return json.Unmarshal(body, out)
+}
+
+// send posts a request, checking the status but leaving the body to the caller.
+func (e *etcdSync) send(ctx context.Context, endpoint string, path string, token string, request interface{}) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		failure := struct {
+			Message string `json:"message"`
+		}{}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&failure)
+		return nil, fmt.Errorf("%v returned status %v: %v", path, resp.StatusCode, failure.Message)
+	}
+	return resp, nil
+}
@@ -0,0 +1,105 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var blackboxProbers = map[string]bool{"http": true, "tcp": true, "icmp": true, "dns": true, "grpc": true, "unix": true}
+
+// validateBlackboxConfig checks blackbox exporter modules use a known prober and a valid timeout.
+func validateBlackboxConfig(file renderedFile, all []renderedFile) error {
+	cfg := struct {
+		Modules map[string]struct {
+			Prober  string `yaml:"prober"`
+			Timeout string `yaml:"timeout"`
+		} `yaml:"modules"`
+	}{}
+	if err := yaml.Unmarshal(file.content, &cfg); err != nil {
+		return err
+	}
+	if len(cfg.Modules) == 0 {
+		return fmt.Errorf("no modules defined")
+	}
+	for name, module := range cfg.Modules {
+		if !blackboxProbers[module.Prober] {
+			return fmt.Errorf("module %q has unknown prober %q", name, module.Prober)
+		}
+		if module.Timeout != "" {
+			if _, err := time.ParseDuration(module.Timeout); err != nil {
+				return fmt.Errorf("module %q has invalid timeout %q", name, module.Timeout)
+			}
+		}
+	}
+	return nil
+}
+
+// validateSNMPConfig checks the generated snmp.yml structure: every module needs something
+// to walk or get and every auth a supported SNMP version.
+func validateSNMPConfig(file renderedFile, all []renderedFile) error {
+	cfg := struct {
+		Auths map[string]struct {
+			Version int `yaml:"version"`
+		} `yaml:"auths"`
+		Modules map[string]struct {
+			Walk    []string `yaml:"walk"`
+			Get     []string `yaml:"get"`
+			Metrics []struct {
+				Name string `yaml:"name"`
+				Oid  string `yaml:"oid"`
+				Type string `yaml:"type"`
+			} `yaml:"metrics"`
+		} `yaml:"modules"`
+	}{}
+	if err := yaml.Unmarshal(file.content, &cfg); err != nil {
+		return err
+	}
+	if len(cfg.Modules) == 0 {
+		return fmt.Errorf("no modules defined")
+	}
+	for name, auth := range cfg.Auths {
+		if auth.Version != 0 && (auth.Version < 1 || auth.Version > 3) {
+			return fmt.Errorf("auth %q has unsupported version %d", name, auth.Version)
+		}
+	}
+	for name, module := range cfg.Modules {
+		if len(module.Walk) == 0 && len(module.Get) == 0 {
+			return fmt.Errorf("module %q has nothing to walk or get", name)
+		}
+		for _, metric := range module.Metrics {
+			if !metricNamePattern.MatchString(metric.Name) {
+				return fmt.Errorf("module %q has invalid metric name %q", name, metric.Name)
+			}
+			if metric.Oid == "" {
+				return fmt.Errorf("module %q metric %q has no oid", name, metric.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var failureWebhookSpecs stringList
+
+func init() {
+	flag.Var(&failureWebhookSpecs, "failure-webhook", "Webhook notified when validation or reloads keep failing, as comma separated key=value pairs, e.g. \"url=https://hooks.slack.com/services/...,format=slack,after=3\". "+
+		"Keys: url, format (slack, teams or generic JSON), after (consecutive failures before notifying, default 3) and template (file holding a Go template for the payload). May be repeated.")
+}
+
+// defaultPayloadTemplates are used when a webhook doesn't supply its own template. The json
+// function quotes a value as a JSON string.
+var defaultPayloadTemplates = map[string]string{
+	"slack":   `{"text": {{json .Message}}}`,
+	"teams":   `{"@type": "MessageCard", "@context": "https://schema.org/extensions", "themeColor": "d62728", "summary": {{json .Summary}}, "text": {{json .Message}}}`,
+	"generic": `{"kind": {{json .Kind}}, "failures": {{.Failures}}, "error": {{json .Error}}, "host": {{json .Host}}, "time": {{json .Time}}, "message": {{json .Message}}}`,
+}
+
+// failureNotice is the data available to payload templates.
+type failureNotice struct {
+	Kind     string
+	Failures int
+	Error    string
+	Host     string
+	Time     string
+	Summary  string
+	Message  string
+}
+
+// failureWebhook posts a notice once a kind of failure has happened enough times in a row.
+type failureWebhook struct {
+	url      string
+	after    int
+	template *template.Template
+}
+
+func parseFailureWebhook(spec string) (*failureWebhook, error) {
+	hook := &failureWebhook{after: 3}
+	format, templateFile := "generic", ""
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected key=value in %q", pair)
+		}
+		key, value := kv[0], kv[1]
+
+		switch key {
+		case "url":
+			hook.url = value
+		case "format":
+			format = value
+		case "after":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid after value %q", value)
+			}
+			hook.after = n
+		case "template":
+			templateFile = value
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	if hook.url == "" {
+		return nil, fmt.Errorf("url is required in %q", spec)
+	}
+
+	text, known := defaultPayloadTemplates[format]
+	if !known {
+		return nil, fmt.Errorf("unknown webhook format %q", format)
+	}
+	if templateFile != "" {
+		contents, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(contents)
+	}
+	tmpl, err := template.New(hook.url).Funcs(template.FuncMap{"json": jsonString}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload template: %v", err)
+	}
+	hook.template = tmpl
+	return hook, nil
+}
+
+func jsonString(v interface{}) (string, error) {
+	encoded, err := json.Marshal(fmt.Sprint(v))
+	return string(encoded), err
+}
+
+// failureNotifier counts consecutive validation and reload failures, notifying the webhooks
+// when a count reaches their threshold. A nil notifier does nothing.
+type failureNotifier struct {
+	hooks []*failureWebhook
+
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+func newFailureNotifier(specs []string) (*failureNotifier, error) {
+	notifier := &failureNotifier{failures: map[string]int{}}
+	for _, spec := range specs {
+		hook, err := parseFailureWebhook(spec)
+		if err != nil {
+			return nil, err
+		}
+		notifier.hooks = append(notifier.hooks, hook)
+	}
+	return notifier, nil
+}
+
+// runFinished counts validation failures. Other processing errors are already retried on
+// the next change and aren't counted.
+func (n *failureNotifier) runFinished(rendered []renderedFile, err error) {
+	if n == nil {
+		return
+	}
+	if _, invalid := err.(*validationError); invalid {
+		n.record("validation", err)
+	} else if err == nil {
+		n.record("validation", nil)
+	}
+}
+
+func (n *failureNotifier) reloadFinished(err error) {
+	if n == nil {
+		return
+	}
+	n.record("reload", err)
+}
+
+func (n *failureNotifier) record(kind string, err error) {
+	n.mu.Lock()
+	if err == nil {
+		n.failures[kind] = 0
+		n.mu.Unlock()
+		return
+	}
+	n.failures[kind]++
+	count := n.failures[kind]
+	n.mu.Unlock()
+
+	host, _ := os.Hostname()
+	notice := failureNotice{
+		Kind:     kind,
+		Failures: count,
+		Error:    err.Error(),
+		Host:     host,
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Summary:  fmt.Sprintf("Config %v failing on %v", kind, host),
+		Message:  fmt.Sprintf("Config %v has failed %d times in a row on %v: %v", kind, count, host, err),
+	}
+	for _, hook := range n.hooks {
+		// notify once per run of failures rather than on every failure after the threshold
+		if count == hook.after {
+			go hook.send(notice)
+		}
+	}
+}
+
+func (h *failureWebhook) send(notice failureNotice) {
+	body := &bytes.Buffer{}
+	if err := h.template.Execute(body, notice); err != nil {
+		log.WithError(err).Error("Error rendering failure webhook payload")
+		return
+	}
+	resp, err := reloadClient.Post(h.url, "application/json", body)
+	if err != nil {
+		log.WithError(err).Error("Error sending failure webhook")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Errorf("Failure webhook returned status %v", resp.StatusCode)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix starts the name of the environment variable for each flag, e.g.
+// PROM_CONFIG_WATCHER_WATCH_PATH for --watch-path.
+const envPrefix = "PROM_CONFIG_WATCHER_"
+
+// stringList is a flag.Value that can be repeated on the command line, collecting
+// each occurrence.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// splitList returns the items of a comma separated flag, dropping empty ones.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// flagWasSet reports whether the named flag was given on the command line, in the environment
+// or in the config file.
+func flagWasSet(name string) bool {
+	set := explicitFlags[name] || fileSettings[name]
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// explicitFlags are the flags given on the command line or in the environment, which the
+// config file doesn't override.
+var explicitFlags = map[string]bool{}
+
+// fileSettings are the flags set by the config file.
+var fileSettings = map[string]bool{}
+
+// settingsSnapshot holds the flag values from before a config file's settings were applied,
+// so that a file rejected afterwards leaves the running settings as they were.
+type settingsSnapshot struct {
+	values map[string]string
+	lists  map[string]stringList
+	file   map[string]bool
+}
+
+func snapshotSettings() settingsSnapshot {
+	snapshot := settingsSnapshot{values: map[string]string{}, lists: map[string]stringList{}, file: map[string]bool{}}
+	flag.VisitAll(func(f *flag.Flag) {
+		if list, isList := f.Value.(*stringList); isList {
+			snapshot.lists[f.Name] = append(stringList(nil), *list...)
+			return
+		}
+		snapshot.values[f.Name] = f.Value.String()
+	})
+	for name := range fileSettings {
+		snapshot.file[name] = true
+	}
+	return snapshot
+}
+
+func (s settingsSnapshot) restore() {
+	flag.VisitAll(func(f *flag.Flag) {
+		if list, isList := f.Value.(*stringList); isList {
+			*list = s.lists[f.Name]
+			return
+		}
+		if f.Value.String() != s.values[f.Name] {
+			f.Value.Set(s.values[f.Name])
+		}
+	})
+	fileSettings = s.file
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// applyEnvironment sets the flags not given on the command line from their environment
+// variables. Repeatable flags take one value per line.
+func applyEnvironment() error {
+	flag.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicitFlags[f.Name] {
+			return
+		}
+		value, found := os.LookupEnv(envName(f.Name))
+		if !found {
+			return
+		}
+		values := []string{value}
+		if _, repeatable := f.Value.(*stringList); repeatable {
+			values = strings.Split(strings.TrimSpace(value), "\n")
+		}
+		for _, v := range values {
+			if setErr := f.Value.Set(v); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %v: %v", v, envName(f.Name), setErr)
+				return
+			}
+		}
+		explicitFlags[f.Name] = true
+	})
+	return err
+}
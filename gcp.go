@@ -0,0 +1,216 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	gcpSecretManagerEnabled = flag.Bool("gcp-secret-manager", false, "Resolve ${gcp-sm:secret#key} references in source files from GCP Secret Manager, using the workload identity of the pod. Append @version to pin a version, the latest is used otherwise.")
+	gcpProject              = flag.String("gcp-project", os.Getenv("GOOGLE_CLOUD_PROJECT"), "GCP project of secrets referenced by name alone. Defaults to the project of the metadata server.")
+)
+
+// gcpClient calls Google APIs with access tokens from the metadata server, which on GKE
+// hands out tokens for the workload identity bound to the pod's service account.
+type gcpClient struct {
+	client   *http.Client
+	metadata *http.Client
+	host     string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	project string
+}
+
+func newGCPClient() *gcpClient {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	return &gcpClient{client: reloadClient, metadata: newMetadataClient(), host: host}
+}
+
+func (g *gcpClient) metadataGet(path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%v/computeMetadata/v1/%v", g.host, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := g.metadata.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("metadata server: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("metadata server returned status %v for %v", resp.StatusCode, path)
+	}
+	return body, nil
+}
+
+// accessToken returns a cached token, fetching a new one shortly before it expires.
+func (g *gcpClient) accessToken() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.token != "" && time.Until(g.expires) > time.Minute {
+		return g.token, nil
+	}
+	body, err := g.metadataGet("instance/service-accounts/default/token")
+	if err != nil {
+		return "", err
+	}
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("decoding access token: %v", err)
+	}
+	g.token = token.AccessToken
+	g.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return g.token, nil
+}
+
+// projectID returns --gcp-project, or the project the metadata server is in.
+func (g *gcpClient) projectID() (string, error) {
+	if *gcpProject != "" {
+		return *gcpProject, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.project == "" {
+		body, err := g.metadataGet("project/project-id")
+		if err != nil {
+			return "", err
+		}
+		g.project = strings.TrimSpace(string(body))
+	}
+	return g.project, nil
+}
+
+// do sends an authorized request to a Google API, decoding the JSON response into out, or
+// storing it as is when out is a *[]byte.
+func (g *gcpClient) do(req *http.Request, out interface{}) error {
+	token, err := g.accessToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxSourceSize+1))
+	if len(body) > maxSourceSize {
+		return fmt.Errorf("%v response larger than %v bytes", req.URL.Host, maxSourceSize)
+	}
+	if resp.StatusCode/100 != 2 {
+		failure := struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}{}
+		json.Unmarshal(body, &failure)
+		return &gcpStatusError{host: req.URL.Host, status: resp.StatusCode, message: failure.Error.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	// media downloads are returned as they are
+	if raw, isRaw := out.(*[]byte); isRaw {
+		*raw = body
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// gcpStatusError is a failed response from a Google API.
+type gcpStatusError struct {
+	host    string
+	status  int
+	message string
+}
+
+func (e *gcpStatusError) Error() string {
+	return fmt.Sprintf("%v returned status %v: %v", e.host, e.status, e.message)
+}
+
+// gcpSecretManager resolves ${gcp-sm:secret@version#key} references. The secret is either a
+// name in --gcp-project or a full projects/p/secrets/s resource name.
+type gcpSecretManager struct {
+	gcp *gcpClient
+}
+
+func (s *gcpSecretManager) resolve(ref string) (secretValue, error) {
+	name, key := ref, ""
+	if i := strings.LastIndex(name, "#"); i >= 0 {
+		name, key = name[:i], name[i+1:]
+	}
+	version := "latest"
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		name, version = name[:i], name[i+1:]
+	}
+	if !strings.HasPrefix(name, "projects/") {
+		project, err := s.gcp.projectID()
+		if err != nil {
+			return secretValue{}, err
+		}
+		name = fmt.Sprintf("projects/%v/secrets/%v", project, name)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://secretmanager.googleapis.com/v1/%v/versions/%v:access", name, version), nil)
+	if err != nil {
+		return secretValue{}, err
+	}
+	out := struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}{}
+	if err := s.gcp.do(req, &out); err != nil {
+		return secretValue{}, err
+	}
+	data, err := base64.StdEncoding.DecodeString(out.Payload.Data)
+	if err != nil {
+		return secretValue{}, fmt.Errorf("decoding secret payload: %v", err)
+	}
+	if key == "" {
+		return secretValue{value: string(data)}, nil
+	}
+	return jsonField(string(data), key)
+}
@@ -0,0 +1,146 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	gcsSource         = flag.String("gcs-source", "", "Google Cloud Storage bucket and object prefix, as bucket/prefix or gs://bucket/prefix, whose objects are synced into --gcs-source-dir using the workload identity of the pod.")
+	gcsSourceDir      = flag.String("gcs-source-dir", "/var/lib/prom-config-watcher/gcs", "Directory the objects of --gcs-source are written to, named after the prefix.")
+	gcsSourceInterval = flag.Duration("gcs-source-interval", time.Minute, "How often --gcs-source is listed for changed objects.")
+)
+
+// gcsSync mirrors the objects under a prefix, downloading only those whose generation has
+// changed.
+type gcsSync struct {
+	gcp      *gcpClient
+	endpoint string
+	bucket   string
+	prefix   string
+	// generations are the generations of the objects written, by file name
+	generations map[string]string
+	mirror      *sourceMirror
+}
+
+func configureGCSSource() error {
+	if *gcsSource == "" {
+		return nil
+	}
+	spec := strings.TrimPrefix(*gcsSource, "gs://")
+	bucket, prefix := spec, ""
+	if i := strings.Index(spec, "/"); i >= 0 {
+		bucket, prefix = spec[:i], spec[i+1:]
+	}
+	if bucket == "" {
+		return fmt.Errorf("invalid --gcs-source %q, expected bucket/prefix", *gcsSource)
+	}
+	g := &gcsSync{gcp: newGCPClient(), endpoint: gcsEndpoint(), bucket: bucket, prefix: prefix, generations: map[string]string{}}
+	mirror, err := addMirror("gcs", "gs://"+spec, *gcsSourceDir, *gcsSourceInterval, g.fetch)
+	if err != nil {
+		return err
+	}
+	g.mirror = mirror
+	return nil
+}
+
+// gcsEndpoint is the Cloud Storage API, or the emulator named by STORAGE_EMULATOR_HOST as
+// the client libraries use it.
+func gcsEndpoint() string {
+	endpoint := os.Getenv("STORAGE_EMULATOR_HOST")
+	if endpoint == "" {
+		return "https://storage.googleapis.com"
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	return endpoint
+}
+
+// fetch lists the prefix and downloads the objects with a new generation.
+func (g *gcsSync) fetch() (bool, error) {
+	files := map[string][]byte{}
+	generations := map[string]string{}
+	pageToken := ""
+	for {
+		query := url.Values{"prefix": {g.prefix}, "fields": {"items(name,generation),nextPageToken"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%v/storage/v1/b/%v/o?%v", g.endpoint, url.PathEscape(g.bucket), query.Encode()), nil)
+		if err != nil {
+			return false, err
+		}
+		page := struct {
+			Items []struct {
+				Name       string `json:"name"`
+				Generation string `json:"generation"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}{}
+		if err := g.gcp.do(req, &page); err != nil {
+			return false, fmt.Errorf("listing gs://%v/%v: %v", g.bucket, g.prefix, err)
+		}
+		for _, object := range page.Items {
+			name := strings.TrimLeft(strings.TrimPrefix(object.Name, g.prefix), "/")
+			if name == "" || strings.HasSuffix(name, "/") {
+				continue
+			}
+			generations[name] = object.Generation
+			if _, err := os.Stat(filepath.Join(g.mirror.dir, filepath.FromSlash(name))); err == nil && g.generations[name] == object.Generation {
+				files[name] = nil
+				continue
+			}
+			media := url.Values{"alt": {"media"}, "generation": {object.Generation}}
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%v/storage/v1/b/%v/o/%v?%v", g.endpoint, url.PathEscape(g.bucket), url.PathEscape(object.Name), media.Encode()), nil)
+			if err != nil {
+				return false, err
+			}
+			var content []byte
+			if err := g.gcp.do(req, &content); err != nil {
+				return false, fmt.Errorf("fetching gs://%v/%v: %v", g.bucket, object.Name, err)
+			}
+			files[name] = content
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+	changed, err := mirrorFiles(g.mirror.dir, files)
+	if err == nil {
+		g.generations = generations
+	}
+	return changed, err
+}
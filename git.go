@@ -0,0 +1,195 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// gitMetadataDir is the repository metadata in a checkout, never rendered.
+const gitMetadataDir = ".git"
+
+// gitTimeout limits a single git command, such as a fetch.
+const gitTimeout = 5 * time.Minute
+
+var (
+	gitRepoURL        = flag.String("git-repo", "", "Git repository, over HTTPS or SSH, that is checked out to --git-checkout-dir and kept up to date. Point --watch-path or the pipelines' watch paths at the checkout to render it.")
+	gitRef            = flag.String("git-ref", "", "Branch or tag of --git-repo to check out. Defaults to the repository's default branch.")
+	gitCheckoutDir    = flag.String("git-checkout-dir", "/var/lib/prom-config-watcher/git", "Directory --git-repo is checked out to. Local changes to it are discarded on every sync.")
+	gitPollInterval   = flag.Duration("git-poll-interval", time.Minute, "How often --git-repo is fetched for new commits.")
+	gitBinary         = flag.String("git-binary", "git", "Path to the git binary.")
+	gitUsername       = flag.String("git-username", "", "User for HTTPS access to --git-repo. Defaults to x-access-token when only a password is given, as GitHub expects for tokens.")
+	gitPasswordFile   = flag.String("git-password-file", "", "File holding the password or access token for HTTPS access to --git-repo.")
+	gitSSHKeyFile     = flag.String("git-ssh-key-file", "", "Private key for SSH access to --git-repo.")
+	gitKnownHostsFile = flag.String("git-known-hosts-file", "", "known_hosts file the SSH host key of --git-repo is checked against. Required when --git-repo is an ssh:// or scp-style URL.")
+)
+
+// gitSource keeps a checkout of a Git repository at the head of a branch or tag.
+type gitSource struct {
+	url string
+	ref string
+	dir string
+	// commit is the commit checked out
+	commit string
+	mirror *sourceMirror
+}
+
+// gitRepo is the --git-repo source, nil when there is none.
+var gitRepo *gitSource
+
+func configureGitSource() error {
+	if *gitRepoURL == "" {
+		return nil
+	}
+	if isSSHGitURL(*gitRepoURL) && *gitKnownHostsFile == "" {
+		return fmt.Errorf("--git-repo %v is fetched over SSH and needs --git-known-hosts-file to check the host key against", *gitRepoURL)
+	}
+	g := &gitSource{url: *gitRepoURL, ref: *gitRef}
+	mirror, err := addMirror("git", g.url, *gitCheckoutDir, *gitPollInterval, g.fetch)
+	if err != nil {
+		return err
+	}
+	g.dir, g.mirror = mirror.dir, mirror
+	gitRepo = g
+	return nil
+}
+
+// fetch fetches the ref and checks it out, reporting whether the commit changed.
+func (g *gitSource) fetch() (bool, error) {
+	if _, err := os.Stat(filepath.Join(g.dir, gitMetadataDir)); os.IsNotExist(err) {
+		if _, err := g.run("init", "--quiet"); err != nil {
+			return false, err
+		}
+	}
+	ref := g.ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	// fetch by url so a changed --git-repo takes effect without touching the remotes
+	if _, err := g.run("fetch", "--quiet", "--depth", "1", "--no-tags", g.url, ref); err != nil {
+		return false, err
+	}
+	fetched, err := g.run("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return false, err
+	}
+	if fetched == g.commit {
+		return false, nil
+	}
+	// the files are replaced in place, the watch settle time covers the checkout
+	if _, err := g.run("checkout", "--quiet", "--force", "--detach", fetched); err != nil {
+		return false, err
+	}
+	if _, err := g.run("clean", "--quiet", "-d", "--force", "-x"); err != nil {
+		return false, err
+	}
+	previous := g.commit
+	g.commit = fetched
+	if previous == "" {
+		log.Infof("Checked out %v of %v", shortCommit(fetched), g.url)
+	} else {
+		log.Infof("%v moved from %v to %v", g.url, shortCommit(previous), shortCommit(fetched))
+	}
+	audit.record(auditEntry{Action: "git-sync", URL: g.url, OldHash: previous, NewHash: fetched, Result: "ok"})
+	return true, nil
+}
+
+// run runs git in the checkout, returning its trimmed output. Credentials are passed through
+// the environment so they don't show up in process listings.
+func (g *gitSource) run(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, *gitBinary, args...)
+	cmd.Dir = g.dir
+	env, err := gitEnvironment()
+	if err != nil {
+		return "", err
+	}
+	cmd.Env = append(os.Environ(), env...)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %v: %v: %v", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// gitEnvironment configures authentication and keeps git from prompting.
+func gitEnvironment() ([]string, error) {
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+	if *gitPasswordFile != "" {
+		password, err := readSecretFile(*gitPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		user := *gitUsername
+		if user == "" {
+			user = "x-access-token"
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+credentials)
+	}
+	if *gitSSHKeyFile != "" || *gitKnownHostsFile != "" {
+		ssh := append([]string{"ssh"}, sshOptions(*gitSSHKeyFile, *gitKnownHostsFile)...)
+		env = append(env, "GIT_SSH_COMMAND="+strings.Join(ssh, " "))
+	}
+	return env, nil
+}
+
+// isSSHGitURL reports whether git fetches url over SSH, either as an ssh:// URL or in the
+// scp-like user@host:path form, which git recognises by a colon before any slash.
+func isSSHGitURL(url string) bool {
+	for _, scheme := range []string{"ssh://", "git+ssh://", "ssh+git://"} {
+		if strings.HasPrefix(url, scheme) {
+			return true
+		}
+	}
+	if strings.Contains(url, "://") {
+		return false
+	}
+	colon := strings.Index(url, ":")
+	return colon > 0 && !strings.Contains(url[:colon], "/")
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
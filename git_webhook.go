@@ -0,0 +1,105 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxWebhookBody limits the size of a webhook payload.
+const maxWebhookBody = 25 << 20
+
+var gitWebhookSecretFile = flag.String("git-webhook-secret-file", "", "File holding the secret of a GitHub or GitLab push webhook. Enables /webhook/git, which fetches --git-repo straight away rather than at the next poll.")
+
+// gitWebhookHandler accepts push events from GitHub, signed with the secret, and GitLab,
+// carrying it as a token.
+func gitWebhookHandler(secret []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !validWebhook(r, body, secret) {
+			log.Debugf("Rejected git webhook from %v", r.RemoteAddr)
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		event := r.Header.Get("X-GitHub-Event")
+		if event == "" {
+			event = r.Header.Get("X-Gitlab-Event")
+		}
+		if event == "ping" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		push := struct {
+			Ref string `json:"ref"`
+		}{}
+		json.Unmarshal(body, &push)
+		if push.Ref != "" && gitRepo.ref != "" && !refMatches(push.Ref, gitRepo.ref) {
+			log.Debugf("Ignoring git webhook for %v", push.Ref)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		log.Infof("Git webhook received for a push to %v, fetching %v now", push.Ref, gitRepo.url)
+		audit.record(auditEntry{Action: "git-webhook", URL: gitRepo.url, Result: "ok"})
+		gitRepo.mirror.requestSync()
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// validWebhook checks GitHub's X-Hub-Signature-256 or GitLab's X-Gitlab-Token.
+func validWebhook(r *http.Request, body []byte, secret []byte) bool {
+	if signature := r.Header.Get("X-Hub-Signature-256"); signature != "" {
+		expected := "sha256=" + hex.EncodeToString(hmacSHA256(secret, string(body)))
+		return hmac.Equal([]byte(signature), []byte(expected))
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), secret) == 1
+	}
+	return false
+}
+
+// refMatches reports whether a pushed ref, such as refs/heads/main, is the branch or tag
+// checked out.
+func refMatches(pushed string, ref string) bool {
+	return pushed == ref || strings.TrimPrefix(strings.TrimPrefix(pushed, "refs/heads/"), "refs/tags/") == ref
+}
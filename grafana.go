@@ -0,0 +1,253 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	grafanaURL          = flag.String("grafana-url", "", "Base url of a Grafana instance to keep in sync with rendered dashboards, datasources and alerting provisioning files.")
+	grafanaMode         = flag.String("grafana-mode", "api", "How Grafana is updated: api pushes dashboards and datasources through the HTTP API, provisioning writes files to the target path (Grafana's provisioning directory) and calls the provisioning reload endpoints.")
+	grafanaTokenFile    = flag.String("grafana-token-file", "", "File containing a Grafana service account token.")
+	grafanaUsername     = flag.String("grafana-username", "", "Username for basic auth to Grafana, when not using a token.")
+	grafanaPasswordFile = flag.String("grafana-password-file", "", "File containing the password for basic auth to Grafana.")
+	grafanaFolderUID    = flag.String("grafana-folder-uid", "", "Folder uid dashboards are placed in when pushed through the API.")
+	grafanaDashboards   = flag.String("grafana-dashboards", "*.dashboard.json", "Glob of rendered dashboard files.")
+	grafanaDatasources  = flag.String("grafana-datasources", "*.datasources.y*ml", "Glob of rendered datasource provisioning files.")
+	grafanaAlerting     = flag.String("grafana-alerting", "*.alerting.y*ml", "Glob of rendered alerting provisioning files. Alerting is always applied through a provisioning reload.")
+)
+
+// grafanaSink keeps Grafana in line with the rendered provisioning files.
+type grafanaSink struct {
+	client *http.Client
+	base   string
+}
+
+func newGrafanaSink() *grafanaSink {
+	return &grafanaSink{client: reloadClient, base: strings.TrimSuffix(*grafanaURL, "/")}
+}
+
+func (g *grafanaSink) name() string {
+	return "grafana " + *grafanaURL
+}
+
+func (g *grafanaSink) files() []string {
+	return []string{*grafanaDashboards, *grafanaDatasources, *grafanaAlerting}
+}
+
+// exclusive returns the files delivered only through the API, which are not written to
+// the target path.
+func (g *grafanaSink) exclusive() []string {
+	if *grafanaMode != "api" {
+		return nil
+	}
+	return []string{*grafanaDashboards, *grafanaDatasources}
+}
+
+func (g *grafanaSink) do(method string, endpoint string, body interface{}) ([]byte, int, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, 0, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, g.base+endpoint, reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	switch {
+	case *grafanaTokenFile != "":
+		token, err := ioutil.ReadFile(*grafanaTokenFile)
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to read grafana token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	case *grafanaUsername != "":
+		password, err := ioutil.ReadFile(*grafanaPasswordFile)
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to read grafana password: %v", err)
+		}
+		req.SetBasicAuth(*grafanaUsername, strings.TrimSpace(string(password)))
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return nil, resp.StatusCode, fmt.Errorf("%v %v returned status %v: %s", method, endpoint, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, resp.StatusCode, nil
+}
+
+func (g *grafanaSink) write(logger *log.Entry, files []renderedFile) error {
+	reload := map[string]bool{}
+	for _, file := range files {
+		var err error
+		switch {
+		case matchesGlobs(file.name, []string{*grafanaAlerting}):
+			reload["alerting"] = true
+		case *grafanaMode != "api" && matchesGlobs(file.name, []string{*grafanaDashboards}):
+			reload["dashboards"] = true
+		case *grafanaMode != "api" && matchesGlobs(file.name, []string{*grafanaDatasources}):
+			reload["datasources"] = true
+		case matchesGlobs(file.name, []string{*grafanaDashboards}):
+			err = g.pushDashboard(logger, file)
+		case matchesGlobs(file.name, []string{*grafanaDatasources}):
+			err = g.pushDatasources(logger, file)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", file.name, err)
+		}
+	}
+
+	for kind := range reload {
+		if _, status, err := g.do(http.MethodPost, "/api/admin/provisioning/"+kind+"/reload", nil); err != nil {
+			return err
+		} else if status == http.StatusNotFound {
+			return fmt.Errorf("grafana has no %v provisioning reload endpoint", kind)
+		}
+		logger.Debugf("Reloaded grafana %v provisioning", kind)
+	}
+	return nil
+}
+
+func (g *grafanaSink) pushDashboard(logger *log.Entry, file renderedFile) error {
+	dashboard := map[string]interface{}{}
+	if err := json.Unmarshal(file.content, &dashboard); err != nil {
+		return err
+	}
+	// ids are instance specific, dashboards are matched by uid
+	delete(dashboard, "id")
+
+	body := map[string]interface{}{
+		"dashboard": dashboard,
+		"overwrite": true,
+		"message":   "Updated by prom-config-watcher",
+	}
+	if *grafanaFolderUID != "" {
+		body["folderUid"] = *grafanaFolderUID
+	}
+	if _, _, err := g.do(http.MethodPost, "/api/dashboards/db", body); err != nil {
+		return err
+	}
+	logger.WithField("file", file.name).Debug("Pushed dashboard to grafana")
+	return nil
+}
+
+// pushDatasources creates or updates each datasource in a provisioning file, matching on uid.
+func (g *grafanaSink) pushDatasources(logger *log.Entry, file renderedFile) error {
+	provisioning := struct {
+		Datasources []map[string]interface{} `yaml:"datasources"`
+	}{}
+	if err := yaml.Unmarshal(file.content, &provisioning); err != nil {
+		return err
+	}
+
+	for _, ds := range provisioning.Datasources {
+		// convert yaml's map[interface{}]interface{} values into json encodable ones
+		converted, err := jsonCompatible(ds)
+		if err != nil {
+			return err
+		}
+		datasource := converted.(map[string]interface{})
+
+		uid, _ := datasource["uid"].(string)
+		if uid == "" {
+			return fmt.Errorf("datasource %v has no uid", datasource["name"])
+		}
+		_, status, err := g.do(http.MethodGet, "/api/datasources/uid/"+url.PathEscape(uid), nil)
+		if err != nil {
+			return err
+		}
+		if status == http.StatusNotFound {
+			_, _, err = g.do(http.MethodPost, "/api/datasources", datasource)
+		} else {
+			_, _, err = g.do(http.MethodPut, "/api/datasources/uid/"+url.PathEscape(uid), datasource)
+		}
+		if err != nil {
+			return err
+		}
+		logger.WithField("file", file.name).Debugf("Pushed datasource %v to grafana", uid)
+	}
+	return nil
+}
+
+// jsonCompatible converts values decoded from yaml so they can be encoded as json.
+func jsonCompatible(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+		for key, item := range v {
+			c, err := jsonCompatible(item)
+			if err != nil {
+				return nil, err
+			}
+			converted[fmt.Sprint(key)] = c
+		}
+		return converted, nil
+	case map[string]interface{}:
+		converted := map[string]interface{}{}
+		for key, item := range v {
+			c, err := jsonCompatible(item)
+			if err != nil {
+				return nil, err
+			}
+			converted[key] = c
+		}
+		return converted, nil
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, item := range v {
+			c, err := jsonCompatible(item)
+			if err != nil {
+				return nil, err
+			}
+			converted[i] = c
+		}
+		return converted, nil
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,146 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var agentBinary = flag.String("agent-binary", "", "Path to a grafana-agent or alloy binary used to run `fmt` on rendered river/alloy config, in addition to the built in syntax checks.")
+
+var agentStaticKeys = map[string]bool{
+	"server": true, "metrics": true, "integrations": true, "logs": true, "traces": true,
+	"agent_management": true, "prometheus": true, "loki": true, "tempo": true,
+}
+
+// validateAgentStatic checks a static mode agent config for unknown top level blocks.
+func validateAgentStatic(file renderedFile, all []renderedFile) error {
+	cfg := map[string]interface{}{}
+	if err := yaml.Unmarshal(file.content, &cfg); err != nil {
+		return err
+	}
+	for key := range cfg {
+		if !agentStaticKeys[key] {
+			return fmt.Errorf("unknown top level block %q", key)
+		}
+	}
+	if _, ok := cfg["prometheus"]; ok {
+		if _, ok := cfg["metrics"]; ok {
+			return fmt.Errorf("only one of prometheus and metrics may be set")
+		}
+	}
+	return nil
+}
+
+// validateRiver checks river/alloy syntax for unterminated strings, comments and unbalanced
+// blocks, optionally confirming with the agent's own formatter.
+func validateRiver(file renderedFile, all []renderedFile) error {
+	if err := checkRiverSyntax(string(file.content)); err != nil {
+		return err
+	}
+	if *agentBinary != "" {
+		return agentFmt(file)
+	}
+	return nil
+}
+
+func checkRiverSyntax(src string) error {
+	closing := map[rune]rune{'}': '{', ']': '[', ')': '('}
+	stack := []rune{}
+	lines := []int{}
+	line := 1
+
+	runes := []rune(src)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '\n':
+			line++
+		case c == '/' && i+1 < len(runes) && runes[i+1] == '/':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			line++
+		case c == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			start := line
+			for i += 2; i+1 < len(runes) && !(runes[i] == '*' && runes[i+1] == '/'); i++ {
+				if runes[i] == '\n' {
+					line++
+				}
+			}
+			if i+1 >= len(runes) {
+				return fmt.Errorf("line %d: unterminated block comment", start)
+			}
+			i++
+		case c == '"' || c == '`':
+			start := line
+			for i++; i < len(runes) && runes[i] != c; i++ {
+				if c == '"' && runes[i] == '\\' {
+					i++
+				} else if runes[i] == '\n' {
+					if c == '"' {
+						return fmt.Errorf("line %d: unterminated string", start)
+					}
+					line++
+				}
+			}
+			if i >= len(runes) {
+				return fmt.Errorf("line %d: unterminated string", start)
+			}
+		case c == '{' || c == '[' || c == '(':
+			stack = append(stack, c)
+			lines = append(lines, line)
+		case closing[c] != 0:
+			if len(stack) == 0 || stack[len(stack)-1] != closing[c] {
+				return fmt.Errorf("line %d: unexpected %q", line, c)
+			}
+			stack = stack[:len(stack)-1]
+			lines = lines[:len(lines)-1]
+		}
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("line %d: %q is never closed", lines[len(lines)-1], stack[len(stack)-1])
+	}
+	return nil
+}
+
+func agentFmt(file renderedFile) error {
+	// fed on stdin so the decrypted config is never written outside the target path
+	cmd := exec.Command(*agentBinary, "fmt")
+	cmd.Stdin = bytes.NewReader(file.content)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v fmt failed: %v: %s", *agentBinary, err, strings.TrimSpace(string(out)))
+	}
+	log.Debugf("%v parsed successfully", file.name)
+	return nil
+}
@@ -0,0 +1,283 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var grpcListenAddress = flag.String("grpc-listen-address", "", "Address the gRPC API, described by watcher.proto, listens on. It pushes config to --push-dir and streams the outcome of runs and reloads. Requests must carry the --push-token-file token as bearer authorization metadata. Empty disables it.")
+
+// statusFeed fans the outcome of runs and reloads out to subscribers. Events are dropped
+// for subscribers that fall behind rather than holding up the pipelines.
+type statusFeed struct {
+	mu          sync.Mutex
+	subscribers map[chan *StatusEvent]bool
+}
+
+var statusEvents = &statusFeed{subscribers: map[chan *StatusEvent]bool{}}
+
+func (f *statusFeed) subscribe() chan *StatusEvent {
+	events := make(chan *StatusEvent, 64)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscribers[events] = true
+	return events
+}
+
+func (f *statusFeed) unsubscribe(events chan *StatusEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subscribers, events)
+}
+
+func (f *statusFeed) publish(event *StatusEvent) {
+	event.TimeUnixNano = time.Now().UnixNano()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for events := range f.subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Debugf("Dropping %v event for a slow subscriber", event.Kind)
+		}
+	}
+}
+
+// startGRPCServer serves the gRPC API in the background.
+func startGRPCServer(push *pushAPI) {
+	if *grpcListenAddress == "" {
+		return
+	}
+	token, err := bearerToken(*pushTokenFile)
+	if err != nil {
+		log.Fatalf("Reading push token: %v", err)
+	}
+	if token == nil {
+		log.Fatal("--grpc-listen-address needs --push-token-file, the gRPC API is never served unauthenticated")
+	}
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := grpcAuthenticate(ctx, token); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := grpcAuthenticate(stream.Context(), token); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	}
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	RegisterConfigWatcherServer(server, &grpcService{push: push})
+
+	// listen before returning so a privileged port is bound before privileges are dropped
+	listener, err := net.Listen("tcp", *grpcListenAddress)
+	if err != nil {
+		log.Fatalf("gRPC server failed: %v", err)
+	}
+	log.Infof("Serving gRPC on %v", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Fatalf("gRPC server failed: %v", err)
+		}
+	}()
+}
+
+func grpcAuthenticate(ctx context.Context, token []byte) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(value), token) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+// grpcRequester names the caller, for logs and the audit trail.
+func grpcRequester(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return "token holder at " + p.Addr.String()
+	}
+	return "token holder"
+}
+
+// grpcService implements the ConfigWatcher service of watcher.proto.
+type grpcService struct {
+	UnimplementedConfigWatcherServer
+	push *pushAPI
+}
+
+func (s *grpcService) PushFiles(ctx context.Context, in *PushFilesRequest) (*PushResponse, error) {
+	if len(in.Files) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no files to push")
+	}
+	for _, file := range in.Files {
+		if !validPushPath(file.Path) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid file path %q", file.Path)
+		}
+	}
+	file, action := "", "push-files"
+	if len(in.Files) == 1 {
+		file = in.Files[0].Path
+	}
+	return s.apply(ctx, in.Wait, action, file, func(files map[string][]byte) error {
+		for _, file := range in.Files {
+			if !file.Delete {
+				files[file.Path] = append([]byte{}, file.Content...)
+				continue
+			}
+			if _, ok := files[file.Path]; !ok {
+				return errPushNotFound
+			}
+			delete(files, file.Path)
+		}
+		return nil
+	})
+}
+
+func (s *grpcService) PushBundle(ctx context.Context, in *PushBundleRequest) (*PushResponse, error) {
+	if len(in.Bundle) > maxSourceSize {
+		return nil, status.Errorf(codes.InvalidArgument, "bundle larger than %v bytes", maxSourceSize)
+	}
+	bundle, err := readPushBundle(in.Bundle)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return s.apply(ctx, in.Wait, "push-bundle", "", replaceWith(bundle))
+}
+
+// apply pushes a change and, when asked to, waits for the pipelines to run and the reload
+// that follows, if any run led to one. A failed run or reload is returned as an Aborted error.
+func (s *grpcService) apply(ctx context.Context, wait bool, action string, file string, change func(files map[string][]byte) error) (*PushResponse, error) {
+	if s.push == nil {
+		return nil, status.Error(codes.FailedPrecondition, "pushes aren't accepted without --push-dir")
+	}
+	var events chan *StatusEvent
+	if wait {
+		events = statusEvents.subscribe()
+		defer statusEvents.unsubscribe(events)
+	}
+	pipelines, changed, err := s.push.apply(grpcRequester(ctx), action, file, change)
+	if err != nil {
+		return nil, grpcPushError(err)
+	}
+	response := &PushResponse{Changed: changed}
+	pending := map[string]bool{}
+	for _, pipe := range pipelines {
+		response.Pipelines = append(response.Pipelines, pipe.name)
+		pending[pipe.name] = true
+	}
+	if !wait || !changed {
+		return response, nil
+	}
+	reload := false
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case event := <-events:
+			switch {
+			case event.Kind == StatusEvent_RUN && pending[event.Pipeline]:
+				delete(pending, event.Pipeline)
+				response.Events = append(response.Events, event)
+				if !event.Success {
+					return nil, status.Errorf(codes.Aborted, "pipeline %v failed: %v", event.Pipeline, event.Error)
+				}
+				reload = reload || event.Reload
+				if len(pending) == 0 && !reload {
+					return response, nil
+				}
+			case event.Kind == StatusEvent_STEP && len(pending) == 0:
+				response.Events = append(response.Events, event)
+			case event.Kind == StatusEvent_RELOAD && len(pending) == 0:
+				response.Events = append(response.Events, event)
+				if !event.Success {
+					return nil, status.Errorf(codes.Aborted, "reload failed: %v", event.Error)
+				}
+				return response, nil
+			}
+		}
+	}
+}
+
+func grpcPushError(err error) error {
+	if _, invalid := err.(*validationError); invalid {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	switch err {
+	case errPushNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case errNoPushPipelines:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// Subscribe streams events until the client goes away.
+func (s *grpcService) Subscribe(in *SubscribeRequest, stream ConfigWatcher_SubscribeServer) error {
+	wanted := map[string]bool{}
+	for _, name := range in.Pipelines {
+		wanted[name] = true
+	}
+	events := statusEvents.subscribe()
+	defer statusEvents.unsubscribe(events)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event := <-events:
+			if event.Kind == StatusEvent_RUN && len(wanted) > 0 && !wanted[event.Pipeline] {
+				continue
+			}
+			if err := stream.Send(event); err != nil {
+				return fmt.Errorf("sending event: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// heartbeatInterval is how often the event loop and watcher goroutine report they are alive.
+const heartbeatInterval = 10 * time.Second
+
+var (
+	livenessTimeout     = flag.Duration("liveness-timeout", time.Minute, "How long the event loop or file watcher may go without a heartbeat before /healthz reports the watcher as not alive.")
+	readyRequiresReload = flag.Bool("ready-requires-reload", false, "Only become ready once the first reload has been acknowledged, rather than after the initial render.")
+	readyFile           = flag.String("ready-file", "", "File created once the watcher becomes ready, for containers that wait on it before starting.")
+	exitWhenReady       = flag.Bool("exit-when-ready", false, "Exit once the watcher becomes ready, for use as an init container that renders the config before Prometheus starts.")
+)
+
+// heartbeat records when a long running goroutine last reported in.
+type heartbeat struct {
+	last int64
+}
+
+func (h *heartbeat) beat() {
+	atomic.StoreInt64(&h.last, time.Now().UnixNano())
+}
+
+func (h *heartbeat) age() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&h.last)))
+}
+
+var (
+	loopHeartbeat    heartbeat
+	watcherHeartbeat heartbeat
+
+	// processed tracks whether each pipeline has had a successful processing run
+	processed   = map[string]bool{}
+	processedMu sync.Mutex
+	// reloadedOnce is set after the first successful reload sequence
+	reloadedOnce int32
+
+	becameReady sync.Once
+	// exitReady is closed when the watcher becomes ready with --exit-when-ready, for the watch
+	// loop to shut down as it does on a signal
+	exitReady = make(chan struct{})
+)
+
+// expectProcessed registers pipelines whose first run the watcher waits for before it is
+// ready. Every pipeline is registered before any of them runs, so that the first to finish
+// doesn't make the watcher ready on its own.
+func expectProcessed(pipelines ...*pipeline) {
+	processedMu.Lock()
+	defer processedMu.Unlock()
+	for _, pipe := range pipelines {
+		if _, known := processed[pipe.name]; !known {
+			processed[pipe.name] = false
+		}
+	}
+}
+
+// forgetProcessed stops waiting for a pipeline that has been removed.
+func forgetProcessed(name string) {
+	processedMu.Lock()
+	delete(processed, name)
+	processedMu.Unlock()
+	checkReady()
+}
+
+func markProcessed(name string) {
+	processedMu.Lock()
+	processed[name] = true
+	processedMu.Unlock()
+	checkReady()
+}
+
+// unprocessed returns the pipelines that haven't had a successful run yet.
+func unprocessed() []string {
+	processedMu.Lock()
+	defer processedMu.Unlock()
+	names := []string{}
+	for name, done := range processed {
+		if !done {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func allProcessed() bool {
+	processedMu.Lock()
+	empty := len(processed) == 0
+	processedMu.Unlock()
+	return !empty && len(unprocessed()) == 0
+}
+
+// markReloaded is registered with the reloader to track the first successful reload.
+func markReloaded(err error) {
+	if err != nil {
+		return
+	}
+	atomic.StoreInt32(&reloadedOnce, 1)
+	checkReady()
+}
+
+func isReady() bool {
+	if !allProcessed() {
+		return false
+	}
+	return !*readyRequiresReload || atomic.LoadInt32(&reloadedOnce) == 1
+}
+
+// removeReadyFile removes a --ready-file left by a previous run, so nothing waiting on it
+// starts before this run is ready.
+func removeReadyFile() {
+	if *readyFile == "" {
+		return
+	}
+	if err := os.Remove(*readyFile); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Unable to remove the ready file left by a previous run: %v", err)
+	}
+}
+
+// checkReady signals readiness the first time the watcher becomes ready.
+func checkReady() {
+	if !isReady() {
+		return
+	}
+	becameReady.Do(func() {
+		log.Info("Initial config is in place, watcher is ready")
+		sdNotify("READY=1")
+		if *readyFile != "" {
+			if err := ioutil.WriteFile(*readyFile, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644); err != nil {
+				log.WithField("file", *readyFile).WithError(err).Error("Error creating ready file")
+			}
+		}
+		if *exitWhenReady {
+			close(exitReady)
+		}
+	})
+}
+
+// healthzHandler reports liveness, failing if the event loop or watcher has stalled.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if age := loopHeartbeat.age(); age > *livenessTimeout {
+		http.Error(w, fmt.Sprintf("event loop has not reported in %v", age.Round(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	if age := watcherHeartbeat.age(); age > *livenessTimeout {
+		http.Error(w, fmt.Sprintf("file watcher has not reported in %v", age.Round(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports readiness once config has been processed and the services being
+// reloaded can be reached.
+func readyzHandler(steps func() []*reloadStep) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allProcessed() {
+			http.Error(w, fmt.Sprintf("config has not been processed successfully yet by %v", strings.Join(unprocessed(), ", ")), http.StatusServiceUnavailable)
+			return
+		}
+		if !isReady() {
+			http.Error(w, "waiting for the first reload to be acknowledged", http.StatusServiceUnavailable)
+			return
+		}
+		for _, step := range steps() {
+			if step.url == "" && len(step.health) == 0 {
+				continue
+			}
+			if err := probeHealthy(step); err != nil {
+				http.Error(w, fmt.Sprintf("%v is not reachable: %v", step.name, err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
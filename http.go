@@ -0,0 +1,103 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
+)
+
+var (
+	httpProxy  = flag.String("http-proxy", "", "Proxy URL for outbound http requests. Overrides HTTP_PROXY when set.")
+	httpsProxy = flag.String("https-proxy", "", "Proxy URL for outbound https requests. Overrides HTTPS_PROXY when set.")
+	noProxy    = flag.String("no-proxy", "", "Comma separated list of hosts and domains that bypass the proxy. Overrides NO_PROXY when set.")
+
+	dialTimeout     = flag.Duration("dial-timeout", 5*time.Second, "Maximum time to wait for outbound connections to be established.")
+	keepAlive       = flag.Duration("keep-alive", 30*time.Second, "Keep-alive period for outbound connections. A negative value disables keep-alives.")
+	idleConnTimeout = flag.Duration("idle-conn-timeout", 90*time.Second, "How long idle outbound connections are kept open for reuse.")
+)
+
+// proxyFunc builds the proxy selection used by all outbound clients. The standard
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables are honored, with any explicitly
+// set flags taking precedence over them.
+func proxyFunc() func(*http.Request) (*url.URL, error) {
+	cfg := httpproxy.FromEnvironment()
+	if *httpProxy != "" {
+		cfg.HTTPProxy = *httpProxy
+	}
+	if *httpsProxy != "" {
+		cfg.HTTPSProxy = *httpsProxy
+	}
+	if *noProxy != "" {
+		cfg.NoProxy = *noProxy
+	}
+	log.Debugf("Outbound proxy settings: http=%q https=%q no_proxy=%q", cfg.HTTPProxy, cfg.HTTPSProxy, cfg.NoProxy)
+
+	proxy := cfg.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// newHTTPClient returns the client used for outbound requests the watcher makes,
+// so that proxy, connection and SPIFFE mTLS settings apply consistently to the reload
+// notifier and remote sources. A timeout of 0 means requests are not time limited.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   *dialTimeout,
+		KeepAlive: *keepAlive,
+	}
+	transport := &http.Transport{
+		Proxy:                 proxyFunc(),
+		DialContext:           dialer.DialContext,
+		DisableKeepAlives:     *keepAlive < 0,
+		IdleConnTimeout:       *idleConnTimeout,
+		TLSHandshakeTimeout:   *dialTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if spiffe != nil {
+		transport.TLSClientConfig = spiffe.clientTLSConfig()
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// newMetadataClient returns the client for a cloud instance metadata service. The service is
+// link-local to the instance, so requests to it never go through the outbound proxy.
+func newMetadataClient() *http.Client {
+	dialer := &net.Dialer{Timeout: *dialTimeout}
+	transport := &http.Transport{
+		Proxy:             nil,
+		DialContext:       dialer.DialContext,
+		DisableKeepAlives: *keepAlive < 0,
+		IdleConnTimeout:   *idleConnTimeout,
+	}
+	return &http.Client{Timeout: 5 * time.Second, Transport: transport}
+}
@@ -0,0 +1,172 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	httpSD          = flag.Bool("http-sd", false, "Serve the rendered file_sd target lists at /sd/<file> for Prometheus's http_sd_config, so they can be used without sharing a volume. Pipelines from --config with remote_sinks are served at /sd/<pipeline>/<file>.")
+	httpSDFiles     = stringList{}
+	httpSDOnly      = flag.Bool("http-sd-only", false, "Serve the --http-sd-files only over HTTP SD, writing them nowhere else.")
+	httpSDTokenFile = flag.String("http-sd-token-file", "", "File holding a bearer token that requests to /sd/ must carry, set as authorization in the http_sd_config. --http-sd needs this or --oidc-issuer-url.")
+)
+
+func init() {
+	flag.Var(&httpSDFiles, "http-sd-files", "Glob of rendered files served by --http-sd, which must be file_sd target lists in JSON or YAML. May be repeated, defaults to *.json.")
+}
+
+// sdStore holds the target lists served over HTTP SD, by path below /sd/.
+type sdStore struct {
+	mu    sync.RWMutex
+	lists map[string][]byte
+	// rendered is set once a sink has written, before then requests fail so Prometheus keeps
+	// the targets it has rather than seeing an empty list
+	rendered bool
+}
+
+var sdLists = &sdStore{lists: map[string][]byte{}}
+
+// replace swaps every list below prefix for lists at once, so a refresh never sees part of a
+// render.
+func (s *sdStore) replace(prefix string, lists map[string][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.lists {
+		if strings.HasPrefix(name, prefix) {
+			delete(s.lists, name)
+		}
+	}
+	for name, list := range lists {
+		s.lists[name] = list
+	}
+	s.rendered = true
+}
+
+// httpSDHandler serves a target list as Prometheus expects it: a 200 response holding the
+// complete JSON list on every refresh.
+func httpSDHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/sd/")
+	sdLists.mu.RLock()
+	list, found := sdLists.lists[name]
+	rendered := sdLists.rendered
+	sdLists.mu.RUnlock()
+	if !rendered {
+		http.Error(w, "targets haven't been rendered yet", http.StatusServiceUnavailable)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	log.Debugf("Serving %v to %v, refreshed every %vs", name, r.RemoteAddr, r.Header.Get("X-Prometheus-Refresh-Interval-Seconds"))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(list)
+}
+
+// httpSDSink publishes rendered target lists to the HTTP SD endpoint.
+type httpSDSink struct {
+	prefix string
+	globs  []string
+}
+
+func newHTTPSDSink(dir string) *httpSDSink {
+	globs := []string(httpSDFiles)
+	if len(globs) == 0 {
+		globs = []string{"*.json"}
+	}
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	return &httpSDSink{prefix: prefix, globs: globs}
+}
+
+func (h *httpSDSink) name() string {
+	return "http sd"
+}
+
+func (h *httpSDSink) files() []string {
+	return h.globs
+}
+
+// exclusive returns the files only served over HTTP SD.
+func (h *httpSDSink) exclusive() []string {
+	if *httpSDOnly {
+		return h.globs
+	}
+	return nil
+}
+
+// write converts every target list to JSON before any is served, keeping the previous lists
+// when one of them can't be read.
+func (h *httpSDSink) write(logger *log.Entry, files []renderedFile) error {
+	lists := map[string][]byte{}
+	for _, file := range files {
+		groups := []fileSDGroup{}
+		if err := yaml.Unmarshal(file.content, &groups); err != nil {
+			return fmt.Errorf("%v isn't a target list: %v", file.name, err)
+		}
+		// Prometheus expects arrays, even when a file or group is empty
+		if groups == nil {
+			groups = []fileSDGroup{}
+		}
+		for i := range groups {
+			if groups[i].Targets == nil {
+				groups[i].Targets = []string{}
+			}
+		}
+		list, err := json.Marshal(groups)
+		if err != nil {
+			return err
+		}
+		lists[path.Join(h.prefix, file.name)] = list
+	}
+	sdLists.replace(h.prefix, lists)
+	names := []string{}
+	for name := range lists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	logger.Debugf("Serving target lists %v over HTTP SD", strings.Join(names, ", "))
+	return nil
+}
@@ -0,0 +1,188 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxSourceSize limits the size of a single file fetched from a remote source.
+const maxSourceSize = 32 << 20
+
+var (
+	httpSourceDir         = flag.String("http-source-dir", "/var/lib/prom-config-watcher/http", "Directory the files fetched from --http-source urls are written to, for pipelines to watch.")
+	httpSourceInterval    = flag.Duration("http-source-interval", time.Minute, "How often --http-source urls are polled, with conditional requests so unchanged files aren't downloaded again.")
+	httpSourceAuth        = flag.String("http-source-auth", "", "How --http-source-credentials are sent: bearer, or basic for a user:password secret.")
+	httpSourceCredentials = flag.String("http-source-credentials", "", "Secret reference, such as keyring:service/account or vault:path#key, for the credentials sent to --http-source urls.")
+
+	httpSourceSpecs stringList
+)
+
+func init() {
+	flag.Var(&httpSourceSpecs, "http-source", "URL of a config file to fetch into --http-source-dir, as url or file=url to choose the file name, which defaults to the last element of the url's path. May be repeated.")
+}
+
+// httpSourceFile is a file fetched from a url.
+type httpSourceFile struct {
+	file string
+	url  string
+	// etag and lastModified validate the copy written, for conditional requests
+	etag         string
+	lastModified string
+}
+
+// httpSources fetches the --http-source urls.
+type httpSources struct {
+	files       []*httpSourceFile
+	credentials *stepCredentials
+	mirror      *sourceMirror
+}
+
+func configureHTTPSources() error {
+	if len(httpSourceSpecs) == 0 {
+		return nil
+	}
+	h := &httpSources{}
+	names := map[string]bool{}
+	for _, spec := range httpSourceSpecs {
+		file, err := parseHTTPSource(spec)
+		if err != nil {
+			return err
+		}
+		if names[file.file] {
+			return fmt.Errorf("more than one --http-source is written to %v", file.file)
+		}
+		names[file.file] = true
+		h.files = append(h.files, file)
+	}
+	if *httpSourceAuth != "" || *httpSourceCredentials != "" {
+		credentials, err := parseStepCredentials(*httpSourceAuth, *httpSourceCredentials)
+		if err != nil {
+			return fmt.Errorf("--http-source-credentials: %v", err)
+		}
+		if secretResolvers[credentials.scheme] == nil {
+			return fmt.Errorf("--http-source-credentials come from %v, which isn't configured", credentials.scheme)
+		}
+		h.credentials = credentials
+	}
+	mirror, err := addMirror("http", "--http-source", *httpSourceDir, *httpSourceInterval, h.fetch)
+	if err != nil {
+		return err
+	}
+	h.mirror = mirror
+	return nil
+}
+
+func parseHTTPSource(spec string) (*httpSourceFile, error) {
+	file, rawURL := "", spec
+	if i := strings.Index(spec, "="); i > 0 && i < strings.Index(spec, "://") {
+		file, rawURL = spec[:i], spec[i+1:]
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid --http-source %q, expected an http or https url", spec)
+	}
+	if file == "" {
+		file = path.Base(u.Path)
+	}
+	if file == "." || file == "/" || !safeRelativePath(file) {
+		return nil, fmt.Errorf("--http-source %q needs a file name, given as file=url", spec)
+	}
+	return &httpSourceFile{file: file, url: rawURL}, nil
+}
+
+// fetch downloads the files that have changed. Nothing is written unless every url could be
+// fetched, so a failing url doesn't remove its file.
+func (h *httpSources) fetch() (bool, error) {
+	files := map[string][]byte{}
+	validators := map[*httpSourceFile][2]string{}
+	for _, file := range h.files {
+		if _, err := os.Stat(filepath.Join(h.mirror.dir, file.file)); err != nil {
+			// the copy has gone, fetch it in full
+			file.etag, file.lastModified = "", ""
+		}
+		content, etag, lastModified, err := h.get(file)
+		if err != nil {
+			return false, fmt.Errorf("fetching %v: %v", file.url, err)
+		}
+		files[file.file] = content
+		validators[file] = [2]string{etag, lastModified}
+	}
+	changed, err := mirrorFiles(h.mirror.dir, files)
+	if err != nil {
+		return changed, err
+	}
+	// the validators only describe what's on disk once it has been written
+	for file, v := range validators {
+		file.etag, file.lastModified = v[0], v[1]
+	}
+	return changed, nil
+}
+
+// get fetches a url unless it is unchanged, in which case the content is nil.
+func (h *httpSources) get(file *httpSourceFile) ([]byte, string, string, error) {
+	req, err := http.NewRequest(http.MethodGet, file.url, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if file.etag != "" {
+		req.Header.Set("If-None-Match", file.etag)
+	}
+	if file.lastModified != "" {
+		req.Header.Set("If-Modified-Since", file.lastModified)
+	}
+	if err := h.credentials.apply(req); err != nil {
+		return nil, "", "", err
+	}
+	resp, err := reloadClient.Do(req)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, file.etag, file.lastModified, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("status %v", resp.StatusCode)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSourceSize+1))
+	if err != nil {
+		return nil, "", "", err
+	}
+	if len(content) > maxSourceSize {
+		return nil, "", "", fmt.Errorf("larger than %v bytes", maxSourceSize)
+	}
+	return content, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+}
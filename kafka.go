@@ -0,0 +1,119 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+var (
+	kafkaBrokers      = flag.String("kafka-brokers", "", "Comma separated Kafka bootstrap brokers, as host:port, tried in turn. Enables publishing an event to --kafka-topic for every applied config generation, keyed by the watcher's host name.")
+	kafkaTopic        = flag.String("kafka-topic", "prometheus-config-events", "Kafka topic events are published to.")
+	kafkaUsername     = flag.String("kafka-username", "", "User to authenticate to Kafka with over SASL/PLAIN, along with --kafka-password-file.")
+	kafkaPasswordFile = flag.String("kafka-password-file", "", "File holding the password of --kafka-username.")
+	kafkaTLS          = flag.Bool("kafka-tls", false, "Connect to the Kafka brokers over TLS.")
+	kafkaCAFile       = flag.String("kafka-ca-file", "", "CA certificates the Kafka broker certificates are verified with, instead of the system roots.")
+	kafkaCertFile     = flag.String("kafka-cert-file", "", "Client certificate presented to the Kafka brokers.")
+	kafkaKeyFile      = flag.String("kafka-key-file", "", "Private key of --kafka-cert-file.")
+)
+
+// kafkaPublisher produces events to a topic, connecting for each event as they are rare.
+type kafkaPublisher struct {
+	brokers []string
+	tls     *tls.Config
+}
+
+func configureKafka() (*kafkaPublisher, error) {
+	if *kafkaBrokers == "" {
+		return nil, nil
+	}
+	k := &kafkaPublisher{}
+	for _, broker := range strings.Split(*kafkaBrokers, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			k.brokers = append(k.brokers, broker)
+		}
+	}
+	if len(k.brokers) == 0 {
+		return nil, fmt.Errorf("--kafka-brokers is empty")
+	}
+	if *kafkaTopic == "" {
+		return nil, fmt.Errorf("--kafka-topic is empty")
+	}
+	if *kafkaTLS {
+		tlsConfig, err := clientTLSConfig(*kafkaCAFile, *kafkaCertFile, *kafkaKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("kafka: %v", err)
+		}
+		k.tls = tlsConfig
+	}
+	return k, nil
+}
+
+func (k *kafkaPublisher) name() string {
+	return "kafka " + *kafkaTopic
+}
+
+// publish produces the event, waiting for all in sync replicas to have it. Events are keyed
+// by host, and partitioned as the Java client does, so one watcher's events stay in order.
+// The event bus retries failures, so the writer doesn't.
+func (k *kafkaPublisher) publish(event *busEvent, payload []byte) error {
+	transport := &kafka.Transport{
+		DialTimeout: *reloadTimeout,
+		ClientID:    "prom-config-watcher",
+		TLS:         k.tls,
+	}
+	defer transport.CloseIdleConnections()
+	if *kafkaUsername != "" {
+		password, err := readSecretFile(*kafkaPasswordFile)
+		if err != nil {
+			return err
+		}
+		transport.SASL = plain.Mechanism{Username: *kafkaUsername, Password: password}
+	}
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(k.brokers...),
+		Topic:        *kafkaTopic,
+		Balancer:     &kafka.Murmur2Balancer{},
+		RequiredAcks: kafka.RequireAll,
+		MaxAttempts:  1,
+		BatchSize:    1,
+		WriteTimeout: *reloadTimeout,
+		ReadTimeout:  *reloadTimeout,
+		Transport:    transport,
+	}
+	defer writer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *reloadTimeout)
+	defer cancel()
+	return writer.WriteMessages(ctx, kafka.Message{Key: []byte(event.Host), Value: payload, Time: event.Time})
+}
@@ -0,0 +1,216 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// serviceAccountDir holds the credentials mounted into pods for talking to the API server.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient makes requests to the Kubernetes API server using the pod's service account.
+type kubeClient struct {
+	client    *http.Client
+	host      string
+	namespace string
+}
+
+// newInClusterClient builds a client from the service account and environment kubernetes
+// provides to every pod.
+func newInClusterClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a kubernetes cluster")
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in the service account CA")
+	}
+	namespace, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account namespace: %v", err)
+	}
+
+	client := newHTTPClient(*reloadTimeout)
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	client.Transport = transport
+	return &kubeClient{
+		client:    client,
+		host:      "https://" + net.JoinHostPort(host, port),
+		namespace: strings.TrimSpace(string(namespace)),
+	}, nil
+}
+
+// do sends a request to the API server. The token is read for every request as projected
+// service account tokens are rotated while the pod runs.
+func (k *kubeClient) do(method string, path string, contentType string, body []byte) ([]byte, int, error) {
+	return k.doContext(context.Background(), method, path, contentType, body)
+}
+
+// doContext is do for requests that must finish by the deadline of ctx, which may be sooner
+// than the client's timeout.
+func (k *kubeClient) doContext(ctx context.Context, method string, path string, contentType string, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, k.host+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to read service account token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return nil, resp.StatusCode, fmt.Errorf("%v %v returned status %v: %s", method, path, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, resp.StatusCode, nil
+}
+
+// objectRef identifies a kubernetes object, written as apiVersion/Kind/name, e.g.
+// v1/Pod/prometheus-0 or monitoring.coreos.com/v1/Prometheus/k8s.
+type objectRef struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace"`
+}
+
+func parseObjectRef(spec string, namespace string) (objectRef, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) < 3 {
+		return objectRef{}, fmt.Errorf("%q is not in the form apiVersion/Kind/name", spec)
+	}
+	n := len(parts)
+	return objectRef{
+		APIVersion: strings.Join(parts[:n-2], "/"),
+		Kind:       parts[n-2],
+		Name:       parts[n-1],
+		Namespace:  namespace,
+	}, nil
+}
+
+// path is the API server path of the object. The resource name is guessed from the kind,
+// which holds for the kinds config is usually attached to (pods, configmaps, prometheuses).
+func (o objectRef) path() string {
+	resource := strings.ToLower(o.Kind)
+	switch {
+	case strings.HasSuffix(resource, "s"):
+		resource += "es"
+	case strings.HasSuffix(resource, "y"):
+		resource = strings.TrimSuffix(resource, "y") + "ies"
+	default:
+		resource += "s"
+	}
+	prefix := "/apis/" + o.APIVersion
+	if o.APIVersion == "v1" {
+		prefix = "/api/v1"
+	}
+	return fmt.Sprintf("%v/namespaces/%v/%v/%v", prefix, o.Namespace, resource, o.Name)
+}
+
+// ownPod refers to the pod the watcher runs in, named by the POD_NAME environment variable
+// (set through the downward API) or the hostname.
+func ownPod(namespace string) objectRef {
+	name := os.Getenv("POD_NAME")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	return objectRef{APIVersion: "v1", Kind: "Pod", Name: name, Namespace: namespace}
+}
+
+// watch streams watch events from the API server, calling handle with each event's type and
+// object until the stream ends or handle returns an error.
+func (k *kubeClient) watch(path string, handle func(eventType string, object json.RawMessage) error) error {
+	req, err := http.NewRequest(http.MethodGet, k.host+path, nil)
+	if err != nil {
+		return err
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return fmt.Errorf("unable to read service account token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	// the stream stays open indefinitely, so it can't share the client's timeout
+	client := *k.client
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("watch %v returned status %v: %s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}{}
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		if event.Type == "ERROR" {
+			return fmt.Errorf("watch %v failed: %s", path, event.Object)
+		}
+		if event.Type == "BOOKMARK" {
+			continue
+		}
+		if err := handle(event.Type, event.Object); err != nil {
+			return err
+		}
+	}
+}
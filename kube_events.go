@@ -0,0 +1,123 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	kubeEvents      = flag.Bool("kube-events", false, "Emit kubernetes Events for applied and failed configs when running in a cluster.")
+	kubeEventObject = flag.String("kube-event-object", "", "Object the Events are attached to, as apiVersion/Kind/name in the watcher's namespace, e.g. monitoring.coreos.com/v1/Prometheus/k8s. Defaults to the watcher's own pod.")
+)
+
+// kubeEventRecorder posts an Event for every config run that fails and every reload sequence.
+// A nil recorder does nothing.
+type kubeEventRecorder struct {
+	kube   *kubeClient
+	object objectRef
+	host   string
+}
+
+func newKubeEventRecorder() (*kubeEventRecorder, error) {
+	kube, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	object := ownPod(kube.namespace)
+	if *kubeEventObject != "" {
+		if object, err = parseObjectRef(*kubeEventObject, kube.namespace); err != nil {
+			return nil, err
+		}
+	}
+	host, _ := os.Hostname()
+	return &kubeEventRecorder{kube: kube, object: object, host: host}, nil
+}
+
+// runFinished records a processing run, only failures are worth an Event as successful runs
+// are followed by a reload.
+func (k *kubeEventRecorder) runFinished(rendered []renderedFile, err error) {
+	if k == nil || err == nil {
+		return
+	}
+	if _, invalid := err.(*validationError); invalid {
+		go k.emit("Warning", "ConfigInvalid", fmt.Sprintf("Config failed validation and was not applied: %v", err))
+		return
+	}
+	go k.emit("Warning", "ConfigProcessingFailed", fmt.Sprintf("Error processing config: %v", err))
+}
+
+// reloadFinished records the outcome of a reload sequence.
+func (k *kubeEventRecorder) reloadFinished(err error) {
+	if k == nil {
+		return
+	}
+	if err != nil {
+		go k.emit("Warning", "ConfigReloadFailed", err.Error())
+		return
+	}
+	go k.emit("Normal", "ConfigReloaded", "Config applied and reloaded")
+}
+
+func (k *kubeEventRecorder) emit(eventType string, reason string, message string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	event := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Event",
+		"metadata": map[string]interface{}{
+			"generateName": k.object.Name + "-",
+			"namespace":    k.kube.namespace,
+		},
+		"involvedObject":     k.object,
+		"type":               eventType,
+		"reason":             reason,
+		"message":            message,
+		"firstTimestamp":     now,
+		"lastTimestamp":      now,
+		"count":              1,
+		"source":             map[string]string{"component": "prom-config-watcher", "host": k.host},
+		"reportingComponent": "prom-config-watcher",
+		"reportingInstance":  k.host,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.WithError(err).Error("Error encoding kubernetes Event")
+		return
+	}
+	_, status, err := k.kube.do(http.MethodPost, "/api/v1/namespaces/"+k.kube.namespace+"/events", "application/json", body)
+	if err == nil && status == http.StatusNotFound {
+		err = fmt.Errorf("namespace %v not found", k.kube.namespace)
+	}
+	if err != nil {
+		log.WithError(err).Error("Error creating kubernetes Event")
+	}
+}
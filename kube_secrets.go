@@ -0,0 +1,174 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var kubeSecretsEnabled = flag.Bool("kube-secrets", false, "Resolve ${k8s-secret://namespace/name#key} references in source files through the Kubernetes API, watching the secrets so changes re-render the config. Needs get and watch on the secrets.")
+
+// kubeSecretData is the decoded data of a secret, nil when the secret doesn't exist.
+type kubeSecretData map[string]string
+
+// kubeSecrets resolves references to Kubernetes Secrets. Each secret referenced is fetched
+// once and then kept up to date by a watch.
+type kubeSecrets struct {
+	kube *kubeClient
+
+	mu      sync.Mutex
+	watched map[string]kubeSecretData
+}
+
+func newKubeSecrets() (*kubeSecrets, error) {
+	kube, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return &kubeSecrets{kube: kube, watched: map[string]kubeSecretData{}}, nil
+}
+
+func (k *kubeSecrets) resolve(ref string) (secretValue, error) {
+	ref = strings.TrimPrefix(ref, "//")
+	i := strings.LastIndex(ref, "#")
+	if i < 0 {
+		return secretValue{}, fmt.Errorf("expected namespace/name#key")
+	}
+	name, key := ref[:i], ref[i+1:]
+	namespace := k.kube.namespace
+	if j := strings.Index(name, "/"); j >= 0 {
+		namespace, name = name[:j], name[j+1:]
+	}
+
+	id := namespace + "/" + name
+	k.mu.Lock()
+	data, watching := k.watched[id]
+	k.mu.Unlock()
+	if !watching {
+		var err error
+		if data, err = k.get(namespace, name); err != nil {
+			return secretValue{}, err
+		}
+		k.mu.Lock()
+		k.watched[id] = data
+		k.mu.Unlock()
+		go k.watch(namespace, name)
+	}
+	if data == nil {
+		return secretValue{}, fmt.Errorf("secret %v not found", id)
+	}
+	value, found := data[key]
+	if !found {
+		return secretValue{}, fmt.Errorf("secret %v has no key %q", id, key)
+	}
+	return secretValue{value: value}, nil
+}
+
+// kubeSecretObject is the part of a Secret the watcher reads.
+type kubeSecretObject struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string]string `json:"data"`
+}
+
+func (o kubeSecretObject) decode() (kubeSecretData, error) {
+	data := kubeSecretData{}
+	for key, encoded := range o.Data {
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decoding key %v: %v", key, err)
+		}
+		data[key] = string(value)
+	}
+	return data, nil
+}
+
+func (k *kubeSecrets) get(namespace string, name string) (kubeSecretData, error) {
+	body, status, err := k.kube.do(http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%v/secrets/%v", namespace, name), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	secret := kubeSecretObject{}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return nil, fmt.Errorf("decoding secret %v/%v: %v", namespace, name, err)
+	}
+	return secret.decode()
+}
+
+// watch follows changes to a secret for as long as the watcher runs, asking for the config
+// to be processed again whenever its data changes.
+func (k *kubeSecrets) watch(namespace string, name string) {
+	id := namespace + "/" + name
+	query := url.Values{"watch": {"1"}, "fieldSelector": {"metadata.name=" + name}}
+	path := fmt.Sprintf("/api/v1/namespaces/%v/secrets?%v", namespace, query.Encode())
+	for {
+		err := k.kube.watch(path, func(eventType string, object json.RawMessage) error {
+			secret := kubeSecretObject{}
+			if err := json.Unmarshal(object, &secret); err != nil {
+				return err
+			}
+			var data kubeSecretData
+			if eventType != "DELETED" {
+				var err error
+				if data, err = secret.decode(); err != nil {
+					return err
+				}
+			}
+			k.update(id, data)
+			return nil
+		})
+		log.WithError(err).Debugf("Watch of secret %v ended, restarting", id)
+		time.Sleep(5 * time.Second)
+		// catch up on changes missed while the watch was down
+		if data, err := k.get(namespace, name); err == nil {
+			k.update(id, data)
+		}
+	}
+}
+
+func (k *kubeSecrets) update(id string, data kubeSecretData) {
+	k.mu.Lock()
+	previous := k.watched[id]
+	k.watched[id] = data
+	k.mu.Unlock()
+	if fmt.Sprint(previous) != fmt.Sprint(data) {
+		log.Debugf("Secret %v has changed, reading its references again", id)
+		secrets.expire("k8s-secret")
+	}
+}
@@ -0,0 +1,195 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	kubeSources      stringList
+	kubeSourceDir    = flag.String("kube-source-dir", "/var/lib/prom-config-watcher/kube", "Directory the keys of the --kube-source objects are written to, each object's keys in a directory named after it. The keys of Secrets are only readable by the watcher.")
+	kubeSourceResync = flag.Duration("kube-source-resync", 5*time.Minute, "How often the --kube-source objects are read again in case a watch missed a change.")
+)
+
+func init() {
+	flag.Var(&kubeSources, "kube-source", "ConfigMap or Secret whose keys are written as files to --kube-source-dir, as configmap/name or secret/name in the watcher's namespace, or namespace/configmap/name. Changes are picked up straight away with a watch rather than waiting for the kubelet to update a volume. Needs get, list and watch on the objects. May be repeated.")
+}
+
+// kubeSourceObject is a ConfigMap or Secret mirrored as a directory of files.
+type kubeSourceObject struct {
+	// resource is configmaps or secrets
+	resource  string
+	namespace string
+	name      string
+}
+
+func (o kubeSourceObject) String() string {
+	return fmt.Sprintf("%v %v/%v", strings.TrimSuffix(o.resource, "s"), o.namespace, o.name)
+}
+
+// kubeSourceSync mirrors the keys of ConfigMaps and Secrets. Each object is read on every
+// fetch, and watched so a change starts a fetch straight away.
+type kubeSourceSync struct {
+	kube    *kubeClient
+	objects []kubeSourceObject
+	// watching is set once the watches have been started, after the first fetch
+	watching bool
+	mirror   *sourceMirror
+}
+
+func configureKubeSource() error {
+	if len(kubeSources) == 0 {
+		return nil
+	}
+	kube, err := newInClusterClient()
+	if err != nil {
+		return fmt.Errorf("--kube-source: %v", err)
+	}
+	k := &kubeSourceSync{kube: kube}
+	names := map[string]bool{}
+	for _, spec := range kubeSources {
+		parts := strings.Split(spec, "/")
+		if len(parts) == 2 {
+			parts = append([]string{kube.namespace}, parts...)
+		}
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return fmt.Errorf("--kube-source %q is not in the form [namespace/]configmap/name or [namespace/]secret/name", spec)
+		}
+		object := kubeSourceObject{namespace: parts[0], name: parts[2]}
+		switch strings.ToLower(parts[1]) {
+		case "configmap":
+			object.resource = "configmaps"
+		case "secret":
+			object.resource = "secrets"
+		default:
+			return fmt.Errorf("--kube-source %q is neither a configmap nor a secret", spec)
+		}
+		if names[object.name] {
+			return fmt.Errorf("more than one --kube-source is named %v", object.name)
+		}
+		names[object.name] = true
+		k.objects = append(k.objects, object)
+	}
+	mirror, err := addMirror("kube", "--kube-source", *kubeSourceDir, *kubeSourceResync, k.fetch)
+	if err != nil {
+		return err
+	}
+	k.mirror = mirror
+	return nil
+}
+
+// fetch reads every object and writes out their keys, those of Secrets only readable by the
+// watcher. An object that doesn't exist fails the fetch rather than removing its files, as a
+// volume mount would fail to start.
+func (k *kubeSourceSync) fetch() (bool, error) {
+	files, private := map[string][]byte{}, map[string]bool{}
+	for _, object := range k.objects {
+		data, err := k.get(object)
+		if err != nil {
+			return false, err
+		}
+		for key, value := range data {
+			files[object.name+"/"+key] = value
+			private[object.name+"/"+key] = object.resource == "secrets"
+		}
+	}
+	if !k.watching {
+		k.watching = true
+		for _, object := range k.objects {
+			go k.watch(object)
+		}
+	}
+	return mirrorPrivateFiles(k.mirror.dir, files, private)
+}
+
+func (k *kubeSourceSync) get(object kubeSourceObject) (map[string][]byte, error) {
+	body, status, err := k.kube.do(http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%v/%v/%v", object.namespace, object.resource, object.name), "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %v", object, err)
+	}
+	if status == http.StatusNotFound {
+		return nil, fmt.Errorf("%v not found", object)
+	}
+	data := map[string][]byte{}
+	if object.resource == "secrets" {
+		// secret values are base64 encoded, which []byte decodes
+		secret := struct {
+			Data map[string][]byte `json:"data"`
+		}{}
+		if err := json.Unmarshal(body, &secret); err != nil {
+			return nil, fmt.Errorf("decoding %v: %v", object, err)
+		}
+		for key, value := range secret.Data {
+			data[key] = value
+		}
+	} else {
+		configMap := struct {
+			Data       map[string]string `json:"data"`
+			BinaryData map[string][]byte `json:"binaryData"`
+		}{}
+		if err := json.Unmarshal(body, &configMap); err != nil {
+			return nil, fmt.Errorf("decoding %v: %v", object, err)
+		}
+		for key, value := range configMap.BinaryData {
+			data[key] = value
+		}
+		for key, value := range configMap.Data {
+			data[key] = []byte(value)
+		}
+	}
+	// keys with empty values decode to nil, which mirrorFiles takes as unchanged
+	for key, value := range data {
+		if value == nil {
+			data[key] = []byte{}
+		}
+	}
+	return data, nil
+}
+
+// watch follows changes to an object for as long as the watcher runs, asking for a fetch on
+// every event. Restarting a watch replays the object as added, so nothing is missed while
+// it was down.
+func (k *kubeSourceSync) watch(object kubeSourceObject) {
+	query := url.Values{"watch": {"1"}, "fieldSelector": {"metadata.name=" + object.name}}
+	path := fmt.Sprintf("/api/v1/namespaces/%v/%v?%v", object.namespace, object.resource, query.Encode())
+	for {
+		err := k.kube.watch(path, func(eventType string, _ json.RawMessage) error {
+			log.Debugf("Watch of %v reported %v", object, strings.ToLower(eventType))
+			k.mirror.requestSync()
+			return nil
+		})
+		log.WithError(err).Debugf("Watch of %v ended, restarting", object)
+		time.Sleep(5 * time.Second)
+	}
+}
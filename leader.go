@@ -0,0 +1,296 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// leaseTimeFormat is the MicroTime format of a Lease's acquire and renew times.
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+var (
+	leaderElect              = flag.Bool("leader-elect", false, "Hold a kubernetes Lease while applying config, so that of several replicas writing to the same target path or sinks only one renders, reloads and notifies. The others wait to take over.")
+	leaderElectLease         = flag.String("leader-elect-lease", "prom-config-watcher", "Name of the Lease in the watcher's namespace the replicas elect a leader with.")
+	leaderElectLeaseDuration = flag.Duration("leader-elect-lease-duration", 15*time.Second, "How long the Lease has to go unrenewed before a waiting replica takes over.")
+	leaderElectRenewDeadline = flag.Duration("leader-elect-renew-deadline", 10*time.Second, "How long the leader keeps failing to renew the Lease before it stops applying config and exits. Must be shorter than --leader-elect-lease-duration.")
+	leaderElectRetryPeriod   = flag.Duration("leader-elect-retry-period", 2*time.Second, "How often the leader renews the Lease and waiting replicas try to acquire it.")
+)
+
+// leader is the elector holding the Lease, nil unless --leader-elect is set.
+var leader *leaderElector
+
+// leaseSpec is the part of a coordination.k8s.io/v1 Lease used for the election.
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec leaseSpec `json:"spec"`
+}
+
+// leaderElector takes part in the election the way client-go's leader election does, so the
+// watcher can share a Lease's conventions with the tooling that inspects them. Expiry is
+// judged by when this replica last saw the Lease change rather than the renew time written
+// by the holder, so clock skew between nodes doesn't matter.
+type leaderElector struct {
+	kube     *kubeClient
+	path     string
+	identity string
+
+	mu sync.Mutex
+	// observed is the Lease last read or written, observedAt when it last changed
+	observed   leaseSpec
+	observedAt time.Time
+	// renewed is when the leader last renewed the Lease
+	renewed time.Time
+	// released is set on shutdown, after which the Lease isn't renewed or acquired
+	released bool
+}
+
+func newLeaderElector() (*leaderElector, error) {
+	if *leaderElectRenewDeadline >= *leaderElectLeaseDuration {
+		return nil, fmt.Errorf("--leader-elect-renew-deadline must be shorter than --leader-elect-lease-duration")
+	}
+	if *leaderElectRetryPeriod >= *leaderElectRenewDeadline {
+		return nil, fmt.Errorf("--leader-elect-retry-period must be shorter than --leader-elect-renew-deadline")
+	}
+	kube, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	// the pod name tells replicas apart, with the pid in case a pod runs several watchers
+	identity := fmt.Sprintf("%v_%v", ownPod(kube.namespace).Name, os.Getpid())
+	return &leaderElector{
+		kube:     kube,
+		path:     fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%v/leases/%v", kube.namespace, *leaderElectLease),
+		identity: identity,
+	}, nil
+}
+
+// awaitLeadership blocks until this replica holds the Lease, then keeps renewing it in the
+// background. The heartbeats are kept up while waiting, as a replica on standby is healthy.
+func awaitLeadership() {
+	if !*leaderElect {
+		return
+	}
+	var err error
+	if leader, err = newLeaderElector(); err != nil {
+		log.Fatalf("Unable to take part in leader election: %v", err)
+	}
+	waiting := ""
+	for {
+		loopHeartbeat.beat()
+		watcherHeartbeat.beat()
+		ctx, cancel := context.WithTimeout(context.Background(), *leaderElectRenewDeadline)
+		acquired, holder, err := leader.tryAcquireOrRenew(ctx)
+		cancel()
+		if err != nil {
+			log.WithError(err).Warnf("Error acquiring Lease %v", *leaderElectLease)
+		}
+		if acquired {
+			break
+		}
+		if holder != waiting && holder != "" {
+			log.Infof("Waiting to become leader, Lease %v is held by %v", *leaderElectLease, holder)
+			waiting = holder
+		}
+		time.Sleep(*leaderElectRetryPeriod)
+	}
+	log.Infof("Became leader as %v, holding Lease %v", leader.identity, *leaderElectLease)
+	isLeader.Set(1)
+	go leader.renew()
+}
+
+// renew keeps the Lease for as long as it can be renewed within --leader-elect-renew-deadline.
+// Every attempt has to finish by that deadline, so a request hanging on the API server can't
+// keep this replica applying config after the Lease has expired and another has taken over.
+// A leader that loses the Lease exits straight away, as the replica taking over may already
+// be writing, and is restarted to wait its turn again.
+func (l *leaderElector) renew() {
+	for range time.Tick(*leaderElectRetryPeriod) {
+		l.mu.Lock()
+		deadline := l.renewed.Add(*leaderElectRenewDeadline)
+		l.mu.Unlock()
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		acquired, holder, err := l.tryAcquireOrRenew(ctx)
+		cancel()
+		l.mu.Lock()
+		released := l.released
+		l.mu.Unlock()
+		if released {
+			return
+		}
+		switch {
+		case acquired:
+			continue
+		case err == nil && holder != "":
+			log.Errorf("Lost Lease %v to %v, exiting", *leaderElectLease, holder)
+		case time.Now().Before(deadline):
+			log.WithError(err).Warnf("Error renewing Lease %v", *leaderElectLease)
+			continue
+		default:
+			log.WithError(err).Errorf("Unable to renew Lease %v for %v, exiting", *leaderElectLease, *leaderElectRenewDeadline)
+		}
+		isLeader.Set(0)
+		os.Exit(1)
+	}
+}
+
+// tryAcquireOrRenew takes the Lease if it's free or has expired, or renews it if already
+// held, returning whether it's held and who holds it. Updates carry the resourceVersion read,
+// so of two replicas racing for the Lease only one succeeds.
+func (l *leaderElector) tryAcquireOrRenew(ctx context.Context) (bool, string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return false, "", nil
+	}
+	now := time.Now()
+	spec := leaseSpec{
+		HolderIdentity:       l.identity,
+		LeaseDurationSeconds: int((*leaderElectLeaseDuration + time.Second - 1) / time.Second),
+		AcquireTime:          now.UTC().Format(leaseTimeFormat),
+		RenewTime:            now.UTC().Format(leaseTimeFormat),
+	}
+
+	body, status, err := l.kube.doContext(ctx, http.MethodGet, l.path, "", nil)
+	if err != nil {
+		return false, "", err
+	}
+	if status == http.StatusNotFound {
+		current := lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease", Spec: spec}
+		current.Metadata.Name, current.Metadata.Namespace = *leaderElectLease, l.kube.namespace
+		if err := l.write(ctx, http.MethodPost, fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%v/leases", l.kube.namespace), current); err != nil {
+			return false, "", err
+		}
+		l.observe(spec, now)
+		l.renewed = now
+		return true, l.identity, nil
+	}
+
+	var current lease
+	if err := json.Unmarshal(body, &current); err != nil {
+		return false, "", fmt.Errorf("decoding Lease %v: %v", *leaderElectLease, err)
+	}
+	if current.Spec != l.observed {
+		l.observe(current.Spec, now)
+	}
+	holder := current.Spec.HolderIdentity
+	expiry := l.observedAt.Add(time.Duration(current.Spec.LeaseDurationSeconds) * time.Second)
+	if holder != "" && holder != l.identity && now.Before(expiry) {
+		return false, holder, nil
+	}
+
+	if holder == l.identity {
+		spec.AcquireTime = current.Spec.AcquireTime
+		spec.LeaseTransitions = current.Spec.LeaseTransitions
+	} else {
+		spec.LeaseTransitions = current.Spec.LeaseTransitions + 1
+	}
+	current.Spec = spec
+	if err := l.write(ctx, http.MethodPut, l.path, current); err != nil {
+		return false, holder, err
+	}
+	l.observe(spec, now)
+	l.renewed = now
+	return true, l.identity, nil
+}
+
+func (l *leaderElector) observe(spec leaseSpec, at time.Time) {
+	l.observed, l.observedAt = spec, at
+}
+
+func (l *leaderElector) write(ctx context.Context, method string, path string, current lease) error {
+	body, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	_, status, err := l.kube.doContext(ctx, method, path, "application/json", body)
+	if err == nil && status == http.StatusNotFound {
+		err = fmt.Errorf("namespace %v not found", l.kube.namespace)
+	}
+	return err
+}
+
+// release gives up the Lease on shutdown, once nothing more will be written, so a waiting
+// replica takes over on its next attempt instead of waiting for the Lease to expire.
+func (l *leaderElector) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return
+	}
+	l.released = true
+	isLeader.Set(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *leaderElectRenewDeadline)
+	defer cancel()
+	body, status, err := l.kube.doContext(ctx, http.MethodGet, l.path, "", nil)
+	if err == nil && status == http.StatusNotFound {
+		return
+	}
+	var current lease
+	if err == nil {
+		err = json.Unmarshal(body, &current)
+	}
+	if err == nil && current.Spec.HolderIdentity != l.identity {
+		return
+	}
+	if err == nil {
+		current.Spec.HolderIdentity = ""
+		current.Spec.LeaseDurationSeconds = 1
+		current.Spec.RenewTime = time.Now().UTC().Format(leaseTimeFormat)
+		err = l.write(ctx, http.MethodPut, l.path, current)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("Error releasing Lease %v, it will expire in %v", *leaderElectLease, *leaderElectLeaseDuration)
+		return
+	}
+	log.Infof("Released Lease %v", *leaderElectLease)
+}
@@ -0,0 +1,99 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// renderedFileMode is the mode rendered files are written with, before the umask.
+const renderedFileMode os.FileMode = 0644
+
+// minLeakLength is the shortest secret value looked for, shorter values matching too much
+// unrelated text.
+const minLeakLength = 6
+
+var (
+	secretLeakCheck = flag.String("secret-leak-check", "off", "Scan rendered files for values read from secret stores: off, warn, or block to refuse writing a file that would expose one in a world readable file or a --non-sensitive-path.")
+
+	nonSensitivePaths stringList
+)
+
+func init() {
+	flag.Var(&nonSensitivePaths, "non-sensitive-path", "Glob of rendered files that must never contain secrets, matched against the file name and target path. May be repeated.")
+}
+
+func checkLeakSettings() error {
+	switch *secretLeakCheck {
+	case "off", "warn", "block":
+		return nil
+	}
+	return fmt.Errorf("unknown --secret-leak-check mode %q, expected off, warn or block", *secretLeakCheck)
+}
+
+// checkSecretLeaks looks for secret values in files that would expose them, returning an
+// error listing them in block mode.
+func checkSecretLeaks(logger *log.Entry, targetPath string, files []renderedFile) error {
+	if *secretLeakCheck == "off" {
+		return nil
+	}
+	values := secrets.values()
+	if len(values) == 0 {
+		return nil
+	}
+	worldReadable := (renderedFileMode&^processUmask)&0004 != 0
+
+	leaks := []string{}
+	for _, file := range files {
+		target := filepath.Join(targetPath, file.name)
+		reason := ""
+		switch {
+		case len(nonSensitivePaths) > 0 && (matchesGlobs(file.name, nonSensitivePaths) || matchesGlobs(target, nonSensitivePaths)):
+			reason = "is marked non-sensitive"
+		case worldReadable:
+			reason = "would be world readable"
+		default:
+			continue
+		}
+		for key, value := range values {
+			if !strings.Contains(string(file.content), value) {
+				continue
+			}
+			logger.WithFields(log.Fields{"file": file.name, "secret": key}).Warnf("Rendered file %v but contains a secret", reason)
+			secretLeaks.Inc()
+			leaks = append(leaks, fmt.Sprintf("%v contains %v", file.name, key))
+		}
+	}
+	if len(leaks) > 0 && *secretLeakCheck == "block" {
+		return fmt.Errorf("secrets would be exposed: %v", strings.Join(leaks, "; "))
+	}
+	return nil
+}
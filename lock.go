@@ -0,0 +1,100 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lockFileName is the lock file created in each target path.
+const lockFileName = ".prom-config-watcher.lock"
+
+var (
+	lockTargets = flag.Bool("lock-target", true, "Take an exclusive lock on each target path so that two watchers can't write to the same directory.")
+	lockWait    = flag.Duration("lock-wait", 0, "How long to wait for another watcher to release a target path's lock before giving up. 0 gives up straight away.")
+)
+
+var (
+	heldLocksMu sync.Mutex
+	// heldLocks are the open lock files by target path, kept open for the life of the process
+	heldLocks = map[string]*os.File{}
+)
+
+// lockTarget takes the lock on dir, waiting up to --lock-wait for another watcher to release it.
+// Locks are held until the process exits, taking one already held does nothing.
+func lockTarget(dir string) error {
+	if !*lockTargets || *dryRun {
+		return nil
+	}
+	heldLocksMu.Lock()
+	defer heldLocksMu.Unlock()
+	if heldLocks[path.Clean(dir)] != nil {
+		return nil
+	}
+
+	name := path.Join(dir, lockFileName)
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(*lockWait)
+	logged := false
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			break
+		}
+		if !logged {
+			log.WithField("file", name).Infof("Waiting up to %v for another watcher to release the target path", *lockWait)
+			logged = true
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err == syscall.EWOULDBLOCK {
+		owner := make([]byte, 32)
+		n, _ := file.Read(owner)
+		file.Close()
+		return fmt.Errorf("%v is locked by another watcher (pid %v)", dir, string(owner[:n]))
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// record the owner for whoever finds the directory locked
+	file.Truncate(0)
+	file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	heldLocks[path.Clean(dir)] = file
+	return nil
+}
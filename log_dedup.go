@@ -0,0 +1,160 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var logDedupWindow = flag.Duration("log-dedup-window", 5*time.Minute, "Identical warnings and errors logged within this window are suppressed and summarized with a repeat count when it ends. 0 disables deduplication.")
+
+// fields that differ between otherwise identical lines and are ignored when comparing them
+var volatileLogFields = map[string]bool{"run_id": true, "duration": true}
+
+// repeatedLine tracks a warning or error seen in the current window.
+type repeatedLine struct {
+	level      log.Level
+	message    string
+	fields     log.Fields
+	first      time.Time
+	suppressed int
+}
+
+// suppressedField marks an entry the deduper has suppressed, so the formatter and the other
+// log outputs can skip it.
+const suppressedField = "suppressed_repeat"
+
+// logDeduper is a hook marking repeats of warnings and errors within a window as suppressed.
+// A summary line with the repeat count is logged once the window ends.
+type logDeduper struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]*repeatedLine
+}
+
+func newLogDeduper(window time.Duration) *logDeduper {
+	d := &logDeduper{window: window, seen: map[string]*repeatedLine{}}
+	go func() {
+		for range time.Tick(window / 4) {
+			d.flush(time.Now())
+		}
+	}()
+	return d
+}
+
+// dedupKey identifies identical lines by level, message and the non volatile fields.
+func dedupKey(entry *log.Entry) string {
+	key := &strings.Builder{}
+	fmt.Fprintf(key, "%v\x00%v", entry.Level, entry.Message)
+	names := []string{}
+	for name := range entry.Data {
+		if !volatileLogFields[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(key, "\x00%v=%v", name, entry.Data[name])
+	}
+	return key.String()
+}
+
+func (d *logDeduper) Levels() []log.Level {
+	return []log.Level{log.ErrorLevel, log.WarnLevel}
+}
+
+// Fire runs before the entry is formatted or passed to the other hooks, which must be added
+// after the deduper.
+func (d *logDeduper) Fire(entry *log.Entry) error {
+	if _, summary := entry.Data["repeated"]; summary {
+		return nil
+	}
+
+	key := dedupKey(entry)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	line, seen := d.seen[key]
+	if seen && entry.Time.Sub(line.first) < d.window {
+		line.suppressed++
+		entry.Data[suppressedField] = true
+		return nil
+	}
+	if !seen {
+		fields := log.Fields{}
+		for name, value := range entry.Data {
+			if !volatileLogFields[name] {
+				fields[name] = value
+			}
+		}
+		d.seen[key] = &repeatedLine{level: entry.Level, message: entry.Message, fields: fields, first: entry.Time}
+	}
+	return nil
+}
+
+func suppressed(entry *log.Entry) bool {
+	_, marked := entry.Data[suppressedField]
+	return marked
+}
+
+// dedupFormatter returns nothing for suppressed entries, which logrus then doesn't write.
+type dedupFormatter struct {
+	log.Formatter
+}
+
+func (f dedupFormatter) Format(entry *log.Entry) ([]byte, error) {
+	if suppressed(entry) {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
+
+// flush logs a summary for each line whose window has ended and had repeats.
+func (d *logDeduper) flush(now time.Time) {
+	d.mu.Lock()
+	summaries := []*repeatedLine{}
+	for key, line := range d.seen {
+		if now.Sub(line.first) < d.window {
+			continue
+		}
+		delete(d.seen, key)
+		if line.suppressed > 0 {
+			summaries = append(summaries, line)
+		}
+	}
+	d.mu.Unlock()
+
+	// logged after unlocking as the summaries pass back through Format
+	for _, line := range summaries {
+		log.WithFields(line.fields).WithField("repeated", line.suppressed).Logf(line.level, "%v (repeated %d times in the last %v)", line.message, line.suppressed, d.window)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var (
+	logFile           = flag.String("log-file", "", "File to write logs to, rotated by the watcher itself according to the --log-file-* flags. Logs still go to stderr unless --log-stderr=false.")
+	logFileMaxSize    = flag.Int("log-file-max-size", 100, "Size in megabytes at which the log file is rotated.")
+	logFileMaxAge     = flag.Duration("log-file-max-age", 0, "How long rotated log files are kept, rounded to whole days. 0 keeps them regardless of age.")
+	logFileMaxBackups = flag.Int("log-file-max-backups", 5, "Number of rotated log files kept. 0 keeps them all, subject to --log-file-max-age.")
+	logFileRotate     = flag.Duration("log-file-rotate-interval", 0, "Also rotate the log file on this interval, such as 24h, regardless of its size. 0 only rotates by size.")
+	logFileCompress   = flag.Bool("log-file-compress", false, "Gzip rotated log files.")
+)
+
+// openLogFile returns the rotating writer for --log-file.
+func openLogFile() io.Writer {
+	writer := &lumberjack.Logger{
+		Filename:   *logFile,
+		MaxSize:    *logFileMaxSize,
+		MaxAge:     int((*logFileMaxAge + 24*time.Hour - 1) / (24 * time.Hour)),
+		MaxBackups: *logFileMaxBackups,
+		LocalTime:  true,
+		Compress:   *logFileCompress,
+	}
+	if *logFileRotate > 0 {
+		go func() {
+			for range time.Tick(*logFileRotate) {
+				if err := writer.Rotate(); err != nil {
+					log.WithField("file", *logFile).WithError(err).Error("Error rotating log file")
+				}
+			}
+		}()
+	}
+	return writer
+}
+
+// logOutput is where formatted log lines are written: stderr, the log file, both or neither.
+func logOutput() io.Writer {
+	switch {
+	case *logFile != "" && *logStderr:
+		return io.MultiWriter(os.Stderr, openLogFile())
+	case *logFile != "":
+		return openLogFile()
+	case *logStderr:
+		return os.Stderr
+	}
+	return ioutil.Discard
+}
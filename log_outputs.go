@@ -0,0 +1,195 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+var (
+	logStderr    = flag.Bool("log-stderr", true, "Write logs to stderr. Turn off when logging to journald from a systemd unit to avoid duplicate lines.")
+	logSyslog    = flag.String("log-syslog", "", "Also send logs to syslog: local for the local daemon, or a udp://host:port or tcp://host:port address.")
+	logSyslogTag = flag.String("log-syslog-tag", "prom-config-watcher", "Tag of lines sent to syslog.")
+	logJournald  = flag.Bool("log-journald", false, "Also send logs to systemd-journald, with log fields as journal fields.")
+)
+
+// configureLogOutputs adds the syslog, journald and file outputs and optionally silences stderr.
+func configureLogOutputs() error {
+	log.SetOutput(logOutput())
+	if *logSyslog != "" {
+		hook, err := newSyslogHook(*logSyslog, *logSyslogTag)
+		if err != nil {
+			return fmt.Errorf("unable to connect to syslog: %v", err)
+		}
+		log.AddHook(hook)
+	}
+	if *logJournald {
+		hook, err := newJournaldHook()
+		if err != nil {
+			return fmt.Errorf("unable to connect to journald: %v", err)
+		}
+		log.AddHook(hook)
+	}
+	return nil
+}
+
+type syslogHook struct {
+	writer    *syslog.Writer
+	formatter log.Formatter
+}
+
+func newSyslogHook(address string, tag string) (*syslogHook, error) {
+	network, raddr := "", ""
+	if address != "local" {
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	// syslog adds its own timestamp
+	return &syslogHook{writer: writer, formatter: &log.TextFormatter{DisableTimestamp: true, DisableColors: true}}, nil
+}
+
+func (h *syslogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *log.Entry) error {
+	if suppressed(entry) {
+		return nil
+	}
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	message := strings.TrimSpace(string(line))
+	switch entry.Level {
+	case log.PanicLevel, log.FatalLevel:
+		return h.writer.Crit(message)
+	case log.ErrorLevel:
+		return h.writer.Err(message)
+	case log.WarnLevel:
+		return h.writer.Warning(message)
+	case log.InfoLevel:
+		return h.writer.Info(message)
+	default:
+		return h.writer.Debug(message)
+	}
+}
+
+// journaldHook sends entries to journald over its native protocol, so fields can be
+// filtered on with journalctl, e.g. journalctl FILE=/config/prometheus.yml.
+type journaldHook struct {
+	conn *net.UnixConn
+}
+
+func newJournaldHook() (*journaldHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldHook{conn: conn}, nil
+}
+
+func (h *journaldHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// journaldPriority maps log levels to syslog priorities.
+var journaldPriority = map[log.Level]int{
+	log.PanicLevel: 2,
+	log.FatalLevel: 2,
+	log.ErrorLevel: 3,
+	log.WarnLevel:  4,
+	log.InfoLevel:  6,
+	log.DebugLevel: 7,
+	log.TraceLevel: 7,
+}
+
+func (h *journaldHook) Fire(entry *log.Entry) error {
+	if suppressed(entry) {
+		return nil
+	}
+	msg := &bytes.Buffer{}
+	writeJournalField(msg, "MESSAGE", entry.Message)
+	writeJournalField(msg, "PRIORITY", fmt.Sprint(journaldPriority[entry.Level]))
+	writeJournalField(msg, "SYSLOG_IDENTIFIER", *logSyslogTag)
+	for name, value := range entry.Data {
+		if err, isErr := value.(error); isErr {
+			value = err.Error()
+		}
+		writeJournalField(msg, journalFieldName(name), fmt.Sprint(value))
+	}
+	_, err := h.conn.Write(msg.Bytes())
+	return err
+}
+
+// journalFieldName converts a log field name to the upper case letters, digits and
+// underscores journald accepts. Leading underscores are reserved for trusted fields.
+func journalFieldName(name string) string {
+	converted := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+	converted = strings.TrimLeft(converted, "_")
+	if converted == "" || (converted[0] >= '0' && converted[0] <= '9') {
+		converted = "F" + converted
+	}
+	return converted
+}
+
+// writeJournalField appends a field, using the length prefixed form for values with newlines.
+func writeJournalField(buf *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%v=%v\n", name, value)
+		return
+	}
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,118 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	logFormat         = flag.String("log-format", "text", "Log output format, text or json. JSON lines carry file, pipeline, run_id, duration and error fields where they apply.")
+	logLevelTokenFile = flag.String("log-level-token-file", "", "File holding a bearer token that enables the /loglevel endpoint for changing the log level at runtime. The endpoint is disabled when unset, unless --oidc-issuer-url is.")
+)
+
+func configureLogging() error {
+	switch *logFormat {
+	case "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", *logFormat)
+	}
+	// the deduper has to run before the other hooks so they can skip suppressed lines
+	if *logDedupWindow > 0 {
+		log.AddHook(newLogDeduper(*logDedupWindow))
+		log.SetFormatter(dedupFormatter{log.StandardLogger().Formatter})
+	}
+	return configureLogOutputs()
+}
+
+// newRunID returns a random id used to correlate the log lines of a processing run.
+func newRunID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
+
+// toggleDebugOnSignal switches between debug and the startup log level each time SIGUSR2 is received.
+func toggleDebugOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	base := log.GetLevel()
+	if base >= log.DebugLevel {
+		base = log.InfoLevel
+	}
+	go func() {
+		for range sigs {
+			level := log.DebugLevel
+			if log.GetLevel() == log.DebugLevel {
+				level = base
+			}
+			log.SetLevel(level)
+			log.Infof("Received SIGUSR2, log level is now %v", level)
+		}
+	}()
+}
+
+// logLevelHandler reports the log level on GET and changes it on PUT or POST, with the new level as
+// the request body.
+func logLevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			level, err := log.ParseLevel(strings.TrimSpace(string(body)))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.SetLevel(level)
+			log.Infof("Log level changed to %v by %v", level, requester(r))
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintln(w, log.GetLevel())
+	})
+}
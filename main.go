@@ -20,147 +20,516 @@ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
 LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
 OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 SOFTWARE.
- */
+*/
 
 package main
 
 import (
-	log "github.com/sirupsen/logrus"
 	"flag"
+	"fmt"
 	"github.com/go-fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
 	"os"
 
 	"time"
 
-	"os/signal"
-	"syscall"
 	"io/ioutil"
+	"os/signal"
 	"path"
-	"net/http"
+	"path/filepath"
+	"strings"
+	"syscall"
 )
 
 var (
 	watchedPath      = flag.String("watch-path", "/config", "Path to be watched (default /config)")
 	expandVars       = flag.Bool("expand-vars", true, "Expand $env variables found in files (default true).")
 	targetPath       = flag.String("target-path", "/processed-config", "Path to copy processed files to (default /processed-config)")
-	prometheusUrl    = flag.String("prometheus-url", "http://localhost:9090/-/reload", "Url to send a POST to prometheus for it to reload its config. (default http://localhost:9090/-/reload)")
+	prometheusUrl    = flag.String("prometheus-url", "http://localhost:9090/-/reload", "Url to send a POST to prometheus for it to reload its config. (default http://localhost:9090/-/reload, or the reload url of the --mode service)")
 	processDelayTime = flag.Duration("process-delay-time", 5*time.Second, "time to wait after a detected change to process files. This allows capturing multiple close timed changes in a single update.")
 	debugLogs        = flag.Bool("debug", false, "Enable debug log output")
+
+	shutdownGracePeriod = flag.Duration("shutdown-grace-period", 30*time.Second, "How long to wait on SIGINT or SIGTERM for a processing run or reload in progress to finish before exiting.")
+
+	reloadOnGlobs stringList
 )
 
+func init() {
+	flag.Var(&reloadOnGlobs, "reload-on", "Glob matched against changed file names (relative to the watch path) that should trigger a reload. All files are still processed. May be repeated, defaults to all files.")
+}
+
+// fileChange describes a change seen on a watched file.
+type fileChange struct {
+	name    string
+	modTime time.Time
+}
+
 func main() {
+	cmd, err := parseCommandLine(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *showVersion {
+		fmt.Println(currentBuild())
+		os.Exit(0)
+	}
+	if *configFile != "" {
+		if loadedConfig, err = loadConfig(*configFile); err == nil {
+			err = loadedConfig.applySettings()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid config file: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if err := applyUmask(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 	log.SetLevel(log.InfoLevel)
-	log.Info("Prometheus Configuration Watcher")
-	log.Info("Github: https://github.com/khaines/prom-config-watcher")
-	flag.Parse()
+	if err := configureLogging(); err != nil {
+		log.Fatal(err)
+	}
 	if *debugLogs {
 		log.SetLevel(log.DebugLevel)
 	}
+	if err := startSPIFFE(); err != nil {
+		log.Fatal(err)
+	}
+	reloadClient = newHTTPClient(*reloadTimeout)
+	os.Exit(cmd.run())
+}
 
-	sigs := make(chan os.Signal, 1)
+// setupWatcher does the setup shared by the commands that apply config and reload services.
+func setupWatcher() (steps []*reloadStep, flushTraces func()) {
+	log.Info("Prometheus Configuration Watcher")
+	log.Info("Github: https://github.com/khaines/prom-config-watcher")
+	log.Info(currentBuild())
+	toggleDebugOnSignal()
+	flushTraces, err := configureTracing()
+	if err != nil {
+		log.Fatalf("Failed to configure tracing: %v", err)
+	}
+	if *auditLogPath != "" {
+		if audit, err = openAuditLog(*auditLogPath); err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+	}
+	steps, err = configuredSteps()
+	if err != nil {
+		log.Fatalf("Invalid reload step: %v", err)
+	}
+	if err := configureSecrets(); err != nil {
+		log.Fatalf("Unable to configure secret stores: %v", err)
+	}
+	if err := checkStepCredentials(steps); err != nil {
+		log.Fatalf("Invalid reload step: %v", err)
+	}
+	if err := configureStateEncryption(); err != nil {
+		log.Fatalf("Unable to configure state encryption: %v", err)
+	}
+	if err := configureSources(); err != nil {
+		log.Fatalf("Invalid source: %v", err)
+	}
+	if err := checkSignatureSettings(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkUploadURL(*uploadURL); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkSSHTargets(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkRouteTests(); err != nil {
+		log.Fatal(err)
+	}
+	return steps, flushTraces
+}
 
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+// defaultPipeline is the pipeline configured by the command line flags.
+func defaultPipeline(steps []*reloadStep, targetDir string) *pipeline {
+	return &pipeline{
+		name:       "default",
+		watchPath:  *watchedPath,
+		targetPath: targetDir,
+		expandVars: *expandVars,
+		reloadOn:   reloadOnGlobs,
+		validators: stepValidators(steps),
+		sinks:      configureSinks(targetDir, true, *uploadURL, ""),
+	}
+}
+
+// runWatch processes the config whenever it changes, reloading the services that use it.
+func runWatch() int {
+	removeReadyFile()
+	steps, flushTraces := setupWatcher()
+	pipelines, err := configuredPipelines(steps)
+	if err != nil {
+		log.Fatalf("Invalid pipeline: %v", err)
+	}
+	windows, err := parseMaintenanceWindows(maintenanceWindowSpecs)
+	if err != nil {
+		log.Fatalf("Invalid maintenance window: %v", err)
+	}
+	reloads := newReloader(steps, windows)
+	if reloads.pager, err = newPager(); err != nil {
+		log.Fatalf("Unable to configure paging: %v", err)
+	}
 
-	lastConfigProcess := time.Time{}
-	// initializing config change to now will trigger an initial run to process the config files
-	lastConfigChange := time.Now()
-	delayTimer := time.NewTimer(0)
+	if *requireApproval {
+		approvals = newApprovalGate()
+		if *approvalFile != "" {
+			go approvals.watchApprovalFile(*approvalFile)
+		}
+	}
 
-	fileChangeTime, err := startWatchingPath(*watchedPath)
+	reloads.onResult(recordReload)
+	reloads.onResult(markReloaded)
+	reloads.onResult(board.reloadFinished)
+	stateRequests := make(chan stateRequest)
+	triggerRequests := make(chan triggerRequest)
+	pushRequests := make(chan pushRequest)
+	push, err := newPushAPI(pushRequests)
 	if err != nil {
-		log.Fatalf("Failed to start watching path %v, exiting")
-		os.Exit(1)
-		return
+		log.Fatalf("Unable to accept pushes: %v", err)
+	}
+	startServer(reloads.currentSteps, stateRequests, triggerRequests, push)
+	if err := startBusTriggers(triggerRequests); err != nil {
+		log.Fatalf("Unable to subscribe to triggers: %v", err)
+	}
+	startGRPCServer(push)
+	startProfiling()
+	awaitLeadership()
+	createTargets(pipelines)
+	harden(pipelines)
+	syncMirrors()
+	preflight(pipelines, steps)
+
+	runListeners := []func(rendered []renderedFile, err error){}
+	if *pushgatewayURL != "" {
+		pushgateway := newPushgatewayPublisher()
+		reloads.onResult(pushgateway.reloadFinished)
+		runListeners = append(runListeners, pushgateway.runFinished)
+	}
+	if *kubeEvents {
+		events, err := newKubeEventRecorder()
+		if err != nil {
+			log.Fatalf("Unable to emit kubernetes events: %v", err)
+		}
+		reloads.onResult(events.reloadFinished)
+		runListeners = append(runListeners, events.runFinished)
+	}
+	if *statusConfigMap != "" || *statusObject != "" {
+		status, err := newStatusReporter()
+		if err != nil {
+			log.Fatalf("Unable to report status: %v", err)
+		}
+		reloads.onResult(status.reloadFinished)
+		runListeners = append(runListeners, status.runFinished)
+	}
+	if len(failureWebhookSpecs) > 0 {
+		failures, err := newFailureNotifier(failureWebhookSpecs)
+		if err != nil {
+			log.Fatalf("Invalid failure webhook: %v", err)
+		}
+		reloads.onResult(failures.reloadFinished)
+		runListeners = append(runListeners, failures.runFinished)
+	}
+	if len(runWebhookURLs) > 0 {
+		runWebhooks, err = newRunNotifier(runWebhookURLs)
+		if err != nil {
+			log.Fatalf("Invalid run webhook: %v", err)
+		}
+		reloads.onChangesReloaded(runWebhooks.reloadFinished)
+	}
+	bus, err := configureEventBus()
+	if err != nil {
+		log.Fatalf("Unable to publish events: %v", err)
+	}
+	if bus != nil {
+		reloads.onChangesReloaded(bus.reloadFinished)
+	}
+	go reloads.run()
+
+	loops := &pipelineLoops{reloads: reloads, listeners: runListeners, loops: map[string]*pipelineLoop{}}
+	expectProcessed(pipelines...)
+	for _, pipe := range pipelines {
+		if err := loops.start(pipe, *skipInitialRun); err != nil {
+			log.Fatalf("Failed to start watching path %v, exiting", pipe.watchPath)
+			return 1
+		}
+	}
+	if len(secretResolvers) > 0 {
+		go secrets.refresh()
+	}
+	startMirrors()
+	var configChanges <-chan struct{}
+	if *configFile != "" {
+		configChanges = watchConfigFile(*configFile)
 	}
 
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	forceSigs := make(chan os.Signal, 1)
+	signal.Notify(forceSigs, syscall.SIGUSR1)
+	watchdog := watchdogTicks()
+	exit := func() int {
+		sdNotify("STOPPING=1")
+		code := shutdown(loops, sigs)
+		leader.release()
+		flushTraces()
+		return code
+	}
 	for {
 		select {
+		case request := <-stateRequests:
+			request.reply <- loops.dump()
+		case request := <-triggerRequests:
+			err := loops.forceNamed(request.pipeline)
+			if err == nil {
+				log.Infof("Trigger requested, processing and reloading %v now", pipelineOrAll(request.pipeline))
+			}
+			request.reply <- err
+		case request := <-pushRequests:
+			request.reply <- loops.pipelinesWithin(*pushDir)
+		case <-forceSigs:
+			log.Info("Received SIGUSR1, processing and reloading all pipelines now")
+			loops.force()
+		case <-secrets.rotated:
+			loops.forceSources(secrets.takeRotated())
+		case mirror := <-mirrorUpdates:
+			loops.forceWithin(mirror.dir, fmt.Sprintf("%v has changed", mirror.name))
+		case <-configChanges:
+			reloadConfigFile(loops)
 		case <-sigs:
 			log.Infof("Received SIGINT or SIGTERM. Shutting down")
-			os.Exit(0)
-			return
-		case lastConfigChange = <-fileChangeTime:
-			// reset the delay timer in case other changes are triggered rapidly
-			delayTimer.Reset(*processDelayTime)
-
-		case <-delayTimer.C:
-			// process delay timer has tripped, process the config files.
-			if lastConfigProcess.Before(lastConfigChange) {
-				// process
-				processConfigChanges(*watchedPath, *targetPath, *expandVars)
-				notifyPrometheus(*prometheusUrl)
-				lastConfigProcess = time.Now()
+			return exit()
+		case <-exitReady:
+			log.Info("Exiting now that the watcher is ready")
+			return exit()
+		case <-watchdog:
+			// the pipeline loops and the watchers report through their heartbeats
+			if loopHeartbeat.age() < *livenessTimeout && watcherHeartbeat.age() < *livenessTimeout {
+				sdNotify("WATCHDOG=1")
 			}
-
 		}
+	}
+}
 
+// shutdown lets the pipelines finish the runs in progress and any reload being sent, within
+// --shutdown-grace-period. A second signal exits straight away.
+func shutdown(loops *pipelineLoops, sigs <-chan os.Signal) int {
+	deadline := time.After(*shutdownGracePeriod)
+	for _, done := range []<-chan struct{}{loops.stop(), loops.reloads.stop()} {
+		select {
+		case <-done:
+		case <-deadline:
+			log.Warnf("Work still in progress after the %v shutdown grace period, exiting anyway", *shutdownGracePeriod)
+			return 1
+		case <-sigs:
+			log.Warn("Received a second signal, exiting without waiting for work in progress")
+			return 1
+		}
 	}
+	return 0
+}
+
+// renderedFile is a processed config file waiting to be written to the target path.
+type renderedFile struct {
+	source  string
+	name    string
+	content []byte
+}
+
+// sourceFile is a source file read for a run. Each file is read once, so that a signature is
+// verified over exactly the content that gets rendered.
+type sourceFile struct {
+	path string
+	// rel is the slash separated path relative to the watch path, or the file name when the
+	// watch path is a single file
+	rel     string
+	content []byte
+}
 
+// skipSource reports whether an entry of a watched directory is left out of a run: the
+// timestamped directories kubernetes projects volumes through, git metadata, the temporary
+// files of atomic writes and the signature. Rendering and the signature manifest both read
+// the sources through readSources, so they always cover the same files.
+func skipSource(name string) bool {
+	return strings.HasPrefix(name, "..") || name == gitMetadataDir || isAtomicWriteTemp(name) || isSignatureFile(name)
 }
 
-func notifyPrometheus(url string) {
-	log.Debug("Posting reload command to Prometheus")
-	resp, err := http.Post(url, "plain/text", nil)
+// readSources reads the source files under srcPath, logging those that can't be read.
+func readSources(logger *log.Entry, srcPath string) []sourceFile {
+	stat, err := os.Stat(srcPath)
 	if err != nil {
-		log.Errorf("Error posting reload command to Prometheues: %v", err)
-		return
+		logger.WithField("file", srcPath).WithError(err).Error("Error processing changes")
+		return nil
+	}
+	if !stat.IsDir() {
+		return readSourceFile(logger, srcPath, path.Base(srcPath), nil)
 	}
-	defer resp.Body.Close()
-	log.Debugf("Status code %v", resp.StatusCode)
+	return readSourceDir(logger, srcPath, "", nil)
 }
 
-func processConfigChanges(srcPath string, dstPath string, expandVars bool) {
-	log.Debugf("Processing changes for %v", srcPath)
-	// if we are in a folder, process the files within
-	stat, err := os.Stat(srcPath)
+func readSourceDir(logger *log.Entry, root string, rel string, sources []sourceFile) []sourceFile {
+	dir := path.Join(root, rel)
+	logger.Debugf("Processing changes for %v", dir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logger.WithField("file", dir).WithError(err).Error("Failed to list files")
+		return sources
+	}
+	for _, fileName := range files {
+		if skipSource(fileName.Name()) {
+			continue
+		}
+		name := path.Join(rel, fileName.Name())
+		stat, err := os.Stat(path.Join(root, name))
+		if err != nil {
+			logger.WithField("file", path.Join(root, name)).WithError(err).Error("Error processing changes")
+			continue
+		}
+		if stat.IsDir() {
+			sources = readSourceDir(logger, root, name, sources)
+			continue
+		}
+		sources = readSourceFile(logger, path.Join(root, name), name, sources)
+	}
+	return sources
+}
+
+func readSourceFile(logger *log.Entry, filePath string, rel string, sources []sourceFile) []sourceFile {
+	logger.Debugf("Processing changes for %v", filePath)
+	contents, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		log.Errorf("Error processing changes in %v: %v", srcPath, err)
-		return
+		logger.WithField("file", filePath).WithError(err).Error("Error reading file")
+		return sources
 	}
+	return append(sources, sourceFile{path: filePath, rel: rel, content: contents})
+}
 
-	if stat.IsDir() {
-		files, err := ioutil.ReadDir(srcPath)
+// processConfigChanges reads and renders the source files under srcPath.
+func processConfigChanges(logger *log.Entry, srcPath string, expandVars bool, rendered []renderedFile) ([]renderedFile, error) {
+	return renderSources(logger, readSources(logger, srcPath), expandVars, rendered)
+}
+
+// renderSources renders source files that have already been read, unpacking any bundles. It
+// renders every file it can, but a file that fails to decrypt or expand fails the whole
+// render, as writing the rest would leave a partial set of config in place.
+func renderSources(logger *log.Entry, sources []sourceFile, expandVars bool, rendered []renderedFile) ([]renderedFile, error) {
+	failures := []string{}
+	for _, source := range sources {
+		if isBundle(source.path) {
+			var err error
+			if rendered, err = processBundle(logger, source, expandVars, rendered); err != nil {
+				failures = append(failures, err.Error())
+			}
+			continue
+		}
+		start := time.Now()
+		file, err := processFile(source, expandVars)
 		if err != nil {
-			log.Errorf("Failed to list files in %v: %v", srcPath, err)
-			return
+			logger.WithField("file", source.path).WithError(err).Error("Error rendering file")
+			failures = append(failures, fmt.Sprintf("%v: %v", source.path, err))
+			continue
 		}
+		logger.WithFields(log.Fields{"file": source.path, "duration": time.Since(start).Seconds()}).Debug("Rendered file")
+		rendered = append(rendered, file)
+	}
+
+	if len(failures) > 0 {
+		return rendered, fmt.Errorf("%d file(s) failed to render: %v", len(failures), strings.Join(failures, "; "))
+	}
+	return rendered, nil
+}
+
+func processFile(source sourceFile, expandVars bool) (renderedFile, error) {
+	contents := source.content
+	fileName := path.Base(source.path)
+	var err error
+	if strings.HasSuffix(fileName, ageSuffix) {
+		if contents, err = ageDecrypt(source.path, contents); err != nil {
+			return renderedFile{}, err
+		}
+		fileName = strings.TrimSuffix(fileName, ageSuffix)
+	} else if isSOPSEncrypted(contents) {
+		if contents, err = sopsDecrypt(source.path, contents); err != nil {
+			return renderedFile{}, err
+		}
+	}
+	// expand any environmenal vars and secret references present
+	updatedContent, err := expandContent(string(contents), expandVars, source.path)
+	if err != nil {
+		return renderedFile{}, err
+	}
 
-		for _, fileName := range files {
-			processConfigChanges(path.Join(srcPath, fileName.Name()), dstPath, expandVars)
+	return renderedFile{source: source.path, name: fileName, content: []byte(updatedContent)}, nil
+}
+
+// writeRenderedFiles writes updated content to the destination folder.
+func writeRenderedFiles(logger *log.Entry, files []renderedFile, destFolder string) {
+	for _, file := range files {
+		targetFile := path.Join(destFolder, file.name)
+		fileLogger := logger.WithField("file", targetFile)
+		fileLogger.Debug("writing updated content")
+		if err := writeFileAtomic(targetFile, file.content, renderedFileMode); err != nil {
+			fileLogger.WithError(err).Error("Error writing file")
+			continue
 		}
-	} else {
-		processFile(srcPath, dstPath,expandVars)
+		filesWritten.Inc()
 	}
 }
 
-func processFile(filePath string, destFolder string, expandVars bool) {
+// isAtomicWriteTemp reports whether name is one of writeFileAtomic's temporary files, which
+// come and go while a mirrored source is updated. They are named "."+base+".tmp" followed
+// by the random digits ioutil.TempFile appends, so a source such as .alerts.tmpl isn't one.
+func isAtomicWriteTemp(name string) bool {
+	i := strings.LastIndex(name, ".tmp")
+	if !strings.HasPrefix(name, ".") || i < 2 || i+len(".tmp") == len(name) {
+		return false
+	}
+	for _, c := range name[i+len(".tmp"):] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
 
-	// read in the file
-	contents, err := ioutil.ReadFile(filePath)
+// writeFileAtomic replaces name with content through a temporary file in the same directory,
+// so that readers, or a watcher stopped part way through, never see a partially written file.
+func writeFileAtomic(name string, content []byte, perm os.FileMode) error {
+	dir, base := path.Split(name)
+	tmp, err := ioutil.TempFile(dir, "."+base+".tmp")
 	if err != nil {
-		log.Errorf("Error reading %v: %v", filePath, err)
+		return err
 	}
-	 updatedContent:=""
-	if expandVars {
-		// expand any environmenal vars present
-		updatedContent = os.ExpandEnv(string(contents))
-	}else{
-		updatedContent = string(contents)
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
 	}
-
-	// write updated content to the destination folder
-	_, fileName := path.Split(filePath)
-	targetFile := path.Join(destFolder, fileName)
-	log.Debugf("writing updated content to %v", targetFile)
-	ioutil.WriteFile(targetFile, []byte(updatedContent), 0644)
+	// temporary files are created 0600, give the file its intended mode
+	if err := tmp.Chmod(perm &^ processUmask); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
 }
 
-func startWatchingPath(path string) (chan time.Time, error) {
+// startWatchingPath sends changes to files in path until done is closed.
+func startWatchingPath(path string, done <-chan struct{}) (chan fileChange, error) {
 
 	log.Debugf("Creating watcher for path %v", path)
 
 	// need a channel for calling back about changes happening in files
-	changeTime := make(chan time.Time)
+	changes := make(chan fileChange)
 
 	// create a file watcher
 	watcher, err := fsnotify.NewWatcher()
@@ -173,33 +542,53 @@ func startWatchingPath(path string) (chan time.Time, error) {
 	if os.IsNotExist(err) {
 		log.Infof("%v no longer exists", path)
 	} else if err != nil {
-		log.Warnf("Failed to watch %v because of error: %v", path, err)
+		log.WithField("file", path).WithError(err).Warn("Failed to watch path")
 	}
 
 	// let the watcher run in the background
-	go listenForChanges(watcher, changeTime)
+	go listenForChanges(path, watcher, changes, done)
 
-	return changeTime, nil
+	return changes, nil
 }
 
-func listenForChanges(watcher *fsnotify.Watcher, changeTime chan time.Time) {
+func listenForChanges(path string, watcher *fsnotify.Watcher, changes chan fileChange, done <-chan struct{}) {
+
+	heartbeats := time.NewTicker(heartbeatInterval)
+	defer heartbeats.Stop()
+	defer watcher.Close()
+	watcherHeartbeat.beat()
 
 	// main loop for processing events from the FS watcher
 	for {
 		select {
+		case <-done:
+			return
+
+		case <-heartbeats.C:
+			watcherHeartbeat.beat()
+
 		case err := <-watcher.Errors:
-			log.Errorf("Error from watcher: %v", err)
+			log.WithError(err).Error("Error from watcher")
 
 		case event := <-watcher.Events:
-			log.Debugf("Received an event for %v", event.Name)
+			log.WithField("file", event.Name).Debug("Received an event")
+			if base := filepath.Base(event.Name); base == gitMetadataDir || isAtomicWriteTemp(base) {
+				continue
+			}
+			fsnotifyEvents.WithLabelValues(path, event.Op.String()).Inc()
 			stat, err := os.Stat(event.Name)
 			if err != nil {
-				log.Errorf("Could not get modified time for %v: %v", event.Name, err)
+				log.WithField("file", event.Name).WithError(err).Error("Could not get modified time")
+				eventsDropped.WithLabelValues(path, "stat_failed").Inc()
 				continue
 			}
 			log.Debugf("Modified time of %v is %v", event.Name, stat.ModTime())
 
-			changeTime <- stat.ModTime()
+			select {
+			case changes <- fileChange{name: event.Name, modTime: stat.ModTime()}:
+			case <-done:
+				return
+			}
 
 		}
 	}
@@ -0,0 +1,136 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestIsAtomicWriteTemp(t *testing.T) {
+	dir := t.TempDir()
+	tmp, err := ioutil.TempFile(dir, ".alerts.yml.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	tests := []struct {
+		name string
+		temp bool
+	}{
+		{filepath.Base(tmp.Name()), true},
+		{".prometheus.yml.tmp123456", true},
+		{".alerts.tmpl", false},
+		{".alerts.tmp", false},
+		{".tmp123", false},
+		{"alerts.yml.tmp123", false},
+		{".rules.tmp.yml", false},
+		{".tmp.d", false},
+	}
+	for _, test := range tests {
+		if got := isAtomicWriteTemp(test.name); got != test.temp {
+			t.Errorf("isAtomicWriteTemp(%q) = %v, want %v", test.name, got, test.temp)
+		}
+	}
+}
+
+func TestRenderSources(t *testing.T) {
+	os.Setenv("PCW_TEST_CLUSTER", "east")
+	defer os.Unsetenv("PCW_TEST_CLUSTER")
+	ok := sourceFile{path: "/config/prometheus.yml", rel: "prometheus.yml", content: []byte("cluster: ${PCW_TEST_CLUSTER}")}
+	// without --age-identity-file an age encrypted source can't be decrypted
+	encrypted := sourceFile{path: "/config/alerts.yml.age", rel: "alerts.yml.age", content: []byte("encrypted")}
+	other := sourceFile{path: "/config/rules.yml.age", rel: "rules.yml.age", content: []byte("encrypted")}
+	bundle := sourceFile{path: "/config/rules.tgz", rel: "rules.tgz", content: tarGzip(t, map[string]string{"team.yml.age": "encrypted"})}
+	unpack := *unpackBundles
+	*unpackBundles = true
+	defer func() { *unpackBundles = unpack }()
+
+	tests := []struct {
+		name     string
+		sources  []sourceFile
+		rendered []string
+		// failures are the sources the error names, no error when empty
+		failures []string
+	}{
+		{"rendered", []sourceFile{ok}, []string{"cluster: east"}, nil},
+		{"failure", []sourceFile{encrypted, ok}, []string{"cluster: east"}, []string{"alerts.yml.age"}},
+		{"every failure", []sourceFile{encrypted, ok, other}, []string{"cluster: east"}, []string{"alerts.yml.age", "rules.yml.age"}},
+		{"failure in a bundle", []sourceFile{ok, bundle}, []string{"cluster: east"}, []string{"rules.tgz", "team.yml.age"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := renderSources(log.NewEntry(log.StandardLogger()), test.sources, true, nil)
+			rendered := []string{}
+			for _, file := range files {
+				rendered = append(rendered, string(file.content))
+			}
+			if !reflect.DeepEqual(rendered, test.rendered) {
+				t.Errorf("rendered %q, want %q", rendered, test.rendered)
+			}
+			if len(test.failures) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected the failure to render %v to be returned", test.failures)
+			}
+			for _, failure := range test.failures {
+				if !strings.Contains(err.Error(), failure) {
+					t.Errorf("error %q doesn't name %v", err, failure)
+				}
+			}
+		})
+	}
+}
+
+// tarGzip makes a .tar.gz bundle of the files.
+func tarGzip(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,216 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "prom_config_watcher"
+
+var (
+	eventsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_received_total",
+		Help:      "File system events received for the watched path.",
+	})
+	processingRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "processing_runs_total",
+		Help:      "Processing runs, by result.",
+	}, []string{"result"})
+	processingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "processing_duration_seconds",
+		Help:      "Time taken to render, validate and write the config files.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	filesWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_written_total",
+		Help:      "Rendered files written to the target path.",
+	})
+	validationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "validation_failures_total",
+		Help:      "Rendered files that failed validation, by validator.",
+	}, []string{"validator"})
+	reloadAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reload_attempts_total",
+		Help:      "Reload notifications sent, by reload step.",
+	}, []string{"step"})
+	reloadFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reload_failures_total",
+		Help:      "Reload notifications that failed, by reload step.",
+	}, []string{"step"})
+	stepDegraded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "step_degraded",
+		Help:      "Whether the service of a reload step wasn't healthy after its last reload, by reload step.",
+	}, []string{"step"})
+	lastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_successful_reload_timestamp_seconds",
+		Help:      "Time of the last reload sequence that completed successfully.",
+	})
+	fsnotifyEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "fsnotify_events_total",
+		Help:      "Raw events from the file system watcher, by watched path and operation.",
+	}, []string{"path", "op"})
+	eventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_dropped_total",
+		Help:      "File system events that were discarded without being processed, by watched path and reason.",
+	}, []string{"path", "reason"})
+	eventsCoalesced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_coalesced_total",
+		Help:      "Events for a file that already had a change waiting to be processed, by watched path.",
+	}, []string{"path"})
+	debounceResets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "debounce_resets_total",
+		Help:      "Times a change arrived while waiting out --process-delay-time, pushing processing back, by watched path.",
+	}, []string{"path"})
+	debounceWindow = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "debounce_window_seconds",
+		Help:      "Time from the first change of a batch until it was processed.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+	phaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "phase_duration_seconds",
+		Help:      "Time taken by each phase of processing: render, validate and write.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"phase"})
+	reloadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "reload_duration_seconds",
+		Help:      "Time taken to reload each step, including waiting for it to become healthy.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"step"})
+	changeToReload = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "change_to_reload_seconds",
+		Help:      "Time from a change being seen on disk until the reload sequence covering it succeeded.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	})
+	configHash = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_info",
+		Help:      "Always 1, with the hash of the last rendered and last successfully reloaded config as labels.",
+	}, []string{"state", "hash"})
+
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_file_reloads_total",
+		Help:      "Reloads of the watcher's own config file, by result.",
+	}, []string{"result"})
+
+	secretLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_lookups_total",
+		Help:      "Secret lookups, by store and whether the value was read, cached, stale or failed.",
+	}, []string{"scheme", "result"})
+	secretRotations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_rotations_total",
+		Help:      "Secrets found to have changed when read again, by store.",
+	}, []string{"scheme"})
+	sourceSyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "source_syncs_total",
+		Help:      "Fetches of remote sources such as --git-repo, by type of source and whether they failed, found nothing new or found changes.",
+	}, []string{"source", "result"})
+	vaultUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_up",
+		Help:      "Whether the last request to Vault got a response.",
+	})
+	vaultTokenExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_token_expiry_timestamp_seconds",
+		Help:      "When the Vault token expires unless renewed, 0 for tokens that don't expire.",
+	})
+	isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "Whether this replica holds the --leader-elect Lease and applies config.",
+	})
+	secretLeaks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_leaks_total",
+		Help:      "Secret values found in rendered files that are world readable or marked non-sensitive.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		eventsReceived,
+		processingRuns,
+		processingDuration,
+		filesWritten,
+		validationFailures,
+		reloadAttempts,
+		reloadFailures,
+		stepDegraded,
+		lastReloadSuccess,
+		configHash,
+		fsnotifyEvents,
+		eventsDropped,
+		eventsCoalesced,
+		debounceResets,
+		debounceWindow,
+		phaseDuration,
+		reloadDuration,
+		changeToReload,
+		configReloads,
+		secretLookups,
+		secretRotations,
+		secretLeaks,
+		vaultUp,
+		vaultTokenExpiry,
+		sourceSyncs,
+		isLeader,
+	)
+}
+
+// recordReload is registered with the reloader to track successful reload sequences.
+func recordReload(err error) {
+	if err == nil {
+		lastReloadSuccess.SetToCurrentTime()
+	}
+}
+
+func runResult(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
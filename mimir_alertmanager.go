@@ -0,0 +1,124 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	amAPIURL          = flag.String("alertmanager-api-url", "", "Base url of a Mimir or Cortex Alertmanager. When set, the rendered Alertmanager config and templates are uploaded to its config API.")
+	amAPITenant       = flag.String("alertmanager-api-tenant", "", "Tenant id for the Alertmanager config API. Defaults to --ruler-tenant.")
+	amAPIUsername     = flag.String("alertmanager-api-username", "", "Username for basic auth to the Alertmanager config API. Defaults to --ruler-username.")
+	amAPIPasswordFile = flag.String("alertmanager-api-password-file", "", "File containing the password for the Alertmanager config API. Defaults to --ruler-password-file.")
+	amAPIConfig       = flag.String("alertmanager-api-config", "alertmanager.yml", "Name of the rendered file uploaded as the Alertmanager config.")
+	amAPITemplates    = flag.String("alertmanager-api-templates", "*.tmpl", "Glob of rendered template files uploaded with the Alertmanager config.")
+)
+
+// amUserConfig is the body of the Mimir/Cortex /api/v1/alerts endpoint.
+type amUserConfig struct {
+	TemplateFiles      map[string]string `yaml:"template_files"`
+	AlertmanagerConfig string            `yaml:"alertmanager_config"`
+}
+
+// alertmanagerAPISink uploads the tenant's Alertmanager config and templates.
+type alertmanagerAPISink struct {
+	api      *tenantAPI
+	endpoint string
+}
+
+func orDefault(value string, fallback string) string {
+	if value != "" {
+		return value
+	}
+	return fallback
+}
+
+func newAlertmanagerAPISink() *alertmanagerAPISink {
+	return &alertmanagerAPISink{
+		api: &tenantAPI{
+			client:       reloadClient,
+			tenant:       orDefault(*amAPITenant, *rulerTenant),
+			username:     orDefault(*amAPIUsername, *rulerUsername),
+			passwordFile: orDefault(*amAPIPasswordFile, *rulerPasswordFile),
+		},
+		endpoint: strings.TrimSuffix(*amAPIURL, "/") + "/api/v1/alerts",
+	}
+}
+
+func (a *alertmanagerAPISink) name() string {
+	return "alertmanager api " + *amAPIURL
+}
+
+func (a *alertmanagerAPISink) files() []string {
+	return []string{*amAPIConfig, *amAPITemplates}
+}
+
+func (a *alertmanagerAPISink) write(logger *log.Entry, files []renderedFile) error {
+	desired := amUserConfig{TemplateFiles: map[string]string{}}
+	for _, file := range files {
+		if file.name == *amAPIConfig {
+			desired.AlertmanagerConfig = string(file.content)
+		} else {
+			desired.TemplateFiles[file.name] = string(file.content)
+		}
+	}
+	if desired.AlertmanagerConfig == "" {
+		return fmt.Errorf("no rendered %v to upload", *amAPIConfig)
+	}
+
+	body, status, err := a.api.do(http.MethodGet, a.endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusNotFound {
+		current := amUserConfig{}
+		if err := yaml.Unmarshal(body, &current); err == nil && current.AlertmanagerConfig == desired.AlertmanagerConfig &&
+			(reflect.DeepEqual(current.TemplateFiles, desired.TemplateFiles) || len(current.TemplateFiles)+len(desired.TemplateFiles) == 0) {
+			logger.Debug("Alertmanager config API is already up to date")
+			return nil
+		}
+	}
+
+	upload, err := yaml.Marshal(desired)
+	if err != nil {
+		return err
+	}
+	if _, status, err = a.api.do(http.MethodPost, a.endpoint, upload); err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		return fmt.Errorf("%v not found, is the Alertmanager config API enabled?", a.endpoint)
+	}
+	logger.Infof("Uploaded Alertmanager config with %d templates", len(desired.TemplateFiles))
+	return nil
+}
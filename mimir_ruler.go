@@ -0,0 +1,196 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	rulerURL              = flag.String("ruler-url", "", "Base url of a Mimir or Cortex ruler. When set, rendered rule files are synchronized to the ruler API instead of being written to the target path.")
+	rulerAPIPrefix        = flag.String("ruler-api-prefix", "/prometheus/config/v1/rules", "Path of the ruler config API. Use /api/v1/rules for Cortex.")
+	rulerTenant           = flag.String("ruler-tenant", "", "Tenant id sent in the X-Scope-OrgID header to the ruler.")
+	rulerUsername         = flag.String("ruler-username", "", "Username for basic auth to the ruler.")
+	rulerPasswordFile     = flag.String("ruler-password-file", "", "File containing the password for basic auth to the ruler.")
+	rulerDeleteNamespaces = flag.Bool("ruler-delete-namespaces", false, "Delete ruler namespaces that have no matching rule file, rather than only groups removed from managed namespaces.")
+	rulerFiles            = stringList{}
+)
+
+func init() {
+	flag.Var(&rulerFiles, "ruler-files", "Glob of rendered files synchronized to the ruler, each file becoming a namespace named after it. May be repeated, defaults to *.rules.yml and *.rules.yaml.")
+}
+
+// rulerSink synchronizes rule groups with the Mimir/Cortex ruler, creating, updating and
+// deleting groups so the ruler matches the rendered files.
+type rulerSink struct {
+	api   *tenantAPI
+	base  string
+	globs []string
+}
+
+func newRulerSink() *rulerSink {
+	globs := []string(rulerFiles)
+	if len(globs) == 0 {
+		globs = []string{"*.rules.yml", "*.rules.yaml"}
+	}
+	return &rulerSink{
+		api:   &tenantAPI{client: reloadClient, tenant: *rulerTenant, username: *rulerUsername, passwordFile: *rulerPasswordFile},
+		base:  strings.TrimSuffix(*rulerURL, "/") + *rulerAPIPrefix,
+		globs: globs,
+	}
+}
+
+func (r *rulerSink) name() string {
+	return "ruler " + *rulerURL
+}
+
+func (r *rulerSink) files() []string {
+	return r.globs
+}
+
+// current returns the rule groups the ruler has for the tenant, keyed by namespace and group name.
+func (r *rulerSink) current() (map[string]map[string]yaml.MapSlice, error) {
+	body, status, err := r.api.do(http.MethodGet, r.base, nil)
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string]map[string]yaml.MapSlice{}
+	if status == http.StatusNotFound {
+		return groups, nil
+	}
+
+	namespaces := map[string][]yaml.MapSlice{}
+	if err := yaml.Unmarshal(body, &namespaces); err != nil {
+		return nil, fmt.Errorf("unable to parse ruler response: %v", err)
+	}
+	for namespace, list := range namespaces {
+		groups[namespace] = indexGroups(list)
+	}
+	return groups, nil
+}
+
+func indexGroups(list []yaml.MapSlice) map[string]yaml.MapSlice {
+	groups := map[string]yaml.MapSlice{}
+	for _, group := range list {
+		for _, item := range group {
+			if item.Key == "name" {
+				groups[fmt.Sprint(item.Value)] = group
+			}
+		}
+	}
+	return groups
+}
+
+// sameGroup compares groups independent of key order and formatting.
+func sameGroup(a yaml.MapSlice, b yaml.MapSlice) bool {
+	var left, right interface{}
+	ab, _ := yaml.Marshal(a)
+	bb, _ := yaml.Marshal(b)
+	if yaml.Unmarshal(ab, &left) != nil || yaml.Unmarshal(bb, &right) != nil {
+		return false
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+func rulerNamespace(fileName string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(fileName, path.Ext(fileName)), ".rules")
+}
+
+func (r *rulerSink) write(logger *log.Entry, files []renderedFile) error {
+	desired := map[string]map[string]yaml.MapSlice{}
+	for _, file := range files {
+		parsed := struct {
+			Groups []yaml.MapSlice `yaml:"groups"`
+		}{}
+		if err := yaml.Unmarshal(file.content, &parsed); err != nil {
+			return fmt.Errorf("unable to parse %v: %v", file.name, err)
+		}
+		desired[rulerNamespace(file.name)] = indexGroups(parsed.Groups)
+	}
+
+	current, err := r.current()
+	if err != nil {
+		return err
+	}
+
+	created, updated, deleted := 0, 0, 0
+	for namespace, groups := range desired {
+		for name, group := range groups {
+			existing, ok := current[namespace][name]
+			if ok && sameGroup(existing, group) {
+				continue
+			}
+			body, err := yaml.Marshal(group)
+			if err != nil {
+				return err
+			}
+			if _, _, err := r.api.do(http.MethodPost, r.base+"/"+url.PathEscape(namespace), body); err != nil {
+				return err
+			}
+			if ok {
+				updated++
+			} else {
+				created++
+			}
+			logger.Debugf("Pushed rule group %v/%v to the ruler", namespace, name)
+		}
+	}
+
+	for namespace, groups := range current {
+		if _, managed := desired[namespace]; !managed {
+			if !*rulerDeleteNamespaces {
+				continue
+			}
+			if _, _, err := r.api.do(http.MethodDelete, r.base+"/"+url.PathEscape(namespace), nil); err != nil {
+				return err
+			}
+			deleted += len(groups)
+			logger.Debugf("Deleted ruler namespace %v", namespace)
+			continue
+		}
+		for name := range groups {
+			if _, ok := desired[namespace][name]; ok {
+				continue
+			}
+			if _, _, err := r.api.do(http.MethodDelete, r.base+"/"+url.PathEscape(namespace)+"/"+url.PathEscape(name), nil); err != nil {
+				return err
+			}
+			deleted++
+			logger.Debugf("Deleted rule group %v/%v from the ruler", namespace, name)
+		}
+	}
+
+	logger.Infof("Synchronized rules with the ruler: %d created, %d updated, %d deleted", created, updated, deleted)
+	return nil
+}
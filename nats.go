@@ -0,0 +1,211 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	natsURL            = flag.String("nats-url", "", "Comma separated NATS servers, as nats://host:4222 or tls://host:4222, tried in turn, used by --nats-subject and --nats-trigger-subject.")
+	natsSubject        = flag.String("nats-subject", "", "NATS subject an event is published to for every applied config generation. Events carry a Nats-Msg-Id header, so JetStream streams drop duplicates.")
+	natsTriggerSubject = flag.String("nats-trigger-subject", "", "NATS subject whose messages re-sync every source and re-render, as a POST to /trigger does. A message holding a pipeline name only re-renders that pipeline.")
+	natsTokenFile      = flag.String("nats-token-file", "", "File holding the token to authenticate to NATS with.")
+	natsUsername       = flag.String("nats-username", "", "User to authenticate to NATS with, along with --nats-password-file.")
+	natsPasswordFile   = flag.String("nats-password-file", "", "File holding the password of --nats-username.")
+	natsCAFile         = flag.String("nats-ca-file", "", "CA certificates the NATS server certificate is verified with, instead of the system roots.")
+	natsCertFile       = flag.String("nats-cert-file", "", "Client certificate presented to NATS servers that require TLS.")
+	natsKeyFile        = flag.String("nats-key-file", "", "Private key of --nats-cert-file.")
+)
+
+// natsClient connects to the --nats-url servers.
+type natsClient struct {
+	servers []string
+	tls     *tls.Config
+}
+
+func newNATSClient() (*natsClient, error) {
+	n := &natsClient{}
+	for _, server := range strings.Split(*natsURL, ",") {
+		if server = strings.TrimSpace(server); server == "" {
+			continue
+		}
+		u, err := url.Parse(server)
+		if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+			return nil, fmt.Errorf("--nats-url %q isn't of the form nats://host:port or tls://host:port", server)
+		}
+		n.servers = append(n.servers, server)
+	}
+	if len(n.servers) == 0 {
+		return nil, fmt.Errorf("--nats-url is empty")
+	}
+	tlsConfig, err := clientTLSConfig(*natsCAFile, *natsCertFile, *natsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("nats: %v", err)
+	}
+	n.tls = tlsConfig
+	return n, nil
+}
+
+func validNATSSubject(subject string) bool {
+	return subject != "" && !strings.ContainsAny(subject, " \t\r\n")
+}
+
+// connect connects to the first server that accepts the connection, reading the credentials
+// afresh so rotated ones are picked up. TLS is used for tls:// servers and servers that
+// require it.
+func (n *natsClient) connect(options ...nats.Option) (*nats.Conn, error) {
+	options = append(options,
+		nats.Name("prom-config-watcher"),
+		nats.Timeout(*reloadTimeout),
+		nats.DontRandomize(),
+		func(o *nats.Options) error {
+			o.TLSConfig = n.tls.Clone()
+			return nil
+		})
+	if *natsTokenFile != "" {
+		token, err := readSecretFile(*natsTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, nats.Token(token))
+	}
+	if *natsUsername != "" {
+		password, err := readSecretFile(*natsPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, nats.UserInfo(*natsUsername, password))
+	}
+	return nats.Connect(strings.Join(n.servers, ","), options...)
+}
+
+// natsPublisher publishes events to --nats-subject, keeping its connection between events and
+// connecting again once the client has given up reconnecting.
+type natsPublisher struct {
+	client *natsClient
+	conn   *nats.Conn
+}
+
+func configureNATS() (*natsPublisher, error) {
+	if *natsSubject == "" {
+		return nil, nil
+	}
+	if !validNATSSubject(*natsSubject) {
+		return nil, fmt.Errorf("--nats-subject %q isn't a valid subject", *natsSubject)
+	}
+	client, err := newNATSClient()
+	if err != nil {
+		return nil, err
+	}
+	return &natsPublisher{client: client}, nil
+}
+
+func (n *natsPublisher) name() string {
+	return "nats " + *natsSubject
+}
+
+// publish sends the event and flushes, so errors the server reports for it are returned.
+func (n *natsPublisher) publish(event *busEvent, payload []byte) error {
+	if n.conn == nil || n.conn.IsClosed() {
+		conn, err := n.client.connect()
+		if err != nil {
+			return err
+		}
+		n.conn = conn
+	}
+	message := nats.NewMsg(*natsSubject)
+	message.Data = payload
+	if n.conn.HeadersSupported() {
+		message.Header.Set(nats.MsgIdHdr, event.ID)
+	}
+	if err := n.conn.PublishMsg(message); err != nil {
+		return err
+	}
+	return n.conn.FlushTimeout(*reloadTimeout)
+}
+
+// natsTrigger subscribes to --nats-trigger-subject.
+type natsTrigger struct {
+	client *natsClient
+}
+
+func configureNATSTrigger() (*natsTrigger, error) {
+	if *natsTriggerSubject == "" {
+		return nil, nil
+	}
+	if !validNATSSubject(*natsTriggerSubject) {
+		return nil, fmt.Errorf("--nats-trigger-subject %q isn't a valid subject", *natsTriggerSubject)
+	}
+	client, err := newNATSClient()
+	if err != nil {
+		return nil, err
+	}
+	return &natsTrigger{client: client}, nil
+}
+
+func (n *natsTrigger) name() string {
+	return "nats " + *natsTriggerSubject
+}
+
+// subscribe delivers the payload of every message until the client gives up reconnecting.
+func (n *natsTrigger) subscribe(messages chan<- string) error {
+	closed := make(chan struct{})
+	conn, err := n.client.connect(nats.ClosedHandler(func(*nats.Conn) { close(closed) }))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	received := make(chan *nats.Msg, 64)
+	if _, err := conn.ChanSubscribe(*natsTriggerSubject, received); err != nil {
+		return err
+	}
+	if err := conn.FlushTimeout(*reloadTimeout); err != nil {
+		return err
+	}
+	log.Infof("Subscribed to NATS subject %v", *natsTriggerSubject)
+	for {
+		select {
+		case message := <-received:
+			if len(message.Data) > maxWebhookBody {
+				log.Warnf("Ignoring a %d byte message on NATS subject %v", len(message.Data), *natsTriggerSubject)
+				continue
+			}
+			messages <- string(message.Data)
+		case <-closed:
+			if err := conn.LastError(); err != nil {
+				return err
+			}
+			return fmt.Errorf("connection closed")
+		}
+	}
+}
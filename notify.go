@@ -0,0 +1,302 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxResponseBody limits how much of a failed reload response is captured for logging.
+const maxResponseBody = 4096
+
+var (
+	reloadTimeout       = flag.Duration("reload-timeout", 30*time.Second, "Maximum time to wait for Prometheus to respond to a reload request.")
+	reloadRetries       = flag.Int("reload-retries", 3, "Number of times a failed reload is retried before giving up until the next change.")
+	reloadRetryInterval = flag.Duration("reload-retry-interval", 5*time.Second, "Delay before the first retry of a failed reload. Doubles with each subsequent attempt.")
+	minReloadInterval   = flag.Duration("min-reload-interval", 0, "Minimum time between reloads sent to Prometheus, regardless of how often changes are processed.")
+
+	reloadClient *http.Client
+)
+
+// reloader sends reload requests to Prometheus from its own goroutine so a slow or failing
+// Prometheus can't stall the event loop. Requests made while a reload is in flight are
+// coalesced into a single follow up reload.
+type reloader struct {
+	steps      []*reloadStep
+	requests   chan struct{}
+	done       chan struct{}
+	lastReload time.Time
+	windows    []*maintenanceWindow
+	breaker    circuitBreaker
+	pager      *pager
+
+	// failedStep is the step that caused the last failure, probed while the breaker is open
+	failedStep *reloadStep
+
+	// sending is held while a reload sequence runs
+	sending sync.Mutex
+
+	mu        sync.Mutex
+	pending   changeSet
+	listeners []func(err error)
+	// changeListeners are also told which changes a reload covered
+	changeListeners []func(changes changeSet, err error)
+
+	// failures is the total number of failed reload attempts
+	failures uint64
+}
+
+func newReloader(steps []*reloadStep, windows []*maintenanceWindow) *reloader {
+	return &reloader{
+		steps:    steps,
+		requests: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		windows:  windows,
+		breaker:  circuitBreaker{threshold: *breakerThreshold},
+	}
+}
+
+// stop waits for a reload sequence in progress and prevents any more from starting. The
+// returned channel is closed once no reload is running.
+func (r *reloader) stop() <-chan struct{} {
+	close(r.done)
+	stopped := make(chan struct{})
+	go func() {
+		r.sending.Lock()
+		close(stopped)
+	}()
+	return stopped
+}
+
+// setSteps replaces the reload sequence, taking effect from the next reload.
+func (r *reloader) setSteps(steps []*reloadStep) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.steps = steps
+}
+
+func (r *reloader) currentSteps() []*reloadStep {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.steps
+}
+
+// onResult registers a function called with the outcome of every reload sequence.
+func (r *reloader) onResult(listener func(err error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeners = append(r.listeners, listener)
+}
+
+// onChangesReloaded registers a function called with the outcome of every reload sequence
+// and the changes it covered.
+func (r *reloader) onChangesReloaded(listener func(changes changeSet, err error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changeListeners = append(r.changeListeners, listener)
+}
+
+func (r *reloader) notifyListeners(changes changeSet, err error) {
+	r.mu.Lock()
+	listeners, changeListeners := r.listeners, r.changeListeners
+	r.mu.Unlock()
+	for _, listener := range listeners {
+		listener(err)
+	}
+	for _, listener := range changeListeners {
+		listener(changes, err)
+	}
+}
+
+// trigger requests a reload for the given changes without blocking the caller.
+func (r *reloader) trigger(changes changeSet) {
+	r.mu.Lock()
+	r.pending.merge(changes)
+	r.mu.Unlock()
+
+	select {
+	case r.requests <- struct{}{}:
+	default:
+		log.Debug("Reload already queued")
+	}
+}
+
+// take returns and clears the changes pending a reload.
+func (r *reloader) take() changeSet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changes := r.pending
+	r.pending = changeSet{}
+	return changes
+}
+
+// restore puts changes back after a failed reload so they are included in the next attempt.
+func (r *reloader) restore(changes changeSet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending.merge(changes)
+}
+
+func (r *reloader) run() {
+	// hold fires when a reload held back by the minimum interval or a maintenance window is due
+	var retry, probe, hold <-chan time.Time
+	attempt := 0
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.requests:
+			attempt = 0
+			if r.breaker.open {
+				// the reload that opened the breaker is still pending and covers this one
+				log.Debug("Circuit breaker is open, holding reload until Prometheus recovers")
+				continue
+			}
+			if hold != nil {
+				// the held reload is still pending and covers this one
+				continue
+			}
+		case <-hold:
+		case <-retry:
+		case <-probe:
+			if err := probeHealthy(r.failedStep); err != nil {
+				log.Debugf("Circuit breaker probe failed: %v", err)
+				probe = time.After(*breakerProbeInterval)
+				continue
+			}
+			log.Infof("%v is responding again, closing circuit breaker and sending pending reload", r.failedStep.name)
+			probe = nil
+			r.breaker.success()
+			r.breaker.alert(r.failedStep.url)
+			r.pager.resolve()
+		}
+		retry, hold = nil, nil
+
+		// hold the reload back if the last one was too recent, further requests are
+		// coalesced while waiting
+		if wait := time.Until(r.lastReload.Add(*minReloadInterval)); wait > 0 {
+			log.Debugf("Delaying reload by %v to honor the minimum reload interval", wait)
+			hold = time.After(wait)
+			continue
+		}
+
+		// config has already been written out, only the notification waits for the window to close
+		if until := deferredUntil(r.windows, time.Now()); !until.IsZero() {
+			log.Infof("In a maintenance window, deferring reload until %v", until.Format(time.RFC3339))
+			hold = time.After(time.Until(until))
+			continue
+		}
+		changes := r.take()
+		if changes.empty() {
+			continue
+		}
+		r.lastReload = time.Now()
+		r.sending.Lock()
+		ctx, span := startReloadSpan(changes.rollouts)
+		failed, err := runSteps(ctx, r.currentSteps(), changes)
+		endSpan(span, err)
+		r.sending.Unlock()
+		r.notifyListeners(changes, err)
+		if isDegraded(err) {
+			// the reload went through, retrying it won't make the service healthy
+			log.WithError(err).Warn("Reload sent, but a service is degraded")
+		}
+		if err == nil || isDegraded(err) {
+			attempt = 0
+			r.breaker.success()
+			r.pager.resolve()
+			if err == nil || !err.(*degradedError).stopped {
+				generations.applied(changes.generation)
+			}
+			if !changes.since.IsZero() {
+				changeToReload.Observe(time.Since(changes.since).Seconds())
+			}
+			continue
+		}
+		log.WithError(err).Error("Reload failed")
+		r.failedStep = failed
+		r.restore(changes)
+
+		failures := atomic.AddUint64(&r.failures, 1)
+		opened := r.breaker.failure(err)
+		if r.breaker.open || (r.breaker.threshold <= 0 && r.breaker.consecutive >= *pageAfterFailures) {
+			r.pager.trigger(failed.name, r.breaker.consecutive, err)
+		}
+		if opened {
+			log.Errorf("Reload failed %d times in a row, opening circuit breaker and probing every %v", r.breaker.consecutive, *breakerProbeInterval)
+			r.breaker.alert(failed.url)
+			attempt = 0
+			probe = time.After(*breakerProbeInterval)
+			continue
+		}
+		if attempt < *reloadRetries {
+			delay := *reloadRetryInterval << uint(attempt)
+			attempt++
+			log.Warnf("Reload failed (%d failures total), retrying in %v (attempt %d of %d)", failures, delay, attempt, *reloadRetries)
+			retry = time.After(delay)
+		} else {
+			log.Errorf("Reload failed after %d retries, waiting for the next change", attempt)
+			attempt = 0
+		}
+	}
+}
+
+func postReload(name string, url string, credentials *stepCredentials) error {
+	log.Debugf("Posting reload command to %v", name)
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err == nil {
+		req.Header.Set("Content-Type", "plain/text")
+		err = credentials.apply(req)
+	}
+	var resp *http.Response
+	if err == nil {
+		resp, err = reloadClient.Do(req)
+	}
+	if err != nil {
+		log.WithError(err).Errorf("Error posting reload command to %v", name)
+		audit.record(auditEntry{Action: "reload", Step: name, URL: url, Result: resultString(err), Error: err.Error()})
+		return err
+	}
+	defer resp.Body.Close()
+	log.Debugf("Status code %v", resp.StatusCode)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+		err = fmt.Errorf("reload returned status %v: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		log.WithError(err).Errorf("%v rejected reload", name)
+	}
+	audit.record(auditEntry{Action: "reload", Step: name, URL: url, StatusCode: resp.StatusCode, Result: resultString(err), Error: errorString(err)})
+	return err
+}
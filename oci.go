@@ -0,0 +1,331 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ociTitleAnnotation names the file a layer holds, as set by oras push.
+	ociTitleAnnotation = "org.opencontainers.image.title"
+	// ociUnpackAnnotation marks a layer holding a directory as a gzipped tarball.
+	ociUnpackAnnotation = "io.deis.oras.content.unpack"
+)
+
+var (
+	ociSource         = flag.String("oci-source", "", "OCI artifact, as registry/repository:tag or registry/repository@sha256:digest, whose files are written to --oci-source-dir. Layers are named by their org.opencontainers.image.title annotation, as oras push sets it, and directories pushed with oras are unpacked.")
+	ociSourceDir      = flag.String("oci-source-dir", "/var/lib/prom-config-watcher/oci", "Directory the files of --oci-source are written to.")
+	ociSourceInterval = flag.Duration("oci-source-interval", time.Minute, "How often the tag of --oci-source is checked for a new digest.")
+	ociUsername       = flag.String("oci-username", "", "User to log in to the registry of --oci-source as.")
+	ociPasswordFile   = flag.String("oci-password-file", "", "File holding the password or token of --oci-username.")
+	ociPlainHTTP      = flag.Bool("oci-plain-http", false, "Talk to the registry of --oci-source over plain HTTP, for local registries.")
+	ociCosignKey      = flag.String("oci-cosign-key", "", "Cosign public key the --oci-source artifact must be signed with. Every new digest is verified with cosign before it is unpacked.")
+)
+
+var ociAuthParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// ociSync pulls an artifact from a registry.
+type ociSync struct {
+	registry   string
+	repository string
+	// reference is a tag or digest
+	reference string
+	client    *http.Client
+	// token is the bearer token of the registry, if it asked for one
+	token string
+	// digest is the manifest digest that was written
+	digest string
+	mirror *sourceMirror
+}
+
+// ociDescriptor is a manifest entry pointing at a blob.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func configureOCISource() error {
+	if *ociSource == "" {
+		return nil
+	}
+	o, err := parseOCIReference(*ociSource)
+	if err != nil {
+		return err
+	}
+	o.client = newHTTPClient(*reloadTimeout)
+	mirror, err := addMirror("oci", *ociSource, *ociSourceDir, *ociSourceInterval, o.fetch)
+	if err != nil {
+		return err
+	}
+	o.mirror = mirror
+	return nil
+}
+
+// parseOCIReference splits a reference the way docker does, defaulting to Docker Hub and
+// the latest tag.
+func parseOCIReference(ref string) (*ociSync, error) {
+	o := &ociSync{registry: "registry-1.docker.io", reference: "latest"}
+	name := ref
+	if i := strings.Index(name, "/"); i > 0 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		o.registry, name = name[:i], name[i+1:]
+	} else if !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, o.reference = name[:i], name[i+1:]
+		if !strings.HasPrefix(o.reference, "sha256:") {
+			return nil, fmt.Errorf("--oci-source %q: only sha256 digests are supported", ref)
+		}
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, o.reference = name[:i], name[i+1:]
+	}
+	if name == "" || o.reference == "" {
+		return nil, fmt.Errorf("invalid --oci-source %q", ref)
+	}
+	o.repository = name
+	return o, nil
+}
+
+// fetch pulls the manifest and, if its digest changed, verifies and unpacks the artifact.
+func (o *ociSync) fetch() (bool, error) {
+	manifest, err := o.get("manifests/"+o.reference, "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json")
+	if err != nil {
+		return false, err
+	}
+	digest := "sha256:" + sha256Hex(manifest)
+	if strings.HasPrefix(o.reference, "sha256:") && digest != o.reference {
+		return false, fmt.Errorf("manifest has digest %v, not %v", digest, o.reference)
+	}
+	if digest == o.digest {
+		return false, nil
+	}
+	if *ociCosignKey != "" {
+		if err := o.verifySignature(digest); err != nil {
+			return false, err
+		}
+	}
+	parsed := struct {
+		Layers []ociDescriptor `json:"layers"`
+	}{}
+	if err := json.Unmarshal(manifest, &parsed); err != nil {
+		return false, fmt.Errorf("parsing manifest: %v", err)
+	}
+	files := map[string][]byte{}
+	for _, layer := range parsed.Layers {
+		title := layer.Annotations[ociTitleAnnotation]
+		if title == "" {
+			log.Debugf("Skipping layer %v of %v, it has no title", layer.Digest, *ociSource)
+			continue
+		}
+		blob, err := o.blob(layer)
+		if err != nil {
+			return false, err
+		}
+		if layer.Annotations[ociUnpackAnnotation] != "true" {
+			files[title] = blob
+			continue
+		}
+		unpacked, err := untarGzip(blob)
+		if err != nil {
+			return false, fmt.Errorf("unpacking %v: %v", title, err)
+		}
+		// oras tars the directory itself, so the names already start with the title
+		for name, content := range unpacked {
+			files[name] = content
+		}
+	}
+	changed, err := mirrorFiles(o.mirror.dir, files)
+	if err != nil {
+		return changed, err
+	}
+	previous := o.digest
+	o.digest = digest
+	log.Infof("Pulled %v of %v", digest, *ociSource)
+	audit.record(auditEntry{Action: "oci-pull", URL: *ociSource, OldHash: previous, NewHash: digest, Result: "ok"})
+	return changed, nil
+}
+
+// blob downloads a layer, checking it against its digest.
+func (o *ociSync) blob(layer ociDescriptor) ([]byte, error) {
+	if !strings.HasPrefix(layer.Digest, "sha256:") {
+		return nil, fmt.Errorf("layer digest %q isn't sha256", layer.Digest)
+	}
+	if layer.Size > maxSourceSize {
+		return nil, fmt.Errorf("layer %v is larger than %v bytes", layer.Digest, maxSourceSize)
+	}
+	blob, err := o.get("blobs/"+layer.Digest, "")
+	if err != nil {
+		return nil, err
+	}
+	if digest := "sha256:" + sha256Hex(blob); digest != layer.Digest {
+		return nil, fmt.Errorf("layer %v has digest %v", layer.Digest, digest)
+	}
+	return blob, nil
+}
+
+func (o *ociSync) verifySignature(digest string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	ref := o.registry + "/" + o.repository + "@" + digest
+	args := []string{"verify", "--key", *ociCosignKey}
+	if *ociPlainHTTP {
+		args = append(args, "--allow-http-registry")
+	}
+	out, err := exec.CommandContext(ctx, *cosignBinary, append(args, ref)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("signature verification of %v failed: %v: %s", ref, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// get fetches a path under the repository, logging in when the registry asks to.
+func (o *ociSync) get(p string, accept string) ([]byte, error) {
+	scheme := "https"
+	if *ociPlainHTTP {
+		scheme = "http"
+	}
+	u := fmt.Sprintf("%v://%v/v2/%v/%v", scheme, o.registry, o.repository, p)
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if o.token != "" {
+			req.Header.Set("Authorization", "Bearer "+o.token)
+		} else if err := o.basicAuth(req); err != nil {
+			return nil, err
+		}
+		resp, err := o.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if err := o.login(challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%v returned status %v", u, resp.StatusCode)
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSourceSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > maxSourceSize {
+			return nil, fmt.Errorf("%v is larger than %v bytes", u, maxSourceSize)
+		}
+		return body, nil
+	}
+}
+
+func (o *ociSync) basicAuth(req *http.Request) error {
+	if *ociUsername == "" {
+		return nil
+	}
+	password, err := readSecretFile(*ociPasswordFile)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(*ociUsername, password)
+	return nil
+}
+
+// login fetches a bearer token as the challenge of a 401 describes. Registries using basic
+// auth are sent the password with every request instead.
+func (o *ociSync) login(challenge string) error {
+	o.token = ""
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		if *ociUsername == "" {
+			return fmt.Errorf("registry %v needs credentials, set --oci-username", o.registry)
+		}
+		return nil
+	}
+	params := map[string]string{}
+	for _, match := range ociAuthParam.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+	if params["realm"] == "" {
+		return fmt.Errorf("registry %v sent a challenge without a realm: %v", o.registry, challenge)
+	}
+	query := url.Values{}
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + o.repository + ":pull"
+	}
+	query.Set("scope", scope)
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if err := o.basicAuth(req); err != nil {
+		return err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("logging in to %v: status %v", o.registry, resp.StatusCode)
+	}
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return fmt.Errorf("logging in to %v: %v", o.registry, err)
+	}
+	o.token = token.Token
+	if o.token == "" {
+		o.token = token.AccessToken
+	}
+	return nil
+}
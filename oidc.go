@@ -0,0 +1,315 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	oidcIssuerURL   = flag.String("oidc-issuer-url", "", "Issuer whose ID tokens are accepted as bearer tokens on the endpoints that trigger reloads or expose config, /trigger, /approve, /loglevel, /status and /debug/state.")
+	oidcAudience    = flag.String("oidc-audience", "", "Audience ID tokens must be issued for, required with --oidc-issuer-url as otherwise a token the issuer made for any client would be accepted.")
+	oidcGroupsClaim = flag.String("oidc-groups-claim", "groups", "Claim listing the groups of the caller.")
+
+	// oidcTriggerGroups may force re-renders, approve changes and change the log level
+	oidcTriggerGroups stringList
+	// oidcReadGroups may read the status and state of the watcher
+	oidcReadGroups stringList
+)
+
+func init() {
+	flag.Var(&oidcTriggerGroups, "oidc-trigger-group", "Group allowed to force a re-render, approve changes and change the log level. May be repeated, any authenticated caller is allowed when none are given.")
+	flag.Var(&oidcReadGroups, "oidc-read-group", "Group allowed to read /status and /debug/state. May be repeated, any authenticated caller is allowed when none are given.")
+}
+
+// oidc verifies ID tokens when --oidc-issuer-url is set, nil otherwise.
+var oidc *oidcVerifier
+
+// oidcVerifier checks the signature and claims of ID tokens against the issuer's published keys.
+type oidcVerifier struct {
+	issuer   string
+	audience string
+
+	mu        sync.Mutex
+	jwksURI   string
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func newOIDCVerifier() (*oidcVerifier, error) {
+	if *oidcAudience == "" {
+		return nil, fmt.Errorf("--oidc-issuer-url needs --oidc-audience")
+	}
+	return &oidcVerifier{issuer: strings.TrimSuffix(*oidcIssuerURL, "/"), audience: *oidcAudience}, nil
+}
+
+// key returns the issuer's key with id kid, fetching the keys again when it's unknown, as
+// happens after the issuer rotates them.
+func (o *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key, found := o.keys[kid]; found && time.Since(o.fetchedAt) < time.Hour {
+		return key, nil
+	}
+	// don't let tokens with made up key ids hammer the issuer
+	if time.Since(o.fetchedAt) < time.Minute {
+		if key, found := o.keys[kid]; found {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if err := o.fetchKeys(); err != nil {
+		return nil, err
+	}
+	key, found := o.keys[kid]
+	if !found {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (o *oidcVerifier) fetchKeys() error {
+	o.fetchedAt = time.Now()
+	if o.jwksURI == "" {
+		discovery := struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		if err := getJSON(o.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return fmt.Errorf("discovering the OIDC issuer: %v", err)
+		}
+		// a discovery document naming another issuer would have its keys trusted for ours
+		if strings.TrimSuffix(discovery.Issuer, "/") != o.issuer {
+			return fmt.Errorf("the OIDC discovery document is for issuer %q, not %v", discovery.Issuer, o.issuer)
+		}
+		if discovery.JWKSURI == "" {
+			return fmt.Errorf("the OIDC discovery document has no jwks_uri")
+		}
+		o.jwksURI = discovery.JWKSURI
+	}
+	jwks := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+	if err := getJSON(o.jwksURI, &jwks); err != nil {
+		return fmt.Errorf("fetching the OIDC issuer's keys: %v", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if curves[k.Crv] == nil || errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curves[k.Crv], X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	o.keys = keys
+	return nil
+}
+
+func getJSON(url string, out interface{}) error {
+	resp, err := reloadClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v returned status %v", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// verify checks an ID token, returning its claims.
+func (o *oidcVerifier) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	key, err := o.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWS(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims["iss"] != o.issuer {
+		return nil, fmt.Errorf("token was issued by %v", claims["iss"])
+	}
+	if !containsString(claimStrings(claims["aud"]), o.audience) {
+		return nil, fmt.Errorf("token is not for audience %v", o.audience)
+	}
+	now := float64(time.Now().Unix())
+	const leeway = 60
+	if exp, _ := claims["exp"].(float64); exp+leeway < now {
+		return nil, fmt.Errorf("token has expired")
+	}
+	if nbf, _ := claims["nbf"].(float64); nbf-leeway > now {
+		return nil, fmt.Errorf("token is not valid yet")
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("malformed token")
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("malformed token: %v", err)
+	}
+	return nil
+}
+
+// verifyJWS checks a signature made with one of the RS or ES algorithms.
+func verifyJWS(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if len(alg) != 5 || hashes[alg[2:]] == 0 {
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	hash := hashes[alg[2:]]
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			break
+		}
+		if rsa.VerifyPKCS1v15(pub, hash, digest, signature) != nil {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" || len(signature)%2 != 0 {
+			break
+		}
+		half := len(signature) / 2
+		r, s := new(big.Int).SetBytes(signature[:half]), new(big.Int).SetBytes(signature[half:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("signing algorithm %q doesn't match the key", alg)
+}
+
+// claimStrings reads a claim that may be a single string or a list of them.
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := []string{}
+		for _, v := range value {
+			if s, isString := v.(string); isString {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsString(values []string, want string) bool {
+	for _, value := range values {
+		if value == want {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate checks the request's ID token and that the caller is in one of groups, or any
+// caller when groups is empty, returning the subject, or the status to reply with when the
+// request isn't allowed.
+func (o *oidcVerifier) authenticate(r *http.Request, groups []string) (string, int) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	claims, err := o.verify(token)
+	if err != nil {
+		log.WithError(err).Debugf("Rejected %v request to %v", r.Method, r.URL.Path)
+		return "", http.StatusUnauthorized
+	}
+	if len(groups) > 0 {
+		allowed := false
+		for _, group := range claimStrings(claims[*oidcGroupsClaim]) {
+			allowed = allowed || containsString(groups, group)
+		}
+		if !allowed {
+			return "", http.StatusForbidden
+		}
+	}
+	subject, _ := claims["sub"].(string)
+	return subject, 0
+}
@@ -0,0 +1,215 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIssuer serves discovery and keys for tokens signed with an RSA and an EC key.
+type testIssuer struct {
+	server *httptest.Server
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	// discoveredIssuer is the issuer named by the discovery document, the server's URL if empty
+	discoveredIssuer string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{rsa: rsaKey, ec: ecKey}
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		name := issuer.discoveredIssuer
+		if name == "" {
+			name = issuer.server.URL
+		}
+		json.NewEncoder(w).Encode(map[string]string{"issuer": name, "jwks_uri": issuer.server.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kid": "rsa", "kty": "RSA", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kid": "ec", "kty": "EC", "crv": "P-256", "x": encode(ecKey.X.FillBytes(make([]byte, 32))), "y": encode(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	reloadClient = issuer.server.Client()
+	return issuer
+}
+
+// sign makes a token with the key named by kid, signed with alg.
+func (i *testIssuer) sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch kid {
+	case "ec":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, i.ec, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	default:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, i.rsa, crypto.SHA256, digest[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (i *testIssuer) claims(changes map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss": i.server.URL,
+		"aud": "watcher",
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range changes {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	return claims
+}
+
+func testVerifier(t *testing.T, issuer string, audience string) (*oidcVerifier, error) {
+	t.Helper()
+	previousIssuer, previousAudience := *oidcIssuerURL, *oidcAudience
+	t.Cleanup(func() { *oidcIssuerURL, *oidcAudience = previousIssuer, previousAudience })
+	*oidcIssuerURL, *oidcAudience = issuer, audience
+	return newOIDCVerifier()
+}
+
+func TestOIDCRequiresAudience(t *testing.T) {
+	if _, err := testVerifier(t, "https://issuer.example.com", ""); err == nil {
+		t.Fatal("expected a verifier without an audience to be refused")
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	issuer := newTestIssuer(t)
+	verifier, err := testVerifier(t, issuer.server.URL, "watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := issuer.sign(t, "RS256", "rsa", issuer.claims(nil))
+	tampered := strings.Split(valid, ".")
+	tampered[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"` + issuer.server.URL + `","aud":"watcher","sub":"mallory","exp":9999999999}`))
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"rsa", valid, true},
+		{"ec", issuer.sign(t, "ES256", "ec", issuer.claims(nil)), true},
+		{"audience list", issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"aud": []string{"other", "watcher"}})), true},
+		{"other audience", issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"aud": "other"})), false},
+		{"no audience", issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"aud": nil})), false},
+		{"other issuer", issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		{"expired", issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})), false},
+		{"no expiry", issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"exp": nil})), false},
+		{"not valid yet", issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})), false},
+		{"tampered claims", strings.Join(tampered, "."), false},
+		{"algorithm not matching the key", issuer.sign(t, "ES256", "rsa", issuer.claims(nil)), false},
+		{"unknown key", issuer.sign(t, "RS256", "other", issuer.claims(nil)), false},
+		{"unsigned", strings.Join(append(tampered[:2], ""), "."), false},
+		{"malformed", "not-a-token", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := verifier.verify(test.token)
+			if test.valid && err != nil {
+				t.Fatalf("expected the token to be accepted, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatalf("expected the token to be rejected, got claims %v", claims)
+			}
+		})
+	}
+}
+
+func TestOIDCRejectsMismatchedDiscoveryIssuer(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuer.discoveredIssuer = "https://evil.example.com"
+	verifier, err := testVerifier(t, issuer.server.URL, "watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.verify(issuer.sign(t, "RS256", "rsa", issuer.claims(nil))); err == nil {
+		t.Fatal("expected keys from a discovery document for another issuer to be refused")
+	}
+}
+
+func TestOIDCAuthenticateGroups(t *testing.T) {
+	issuer := newTestIssuer(t)
+	verifier, err := testVerifier(t, issuer.server.URL, "watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"groups": []string{"sre"}}))
+	request := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/trigger", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+	if subject, status := verifier.authenticate(request(token), []string{"sre"}); status != 0 || subject != "alice" {
+		t.Errorf("expected alice to be allowed, got status %v", status)
+	}
+	if _, status := verifier.authenticate(request(token), []string{"admins"}); status != http.StatusForbidden {
+		t.Errorf("expected a caller outside the groups to be forbidden, got status %v", status)
+	}
+	if _, status := verifier.authenticate(request(""), nil); status != http.StatusUnauthorized {
+		t.Errorf("expected a request without a token to be unauthorized, got status %v", status)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	pagerDutyKeyFile  = flag.String("pagerduty-routing-key-file", "", "File holding a PagerDuty Events API v2 routing key. Pages when reloads persistently fail and resolves on recovery.")
+	opsgenieKeyFile   = flag.String("opsgenie-api-key-file", "", "File holding an Opsgenie API key. Raises an alert when reloads persistently fail and closes it on recovery.")
+	opsgenieURL       = flag.String("opsgenie-api-url", "https://api.opsgenie.com", "Opsgenie API url, e.g. https://api.eu.opsgenie.com for EU accounts.")
+	pageAfterFailures = flag.Int("page-after-failures", 5, "Consecutive reload failures before paging when the circuit breaker is disabled. With --breaker-threshold set, paging happens when the breaker opens.")
+)
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagingBackend raises and resolves an incident in an alerting service, identified by a
+// key so repeated triggers and the resolve refer to the same incident.
+type pagingBackend interface {
+	name() string
+	trigger(key string, summary string, details map[string]string) error
+	resolve(key string) error
+}
+
+// pager raises a single incident while reloads are persistently failing. A nil pager does
+// nothing.
+type pager struct {
+	backends []pagingBackend
+	key      string
+
+	mu        sync.Mutex
+	triggered bool
+}
+
+func newPager() (*pager, error) {
+	host, _ := os.Hostname()
+	p := &pager{key: "prom-config-watcher/" + host}
+	if *pagerDutyKeyFile != "" {
+		key, err := readSecretFile(*pagerDutyKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		p.backends = append(p.backends, &pagerDuty{routingKey: key, source: host})
+	}
+	if *opsgenieKeyFile != "" {
+		key, err := readSecretFile(*opsgenieKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		p.backends = append(p.backends, &opsgenie{apiKey: key, api: strings.TrimSuffix(*opsgenieURL, "/"), source: host})
+	}
+	if len(p.backends) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func readSecretFile(name string) (string, error) {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// trigger pages once for a run of failures.
+func (p *pager) trigger(step string, failures int, err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.triggered {
+		return
+	}
+	summary := fmt.Sprintf("Config reloads to %v have failed %d times in a row", step, failures)
+	details := map[string]string{"step": step, "failures": fmt.Sprint(failures), "error": errorString(err)}
+	for _, backend := range p.backends {
+		if err := backend.trigger(p.key, summary, details); err != nil {
+			log.WithError(err).Errorf("Error paging via %v", backend.name())
+			continue
+		}
+		p.triggered = true
+	}
+}
+
+// resolve closes the incident once reloads succeed again.
+func (p *pager) resolve() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.triggered {
+		return
+	}
+	for _, backend := range p.backends {
+		if err := backend.resolve(p.key); err != nil {
+			log.WithError(err).Errorf("Error resolving page via %v", backend.name())
+		}
+	}
+	p.triggered = false
+}
+
+type pagerDuty struct {
+	routingKey string
+	source     string
+}
+
+func (d *pagerDuty) name() string {
+	return "PagerDuty"
+}
+
+func (d *pagerDuty) trigger(key string, summary string, details map[string]string) error {
+	return postPagingJSON(pagerDutyEventsURL, nil, map[string]interface{}{
+		"routing_key":  d.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    key,
+		"payload": map[string]interface{}{
+			"summary":        summary,
+			"source":         d.source,
+			"severity":       "critical",
+			"component":      "prom-config-watcher",
+			"custom_details": details,
+		},
+	})
+}
+
+func (d *pagerDuty) resolve(key string) error {
+	return postPagingJSON(pagerDutyEventsURL, nil, map[string]interface{}{
+		"routing_key":  d.routingKey,
+		"event_action": "resolve",
+		"dedup_key":    key,
+	})
+}
+
+type opsgenie struct {
+	apiKey string
+	api    string
+	source string
+}
+
+func (o *opsgenie) name() string {
+	return "Opsgenie"
+}
+
+func (o *opsgenie) headers() http.Header {
+	return http.Header{"Authorization": []string{"GenieKey " + o.apiKey}}
+}
+
+func (o *opsgenie) trigger(key string, summary string, details map[string]string) error {
+	return postPagingJSON(o.api+"/v2/alerts", o.headers(), map[string]interface{}{
+		"message":     summary,
+		"alias":       key,
+		"description": details["error"],
+		"details":     details,
+		"source":      o.source,
+		"priority":    "P1",
+	})
+}
+
+func (o *opsgenie) resolve(key string) error {
+	endpoint := fmt.Sprintf("%v/v2/alerts/%v/close?identifierType=alias", o.api, url.PathEscape(key))
+	return postPagingJSON(endpoint, o.headers(), map[string]interface{}{"source": o.source})
+}
+
+func postPagingJSON(endpoint string, headers http.Header, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := reloadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("status %v: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	umask         = flag.String("umask", "", "Umask, in octal, applied to every file and directory the watcher creates, such as 027. Inherited from the parent process when unset.")
+	targetDirMode = flag.String("target-dir-mode", "0755", "Mode, in octal, of the target path and its parents when the watcher has to create them. The umask still applies.")
+)
+
+func parseMode(name string, value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid --%v %q, expected an octal mode such as 0755", name, value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// processUmask is the umask in effect, for files whose mode is set explicitly.
+var processUmask os.FileMode
+
+// applyUmask sets the process umask from --umask.
+func applyUmask() error {
+	if *umask == "" {
+		// reading the umask means setting it, put the inherited one straight back
+		processUmask = os.FileMode(syscall.Umask(0))
+		syscall.Umask(int(processUmask))
+		return nil
+	}
+	mask, err := parseMode("umask", *umask)
+	if err != nil {
+		return err
+	}
+	syscall.Umask(int(mask))
+	processUmask = mask
+	return nil
+}
+
+// createTargets creates and locks the target paths of the pipelines at startup, so a path
+// that can't be created or is in use by another watcher is reported straight away.
+func createTargets(pipelines []*pipeline) {
+	if *dryRun {
+		return
+	}
+	for _, pipe := range pipelines {
+		if err := ensureDir(pipe.targetPath); err != nil {
+			log.Fatalf("Unable to create the target path of pipeline %v: %v", pipe.name, err)
+		}
+		if err := lockTarget(pipe.targetPath); err != nil {
+			log.Fatalf("Unable to lock the target path of pipeline %v: %v", pipe.name, err)
+		}
+	}
+}
+
+// ensureDir creates dir and its parents with --target-dir-mode if they don't exist.
+func ensureDir(dir string) error {
+	mode, err := parseMode("target-dir-mode", *targetDirMode)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return fmt.Errorf("creating %v: %v", dir, err)
+	}
+	return nil
+}
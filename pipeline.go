@@ -0,0 +1,123 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// pipeline renders the files in a watched path, validates them and delivers them to its sinks.
+type pipeline struct {
+	name       string
+	watchPath  string
+	targetPath string
+	expandVars bool
+	reloadOn   []string
+	validators []validator
+	sinks      []sink
+}
+
+// validationError is returned by a run whose files failed to render or validate, in which
+// case nothing was written.
+type validationError struct {
+	err error
+}
+
+func (v *validationError) Error() string {
+	return v.err.Error()
+}
+
+// logger returns the logger for a run of the pipeline.
+func (p *pipeline) logger(runID string) *log.Entry {
+	return log.WithFields(log.Fields{"pipeline": p.name, "run_id": runID})
+}
+
+// process runs the pipeline once, returning the rendered files. Each stage is traced as a
+// child of the span in ctx.
+func (p *pipeline) process(ctx context.Context, runID string) ([]renderedFile, error) {
+	logger := p.logger(runID)
+	start := time.Now()
+
+	sources := readSources(logger, p.watchPath)
+	if err := verifySourceSignature(p.watchPath, sources); err != nil {
+		logger.WithError(err).Error("Refusing to apply config that failed signature verification")
+		audit.record(auditEntry{Action: "verify-signature", Pipeline: p.name, RunID: runID, Result: resultString(err), Error: err.Error()})
+		board.runFinished(p, runID, nil, false, err)
+		return nil, &validationError{err: err}
+	}
+
+	_, span := tracer.Start(ctx, "render", trace.WithAttributes(attribute.String("pipeline", p.name), attribute.String("run_id", runID)))
+	phaseStart := time.Now()
+	rendered, err := renderSources(logger, sources, p.expandVars, nil)
+	phaseDuration.WithLabelValues("render").Observe(time.Since(phaseStart).Seconds())
+	span.SetAttributes(attribute.Int("files", len(rendered)))
+	endSpan(span, err)
+	if err != nil {
+		logger.WithError(err).Error("Rendering failed, not applying config")
+		audit.record(auditEntry{Action: "render", Pipeline: p.name, RunID: runID, Result: resultString(err), Error: err.Error()})
+		board.runFinished(p, runID, rendered, false, err)
+		return rendered, &validationError{err: err}
+	}
+	audit.rendered(p.name, runID, rendered)
+
+	_, span = tracer.Start(ctx, "validate")
+	phaseStart = time.Now()
+	err = validateFiles(logger, p.targetPath, rendered, p.validators)
+	phaseDuration.WithLabelValues("validate").Observe(time.Since(phaseStart).Seconds())
+	if err == nil {
+		err = checkSecretLeaks(logger, p.targetPath, rendered)
+	}
+	endSpan(span, err)
+	audit.record(auditEntry{Action: "validate", Pipeline: p.name, RunID: runID, Result: resultString(err), Error: errorString(err)})
+	if err != nil {
+		logger.WithError(err).Error("Validation failed, not applying config")
+		board.runFinished(p, runID, rendered, false, err)
+		return rendered, &validationError{err: err}
+	}
+	if !approvals.check(logger, p.name, rendered) {
+		return rendered, errAwaitingApproval
+	}
+
+	_, span = tracer.Start(ctx, "write")
+	phaseStart = time.Now()
+	if *dryRun {
+		err = planSinks(logger, p.sinks, rendered)
+	} else {
+		err = writeSinks(logger, p.sinks, rendered)
+	}
+	phaseDuration.WithLabelValues("write").Observe(time.Since(phaseStart).Seconds())
+	endSpan(span, err)
+	board.runFinished(p, runID, rendered, true, err)
+
+	elapsed := time.Since(start)
+	processingDuration.Observe(elapsed.Seconds())
+	logger.WithField("duration", elapsed.Seconds()).Debugf("Processed %d files", len(rendered))
+	return rendered, err
+}
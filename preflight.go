@@ -0,0 +1,108 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// credentialFileSuffixes identify the flags naming files the watcher reads credentials or
+// certificates from.
+var credentialFileSuffixes = []string{"-token-file", "-key-file", "-identity-file", "-password-file", "-cert-file", "-ca-file"}
+
+// preflight checks the configuration before the first run, exiting with every problem found
+// rather than leaving them to surface as errors logged on each run.
+func preflight(pipelines []*pipeline, steps []*reloadStep) {
+	problems := []string{}
+	for _, pipe := range pipelines {
+		if _, err := os.Stat(pipe.watchPath); err != nil {
+			problems = append(problems, fmt.Sprintf("pipeline %v: watch path: %v", pipe.name, err))
+		}
+		if *dryRun {
+			continue
+		}
+		if err := checkWritable(pipe.targetPath); err != nil {
+			problems = append(problems, fmt.Sprintf("pipeline %v: target path %v is not writable: %v", pipe.name, pipe.targetPath, err))
+		}
+	}
+	for _, step := range steps {
+		urls := append([]string{step.url}, step.health...)
+		for _, u := range urls {
+			if u == "" {
+				continue
+			}
+			if err := checkURL(u); err != nil {
+				problems = append(problems, fmt.Sprintf("reload step %v: %v", step.name, err))
+			}
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() == "" {
+			return
+		}
+		for _, suffix := range credentialFileSuffixes {
+			if strings.HasSuffix(f.Name, suffix) {
+				if _, err := ioutil.ReadFile(f.Value.String()); err != nil {
+					problems = append(problems, fmt.Sprintf("--%v: %v", f.Name, err))
+				}
+			}
+		}
+	})
+
+	if len(problems) == 0 {
+		return
+	}
+	for _, problem := range problems {
+		log.Error(problem)
+	}
+	log.Fatalf("Found %d problems with the configuration, exiting", len(problems))
+}
+
+func checkWritable(dir string) error {
+	probe, err := ioutil.TempFile(dir, ".preflight")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+func checkURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("malformed url %q: %v", raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("malformed url %q: expected an absolute http or https url", raw)
+	}
+	return nil
+}
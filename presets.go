@@ -0,0 +1,170 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var mode = flag.String("mode", "prometheus", "Service whose config is being watched, which sets the default reload url and validation. One of "+strings.Join(presetNames(), ", ")+".")
+
+// preset holds the defaults for a known service that can be notified of config changes.
+type preset struct {
+	// url is the default reload endpoint
+	url string
+	// health overrides the health check urls derived from the reload url
+	health []string
+	// files are the config files the service cares about when it shares a watched volume
+	files      []string
+	validators []validator
+	// noReload is set for services that pick up changed files on their own
+	noReload bool
+}
+
+var presets = map[string]preset{
+	"prometheus": {
+		url: "http://localhost:9090/-/reload",
+	},
+	"alertmanager": {
+		url:   "http://localhost:9093/-/reload",
+		files: []string{"alertmanager*.yml", "alertmanager*.yaml", "*.tmpl"},
+		validators: []validator{{
+			name:           "alertmanager",
+			files:          []string{"alertmanager*.yml", "alertmanager*.yaml"},
+			validateStaged: validateAlertmanagerConfig,
+		}},
+	},
+	// thanos rule loads every file matched by its --rule-file globs on reload
+	"thanos-rule": {
+		url:   "http://localhost:10902/-/reload",
+		files: []string{"*.rules.yml", "*.rules.yaml"},
+		validators: []validator{{
+			name:     "thanos-rule",
+			validate: ruleValidator(thanosRules),
+		}},
+	},
+	// thanos query watches its --store.sd-files itself, so only the files are checked and
+	// verification (if enabled) confirms query stays healthy
+	"thanos-query": {
+		url:      "http://localhost:10902/-/reload",
+		files:    []string{"*.json", "*.yml", "*.yaml"},
+		noReload: true,
+		validators: []validator{{
+			name:     "thanos-query-sd",
+			files:    []string{"*.json", "*.yml", "*.yaml"},
+			validate: validateFileSD,
+		}},
+	},
+	// vmagent reloads -promscrape.config on /-/reload or SIGHUP, use signal=HUP,process=vmagent
+	// on the step to reload by signal
+	"vmagent": {
+		url:    "http://localhost:8429/-/reload",
+		health: []string{"http://localhost:8429/health"},
+	},
+	// vmalert reloads its -rule files on /-/reload or SIGHUP
+	"vmalert": {
+		url:    "http://localhost:8880/-/reload",
+		health: []string{"http://localhost:8880/health"},
+		files:  []string{"*.rules.yml", "*.rules.yaml"},
+		validators: []validator{{
+			name:     "vmalert",
+			validate: ruleValidator(vmalertRules),
+		}},
+	},
+	// grafana agent in static mode
+	"grafana-agent": {
+		url:   "http://localhost:12345/-/reload",
+		files: []string{"agent*.yml", "agent*.yaml"},
+		validators: []validator{{
+			name:     "grafana-agent",
+			validate: validateAgentStatic,
+		}},
+	},
+	// grafana alloy, and grafana agent in flow mode, which share the river syntax
+	"alloy": {
+		url:   "http://localhost:12345/-/reload",
+		files: []string{"*.alloy", "*.river"},
+		validators: []validator{{
+			name:     "alloy",
+			files:    []string{"*.alloy", "*.river"},
+			validate: validateRiver,
+		}},
+	},
+	// the exporters' globs match their default config names, and blackbox's the common
+	// modules.yml too. An snmp.yml kept as modules.yml needs files= on the step, which
+	// replaces the globs for both the reload and the validator, and only one of the
+	// exporters can claim it.
+	"blackbox-exporter": {
+		url:   "http://localhost:9115/-/reload",
+		files: []string{"blackbox*.yml", "blackbox*.yaml", "modules.yml", "modules.yaml"},
+		validators: []validator{{
+			name:     "blackbox-exporter",
+			validate: validateBlackboxConfig,
+		}},
+	},
+	"snmp-exporter": {
+		url:   "http://localhost:9116/-/reload",
+		files: []string{"snmp*.yml", "snmp*.yaml"},
+		validators: []validator{{
+			name:     "snmp-exporter",
+			validate: validateSNMPConfig,
+		}},
+	},
+}
+
+func presetNames() []string {
+	names := []string{}
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupPreset(name string) (preset, error) {
+	p, ok := presets[name]
+	if !ok {
+		return preset{}, fmt.Errorf("unknown preset %q, expected one of %v", name, strings.Join(presetNames(), ", "))
+	}
+	return p, nil
+}
+
+// apply fills in any settings on the step that weren't given explicitly.
+func (p preset) apply(step *reloadStep) {
+	if step.url == "" {
+		step.url = p.url
+	}
+	if len(step.health) == 0 {
+		step.health = p.health
+	}
+	if len(step.files) == 0 {
+		step.files = p.files
+	}
+	step.validators = p.validators
+	step.noReload = p.noReload
+}
@@ -0,0 +1,142 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	runAsUser      = flag.String("run-as-user", "", "User, by name or uid, to switch to once the listener is bound, logs opened and target paths created and locked.")
+	runAsGroup     = flag.String("run-as-group", "", "Group, by name or gid, to switch to along with --run-as-user. Defaults to the user's primary group.")
+	readOnlySource = flag.Bool("read-only-source", false, "Refuse to run if a watch path can be written to by the watcher, or overlaps a target path, so it can't be made to modify its source volume.")
+)
+
+// dropPrivileges switches to --run-as-user and --run-as-group, clearing supplementary groups.
+func dropPrivileges() error {
+	if *runAsUser == "" && *runAsGroup == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if *runAsUser != "" {
+		u, err := lookupUser(*runAsUser)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if *runAsGroup != "" {
+		g, err := lookupGroup(*runAsGroup)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	// the group has to change first, while the process is still allowed to
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("clearing supplementary groups: %v", err)
+	}
+	if gid >= 0 {
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("switching to gid %d: %v", gid, err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("switching to uid %d: %v", uid, err)
+		}
+	}
+	log.Infof("Running as uid %d, gid %d", syscall.Getuid(), syscall.Getgid())
+	return nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		// a uid with no passwd entry, as is common in containers
+		return &user.User{Uid: name, Gid: name}, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %q: %v", name, err)
+	}
+	return u, nil
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return &user.Group{Gid: name}, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown group %q: %v", name, err)
+	}
+	return g, nil
+}
+
+// checkReadOnlySources enforces --read-only-source for the pipelines.
+func checkReadOnlySources(pipelines []*pipeline) error {
+	if !*readOnlySource {
+		return nil
+	}
+	for _, pipe := range pipelines {
+		source, target := filepath.Clean(pipe.watchPath), filepath.Clean(pipe.targetPath)
+		if within(target, source) || within(source, target) {
+			return fmt.Errorf("pipeline %v: the target path %v overlaps the watch path %v", pipe.name, target, source)
+		}
+		// W_OK, access checks against the real uid which is the one dropped to
+		if err := syscall.Access(source, 2); err == nil {
+			return fmt.Errorf("pipeline %v: the watch path %v is writable, mount it read-only or change its permissions", pipe.name, source)
+		}
+	}
+	return nil
+}
+
+// within reports whether path is dir or inside it.
+func within(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// harden drops privileges and then checks the sources can't be modified.
+func harden(pipelines []*pipeline) {
+	if err := dropPrivileges(); err != nil {
+		log.Fatalf("Unable to drop privileges: %v", err)
+	}
+	if err := checkReadOnlySources(pipelines); err != nil {
+		log.Fatal(err)
+	}
+}
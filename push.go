@@ -0,0 +1,311 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	pushDir       = flag.String("push-dir", "", "Directory config pushed to /api/v1/files/ and /api/v1/bundle is written to, once every pipeline watching it has validated it. Point --watch-path or the pipelines' watch paths at it.")
+	pushTokenFile = flag.String("push-token-file", "", "File holding a bearer token that pushes to --push-dir must carry. One of it or --oidc-issuer-url is needed to accept pushes.")
+)
+
+// pushRequest asks the watch loop for the pipelines watching the push directory.
+type pushRequest struct {
+	reply chan []*pipeline
+}
+
+// pushAPI accepts config pushed over HTTP, staging it through validation before it replaces
+// the content of the push directory.
+type pushAPI struct {
+	dir      string
+	requests chan<- pushRequest
+	// lock serializes pushes, each staging a copy of the directory
+	lock sync.Mutex
+}
+
+// newPushAPI returns nil when --push-dir isn't set.
+func newPushAPI(requests chan<- pushRequest) (*pushAPI, error) {
+	if *pushDir == "" {
+		return nil, nil
+	}
+	dir, err := filepath.Abs(*pushDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &pushAPI{dir: dir, requests: requests}, nil
+}
+
+// filesHandler writes a single file on PUT /api/v1/files/{path} and removes it on DELETE.
+func (p *pushAPI) filesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/v1/files/")
+		if !validPushPath(name) {
+			http.Error(w, fmt.Sprintf("invalid file path %q", name), http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			content, err := readPushBody(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			p.respond(w, r, "push-file", name, func(files map[string][]byte) error {
+				files[name] = content
+				return nil
+			})
+		case http.MethodDelete:
+			p.respond(w, r, "delete-file", name, func(files map[string][]byte) error {
+				if _, ok := files[name]; !ok {
+					return errPushNotFound
+				}
+				delete(files, name)
+				return nil
+			})
+		default:
+			w.Header().Set("Allow", "PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// bundleHandler replaces the whole push directory with a .tar.gz or .zip bundle on POST.
+func (p *pushAPI) bundleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		content, err := readPushBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		bundle, err := readPushBundle(content)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.respond(w, r, "push-bundle", "", replaceWith(bundle))
+	}
+}
+
+// respond applies a push made over HTTP and replies with its outcome.
+func (p *pushAPI) respond(w http.ResponseWriter, r *http.Request, action string, file string, change func(files map[string][]byte) error) {
+	_, changed, err := p.apply(requester(r), action, file, change)
+	if err != nil {
+		_, invalid := err.(*validationError)
+		status := http.StatusInternalServerError
+		switch {
+		case invalid:
+			status = http.StatusUnprocessableEntity
+		case err == errPushNotFound:
+			status = http.StatusNotFound
+		case err == errNoPushPipelines:
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if !changed {
+		fmt.Fprintln(w, "unchanged")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "accepted")
+}
+
+var (
+	errPushNotFound    = fmt.Errorf("no such file")
+	errNoPushPipelines = fmt.Errorf("no pipeline watches the push directory")
+)
+
+// apply applies change to a copy of the push directory, validates it with every pipeline
+// watching the directory and then writes it out, forcing those pipelines to run. It returns
+// the pipelines and whether any file changed. Config failing validation is returned as a
+// *validationError.
+func (p *pushAPI) apply(user string, action string, file string, change func(files map[string][]byte) error) ([]*pipeline, bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	logger := log.WithFields(log.Fields{"action": action, "user": user})
+	if file != "" {
+		logger = logger.WithField("file", file)
+	}
+	entry := auditEntry{Action: action, File: file, User: user}
+
+	files, err := readTree(p.dir)
+	if err == nil {
+		err = change(files)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	request := pushRequest{reply: make(chan []*pipeline, 1)}
+	p.requests <- request
+	pipelines := <-request.reply
+	if len(pipelines) == 0 {
+		return nil, false, errNoPushPipelines
+	}
+	if err := p.stage(logger, pipelines, files); err != nil {
+		logger.WithError(err).Warn("Rejected pushed config")
+		entry.Result, entry.Error = "invalid", err.Error()
+		audit.record(entry)
+		return pipelines, false, &validationError{err: err}
+	}
+	changed, err := mirrorFiles(p.dir, files)
+	if err != nil {
+		logger.WithError(err).Error("Unable to write pushed config")
+		return pipelines, changed, err
+	}
+	entry.Result = "ok"
+	audit.record(entry)
+	if changed {
+		logger.Info("Accepted pushed config")
+		mirrorUpdates <- &sourceMirror{kind: "push", name: "Pushed config", dir: p.dir}
+	}
+	return pipelines, changed, nil
+}
+
+// stage writes files to a scratch copy of the push directory and runs each pipeline's checks
+// over its part of it.
+func (p *pushAPI) stage(logger *log.Entry, pipelines []*pipeline, files map[string][]byte) error {
+	scratch, err := ioutil.TempDir("", "prom-config-watcher-push-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+	if _, err := mirrorFiles(scratch, files); err != nil {
+		return err
+	}
+	for _, pipe := range pipelines {
+		rel, err := filepath.Rel(p.dir, filepath.Clean(pipe.watchPath))
+		if err != nil {
+			return err
+		}
+		staged := filepath.Join(scratch, rel)
+		if _, err := os.Stat(staged); err != nil {
+			return fmt.Errorf("pipeline %v: %v is missing", pipe.name, rel)
+		}
+		sources := readSources(logger, staged)
+		if err := verifySourceSignature(staged, sources); err != nil {
+			return fmt.Errorf("pipeline %v: %v", pipe.name, err)
+		}
+		rendered, err := renderSources(logger, sources, pipe.expandVars, nil)
+		if err == nil {
+			err = validateFiles(logger, pipe.targetPath, rendered, pipe.validators)
+		}
+		if err == nil {
+			err = checkSecretLeaks(logger, pipe.targetPath, rendered)
+		}
+		if err != nil {
+			return fmt.Errorf("pipeline %v: %v", pipe.name, err)
+		}
+	}
+	return nil
+}
+
+// readTree reads the files under dir by their slash separated path relative to it.
+func readTree(dir string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || isAtomicWriteTemp(info.Name()) {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = content
+		return nil
+	})
+	return files, err
+}
+
+func readPushBody(r *http.Request) ([]byte, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSourceSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxSourceSize {
+		return nil, fmt.Errorf("larger than %v bytes", maxSourceSize)
+	}
+	return content, nil
+}
+
+func validPushPath(name string) bool {
+	return safeRelativePath(name) && !strings.HasSuffix(name, "/")
+}
+
+// readPushBundle reads a pushed .tar.gz or .zip bundle, telling them apart by content.
+func readPushBundle(content []byte) (map[string][]byte, error) {
+	var bundle map[string][]byte
+	var err error
+	switch {
+	case bytes.HasPrefix(content, []byte("PK\x03\x04")):
+		bundle, err = unzip(content)
+	case bytes.HasPrefix(content, []byte{0x1f, 0x8b}):
+		bundle, err = untarGzip(content)
+	default:
+		err = fmt.Errorf("expected a .tar.gz or .zip bundle")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle: %v", err)
+	}
+	return bundle, nil
+}
+
+// replaceWith is a change replacing every file with those of a bundle.
+func replaceWith(bundle map[string][]byte) func(files map[string][]byte) error {
+	return func(files map[string][]byte) error {
+		for name := range files {
+			delete(files, name)
+		}
+		for name, content := range bundle {
+			files[name] = content
+		}
+		return nil
+	}
+}
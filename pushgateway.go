@@ -0,0 +1,163 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	pushgatewayURL      = flag.String("pushgateway-url", "", "Url of a Pushgateway to publish processing and reload metrics to after each run.")
+	pushgatewayJob      = flag.String("pushgateway-job", "prom-config-watcher", "Job label used for metrics pushed to the Pushgateway.")
+	pushgatewayInstance = flag.String("pushgateway-instance", "", "Instance label used for metrics pushed to the Pushgateway. Defaults to the hostname.")
+)
+
+// pushgatewayPublisher keeps the latest run and reload outcome and pushes them as a group,
+// replacing the previous values on every push. Pushes are sent one at a time by a single
+// goroutine, so they can't be reordered, and the pipeline loop never waits on one.
+type pushgatewayPublisher struct {
+	endpoint string
+	// wake asks for the latest values to be pushed, coalescing requests made during a push
+	wake chan struct{}
+
+	mu                 sync.Mutex
+	lastRun            time.Time
+	lastSuccess        time.Time
+	filesProcessed     int
+	runSuccess         bool
+	lastReload         time.Time
+	reloadSuccess      bool
+	lastReloadRecorded bool
+}
+
+func newPushgatewayPublisher() *pushgatewayPublisher {
+	instance := *pushgatewayInstance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	endpoint := fmt.Sprintf("%v/metrics/job/%v/instance/%v", *pushgatewayURL, url.PathEscape(*pushgatewayJob), url.PathEscape(instance))
+	p := &pushgatewayPublisher{endpoint: endpoint, wake: make(chan struct{}, 1)}
+	go p.run()
+	return p
+}
+
+// runFinished records a processing run. A nil publisher does nothing.
+func (p *pushgatewayPublisher) runFinished(rendered []renderedFile, err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.lastRun = time.Now()
+	p.filesProcessed = len(rendered)
+	p.runSuccess = err == nil
+	if err == nil {
+		p.lastSuccess = p.lastRun
+	}
+	p.mu.Unlock()
+	p.requestPush()
+}
+
+// reloadFinished records the outcome of a reload sequence.
+func (p *pushgatewayPublisher) reloadFinished(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.lastReload = time.Now()
+	p.reloadSuccess = err == nil
+	p.lastReloadRecorded = true
+	p.mu.Unlock()
+	p.requestPush()
+}
+
+func (p *pushgatewayPublisher) requestPush() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *pushgatewayPublisher) run() {
+	for range p.wake {
+		p.push(p.snapshot())
+	}
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+// snapshot renders the latest values in the text exposition format.
+func (p *pushgatewayPublisher) snapshot() *bytes.Buffer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	body := &bytes.Buffer{}
+	fmt.Fprintf(body, "# TYPE prom_config_watcher_last_run_timestamp_seconds gauge\nprom_config_watcher_last_run_timestamp_seconds %f\n", unixSeconds(p.lastRun))
+	fmt.Fprintf(body, "# TYPE prom_config_watcher_last_success_timestamp_seconds gauge\nprom_config_watcher_last_success_timestamp_seconds %f\n", unixSeconds(p.lastSuccess))
+	fmt.Fprintf(body, "# TYPE prom_config_watcher_last_run_success gauge\nprom_config_watcher_last_run_success %d\n", boolValue(p.runSuccess))
+	fmt.Fprintf(body, "# TYPE prom_config_watcher_files_processed gauge\nprom_config_watcher_files_processed %d\n", p.filesProcessed)
+	if p.lastReloadRecorded {
+		fmt.Fprintf(body, "# TYPE prom_config_watcher_last_reload_timestamp_seconds gauge\nprom_config_watcher_last_reload_timestamp_seconds %f\n", unixSeconds(p.lastReload))
+		fmt.Fprintf(body, "# TYPE prom_config_watcher_last_reload_success gauge\nprom_config_watcher_last_reload_success %d\n", boolValue(p.reloadSuccess))
+	}
+	return body
+}
+
+func (p *pushgatewayPublisher) push(body *bytes.Buffer) {
+	req, err := http.NewRequest(http.MethodPut, p.endpoint, body)
+	if err != nil {
+		log.WithError(err).Error("Error creating Pushgateway request")
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := reloadClient.Do(req)
+	if err != nil {
+		log.WithError(err).Error("Error pushing metrics to the Pushgateway")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Errorf("Pushgateway returned status %v", resp.StatusCode)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	redisURL            = flag.String("redis-url", "redis://127.0.0.1:6379", "Redis server --redis-trigger-channel is subscribed on, as redis://host:port, or rediss://host:port for TLS.")
+	redisTriggerChannel = flag.String("redis-trigger-channel", "", "Redis channel whose messages re-sync every source and re-render, as a POST to /trigger does. A message holding a pipeline name only re-renders that pipeline.")
+	redisUsername       = flag.String("redis-username", "", "ACL user to authenticate to Redis with, along with --redis-password-file.")
+	redisPasswordFile   = flag.String("redis-password-file", "", "File holding the password to authenticate to Redis with.")
+	redisCAFile         = flag.String("redis-ca-file", "", "CA certificates the Redis server certificate is verified with, instead of the system roots.")
+)
+
+// redisTrigger subscribes to --redis-trigger-channel.
+type redisTrigger struct {
+	options *redis.Options
+}
+
+func configureRedisTrigger() (*redisTrigger, error) {
+	if *redisTriggerChannel == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(*redisURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Hostname() == "" {
+		return nil, fmt.Errorf("--redis-url %q isn't of the form redis://host:port or rediss://host:port", *redisURL)
+	}
+	options, err := redis.ParseURL(*redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("--redis-url: %v", err)
+	}
+	if options.TLSConfig != nil {
+		if options.TLSConfig, err = clientTLSConfig(*redisCAFile, "", ""); err != nil {
+			return nil, fmt.Errorf("redis: %v", err)
+		}
+		options.TLSConfig.ServerName = u.Hostname()
+	}
+	options.DialTimeout = *reloadTimeout
+	options.ReadTimeout = *reloadTimeout
+	options.WriteTimeout = *reloadTimeout
+	redis.SetLogger(redisLogger{})
+	return &redisTrigger{options: options}, nil
+}
+
+func (r *redisTrigger) name() string {
+	return "redis " + *redisTriggerChannel
+}
+
+// subscribe delivers the payload of every message until the connection fails. Subscribed
+// connections are quiet, so a dead server is noticed by TCP keepalives.
+func (r *redisTrigger) subscribe(messages chan<- string) error {
+	options := *r.options
+	if options.TLSConfig != nil {
+		options.TLSConfig = options.TLSConfig.Clone()
+	}
+	// the password is read afresh so a rotated one is picked up when subscribing again
+	if *redisPasswordFile != "" {
+		password, err := readSecretFile(*redisPasswordFile)
+		if err != nil {
+			return err
+		}
+		options.Username, options.Password = *redisUsername, password
+	}
+	client := redis.NewClient(&options)
+	defer client.Close()
+
+	ctx := context.Background()
+	subscription := client.Subscribe(ctx, *redisTriggerChannel)
+	defer subscription.Close()
+	// the first reply confirms the subscription, or carries the error connecting
+	if _, err := subscription.ReceiveTimeout(ctx, *reloadTimeout); err != nil {
+		return err
+	}
+	log.Infof("Subscribed to Redis channel %v", *redisTriggerChannel)
+	for {
+		message, err := subscription.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		if len(message.Payload) > maxWebhookBody {
+			log.Warnf("Ignoring a %d byte message on Redis channel %v", len(message.Payload), *redisTriggerChannel)
+			continue
+		}
+		messages <- message.Payload
+	}
+}
+
+// redisLogger sends the Redis client's connection messages to the debug log.
+type redisLogger struct{}
+
+func (redisLogger) Printf(ctx context.Context, format string, args ...interface{}) {
+	log.Debugf("Redis: "+format, args...)
+}
@@ -0,0 +1,185 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// ruleDialect identifies which flavour of rule file is expected, as Thanos and vmalert both
+// extend the Prometheus format with their own fields.
+type ruleDialect string
+
+const (
+	prometheusRules ruleDialect = "prometheus"
+	thanosRules     ruleDialect = "thanos"
+	vmalertRules    ruleDialect = "vmalert"
+)
+
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name     string            `yaml:"name"`
+	Interval string            `yaml:"interval"`
+	Limit    int               `yaml:"limit"`
+	Labels   map[string]string `yaml:"labels"`
+	Rules    []rule            `yaml:"rules"`
+
+	// thanos only
+	PartialResponseStrategy string `yaml:"partial_response_strategy"`
+
+	// vmalert only
+	Concurrency     int                    `yaml:"concurrency"`
+	Type            string                 `yaml:"type"`
+	Params          map[string]interface{} `yaml:"params"`
+	Headers         []string               `yaml:"headers"`
+	NotifierHeaders []string               `yaml:"notifier_headers"`
+	EvalOffset      string                 `yaml:"eval_offset"`
+	EvalDelay       string                 `yaml:"eval_delay"`
+	EvalAlignment   *bool                  `yaml:"eval_alignment"`
+	Debug           bool                   `yaml:"debug"`
+}
+
+type rule struct {
+	Record        string            `yaml:"record"`
+	Alert         string            `yaml:"alert"`
+	Expr          string            `yaml:"expr"`
+	For           string            `yaml:"for"`
+	KeepFiringFor string            `yaml:"keep_firing_for"`
+	Labels        map[string]string `yaml:"labels"`
+	Annotations   map[string]string `yaml:"annotations"`
+
+	// vmalert only
+	Debug              bool `yaml:"debug"`
+	UpdateEntriesLimit *int `yaml:"update_entries_limit"`
+}
+
+func (g ruleGroup) checkDialect(dialect ruleDialect) error {
+	if g.PartialResponseStrategy != "" {
+		if dialect != thanosRules {
+			return fmt.Errorf("partial_response_strategy is only supported by thanos rule")
+		}
+		if g.PartialResponseStrategy != "warn" && g.PartialResponseStrategy != "abort" {
+			return fmt.Errorf("partial_response_strategy must be warn or abort")
+		}
+	}
+
+	vmalertOnly := g.Concurrency != 0 || g.Type != "" || len(g.Params) > 0 || len(g.Headers) > 0 || len(g.NotifierHeaders) > 0 ||
+		g.EvalOffset != "" || g.EvalDelay != "" || g.EvalAlignment != nil || g.Debug
+	for _, r := range g.Rules {
+		vmalertOnly = vmalertOnly || r.Debug || r.UpdateEntriesLimit != nil
+	}
+	if vmalertOnly && dialect != vmalertRules {
+		return fmt.Errorf("uses fields only supported by vmalert")
+	}
+	if g.Type != "" && g.Type != "prometheus" && g.Type != "graphite" && g.Type != "vlogs" {
+		return fmt.Errorf("unknown datasource type %q", g.Type)
+	}
+	return nil
+}
+
+// ruleValidator checks the structure of rule files for the dialect.
+func ruleValidator(dialect ruleDialect) func(file renderedFile, all []renderedFile) error {
+	return func(file renderedFile, all []renderedFile) error {
+		rules := ruleFile{}
+		if err := yaml.UnmarshalStrict(file.content, &rules); err != nil {
+			return err
+		}
+
+		groups := map[string]bool{}
+		for _, group := range rules.Groups {
+			if group.Name == "" {
+				return fmt.Errorf("rule group with an empty name")
+			}
+			if groups[group.Name] {
+				return fmt.Errorf("rule group %q is defined more than once", group.Name)
+			}
+			groups[group.Name] = true
+
+			if err := group.checkDialect(dialect); err != nil {
+				return fmt.Errorf("group %q: %v", group.Name, err)
+			}
+
+			for i, rule := range group.Rules {
+				switch {
+				case rule.Record != "" && rule.Alert != "":
+					return fmt.Errorf("group %q rule %d: only one of record and alert may be set", group.Name, i)
+				case rule.Record == "" && rule.Alert == "":
+					return fmt.Errorf("group %q rule %d: one of record or alert must be set", group.Name, i)
+				case rule.Record != "" && !metricNamePattern.MatchString(rule.Record):
+					return fmt.Errorf("group %q rule %d: invalid recording rule name %q", group.Name, i, rule.Record)
+				case rule.Record != "" && (rule.For != "" || rule.KeepFiringFor != "" || len(rule.Annotations) > 0):
+					return fmt.Errorf("group %q rule %d: recording rules cannot have for, keep_firing_for or annotations", group.Name, i)
+				case rule.Expr == "":
+					return fmt.Errorf("group %q rule %d: expr is empty", group.Name, i)
+				}
+				for name := range rule.Labels {
+					if !labelNamePattern.MatchString(name) {
+						return fmt.Errorf("group %q rule %d: invalid label name %q", group.Name, i, name)
+					}
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// fileSDGroup is a target group in Prometheus file_sd format.
+type fileSDGroup struct {
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+}
+
+// validateFileSD checks a file_sd target list, accepting JSON or YAML.
+func validateFileSD(file renderedFile, all []renderedFile) error {
+	groups := []fileSDGroup{}
+	if err := yaml.UnmarshalStrict(file.content, &groups); err != nil {
+		return err
+	}
+	for i, group := range groups {
+		for _, target := range group.Targets {
+			if _, _, err := net.SplitHostPort(target); err != nil {
+				return fmt.Errorf("group %d: invalid target %q: %v", i, target, err)
+			}
+		}
+		for name := range group.Labels {
+			if !labelNamePattern.MatchString(name) {
+				return fmt.Errorf("group %d: invalid label name %q", i, name)
+			}
+		}
+	}
+	return nil
+}
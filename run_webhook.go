@@ -0,0 +1,260 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runWebhookQueue is how many payloads wait to be sent before new ones are dropped.
+const runWebhookQueue = 100
+
+var (
+	runWebhookURLs       stringList
+	runWebhookSecretFile = flag.String("run-webhook-secret-file", "", "File holding a secret the --run-webhook payloads are signed with, as an HMAC-SHA256 in the X-Prom-Config-Watcher-Signature-256 header.")
+	runWebhookReloadWait = flag.Duration("run-webhook-reload-wait", 5*time.Minute, "How long a --run-webhook payload waits for the reload its run triggered, before it is sent with the reload still pending.")
+)
+
+func init() {
+	flag.Var(&runWebhookURLs, "run-webhook", "URL a JSON payload describing every processing run, its changed files, validation and reload outcome, is posted to. May be repeated.")
+}
+
+// runPayload describes a processing run to downstream systems.
+type runPayload struct {
+	Pipeline   string        `json:"pipeline"`
+	RunID      string        `json:"run_id"`
+	Host       string        `json:"host"`
+	Time       time.Time     `json:"time"`
+	Success    bool          `json:"success"`
+	Error      string        `json:"error,omitempty"`
+	Hash       string        `json:"hash"`
+	Validation payloadCheck  `json:"validation"`
+	Reload     payloadCheck  `json:"reload"`
+	Files      []payloadFile `json:"files"`
+	Changed    []string      `json:"changed"`
+	Removed    []string      `json:"removed"`
+	timer      *time.Timer
+}
+
+// payloadCheck is the result of validating or reloading: passed, failed or none for the
+// validation, and success, failed, pending or skipped for the reload.
+type payloadCheck struct {
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+type payloadFile struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	SHA256 string `json:"sha256"`
+	Size   int    `json:"size"`
+}
+
+// runNotifier posts a payload to the run webhooks after every processing run. Runs that
+// trigger a reload are held back until the reload finishes, so the payload carries its
+// outcome. A nil notifier does nothing.
+type runNotifier struct {
+	urls   []string
+	secret []byte
+	queue  chan *runPayload
+
+	mu sync.Mutex
+	// hashes are the file hashes of each pipeline's last successful run
+	hashes map[string]map[string]string
+	// pending are the payloads waiting for a reload, by run ID
+	pending map[string]*runPayload
+}
+
+var runWebhooks *runNotifier
+
+func newRunNotifier(urls []string) (*runNotifier, error) {
+	n := &runNotifier{
+		urls:    urls,
+		queue:   make(chan *runPayload, runWebhookQueue),
+		hashes:  map[string]map[string]string{},
+		pending: map[string]*runPayload{},
+	}
+	if *runWebhookSecretFile != "" {
+		secret, err := readSecretFile(*runWebhookSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		n.secret = []byte(secret)
+	}
+	go n.send()
+	return n, nil
+}
+
+// runFinished builds the payload of a run, sending it straight away unless reloading is set.
+func (n *runNotifier) runFinished(p *pipeline, runID string, rendered []renderedFile, err error, reloading bool) {
+	if n == nil {
+		return
+	}
+	host, _ := os.Hostname()
+	payload := &runPayload{
+		Pipeline:   p.name,
+		RunID:      runID,
+		Host:       host,
+		Time:       time.Now().UTC(),
+		Success:    err == nil,
+		Hash:       renderHash(rendered),
+		Validation: payloadCheck{Result: "passed"},
+		Reload:     payloadCheck{Result: "skipped"},
+		Files:      []payloadFile{},
+		Changed:    []string{},
+		Removed:    []string{},
+	}
+	_, invalid := err.(*validationError)
+	switch {
+	case invalid:
+		payload.Validation = payloadCheck{Result: "failed", Error: err.Error()}
+	case len(p.validators) == 0:
+		payload.Validation.Result = "none"
+	}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+
+	hashes := map[string]string{}
+	for _, file := range rendered {
+		sum := sha256Hex(file.content)
+		hashes[file.name] = sum
+		payload.Files = append(payload.Files, payloadFile{Name: file.name, Source: file.source, SHA256: sum, Size: len(file.content)})
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	previous := n.hashes[p.name]
+	for name, sum := range hashes {
+		if previous[name] != sum {
+			payload.Changed = append(payload.Changed, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := hashes[name]; !ok {
+			payload.Removed = append(payload.Removed, name)
+		}
+	}
+	sort.Strings(payload.Changed)
+	sort.Strings(payload.Removed)
+	// files are only applied by successful runs, which the next run is compared to
+	if err == nil {
+		n.hashes[p.name] = hashes
+	}
+
+	if !reloading {
+		n.enqueue(payload)
+		return
+	}
+	payload.Reload.Result = "pending"
+	n.pending[runID] = payload
+	payload.timer = time.AfterFunc(*runWebhookReloadWait, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.pending[runID] == payload {
+			delete(n.pending, runID)
+			n.enqueue(payload)
+		}
+	})
+}
+
+// reloadFinished sends the payloads of the runs a reload covered. Runs retried after a
+// failed reload were already sent with the failure.
+func (n *runNotifier) reloadFinished(changes changeSet, err error) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, runID := range changes.runs {
+		payload, ok := n.pending[runID]
+		if !ok {
+			continue
+		}
+		delete(n.pending, runID)
+		payload.timer.Stop()
+		payload.Reload = payloadCheck{Result: "success"}
+		if err != nil {
+			payload.Reload = payloadCheck{Result: "failed", Error: err.Error()}
+		}
+		n.enqueue(payload)
+	}
+}
+
+// enqueue hands a payload to the sender without blocking the pipelines.
+func (n *runNotifier) enqueue(payload *runPayload) {
+	select {
+	case n.queue <- payload:
+	default:
+		log.WithField("run_id", payload.RunID).Error("Run webhook queue is full, dropping payload")
+	}
+}
+
+// send posts the payloads in the order the runs finished.
+func (n *runNotifier) send() {
+	for payload := range n.queue {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.WithError(err).Error("Error encoding run webhook payload")
+			continue
+		}
+		for _, url := range n.urls {
+			if err := n.post(url, body); err != nil {
+				log.WithField("run_id", payload.RunID).WithError(err).Errorf("Error sending run webhook to %v", url)
+			}
+		}
+	}
+}
+
+func (n *runNotifier) post(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != nil {
+		req.Header.Set("X-Prom-Config-Watcher-Signature-256", "sha256="+hex.EncodeToString(hmacSHA256(n.secret, string(body))))
+	}
+	resp, err := reloadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %v", resp.StatusCode)
+	}
+	return nil
+}
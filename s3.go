@@ -0,0 +1,195 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	s3Source         = flag.String("s3-source", "", "S3 bucket and key prefix, as bucket/prefix or s3://bucket/prefix, whose objects are synced into --s3-source-dir. Credentials are found the same way as for the AWS secret stores.")
+	s3SourceDir      = flag.String("s3-source-dir", "/var/lib/prom-config-watcher/s3", "Directory the objects of --s3-source are written to, named by their keys after the prefix.")
+	s3SourceInterval = flag.Duration("s3-source-interval", time.Minute, "How often --s3-source is listed for changed objects.")
+	s3SourceQueueURL = flag.String("s3-source-queue-url", "", "SQS queue receiving the bucket's event notifications, long polled so changes are synced straight away rather than at the next listing.")
+	s3Endpoint       = flag.String("s3-endpoint", "", "S3 endpoint, for S3 compatible stores. Buckets are addressed by path rather than by host name when set.")
+)
+
+// s3Sync mirrors the objects under a prefix.
+type s3Sync struct {
+	aws    *awsClient
+	bucket string
+	prefix string
+	// etags are the ETags of the objects written, by file name
+	etags  map[string]string
+	mirror *sourceMirror
+}
+
+// s3ListResult is a page of a ListObjectsV2 response.
+type s3ListResult struct {
+	Contents []struct {
+		Key  string
+		ETag string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func configureS3Source() error {
+	if *s3Source == "" {
+		return nil
+	}
+	spec := strings.TrimPrefix(*s3Source, "s3://")
+	bucket, prefix := spec, ""
+	if i := strings.Index(spec, "/"); i >= 0 {
+		bucket, prefix = spec[:i], spec[i+1:]
+	}
+	if bucket == "" {
+		return fmt.Errorf("invalid --s3-source %q, expected bucket/prefix", *s3Source)
+	}
+	aws, err := newAWSClient()
+	if err != nil {
+		return fmt.Errorf("aws: %v", err)
+	}
+	s := &s3Sync{aws: aws, bucket: bucket, prefix: prefix, etags: map[string]string{}}
+	if s.mirror, err = addMirror("s3", "s3://"+spec, *s3SourceDir, *s3SourceInterval, s.fetch); err != nil {
+		return err
+	}
+	if *s3SourceQueueURL != "" {
+		go s.receiveEvents(*s3SourceQueueURL)
+	}
+	return nil
+}
+
+// objectURL is the url of a key in the bucket, or of the bucket itself.
+func (s *s3Sync) objectURL(key string) string {
+	return s3ObjectURL(s.aws.region, s.bucket, key)
+}
+
+func s3ObjectURL(region string, bucket string, key string) string {
+	u := &url.URL{Scheme: "https", Host: fmt.Sprintf("%v.s3.%v.amazonaws.com", bucket, region), Path: "/" + key}
+	if *s3Endpoint != "" {
+		endpoint, _ := url.Parse(*s3Endpoint)
+		u.Scheme, u.Host, u.Path = endpoint.Scheme, endpoint.Host, strings.TrimSuffix(endpoint.Path, "/")+"/"+bucket+"/"+key
+	}
+	u.RawPath = awsURIEncode(u.Path, false)
+	return u.String()
+}
+
+// fetch lists the prefix and downloads the objects whose ETag has changed.
+func (s *s3Sync) fetch() (bool, error) {
+	files := map[string][]byte{}
+	etags := map[string]string{}
+	token := ""
+	for {
+		query := map[string]string{"list-type": "2", "prefix": s.prefix}
+		if token != "" {
+			query["continuation-token"] = token
+		}
+		body, err := s.aws.rest(http.MethodGet, "s3", s.objectURL(""), query, nil)
+		if err != nil {
+			return false, fmt.Errorf("listing s3://%v/%v: %v", s.bucket, s.prefix, err)
+		}
+		page := s3ListResult{}
+		if err := xml.Unmarshal(body, &page); err != nil {
+			return false, err
+		}
+		for _, object := range page.Contents {
+			name := strings.TrimLeft(strings.TrimPrefix(object.Key, s.prefix), "/")
+			// skip the empty objects consoles create to represent folders
+			if name == "" || strings.HasSuffix(name, "/") {
+				continue
+			}
+			etags[name] = object.ETag
+			if _, err := os.Stat(filepath.Join(s.mirror.dir, filepath.FromSlash(name))); err == nil && s.etags[name] == object.ETag {
+				files[name] = nil
+				continue
+			}
+			if files[name], err = s.aws.rest(http.MethodGet, "s3", s.objectURL(object.Key), nil, nil); err != nil {
+				return false, fmt.Errorf("fetching s3://%v/%v: %v", s.bucket, object.Key, err)
+			}
+		}
+		if !page.IsTruncated {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	changed, err := mirrorFiles(s.mirror.dir, files)
+	if err == nil {
+		s.etags = etags
+	}
+	return changed, err
+}
+
+// receiveEvents long polls an SQS queue for the bucket's event notifications, syncing
+// straight away whenever one arrives. The notifications only wake the sync, which lists the
+// prefix as usual.
+func (s *s3Sync) receiveEvents(queueURL string) {
+	for {
+		body, err := s.aws.rest(http.MethodGet, "sqs", queueURL, map[string]string{
+			"Action":              "ReceiveMessage",
+			"Version":             "2012-11-05",
+			"WaitTimeSeconds":     "20",
+			"MaxNumberOfMessages": "10",
+		}, nil)
+		if err != nil {
+			log.WithError(err).Error("Unable to receive S3 event notifications")
+			time.Sleep(*s3SourceInterval)
+			continue
+		}
+		received := struct {
+			Messages []struct {
+				ReceiptHandle string
+			} `xml:"ReceiveMessageResult>Message"`
+		}{}
+		if err := xml.Unmarshal(body, &received); err != nil {
+			log.WithError(err).Error("Unable to decode S3 event notifications")
+			continue
+		}
+		if len(received.Messages) == 0 {
+			continue
+		}
+		log.Debugf("Received %d S3 event notifications, syncing %v", len(received.Messages), s.mirror.name)
+		s.mirror.requestSync()
+		for _, message := range received.Messages {
+			if _, err := s.aws.rest(http.MethodGet, "sqs", queueURL, map[string]string{
+				"Action":        "DeleteMessage",
+				"Version":       "2012-11-05",
+				"ReceiptHandle": message.ReceiptHandle,
+			}, nil); err != nil {
+				log.WithError(err).Warn("Unable to delete S3 event notification")
+			}
+		}
+	}
+}
@@ -0,0 +1,429 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	secretRefreshInterval = flag.Duration("secret-refresh-interval", 5*time.Minute, "How long secrets referenced from source files are cached before being read again, the files using them being processed and reloaded when one has changed. Secrets with a shorter lease are read again before it runs out.")
+	secretOnError         = flag.String("secret-on-error", "fail", "What to do when a secret store can't be read: fail the render, or use-cached to keep using the last value read.")
+
+	// secretTTLs override --secret-refresh-interval for a store, as scheme=duration
+	secretTTLs stringList
+)
+
+func init() {
+	flag.Var(&secretTTLs, "secret-ttl", "How long secrets from one store are cached, as scheme=duration, e.g. \"vault=1m\". May be repeated, stores not listed use --secret-refresh-interval.")
+}
+
+// secretRefPattern matches secret references such as ${vault:secret/data/prom#password}.
+var secretRefPattern = regexp.MustCompile(`\$\{([a-z][a-z0-9-]*):([^}]+)\}`)
+
+// secretValue is a value read from a secret store. lease, when set, is how long the store
+// guarantees the value for, and refresh how often the store wants it read again.
+type secretValue struct {
+	value   string
+	lease   time.Duration
+	refresh time.Duration
+}
+
+// secretResolver reads secrets from a store, given the part of a reference after the scheme.
+type secretResolver interface {
+	resolve(ref string) (secretValue, error)
+}
+
+// secretResolvers are the configured stores by reference scheme.
+var secretResolvers = map[string]secretResolver{}
+
+// configureSecrets sets up the secret stores enabled by flags.
+func configureSecrets() error {
+	if err := checkSecretSettings(); err != nil {
+		return err
+	}
+	if err := checkLeakSettings(); err != nil {
+		return err
+	}
+	if *vaultAddress != "" {
+		vault, err := newVaultClient()
+		if err != nil {
+			return fmt.Errorf("vault: %v", err)
+		}
+		secretResolvers["vault"] = vault
+		secrets.policies["vault"] = *vaultOnError
+	}
+	if *awsSecretsManagerEnabled || *awsSSMEnabled {
+		aws, err := newAWSClient()
+		if err != nil {
+			return fmt.Errorf("aws: %v", err)
+		}
+		if *awsSecretsManagerEnabled {
+			secretResolvers["aws-sm"] = &awsSecretsManager{aws: aws}
+		}
+		if *awsSSMEnabled {
+			secretResolvers["ssm"] = &ssmParameterStore{aws: aws}
+		}
+	}
+	if *gcpSecretManagerEnabled {
+		secretResolvers["gcp-sm"] = &gcpSecretManager{gcp: newGCPClient()}
+	}
+	if *azureKeyVaultEnabled {
+		secretResolvers["azkv"] = &azureKeyVault{azure: newAzureClient()}
+	}
+	if *kubeSecretsEnabled {
+		kubeSecrets, err := newKubeSecrets()
+		if err != nil {
+			return fmt.Errorf("kubernetes secrets: %v", err)
+		}
+		secretResolvers["k8s-secret"] = kubeSecrets
+	}
+	if *keyringEnabled {
+		secretResolvers["keyring"] = osKeyring{}
+	}
+	if args := strings.Fields(*credentialHelper); len(args) > 0 {
+		secretResolvers["helper"] = &credentialHelperCommand{args: args}
+	}
+	return nil
+}
+
+// resolveSecret resolves a single reference used by source, from the cache while it is fresh.
+func resolveSecret(scheme string, ref string, source string) (string, error) {
+	resolver := secretResolvers[scheme]
+	if resolver == nil {
+		return "", fmt.Errorf("no secret store is configured for %v: references", scheme)
+	}
+	return secrets.get(scheme, ref, source)
+}
+
+// expandContent resolves the secret references in content and, with expandVars, environment
+// variables. Secrets are resolved in the same pass so values containing $ are left as they are.
+// source is the file the content was read from, processed again when its secrets change.
+func expandContent(content string, expandVars bool, source string) (string, error) {
+	var firstErr error
+	resolve := func(scheme string, ref string) string {
+		value, err := resolveSecret(scheme, ref, source)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return value
+	}
+
+	if expandVars {
+		content = os.Expand(content, func(name string) string {
+			if i := strings.Index(name, ":"); i > 0 && secretResolvers[name[:i]] != nil {
+				return resolve(name[:i], name[i+1:])
+			}
+			return os.Getenv(name)
+		})
+	} else {
+		content = secretRefPattern.ReplaceAllStringFunc(content, func(match string) string {
+			parts := secretRefPattern.FindStringSubmatch(match)
+			if secretResolvers[parts[1]] == nil {
+				return match
+			}
+			return resolve(parts[1], parts[2])
+		})
+	}
+	return content, firstErr
+}
+
+// cachedSecret is a secret used by the rendered config.
+type cachedSecret struct {
+	scheme, ref string
+	value       string
+	read        time.Time
+	ttl         time.Duration
+	// sources are the files using the secret
+	sources map[string]bool
+}
+
+func (c *cachedSecret) fresh(now time.Time) bool {
+	return now.Sub(c.read) < c.ttl
+}
+
+// secretCache holds the secrets read from every store for their TTL. Expired secrets are read
+// again in the background and, when one has changed, the files using it are processed again.
+type secretCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedSecret
+	// rotatedSources are the files using secrets that changed since the last takeRotated
+	rotatedSources map[string]bool
+	// rotated is signalled when a secret has changed
+	rotated chan struct{}
+	// wake starts a refresh straight away
+	wake chan struct{}
+	// policies override --secret-on-error for a store, by scheme
+	policies map[string]string
+	// failedSources are the files that couldn't be rendered because a store was unavailable,
+	// by scheme, processed again once it is back
+	failedSources map[string]map[string]bool
+}
+
+var secrets = &secretCache{
+	entries:        map[string]*cachedSecret{},
+	rotatedSources: map[string]bool{},
+	rotated:        make(chan struct{}, 1),
+	wake:           make(chan struct{}, 1),
+	policies:       map[string]string{},
+	failedSources:  map[string]map[string]bool{},
+}
+
+// checkSecretSettings validates --secret-ttl and --secret-on-error.
+func checkSecretSettings() error {
+	if *secretOnError != "fail" && *secretOnError != "use-cached" {
+		return fmt.Errorf("unknown --secret-on-error policy %q, expected fail or use-cached", *secretOnError)
+	}
+	_, err := parseSecretTTLs()
+	return err
+}
+
+func parseSecretTTLs() (map[string]time.Duration, error) {
+	ttls := map[string]time.Duration{}
+	for _, spec := range secretTTLs {
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid --secret-ttl %q, expected scheme=duration", spec)
+		}
+		ttl, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid --secret-ttl %q: %v", spec, err)
+		}
+		ttls[kv[0]] = ttl
+	}
+	return ttls, nil
+}
+
+// ttlFor is how long a value read from scheme is cached.
+func ttlFor(scheme string, value secretValue) time.Duration {
+	ttls, _ := parseSecretTTLs()
+	ttl, found := ttls[scheme]
+	if !found {
+		ttl = *secretRefreshInterval
+		if value.refresh > 0 && value.refresh < ttl {
+			ttl = value.refresh
+		}
+	}
+	// read leased secrets again before they expire
+	if value.lease > 0 && value.lease*2/3 < ttl {
+		ttl = value.lease * 2 / 3
+	}
+	return ttl
+}
+
+// policy is what to do when scheme's store can't be read.
+func (c *secretCache) policy(scheme string) string {
+	if policy, found := c.policies[scheme]; found {
+		return policy
+	}
+	return *secretOnError
+}
+
+// get returns a secret, reading it from its store unless a fresh value is cached.
+func (c *secretCache) get(scheme string, ref string, source string) (string, error) {
+	key := scheme + ":" + ref
+	c.mu.Lock()
+	entry := c.entries[key]
+	if entry != nil {
+		entry.sources[source] = true
+		if entry.fresh(time.Now()) {
+			c.mu.Unlock()
+			secretLookups.WithLabelValues(scheme, "cached").Inc()
+			audit.record(auditEntry{Action: "resolve-secret", Secret: key, File: source, Cached: true, Result: "ok"})
+			return entry.value, nil
+		}
+	}
+	c.mu.Unlock()
+
+	value, err := secretResolvers[scheme].resolve(ref)
+	if err != nil {
+		if entry != nil && c.policy(scheme) == "use-cached" {
+			secretLookups.WithLabelValues(scheme, "stale").Inc()
+			log.WithError(err).Errorf("Unable to read %v, rendering with the value read %v ago", key, time.Since(entry.read).Round(time.Second))
+			audit.record(auditEntry{Action: "resolve-secret", Secret: key, File: source, Cached: true, Result: "stale", Error: err.Error()})
+			return entry.value, nil
+		}
+		secretLookups.WithLabelValues(scheme, "error").Inc()
+		audit.record(auditEntry{Action: "resolve-secret", Secret: key, File: source, Result: "failed", Error: err.Error()})
+		if source != "" {
+			c.mu.Lock()
+			if c.failedSources[scheme] == nil {
+				c.failedSources[scheme] = map[string]bool{}
+			}
+			c.failedSources[scheme][source] = true
+			c.mu.Unlock()
+		}
+		return "", fmt.Errorf("resolving %v: %v", key, err)
+	}
+	secretLookups.WithLabelValues(scheme, "read").Inc()
+	audit.record(auditEntry{Action: "resolve-secret", Secret: key, File: source, Result: "ok"})
+	c.store(scheme, ref, value, source)
+	return value.value, nil
+}
+
+// store caches a value, reporting whether it differs from the one cached before.
+func (c *secretCache) store(scheme string, ref string, value secretValue, source string) bool {
+	key := scheme + ":" + ref
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[key]
+	if entry == nil {
+		entry = &cachedSecret{scheme: scheme, ref: ref, value: value.value, sources: map[string]bool{}}
+		c.entries[key] = entry
+	}
+	if source != "" {
+		entry.sources[source] = true
+	}
+	changed := entry.value != value.value
+	entry.value = value.value
+	entry.read = time.Now()
+	entry.ttl = ttlFor(scheme, value)
+	if changed {
+		for source := range entry.sources {
+			c.rotatedSources[source] = true
+		}
+	}
+	return changed
+}
+
+// values returns the cached secret values long enough to look for, by reference.
+func (c *secretCache) values() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := map[string]string{}
+	for key, entry := range c.entries {
+		if len(entry.value) >= minLeakLength {
+			values[key] = entry.value
+		}
+	}
+	return values
+}
+
+// expired returns the cached secrets due to be read again.
+func (c *secretCache) expired(now time.Time) []*cachedSecret {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expired := []*cachedSecret{}
+	for _, entry := range c.entries {
+		if !entry.fresh(now) {
+			expired = append(expired, entry)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].scheme+expired[i].ref < expired[j].scheme+expired[j].ref })
+	return expired
+}
+
+// expire marks every secret from scheme as due, for stores that learn of changes themselves.
+func (c *secretCache) expire(scheme string) {
+	c.mu.Lock()
+	for _, entry := range c.entries {
+		if entry.scheme == scheme {
+			entry.read = time.Time{}
+		}
+	}
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// recovered queues the files that failed to render while scheme's store was unavailable to
+// be processed again.
+func (c *secretCache) recovered(scheme string) {
+	c.mu.Lock()
+	failed := c.failedSources[scheme]
+	delete(c.failedSources, scheme)
+	for source := range failed {
+		c.rotatedSources[source] = true
+	}
+	c.mu.Unlock()
+	if len(failed) > 0 {
+		log.Infof("%v is available again, processing the %d files that couldn't be rendered", scheme, len(failed))
+		select {
+		case c.rotated <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// takeRotated returns and clears the files using secrets that have changed.
+func (c *secretCache) takeRotated() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sources := []string{}
+	for source := range c.rotatedSources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	c.rotatedSources = map[string]bool{}
+	return sources
+}
+
+func (c *secretCache) refresh() {
+	ticks := time.Tick(10 * time.Second)
+	for {
+		select {
+		case <-ticks:
+		case <-c.wake:
+		}
+		changed := false
+		for _, entry := range c.expired(time.Now()) {
+			key := entry.scheme + ":" + entry.ref
+			value, err := secretResolvers[entry.scheme].resolve(entry.ref)
+			audit.record(auditEntry{Action: "refresh-secret", Secret: key, Result: resultString(err), Error: errorString(err)})
+			if err != nil {
+				secretLookups.WithLabelValues(entry.scheme, "error").Inc()
+				log.WithError(err).Errorf("Unable to refresh secret %v, keeping the cached value", key)
+				c.mu.Lock()
+				entry.read = time.Now()
+				c.mu.Unlock()
+				continue
+			}
+			secretLookups.WithLabelValues(entry.scheme, "read").Inc()
+			c.recovered(entry.scheme)
+			if c.store(entry.scheme, entry.ref, value, "") {
+				log.Infof("Secret %v has changed", key)
+				secretRotations.WithLabelValues(entry.scheme).Inc()
+				changed = true
+			}
+		}
+		if changed {
+			select {
+			case c.rotated <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	listenAddress = flag.String("listen-address", "", "Address, such as :9533, the watcher's HTTP server listens on for metrics and health checks. The server is disabled when empty, the default.")
+	apiTokenFile  = flag.String("api-token-file", "", "File holding a bearer token that requests to /trigger, /status and /debug/state must carry. Enables those endpoints, which are only served with this or --oidc-issuer-url.")
+)
+
+// startServer serves the watcher's own endpoints in the background.
+func startServer(steps func() []*reloadStep, states chan<- stateRequest, triggers chan<- triggerRequest, push *pushAPI) {
+	if *listenAddress == "" {
+		return
+	}
+	if *oidcIssuerURL != "" {
+		var err error
+		if oidc, err = newOIDCVerifier(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	apiToken, err := bearerToken(*apiTokenFile)
+	if err != nil {
+		log.Fatalf("Reading API token: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.Handle("/readyz", readyzHandler(steps))
+	if apiToken != nil || oidc != nil {
+		mux.Handle("/status", requireAuth(oidcReadGroups, apiToken, http.HandlerFunc(statusHandler)))
+		mux.Handle("/debug/state", requireAuth(oidcReadGroups, apiToken, stateHandler(states)))
+		mux.Handle("/trigger", requireAuth(oidcTriggerGroups, apiToken, triggerHandler(triggers)))
+	}
+	if *logLevelTokenFile != "" || oidc != nil {
+		token, err := bearerToken(*logLevelTokenFile)
+		if err != nil {
+			log.Fatalf("Reading log level token: %v", err)
+		}
+		mux.Handle("/loglevel", requireAuth(oidcTriggerGroups, token, logLevelHandler()))
+	}
+	if approvals != nil && (*approvalTokenFile != "" || oidc != nil) {
+		token, err := bearerToken(*approvalTokenFile)
+		if err != nil {
+			log.Fatalf("Reading approval token: %v", err)
+		}
+		mux.Handle("/approve", requireAuth(oidcTriggerGroups, token, approvals.approvalHandler()))
+	}
+
+	if push != nil {
+		token, err := bearerToken(*pushTokenFile)
+		if err != nil {
+			log.Fatalf("Reading push token: %v", err)
+		}
+		if token == nil && oidc == nil {
+			log.Fatal("--push-dir needs --push-token-file or --oidc-issuer-url, pushes are never accepted unauthenticated")
+		}
+		mux.Handle("/api/v1/files/", requireAuth(oidcTriggerGroups, token, push.filesHandler()))
+		mux.Handle("/api/v1/bundle", requireAuth(oidcTriggerGroups, token, push.bundleHandler()))
+	}
+
+	if *httpSD {
+		token, err := bearerToken(*httpSDTokenFile)
+		if err != nil {
+			log.Fatalf("Reading HTTP SD token: %v", err)
+		}
+		if token == nil && oidc == nil {
+			log.Fatal("--http-sd needs --http-sd-token-file or --oidc-issuer-url, target lists are never served unauthenticated")
+		}
+		mux.Handle("/sd/", requireAuth(oidcReadGroups, token, http.HandlerFunc(httpSDHandler)))
+	}
+
+	if gitRepo != nil && *gitWebhookSecretFile != "" {
+		secret, err := readSecretFile(*gitWebhookSecretFile)
+		if err != nil {
+			log.Fatalf("Reading git webhook secret: %v", err)
+		}
+		mux.Handle("/webhook/git", gitWebhookHandler([]byte(secret)))
+	}
+
+	// listen before returning so a privileged port is bound before privileges are dropped
+	listener, err := net.Listen("tcp", *listenAddress)
+	if err != nil {
+		log.Fatalf("HTTP server failed: %v", err)
+	}
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		log.Infof("Listening on %v with TLS", listener.Addr())
+	} else {
+		log.Infof("Listening on %v", listener.Addr())
+	}
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Fatalf("HTTP server failed: %v", err)
+		}
+	}()
+}
+
+// bearerToken reads the token that requests to a protected endpoint must carry, returning the
+// expected Authorization header.
+func bearerToken(tokenFile string) ([]byte, error) {
+	if tokenFile == "" {
+		// only OIDC authenticated requests are accepted
+		return nil, nil
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return []byte("Bearer " + strings.TrimSpace(string(token))), nil
+}
+
+// requesterKey holds who a request was authenticated as in its context.
+type requesterKey struct{}
+
+// requireAuth lets through requests carrying token as a bearer token, or an OIDC ID token for
+// a caller in one of groups (any caller when groups is empty), replying with 401 or 403
+// otherwise. Endpoints are left open when there's neither a token nor an OIDC issuer.
+func requireAuth(groups []string, token []byte, next http.Handler) http.Handler {
+	if token == nil && oidc == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != nil && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) == 1 {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requesterKey{}, "token holder at "+r.RemoteAddr)))
+			return
+		}
+		if oidc == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		subject, status := oidc.authenticate(r, groups)
+		if status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requesterKey{}, subject)))
+	})
+}
+
+// requester names who made a request, for logs and the audit trail.
+func requester(r *http.Request) string {
+	if name, authenticated := r.Context().Value(requesterKey{}).(string); authenticated {
+		return name
+	}
+	return r.RemoteAddr
+}
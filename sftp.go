@@ -0,0 +1,145 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sftpTimeout limits a single download of the remote directory.
+const sftpTimeout = 5 * time.Minute
+
+var (
+	sftpSource         = flag.String("sftp-source", "", "Remote directory, as sftp://[user@]host[:port]/path, downloaded to --sftp-source-dir over SFTP on every --sftp-source-interval.")
+	sftpSourceDir      = flag.String("sftp-source-dir", "/var/lib/prom-config-watcher/sftp", "Directory the files of --sftp-source are written to.")
+	sftpSourceInterval = flag.Duration("sftp-source-interval", time.Minute, "How often --sftp-source is downloaded.")
+	sftpBinary         = flag.String("sftp-binary", "sftp", "Path to the OpenSSH sftp binary.")
+	sftpSSHKeyFile     = flag.String("sftp-ssh-key-file", "", "Private key to log in to the --sftp-source host with.")
+	sftpKnownHostsFile = flag.String("sftp-known-hosts-file", "", "known_hosts file the host key of --sftp-source is checked against. Required with --sftp-source.")
+)
+
+// sftpSync downloads a remote directory with the sftp binary.
+type sftpSync struct {
+	destination string
+	port        string
+	path        string
+	mirror      *sourceMirror
+}
+
+func configureSFTPSource() error {
+	if *sftpSource == "" {
+		return nil
+	}
+	u, err := url.Parse(*sftpSource)
+	if err != nil || u.Scheme != "sftp" || u.Hostname() == "" || u.Path == "" {
+		return fmt.Errorf("--sftp-source %q isn't of the form sftp://[user@]host[:port]/path", *sftpSource)
+	}
+	if *sftpKnownHostsFile == "" {
+		return fmt.Errorf("--sftp-source needs --sftp-known-hosts-file to check the host key of %s against", u.Hostname())
+	}
+	s := &sftpSync{destination: u.Hostname(), port: u.Port(), path: u.Path}
+	if strings.Contains(u.Hostname(), ":") {
+		s.destination = "[" + u.Hostname() + "]"
+	}
+	if u.User != nil {
+		s.destination = u.User.Username() + "@" + s.destination
+	}
+	mirror, err := addMirror("sftp", *sftpSource, *sftpSourceDir, *sftpSourceInterval, s.fetch)
+	if err != nil {
+		return err
+	}
+	s.mirror = mirror
+	return nil
+}
+
+// fetch downloads the whole directory to a scratch directory and mirrors it, so only files
+// whose content changed are rewritten.
+func (s *sftpSync) fetch() (bool, error) {
+	scratch, err := ioutil.TempDir("", "prom-config-watcher-sftp-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(scratch)
+	download := filepath.Join(scratch, "download")
+	batch := fmt.Sprintf("get -R %v %v\n", sftpQuote(s.path), sftpQuote(download))
+	if err := s.run(batch); err != nil {
+		return false, err
+	}
+	files := map[string][]byte{}
+	err = filepath.Walk(download, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		if info.Size() > maxSourceSize {
+			return fmt.Errorf("%v is larger than %v bytes", path, maxSourceSize)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(download, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(name)] = content
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return mirrorFiles(s.mirror.dir, files)
+}
+
+func (s *sftpSync) run(batch string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sftpTimeout)
+	defer cancel()
+	args := append([]string{"-q", "-b", "-"}, sshOptions(*sftpSSHKeyFile, *sftpKnownHostsFile)...)
+	if s.port != "" {
+		args = append(args, "-P", s.port)
+	}
+	cmd := exec.CommandContext(ctx, *sftpBinary, append(args, s.destination)...)
+	cmd.Stdin = strings.NewReader(batch)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("sftp: %v: %v", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// sftpQuote quotes an argument of an sftp batch command.
+func sftpQuote(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
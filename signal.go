@@ -0,0 +1,135 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal %q", name)
+	}
+	return sig, nil
+}
+
+// findProcesses returns the pids of processes whose command name matches. Signalling a
+// process in another container requires the pod to share its process namespace.
+func findProcesses(name string) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	pids := []int{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		comm, err := ioutil.ReadFile(path.Join("/proc", entry.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(comm)) == name {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+func readPidFile(pidFile string) (int, error) {
+	contents, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(contents)))
+}
+
+// stepProcesses returns the process in pidFile, or every process called name.
+func stepProcesses(name string, pidFile string) ([]int, error) {
+	if pidFile != "" {
+		pid, err := readPidFile(pidFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read pid file %v: %v", pidFile, err)
+		}
+		return []int{pid}, nil
+	}
+	return findProcesses(name)
+}
+
+// processRunning checks the process in pidFile, or a process called name, is running. It is
+// the health check of signal steps, which have no health endpoints.
+func processRunning(name string, pidFile string) error {
+	pids, err := stepProcesses(name, pidFile)
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		// signal 0 only checks the process exists, EPERM means it does but isn't ours
+		if err := syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+			return nil
+		}
+	}
+	if pidFile != "" {
+		return fmt.Errorf("process %v from %v is not running", pids, pidFile)
+	}
+	return fmt.Errorf("no %v process is running", name)
+}
+
+// signalReload sends sig to the process in pidFile, or to every process called name.
+func signalReload(stepName string, sig syscall.Signal, name string, pidFile string) error {
+	pids, err := stepProcesses(name, pidFile)
+	if err != nil {
+		return err
+	}
+	if len(pids) == 0 {
+		return fmt.Errorf("no %v process found to signal", name)
+	}
+
+	for _, pid := range pids {
+		log.Debugf("Sending %v to %v (pid %d)", sig, stepName, pid)
+		if err := syscall.Kill(pid, sig); err != nil {
+			return fmt.Errorf("unable to signal pid %d: %v", pid, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	signatureMode = flag.String("signature-mode", "off", "Verify a detached signature over the source files before rendering them, refusing config that is unsigned or has been tampered with: off, gpg or cosign. The signature covers the output of the manifest command.")
+	signatureFile = flag.String("signature-file", "config.sig", "Name of the detached signature in the watch path. It isn't rendered.")
+	signatureKey  = flag.String("signature-key", "", "Keyring holding the trusted GPG keys, as an absolute path, or the cosign public key that signatures are verified with.")
+	gpgvBinary    = flag.String("gpgv-binary", "gpgv", "Path to the gpgv binary used for --signature-mode=gpg.")
+	cosignBinary  = flag.String("cosign-binary", "cosign", "Path to the cosign binary used for --signature-mode=cosign.")
+)
+
+func checkSignatureSettings() error {
+	switch *signatureMode {
+	case "off":
+		return nil
+	case "gpg", "cosign":
+		if *signatureKey == "" {
+			return fmt.Errorf("--signature-mode=%v needs a --signature-key", *signatureMode)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown --signature-mode %q, expected off, gpg or cosign", *signatureMode)
+}
+
+// isSignatureFile reports whether name is the signature, which is left out of rendering.
+func isSignatureFile(name string) bool {
+	return *signatureMode != "off" && filepath.Base(name) == *signatureFile
+}
+
+// sourceManifest lists the sha256 and path of every source file, in the format of sha256sum
+// and sorted by path, as the content a signature is made over. Paths are relative to the
+// watch path, or the file name when the watch path is a single file.
+func sourceManifest(sources []sourceFile) []byte {
+	sorted := append([]sourceFile{}, sources...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].rel < sorted[j].rel })
+	manifest := &bytes.Buffer{}
+	for _, source := range sorted {
+		fmt.Fprintf(manifest, "%v  %v\n", sha256Hex(source.content), source.rel)
+	}
+	return manifest.Bytes()
+}
+
+// verifySourceSignature checks the signature in the watch path against the source files read
+// from it, which are then rendered as they are rather than read again.
+func verifySourceSignature(watchPath string, sources []sourceFile) error {
+	if *signatureMode == "off" {
+		return nil
+	}
+	dir := watchPath
+	if stat, err := os.Stat(watchPath); err == nil && !stat.IsDir() {
+		dir = filepath.Dir(watchPath)
+	}
+	signature := filepath.Join(dir, *signatureFile)
+	if _, err := os.Stat(signature); err != nil {
+		return fmt.Errorf("config is not signed: %v", err)
+	}
+	manifest := sourceManifest(sources)
+
+	tmp, err := ioutil.TempFile("", "prom-config-watcher-manifest")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(manifest)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	var cmd *exec.Cmd
+	if *signatureMode == "gpg" {
+		cmd = exec.Command(*gpgvBinary, "--keyring", *signatureKey, signature, tmp.Name())
+	} else {
+		cmd = exec.Command(*cosignBinary, "verify-blob", "--key", *signatureKey, "--signature", signature, tmp.Name())
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("signature verification failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// runManifest prints the manifest of --watch-path, which is what gets signed, e.g. with
+// "gpg --detach-sign" or "cosign sign-blob".
+func runManifest() int {
+	if _, err := os.Stat(*watchedPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// a watcher verifying signatures leaves the signature out, as isSignatureFile does, even
+	// when this command runs without --signature-mode
+	sources := []sourceFile{}
+	for _, source := range readSources(log.NewEntry(log.StandardLogger()), *watchedPath) {
+		if filepath.Base(source.path) != *signatureFile {
+			sources = append(sources, source)
+		}
+	}
+	os.Stdout.Write(sourceManifest(sources))
+	return 0
+}
@@ -0,0 +1,145 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// sink receives the rendered config once it has passed validation. files restricts which
+// rendered files are sent to it, an empty list meaning all of them.
+type sink interface {
+	name() string
+	files() []string
+	write(logger *log.Entry, files []renderedFile) error
+}
+
+// targetSink writes rendered files to the local target path, skipping files that are
+// delivered exclusively by another sink.
+type targetSink struct {
+	dir     string
+	exclude []string
+}
+
+func (t *targetSink) name() string {
+	return "target path"
+}
+
+func (t *targetSink) files() []string {
+	return nil
+}
+
+func (t *targetSink) write(logger *log.Entry, files []renderedFile) error {
+	local := []renderedFile{}
+	for _, file := range files {
+		if len(t.exclude) > 0 && matchesGlobs(file.name, t.exclude) {
+			continue
+		}
+		local = append(local, file)
+	}
+	// the target path is created if missing, rather than every write failing
+	if err := ensureDir(t.dir); err != nil {
+		return err
+	}
+	writeRenderedFiles(logger, local, t.dir)
+	return nil
+}
+
+// configureSinks builds the sinks from flags, only writing to the target path unless remote
+// is set. Remote sinks may claim files that shouldn't also be written to the target path.
+// upload is the object store the files are uploaded to, if any, and remoteDir the directory
+// below each --ssh-target, and below /sd/, the files are delivered to.
+func configureSinks(dir string, remote bool, upload string, remoteDir string) []sink {
+	sinks := []sink{}
+	target := &targetSink{dir: dir}
+	if !remote {
+		return append(sinks, target)
+	}
+
+	if *rulerURL != "" {
+		ruler := newRulerSink()
+		sinks = append(sinks, ruler)
+		target.exclude = append(target.exclude, ruler.files()...)
+	}
+	if *amAPIURL != "" {
+		am := newAlertmanagerAPISink()
+		sinks = append(sinks, am)
+		target.exclude = append(target.exclude, am.files()...)
+	}
+	sinks = append(sinks, target)
+	if len(sshTargets) > 0 {
+		sinks = append(sinks, newSSHSink(remoteDir))
+	}
+	if upload != "" {
+		sinks = append(sinks, newUploadSink(upload))
+		if *uploadOnly {
+			target.exclude = append(target.exclude, "*")
+		}
+	}
+
+	if *httpSD {
+		sd := newHTTPSDSink(remoteDir)
+		sinks = append(sinks, sd)
+		target.exclude = append(target.exclude, sd.exclusive()...)
+	}
+
+	// grafana follows the target path so provisioning reloads see the written files
+	if *grafanaURL != "" {
+		grafana := newGrafanaSink()
+		sinks = append(sinks, grafana)
+		target.exclude = append(target.exclude, grafana.exclusive()...)
+	}
+	return sinks
+}
+
+// writeSinks delivers the rendered files to every sink, logging failures so one
+// unavailable remote doesn't prevent the others from being updated.
+func writeSinks(logger *log.Entry, sinks []sink, files []renderedFile) error {
+	var firstErr error
+	for _, s := range sinks {
+		if err := s.write(logger, selectFiles(s, files)); err != nil {
+			logger.WithError(err).Errorf("Error writing config to %v", s.name())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// selectFiles returns the files a sink receives.
+func selectFiles(s sink, files []renderedFile) []renderedFile {
+	globs := s.files()
+	if len(globs) == 0 {
+		return files
+	}
+	selected := []renderedFile{}
+	for _, file := range files {
+		if matchesGlobs(file.name, globs) {
+			selected = append(selected, file)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,89 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var sopsBinary = flag.String("sops-binary", "sops", "Path to the sops binary used to decrypt source files carrying SOPS metadata. Keys are found the way sops finds them: age and GPG keys, or AWS, GCP and Azure KMS credentials from the environment.")
+
+// isSOPSEncrypted reports whether contents were encrypted by SOPS, which adds a sops section
+// with a MAC to YAML, JSON and binary files and sops_ keys to dotenv and INI files.
+func isSOPSEncrypted(contents []byte) bool {
+	if bytes.Contains(contents, []byte("sops_mac=")) {
+		return true
+	}
+	if !bytes.Contains(contents, []byte("sops")) {
+		return false
+	}
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal(contents, &doc); err != nil {
+		return false
+	}
+	metadata, ok := doc["sops"].(map[interface{}]interface{})
+	if !ok {
+		return false
+	}
+	_, hasMAC := metadata["mac"]
+	return hasMAC
+}
+
+// sopsInputType picks the sops format from the file extension, as sops itself does, so that
+// files with other extensions such as .tmpl are still decrypted as YAML.
+func sopsInputType(filePath string) string {
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".json":
+		return "json"
+	case ".env":
+		return "dotenv"
+	case ".ini":
+		return "ini"
+	}
+	return "yaml"
+}
+
+// sopsDecrypt decrypts the content of a source file with sops, passed on stdin as it was read
+// for the run. The plaintext is only held in memory, to be written to the target path once
+// rendered.
+func sopsDecrypt(filePath string, content []byte) ([]byte, error) {
+	inputType := sopsInputType(filePath)
+	cmd := exec.Command(*sopsBinary, "--decrypt", "--input-type", inputType, "--output-type", inputType, "/dev/stdin")
+	cmd.Stdin = bytes.NewReader(content)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("sops failed to decrypt %v: %v: %s", filePath, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
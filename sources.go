@@ -0,0 +1,261 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sourceMirror keeps a local directory in step with config published elsewhere, such as a Git
+// repository or a bucket, for pipelines to watch like any other path.
+type sourceMirror struct {
+	// kind is the type of source, labelling its metrics
+	kind string
+	// name describes the source in logs, e.g. its url
+	name     string
+	dir      string
+	interval time.Duration
+	// fetch brings dir up to date, reporting whether anything changed
+	fetch func() (bool, error)
+	// wake starts a fetch straight away
+	wake chan struct{}
+}
+
+var (
+	// mirrors are the configured sources
+	mirrors []*sourceMirror
+	// mirrorUpdates is sent the mirrors that have changed, for the watch loop to process the
+	// pipelines watching them
+	mirrorUpdates = make(chan *sourceMirror)
+)
+
+// configureSources sets up the sources enabled by flags.
+func configureSources() error {
+	for _, configure := range []func() error{configureGitSource, configureHTTPSources, configureS3Source, configureGCSSource, configureAzureBlobSource, configureConsulKVSource, configureEtcdSource, configureZooKeeperSource, configureSFTPSource, configureOCISource, configureConsulSD, configureDNSSD, configureKubeSource} {
+		if err := configure(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMirror registers a source mirrored to dir every interval.
+func addMirror(kind string, name string, dir string, interval time.Duration, fetch func() (bool, error)) (*sourceMirror, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("%v: the poll interval must be positive", kind)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mirrors {
+		if within(dir, m.dir) || within(m.dir, dir) {
+			return nil, fmt.Errorf("%v and %v can't share the directory %v", m.kind, kind, dir)
+		}
+	}
+	m := &sourceMirror{kind: kind, name: name, dir: dir, interval: interval, fetch: fetch, wake: make(chan struct{}, 1)}
+	mirrors = append(mirrors, m)
+	return m, nil
+}
+
+// syncMirrors brings every mirror up to date before the first render. A mirror that already
+// has content is used as it is when its source can't be reached.
+func syncMirrors() {
+	for _, m := range mirrors {
+		if err := os.MkdirAll(m.dir, 0755); err != nil {
+			log.Fatalf("Unable to create %v: %v", m.dir, err)
+		}
+		if _, err := m.sync(); err != nil {
+			if entries, _ := ioutil.ReadDir(m.dir); len(entries) == 0 {
+				log.Fatalf("Unable to fetch %v: %v", m.name, err)
+			}
+			log.WithError(err).Errorf("Unable to update %v, rendering what was fetched before", m.name)
+		}
+	}
+}
+
+// startMirrors keeps the mirrors up to date in the background.
+func startMirrors() {
+	for _, m := range mirrors {
+		go m.poll()
+	}
+}
+
+// requestSync asks for a fetch straight away, e.g. on a webhook.
+func (m *sourceMirror) requestSync() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *sourceMirror) poll() {
+	ticks := time.Tick(m.interval)
+	for {
+		select {
+		case <-ticks:
+		case <-m.wake:
+		}
+		changed, err := m.sync()
+		if err != nil {
+			log.WithError(err).Errorf("Unable to update %v", m.name)
+			continue
+		}
+		if changed {
+			mirrorUpdates <- m
+		}
+	}
+}
+
+func (m *sourceMirror) sync() (bool, error) {
+	changed, err := m.fetch()
+	result := "unchanged"
+	switch {
+	case err != nil:
+		result = "failed"
+	case changed:
+		result = "updated"
+	}
+	sourceSyncs.WithLabelValues(m.kind, result).Inc()
+	return changed, err
+}
+
+// privateFileMode is the mode of mirrored files holding secrets, such as the keys of a
+// kubernetes Secret, which are kept in directories of privateDirMode.
+const (
+	privateFileMode os.FileMode = 0600
+	privateDirMode  os.FileMode = 0700
+)
+
+// mirrorFiles makes dir hold exactly files, by path relative to dir. Files whose content is
+// nil are known to be unchanged and left as they are. It reports whether anything changed.
+func mirrorFiles(dir string, files map[string][]byte) (bool, error) {
+	return mirrorPrivateFiles(dir, files, nil)
+}
+
+// mirrorPrivateFiles is mirrorFiles for files some of which hold secrets. Those named in
+// private are only readable by the watcher, as are the directories below dir holding them.
+func mirrorPrivateFiles(dir string, files map[string][]byte, private map[string]bool) (bool, error) {
+	names := []string{}
+	for name := range files {
+		if !safeRelativePath(name) {
+			return false, fmt.Errorf("refusing to write %q outside %v", name, dir)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	changed := false
+	wanted := map[string]bool{}
+	for _, name := range names {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		wanted[target] = true
+		mode := renderedFileMode
+		if private[name] {
+			mode = privateFileMode
+			if err := makePrivate(dir, target); err != nil {
+				return changed, err
+			}
+		}
+		content := files[name]
+		if content == nil {
+			continue
+		}
+		if current, err := ioutil.ReadFile(target); err == nil && bytes.Equal(current, content) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return changed, err
+		}
+		if err := writeFileAtomic(target, content, mode); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	// remove what is no longer published, deepest first so emptied directories go too
+	existing := []string{}
+	filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err == nil && name != dir {
+			existing = append(existing, name)
+		}
+		return nil
+	})
+	sort.Sort(sort.Reverse(sort.StringSlice(existing)))
+	for _, name := range existing {
+		info, err := os.Lstat(name)
+		if err != nil || wanted[name] {
+			continue
+		}
+		if info.IsDir() {
+			if entries, _ := ioutil.ReadDir(name); len(entries) > 0 {
+				continue
+			}
+		}
+		if err := os.Remove(name); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// makePrivate creates the directories between dir and target only their owner can enter, and
+// takes away the access others had to them and to target, e.g. when written before secrets
+// were kept private.
+func makePrivate(dir string, target string) error {
+	parent := filepath.Dir(target)
+	if err := os.MkdirAll(parent, privateDirMode); err != nil {
+		return err
+	}
+	for d := parent; within(d, dir) && d != filepath.Clean(dir); d = filepath.Dir(d) {
+		if err := os.Chmod(d, privateDirMode); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(target, privateFileMode); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// safeRelativePath rejects names that would escape the directory they are written to, such
+// as object keys or archive entries containing "..".
+func safeRelativePath(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || filepath.IsAbs(name) || strings.Contains(name, "\\") {
+		return false
+	}
+	clean := filepath.Clean(filepath.FromSlash(name))
+	return clean != "." && clean != ".." && !strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,152 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+var (
+	spiffeEndpointSocket = flag.String("spiffe-endpoint-socket", os.Getenv("SPIFFE_ENDPOINT_SOCKET"), "SPIFFE Workload API socket, such as unix:///run/spire/sockets/agent.sock, to fetch an X.509 SVID from for mTLS on outbound requests. Defaults to SPIFFE_ENDPOINT_SOCKET.")
+
+	// spiffeServerIDs bind hosts to the SPIFFE ID they must present, as host=id
+	spiffeServerIDs stringList
+)
+
+func init() {
+	flag.Var(&spiffeServerIDs, "spiffe-server-id", "Host whose server is verified by its SVID rather than a certificate for its name, and the SPIFFE ID it must present, as host=id, e.g. prometheus.monitoring.svc=spiffe://example.org/ns/monitoring/sa/prometheus. May be repeated. Other hosts are verified as usual against the system roots.")
+}
+
+// spiffe is the SVID source when --spiffe-endpoint-socket is set, nil otherwise.
+var spiffe *spiffeSource
+
+// spiffeSource keeps the watcher's X.509 SVID and trust bundles up to date from the Workload
+// API, which streams a new SVID before the current one expires.
+type spiffeSource struct {
+	source *workloadapi.X509Source
+	// servers are the SPIFFE IDs by host from --spiffe-server-id
+	servers map[string]spiffeid.ID
+}
+
+// startSPIFFE connects to the Workload API, waiting for the first SVID.
+func startSPIFFE() error {
+	if *spiffeEndpointSocket == "" {
+		return nil
+	}
+	s := &spiffeSource{servers: map[string]spiffeid.ID{}}
+	for _, spec := range spiffeServerIDs {
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			return fmt.Errorf("--spiffe-server-id %q is not in the form host=spiffe://id", spec)
+		}
+		id, err := spiffeid.FromString(spec[i+1:])
+		if err != nil {
+			return fmt.Errorf("--spiffe-server-id %q: %v", spec, err)
+		}
+		s.servers[strings.ToLower(spec[:i])] = id
+	}
+
+	addr := *spiffeEndpointSocket
+	if !strings.Contains(addr, "://") {
+		addr = "unix://" + addr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(
+		workloadapi.WithAddr(addr),
+		workloadapi.WithLogger(log.StandardLogger()),
+	))
+	if err != nil {
+		return fmt.Errorf("no SVID received from the Workload API at %v: %v", *spiffeEndpointSocket, err)
+	}
+	s.source = source
+	go s.logUpdates()
+	spiffe = s
+	return nil
+}
+
+// logUpdates logs each SVID the Workload API hands out.
+func (s *spiffeSource) logUpdates() {
+	for range s.source.Updated() {
+		svid, err := s.source.GetX509SVID()
+		if err != nil {
+			log.WithError(err).Error("Invalid SVID from the Workload API")
+			continue
+		}
+		log.Infof("Received SVID %v, valid until %v", svid.ID, svid.Certificates[0].NotAfter.Format(time.RFC3339))
+	}
+}
+
+// clientTLSConfig presents the SVID to servers that ask for a client certificate. The hosts
+// bound by --spiffe-server-id must present an SVID with their ID, verified against the
+// bundle of its trust domain. Any other server is verified as usual against the system
+// roots, so requests to public APIs and secret stores keep working and no workload in the
+// trust domain can stand in for them.
+func (s *spiffeSource) clientTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: tlsconfig.GetClientCertificate(s.source),
+		// verification is done by verifyConnection, as SVIDs identify servers by URI
+		// rather than by host name
+		InsecureSkipVerify: true,
+		VerifyConnection:   s.verifyConnection,
+	}
+}
+
+func (s *spiffeSource) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("server presented no certificate")
+	}
+
+	expected, bound := s.servers[strings.ToLower(state.ServerName)]
+	if !bound {
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{DNSName: state.ServerName, Intermediates: intermediates})
+		return err
+	}
+	id, _, err := x509svid.Verify(state.PeerCertificates, s.source)
+	if err != nil {
+		return fmt.Errorf("verifying the SVID of %v: %v", state.ServerName, err)
+	}
+	if id != expected {
+		return fmt.Errorf("%v presented SVID %q rather than %v", state.ServerName, id, expected)
+	}
+	return nil
+}
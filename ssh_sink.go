@@ -0,0 +1,285 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sshTimeout limits copying the files to a host, and running the reload command on it.
+const sshTimeout = 2 * time.Minute
+
+var (
+	sshTargets        stringList
+	sshReloadCommand  = flag.String("ssh-reload-command", "", "Command run on every --ssh-target host after files were copied to it, e.g. \"curl -fsS -X POST http://localhost:9090/-/reload\".")
+	sshBinary         = flag.String("ssh-binary", "ssh", "Path to the OpenSSH ssh binary.")
+	sshKeyFile        = flag.String("ssh-key-file", "", "Private key to log in to the --ssh-target hosts with.")
+	sshKnownHostsFile = flag.String("ssh-known-hosts-file", "", "known_hosts file the host keys of --ssh-target hosts are checked against. Required with --ssh-target.")
+	sshParallelism    = flag.Int("ssh-parallelism", 10, "How many --ssh-target hosts are copied to at once.")
+)
+
+func init() {
+	flag.Var(&sshTargets, "ssh-target", "Remote directory, as ssh://[user@]host[:port]/path, the rendered files are copied to over SSH after every successful run. The host needs a POSIX shell and tar. "+
+		"Pipelines from --config with remote_sinks copy to a directory named after them below it. May be repeated.")
+}
+
+// sshHost is a directory on a remote host, and what was last copied to it.
+type sshHost struct {
+	target      string
+	destination string
+	port        string
+	dir         string
+	// copied holds the hash of every file last copied, nil after a failure so the next
+	// write copies everything again
+	copied map[string]string
+	// reloadPending is set while files were copied but the reload command failed
+	reloadPending bool
+}
+
+// sshSink copies the rendered files to remote hosts over SSH, one scp-like stream per host,
+// and then runs the reload command there.
+type sshSink struct {
+	hosts []*sshHost
+}
+
+// checkSSHTargets checks the --ssh-target flags up front, as sinks are built without
+// returning errors.
+func checkSSHTargets() error {
+	for _, target := range sshTargets {
+		if _, err := parseSSHTarget(target, ""); err != nil {
+			return err
+		}
+	}
+	if len(sshTargets) > 0 && *sshKnownHostsFile == "" {
+		return fmt.Errorf("--ssh-target needs --ssh-known-hosts-file to check host keys against")
+	}
+	if len(sshTargets) > 0 && *sshParallelism < 1 {
+		return fmt.Errorf("--ssh-parallelism must be at least 1")
+	}
+	return nil
+}
+
+func parseSSHTarget(target, subdir string) (*sshHost, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "ssh" || u.Hostname() == "" || u.Path == "" {
+		return nil, fmt.Errorf("--ssh-target %q isn't of the form ssh://[user@]host[:port]/path", target)
+	}
+	h := &sshHost{target: target, destination: u.Hostname(), port: u.Port(), dir: path.Join(u.Path, subdir)}
+	if u.User != nil {
+		h.destination = u.User.Username() + "@" + h.destination
+	}
+	return h, nil
+}
+
+// newSSHSink builds the sink for targets that passed checkSSHTargets, copying to subdir
+// below each of them.
+func newSSHSink(subdir string) *sshSink {
+	s := &sshSink{}
+	for _, target := range sshTargets {
+		h, _ := parseSSHTarget(target, subdir)
+		s.hosts = append(s.hosts, h)
+	}
+	return s
+}
+
+func (s *sshSink) name() string {
+	if len(s.hosts) == 1 {
+		return "ssh " + s.hosts[0].target
+	}
+	return fmt.Sprintf("ssh to %d hosts", len(s.hosts))
+}
+
+func (s *sshSink) files() []string {
+	return nil
+}
+
+// write copies the files to every host in parallel. A host that fails doesn't stop the
+// others from being updated, it is tried again with all files on the next write.
+func (s *sshSink) write(logger *log.Entry, files []renderedFile) error {
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		failed   int
+		firstErr error
+	)
+	slots := make(chan struct{}, *sshParallelism)
+	for _, h := range s.hosts {
+		wg.Add(1)
+		go func(h *sshHost) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			hostLogger := logger.WithField("host", h.target)
+			if err := h.write(hostLogger, files); err != nil {
+				hostLogger.WithError(err).Error("Error copying config over SSH")
+				lock.Lock()
+				failed++
+				if firstErr == nil {
+					firstErr = err
+				}
+				lock.Unlock()
+			}
+		}(h)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return fmt.Errorf("%d of %d hosts failed, %v", failed, len(s.hosts), firstErr)
+	}
+	return nil
+}
+
+// write copies the files whose content changed since the last copy and reloads the host.
+func (h *sshHost) write(logger *log.Entry, files []renderedFile) error {
+	changed := []renderedFile{}
+	hashes := map[string]string{}
+	for _, file := range files {
+		sum := sha256Hex(file.content)
+		hashes[file.name] = sum
+		if h.copied == nil || h.copied[file.name] != sum {
+			changed = append(changed, file)
+		}
+	}
+	if len(changed) == 0 && !h.reloadPending {
+		logger.Debug("Rendered files are already copied")
+		return nil
+	}
+	if len(changed) > 0 {
+		if err := h.copy(changed); err != nil {
+			h.copied = nil
+			return fmt.Errorf("copying to %v: %v", h.destination, err)
+		}
+		h.copied = hashes
+		logger.Infof("Copied %d files to %v:%v", len(changed), h.destination, h.dir)
+	}
+	if *sshReloadCommand == "" {
+		return nil
+	}
+	if err := h.run(*sshReloadCommand, nil); err != nil {
+		h.reloadPending = true
+		return fmt.Errorf("reloading %v: %v", h.destination, err)
+	}
+	h.reloadPending = false
+	logger.Info("Ran the reload command")
+	return nil
+}
+
+// copy streams the files as a tar archive, which the host unpacks to a temporary directory
+// next to the target and then renames into place one by one, so readers never see a
+// partially written file.
+func (h *sshHost) copy(files []renderedFile) error {
+	archive := &bytes.Buffer{}
+	tw := tar.NewWriter(archive)
+	dirs := map[string]bool{}
+	moves := []string{}
+	for _, file := range files {
+		header := &tar.Header{
+			Name:     file.name,
+			Mode:     int64(renderedFileMode),
+			Size:     int64(len(file.content)),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.content); err != nil {
+			return err
+		}
+		if dir := path.Dir(file.name); dir != "." {
+			dirs[path.Join(h.dir, dir)] = true
+		}
+		moves = append(moves, fmt.Sprintf(`mv -f "$tmp"/%v %v`, shellQuote(file.name), shellQuote(path.Join(h.dir, file.name))))
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	script := []string{
+		"set -e",
+		"mkdir -p " + shellQuote(h.dir),
+		"tmp=$(mktemp -d " + shellQuote(path.Join(h.dir, ".prom-config-watcher.XXXXXX")) + ")",
+		`trap 'rm -rf "$tmp"' EXIT`,
+		`tar -xf - -C "$tmp"`,
+	}
+	sorted := []string{}
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+	for _, dir := range sorted {
+		script = append(script, "mkdir -p "+shellQuote(dir))
+	}
+	script = append(script, moves...)
+	return h.run(strings.Join(script, "\n"), archive)
+}
+
+// run runs a command through the host's shell.
+func (h *sshHost) run(command string, stdin *bytes.Buffer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sshTimeout)
+	defer cancel()
+	args := sshOptions(*sshKeyFile, *sshKnownHostsFile)
+	if h.port != "" {
+		args = append(args, "-p", h.port)
+	}
+	cmd := exec.CommandContext(ctx, *sshBinary, append(args, h.destination, command)...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %v", err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// sshOptions are the OpenSSH options shared by everything that logs in to a remote host,
+// never prompting and checking host keys against knownHosts, which each of them requires.
+func sshOptions(keyFile, knownHosts string) []string {
+	args := []string{"-o", "BatchMode=yes"}
+	if keyFile != "" {
+		args = append(args, "-i", keyFile, "-o", "IdentitiesOnly=yes")
+	}
+	return append(args, "-o", "UserKnownHostsFile="+knownHosts, "-o", "StrictHostKeyChecking=yes")
+}
+
+// shellQuote quotes an argument for a POSIX shell.
+func shellQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,53 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import "flag"
+
+var (
+	awsSSMEnabled         = flag.Bool("aws-ssm", false, "Resolve ${ssm:/parameter/name} references in source files from AWS Systems Manager Parameter Store, decrypting SecureString parameters. Append :version or :label to pin a parameter.")
+	awsSSMRefreshInterval = flag.Duration("aws-ssm-refresh-interval", 0, "How often Parameter Store parameters are read again, when more often than --secret-refresh-interval.")
+)
+
+// ssmParameterStore resolves ${ssm:name} references with GetParameter.
+type ssmParameterStore struct {
+	aws *awsClient
+}
+
+func (s *ssmParameterStore) resolve(ref string) (secretValue, error) {
+	input := struct {
+		Name           string
+		WithDecryption bool
+	}{Name: ref, WithDecryption: true}
+	out := struct {
+		Parameter struct {
+			Value string
+		}
+	}{}
+	if err := s.aws.call("ssm", "AmazonSSM.GetParameter", input, &out); err != nil {
+		return secretValue{}, err
+	}
+	return secretValue{value: out.Parameter.Value, refresh: *awsSSMRefreshInterval}, nil
+}
@@ -0,0 +1,160 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// loopStateTimeout is how long a state dump waits for a pipeline loop, which doesn't answer
+// while a run is in progress.
+const loopStateTimeout = 2 * time.Second
+
+var stateDumpFile = flag.String("state-dump-file", "", "File that state dumps requested with POST /debug/state are written to. They are logged when unset.")
+
+// loopState is a pipeline loop's internal state.
+type loopState struct {
+	Pipeline      string         `json:"pipeline"`
+	WatchPath     string         `json:"watch_path"`
+	TargetPath    string         `json:"target_path"`
+	Busy          bool           `json:"busy"`
+	Pending       changeSetState `json:"pending"`
+	BatchStart    time.Time      `json:"batch_start"`
+	LastChange    time.Time      `json:"last_change"`
+	LastProcess   time.Time      `json:"last_process"`
+	TimerDue      time.Time      `json:"timer_due"`
+	RolloutActive bool           `json:"rollout_active"`
+}
+
+// state asks the loop for its state, reporting it busy if it doesn't answer in time.
+func (l *pipelineLoop) state() loopState {
+	reply := make(chan loopState, 1)
+	timeout := time.After(loopStateTimeout)
+	select {
+	case l.stateRequests <- reply:
+		select {
+		case state := <-reply:
+			return state
+		case <-timeout:
+		}
+	case <-timeout:
+	}
+	return loopState{Pipeline: l.pipe.name, WatchPath: l.pipe.watchPath, TargetPath: l.pipe.targetPath, Busy: true}
+}
+
+// stateDump is the watcher's internal state, for diagnosing a watcher that seems stuck.
+type stateDump struct {
+	Time             time.Time       `json:"time"`
+	Loops            []loopState     `json:"loops"`
+	PendingReload    changeSetState  `json:"pending_reload"`
+	ReloadFailures   uint64          `json:"reload_failures"`
+	AwaitingApproval []*stagedChange `json:"awaiting_approval,omitempty"`
+	LoopHeartbeat    string          `json:"loop_heartbeat_age"`
+	WatcherHeartbeat string          `json:"watcher_heartbeat_age"`
+	Status           statusDocument  `json:"status"`
+}
+
+func (p *pipelineLoops) dump() stateDump {
+	dump := stateDump{
+		Time:             time.Now(),
+		Loops:            []loopState{},
+		ReloadFailures:   atomic.LoadUint64(&p.reloads.failures),
+		LoopHeartbeat:    loopHeartbeat.age().String(),
+		WatcherHeartbeat: watcherHeartbeat.age().String(),
+		Status:           board.document(),
+	}
+	for _, loop := range p.loops {
+		dump.Loops = append(dump.Loops, loop.state())
+	}
+	sort.Slice(dump.Loops, func(i, j int) bool { return dump.Loops[i].Pipeline < dump.Loops[j].Pipeline })
+	p.reloads.mu.Lock()
+	dump.PendingReload = p.reloads.pending.state()
+	p.reloads.mu.Unlock()
+	if approvals != nil {
+		dump.AwaitingApproval = approvals.pending()
+	}
+	return dump
+}
+
+// stateRequest is a request for a state dump, answered by the watch loop which owns the
+// pipeline loops.
+type stateRequest struct {
+	reply chan stateDump
+}
+
+// stateHandler returns a state dump on GET. POST writes it to --state-dump-file, or the log,
+// for collecting alongside the watcher's other output. SIGUSR2 already toggles debug logging,
+// so dumps are only requested over HTTP.
+func stateHandler(requests chan<- stateRequest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		request := stateRequest{reply: make(chan stateDump, 1)}
+		select {
+		case requests <- request:
+		case <-time.After(loopStateTimeout):
+			http.Error(w, "the watch loop is not responding", http.StatusServiceUnavailable)
+			return
+		}
+		body, err := json.MarshalIndent(<-request.reply, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.Method == http.MethodPost {
+			writeStateDump(body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(body, '\n'))
+	}
+}
+
+func writeStateDump(body []byte) {
+	body, err := stateEncryption.seal(body)
+	if err != nil {
+		log.WithError(err).Error("Unable to encrypt state dump")
+		return
+	}
+	if *stateDumpFile == "" {
+		log.WithField("state", string(body)).Info("State dump")
+		return
+	}
+	if err := ioutil.WriteFile(*stateDumpFile, append(body, '\n'), 0644); err != nil {
+		log.WithField("file", *stateDumpFile).WithError(err).Error("Error writing state dump")
+		return
+	}
+	log.WithField("file", *stateDumpFile).Info("Wrote state dump")
+}
@@ -0,0 +1,213 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	stateKeyFile = flag.String("state-encryption-key-file", "", "File holding a 256 bit key, hex or base64 encoded, that state written to disk such as --state-dump-file is encrypted with. Read it back with the decrypt-state command.")
+	stateKMSKey  = flag.String("state-encryption-kms-key", "", "AWS KMS key, by id, ARN or alias, that generates the data key state written to disk is encrypted with. The data key is stored encrypted alongside the state.")
+)
+
+// encryptedState is the envelope encrypted state is written in.
+type encryptedState struct {
+	// Encrypted is the cipher, always aes-256-gcm
+	Encrypted string `json:"encrypted"`
+	// KMSKey and DataKey are set when the key came from KMS, DataKey being the key encrypted
+	// by KMS
+	KMSKey     string `json:"kms_key,omitempty"`
+	DataKey    []byte `json:"data_key,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// stateCipher encrypts state before it is written to disk.
+type stateCipher struct {
+	kmsKey string
+	kms    *awsClient
+
+	mu sync.Mutex
+	// key is the file key, or the data key generated by KMS on first use
+	key     []byte
+	dataKey []byte
+}
+
+// stateEncryption is set when state is encrypted at rest.
+var stateEncryption *stateCipher
+
+func configureStateEncryption() error {
+	switch {
+	case *stateKeyFile != "" && *stateKMSKey != "":
+		return fmt.Errorf("--state-encryption-key-file and --state-encryption-kms-key can't be used together")
+	case *stateKeyFile != "":
+		key, err := readStateKey(*stateKeyFile)
+		if err != nil {
+			return err
+		}
+		stateEncryption = &stateCipher{key: key}
+	case *stateKMSKey != "":
+		aws, err := newAWSClient()
+		if err != nil {
+			return fmt.Errorf("aws: %v", err)
+		}
+		stateEncryption = &stateCipher{kmsKey: *stateKMSKey, kms: aws}
+	}
+	return nil
+}
+
+// readStateKey reads a 256 bit key stored hex or base64 encoded, or as is.
+func readStateKey(name string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSpace(string(contents))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if len(contents) == 32 {
+		return contents, nil
+	}
+	return nil, fmt.Errorf("%v doesn't hold a 256 bit key", name)
+}
+
+// currentKey returns the key to encrypt with, generating a data key with KMS the first time.
+func (c *stateCipher) currentKey() ([]byte, []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.key == nil {
+		generated := struct {
+			CiphertextBlob []byte
+			Plaintext      []byte
+		}{}
+		input := map[string]string{"KeyId": c.kmsKey, "KeySpec": "AES_256"}
+		if err := c.kms.call("kms", "TrentService.GenerateDataKey", input, &generated); err != nil {
+			return nil, nil, fmt.Errorf("generating a data key: %v", err)
+		}
+		c.key, c.dataKey = generated.Plaintext, generated.CiphertextBlob
+	}
+	return c.key, c.dataKey, nil
+}
+
+// seal encrypts state, leaving it as is when encryption isn't configured.
+func (c *stateCipher) seal(state []byte) ([]byte, error) {
+	if c == nil {
+		return state, nil
+	}
+	key, dataKey, err := c.currentKey()
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	envelope := encryptedState{Encrypted: "aes-256-gcm", KMSKey: c.kmsKey, DataKey: dataKey, Nonce: make([]byte, gcm.NonceSize())}
+	if _, err := rand.Read(envelope.Nonce); err != nil {
+		return nil, err
+	}
+	envelope.Ciphertext = gcm.Seal(nil, envelope.Nonce, state, nil)
+	return json.Marshal(envelope)
+}
+
+// open decrypts state written by seal.
+func (c *stateCipher) open(sealed []byte) ([]byte, error) {
+	envelope := encryptedState{}
+	if err := json.Unmarshal(sealed, &envelope); err != nil || envelope.Encrypted == "" {
+		return nil, fmt.Errorf("not encrypted state")
+	}
+	if envelope.Encrypted != "aes-256-gcm" {
+		return nil, fmt.Errorf("unsupported cipher %q", envelope.Encrypted)
+	}
+	var key []byte
+	switch {
+	case envelope.DataKey != nil:
+		if c == nil || c.kms == nil {
+			return nil, fmt.Errorf("the state was encrypted with KMS key %v, set --state-encryption-kms-key to read it", envelope.KMSKey)
+		}
+		decrypted := struct{ Plaintext []byte }{}
+		if err := c.kms.call("kms", "TrentService.Decrypt", map[string][]byte{"CiphertextBlob": envelope.DataKey}, &decrypted); err != nil {
+			return nil, fmt.Errorf("decrypting the data key: %v", err)
+		}
+		key = decrypted.Plaintext
+	case c != nil && c.kms == nil:
+		key = c.key
+	default:
+		return nil, fmt.Errorf("the state was encrypted with a key file, set --state-encryption-key-file to read it")
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, envelope.Nonce, envelope.Ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// runDecryptState prints state written encrypted, such as a state dump.
+func runDecryptState() int {
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "decrypt-state needs the file to decrypt")
+		return exitInvalid
+	}
+	if err := configureStateEncryption(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitInvalid
+	}
+	sealed, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitInvalid
+	}
+	state, err := stateEncryption.open(sealed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to decrypt %v: %v\n", flag.Arg(0), err)
+		return exitInvalid
+	}
+	os.Stdout.Write(state)
+	return exitOK
+}
@@ -0,0 +1,188 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// statusAnnotation is the annotation the status is written to on --status-object.
+const statusAnnotation = "prom-config-watcher/status"
+
+var (
+	statusConfigMap = flag.String("status-configmap", "", "Name of a ConfigMap in the watcher's namespace that the latest config hash, reload time and the errors of the last run and reload are written to. Created if missing.")
+	statusObject    = flag.String("status-object", "", "Object whose "+statusAnnotation+" annotation the latest status is written to, as apiVersion/Kind/name in the watcher's namespace.")
+)
+
+// configStatus is what is reported back after every run and reload.
+type configStatus struct {
+	Generation        string `json:"generation"`
+	LastProcessed     string `json:"lastProcessed,omitempty"`
+	LastReload        string `json:"lastReload,omitempty"`
+	LastReloadSuccess bool   `json:"lastReloadSuccess"`
+	// LastRunError and LastReloadError are kept apart so a successful reload doesn't hide a
+	// run that failed afterwards, or the other way round
+	LastRunError    string `json:"lastRunError"`
+	LastReloadError string `json:"lastReloadError"`
+}
+
+// statusReporter writes the config status to a ConfigMap and/or annotation so tooling that
+// pushed the config can read back whether it landed. Updates are written one at a time by a
+// single goroutine, so they can't be reordered and the pipeline loop never waits on the API
+// server. A nil reporter does nothing.
+type statusReporter struct {
+	kube      *kubeClient
+	configMap string
+	object    *objectRef
+	// wake asks for the latest status to be written, coalescing changes made during a write
+	wake chan struct{}
+
+	mu     sync.Mutex
+	status configStatus
+}
+
+func newStatusReporter() (*statusReporter, error) {
+	kube, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	reporter := &statusReporter{kube: kube, configMap: *statusConfigMap, wake: make(chan struct{}, 1)}
+	if *statusObject != "" {
+		object, err := parseObjectRef(*statusObject, kube.namespace)
+		if err != nil {
+			return nil, err
+		}
+		reporter.object = &object
+	}
+	go reporter.run()
+	return reporter, nil
+}
+
+// runFinished records a processing run, updating the generation when the run succeeded.
+func (s *statusReporter) runFinished(rendered []renderedFile, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.status.LastProcessed = time.Now().UTC().Format(time.RFC3339)
+	if err == nil {
+		s.status.Generation = renderHash(rendered)
+	}
+	s.status.LastRunError = errorString(err)
+	s.mu.Unlock()
+	s.requestPublish()
+}
+
+// reloadFinished records the outcome of a reload sequence.
+func (s *statusReporter) reloadFinished(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.status.LastReload = time.Now().UTC().Format(time.RFC3339)
+	s.status.LastReloadSuccess = err == nil
+	s.status.LastReloadError = errorString(err)
+	s.mu.Unlock()
+	s.requestPublish()
+}
+
+func (s *statusReporter) requestPublish() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *statusReporter) run() {
+	for range s.wake {
+		s.mu.Lock()
+		current := s.status
+		s.mu.Unlock()
+		s.publish(current)
+	}
+}
+
+func (s *statusReporter) publish(current configStatus) {
+	status, err := json.Marshal(current)
+	if err != nil {
+		log.WithError(err).Error("Error encoding status")
+		return
+	}
+
+	if s.configMap != "" {
+		if err := s.writeConfigMap(current); err != nil {
+			log.WithError(err).Errorf("Error writing status to ConfigMap %v", s.configMap)
+		}
+	}
+	if s.object != nil {
+		patch, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{statusAnnotation: string(status)},
+			},
+		})
+		_, code, err := s.kube.do(http.MethodPatch, s.object.path(), "application/merge-patch+json", patch)
+		if err == nil && code == http.StatusNotFound {
+			err = fmt.Errorf("not found")
+		}
+		if err != nil {
+			log.WithError(err).Errorf("Error annotating %v %v with status", s.object.Kind, s.object.Name)
+		}
+	}
+}
+
+// writeConfigMap patches the status into the ConfigMap's data, one key per field, creating
+// the ConfigMap if it doesn't exist yet.
+func (s *statusReporter) writeConfigMap(current configStatus) error {
+	data := map[string]string{
+		"generation":        current.Generation,
+		"lastProcessed":     current.LastProcessed,
+		"lastReload":        current.LastReload,
+		"lastReloadSuccess": fmt.Sprint(current.LastReloadSuccess),
+		"lastRunError":      current.LastRunError,
+		"lastReloadError":   current.LastReloadError,
+	}
+	configMap := objectRef{APIVersion: "v1", Kind: "ConfigMap", Name: s.configMap, Namespace: s.kube.namespace}
+	patch, _ := json.Marshal(map[string]interface{}{"data": data})
+	_, code, err := s.kube.do(http.MethodPatch, configMap.path(), "application/merge-patch+json", patch)
+	if err != nil || code != http.StatusNotFound {
+		return err
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]string{"name": s.configMap, "namespace": s.kube.namespace},
+		"data":       data,
+	})
+	_, _, err = s.kube.do(http.MethodPost, "/api/v1/namespaces/"+s.kube.namespace+"/configmaps", "application/json", body)
+	return err
+}
@@ -0,0 +1,252 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileStatus describes a file from the last render.
+type fileStatus struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Hash   string `json:"hash"`
+	Size   int    `json:"size"`
+}
+
+// pipelineStatus is the outcome of a pipeline's last run.
+type pipelineStatus struct {
+	Name            string       `json:"name"`
+	WatchPath       string       `json:"watch_path"`
+	LastRun         time.Time    `json:"last_run"`
+	RunID           string       `json:"run_id"`
+	Files           []fileStatus `json:"files"`
+	Validation      string       `json:"validation"`
+	ValidationError string       `json:"validation_error,omitempty"`
+	Error           string       `json:"error,omitempty"`
+
+	// run is the run's event, published by runHandedOn
+	run *StatusEvent
+}
+
+// reloadStatus is the outcome of the last reload of a step, or of the whole sequence.
+type reloadStatus struct {
+	Name    string    `json:"name"`
+	Time    time.Time `json:"time"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// statusBoard collects what the status page shows.
+type statusBoard struct {
+	mu        sync.Mutex
+	pipelines []*pipelineStatus
+	reload    *reloadStatus
+	steps     []*reloadStatus
+}
+
+var board = &statusBoard{}
+
+// runFinished records the outcome of a pipeline run. validated is false when the rendered
+// files failed validation, in which case err is the validation failure.
+func (b *statusBoard) runFinished(p *pipeline, runID string, rendered []renderedFile, validated bool, err error) {
+	status := &pipelineStatus{Name: p.name, WatchPath: p.watchPath, LastRun: time.Now(), RunID: runID, Validation: "passed"}
+	for _, file := range rendered {
+		sum := sha256.Sum256(file.content)
+		status.Files = append(status.Files, fileStatus{Name: file.name, Source: file.source, Hash: hex.EncodeToString(sum[:]), Size: len(file.content)})
+	}
+	switch {
+	case len(p.validators) == 0:
+		status.Validation = "none"
+	case !validated:
+		status.Validation = "failed"
+		status.ValidationError = errorString(err)
+	}
+	if validated {
+		status.Error = errorString(err)
+	}
+	status.run = &StatusEvent{Kind: StatusEvent_RUN, Pipeline: p.name, RunId: runID, Success: err == nil, Validation: status.Validation, Error: errorString(err)}
+	for _, file := range rendered {
+		status.run.Files = append(status.run.Files, file.name)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, existing := range b.pipelines {
+		if existing.Name == p.name {
+			b.pipelines[i] = status
+			return
+		}
+	}
+	b.pipelines = append(b.pipelines, status)
+}
+
+// runHandedOn publishes the event of a run recorded by runFinished once the watch loop has
+// decided whether its changes are reloaded, so subscribers know if a reload follows.
+func (b *statusBoard) runHandedOn(p *pipeline, runID string, reload bool) {
+	b.mu.Lock()
+	var event *StatusEvent
+	for _, existing := range b.pipelines {
+		if existing.Name == p.name && existing.RunID == runID {
+			event, existing.run = existing.run, nil
+		}
+	}
+	b.mu.Unlock()
+	if event == nil {
+		return
+	}
+	event.Reload = reload
+	statusEvents.publish(event)
+}
+
+// reloadFinished records the outcome of a reload sequence.
+func (b *statusBoard) reloadFinished(err error) {
+	statusEvents.publish(&StatusEvent{Kind: StatusEvent_RELOAD, Success: err == nil, Error: errorString(err)})
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reload = &reloadStatus{Name: "all", Time: time.Now(), Success: err == nil, Error: errorString(err)}
+}
+
+// stepFinished records the outcome of reloading a single step.
+func (b *statusBoard) stepFinished(name string, err error) {
+	status := &reloadStatus{Name: name, Time: time.Now(), Success: err == nil, Error: errorString(err)}
+	statusEvents.publish(&StatusEvent{Kind: StatusEvent_STEP, Step: name, Success: err == nil, Error: errorString(err)})
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, existing := range b.steps {
+		if existing.Name == name {
+			b.steps[i] = status
+			return
+		}
+	}
+	b.steps = append(b.steps, status)
+}
+
+// statusDocument is everything on the status page.
+type statusDocument struct {
+	Build       buildInfo          `json:"build"`
+	Generations *configGenerations `json:"generations"`
+	Pipelines   []pipelineStatus   `json:"pipelines"`
+	LastReload  *reloadStatus      `json:"last_reload"`
+	Steps       []reloadStatus     `json:"steps"`
+}
+
+func (b *statusBoard) document() statusDocument {
+	doc := statusDocument{Build: currentBuild()}
+	generations.mu.Lock()
+	doc.Generations = &configGenerations{Rendered: generations.Rendered, Applied: generations.Applied, LastApplied: generations.LastApplied}
+	generations.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, p := range b.pipelines {
+		doc.Pipelines = append(doc.Pipelines, *p)
+	}
+	if b.reload != nil {
+		reload := *b.reload
+		doc.LastReload = &reload
+	}
+	for _, step := range b.steps {
+		doc.Steps = append(doc.Steps, *step)
+	}
+	return doc
+}
+
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+	"short": func(hash string) string {
+		if len(hash) > 12 {
+			return hash[:12]
+		}
+		return hash
+	},
+	"when": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Format(time.RFC3339) + " (" + time.Since(t).Round(time.Second).String() + " ago)"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>prom-config-watcher status</title>
+<style>body{font-family:sans-serif;margin:2em}table{border-collapse:collapse;margin-bottom:1.5em}td,th{border:1px solid #ccc;padding:4px 8px;text-align:left}.failed{color:#c00}.ok{color:#080}code{font-size:90%}</style>
+</head>
+<body>
+<h1>prom-config-watcher</h1>
+<p>{{.Build.Version}} ({{.Build.Commit}}, built {{.Build.BuildDate}}) &middot; <a href="?format=json">JSON</a></p>
+<h2>Config</h2>
+<table>
+<tr><th>Rendered</th><td><code>{{short .Generations.Rendered}}</code></td></tr>
+<tr><th>Applied</th><td><code>{{short .Generations.Applied}}</code> at {{when .Generations.LastApplied}}</td></tr>
+</table>
+<h2>Last reload</h2>
+{{with .LastReload}}<p class="{{if .Success}}ok{{else}}failed{{end}}">{{if .Success}}Succeeded{{else}}Failed: {{.Error}}{{end}} at {{when .Time}}</p>{{else}}<p>No reload sent yet.</p>{{end}}
+{{if .Steps}}<table>
+<tr><th>Step</th><th>Last reload</th><th>Result</th></tr>
+{{range .Steps}}<tr><td>{{.Name}}</td><td>{{when .Time}}</td><td class="{{if .Success}}ok{{else}}failed{{end}}">{{if .Success}}ok{{else}}{{.Error}}{{end}}</td></tr>
+{{end}}</table>{{end}}
+{{range .Pipelines}}<h2>Pipeline {{.Name}}</h2>
+<p>Watching <code>{{.WatchPath}}</code>, last run {{when .LastRun}} (run {{.RunID}})</p>
+<p>Validation: <span class="{{if eq .Validation "failed"}}failed{{else}}ok{{end}}">{{.Validation}}</span>{{with .ValidationError}} &mdash; {{.}}{{end}}</p>
+{{with .Error}}<p class="failed">Error: {{.}}</p>{{end}}
+<table>
+<tr><th>File</th><th>Source</th><th>Size</th><th>SHA-256</th></tr>
+{{range .Files}}<tr><td>{{.Name}}</td><td><code>{{.Source}}</code></td><td>{{.Size}}</td><td><code>{{short .Hash}}</code></td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// statusHandler serves the status page as HTML to browsers and as JSON otherwise, or as asked
+// for with ?format=html or ?format=json.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	doc := board.document()
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		format = "html"
+	}
+
+	if format == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusPage.Execute(w, doc); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	body, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,339 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var notifySpecs stringList
+
+func init() {
+	flag.Var(&notifySpecs, "notify", "Reload step as comma separated key=value pairs, e.g. \"name=alertmanager,url=http://localhost:9093/-/reload,verify=30s\". "+
+		"Steps run in the order given and replace --prometheus-url. Keys: name, preset (a known service supplying defaults for the other keys), url, verify (time to wait for the service to become healthy before continuing), "+
+		"health (| separated health check urls), files (| separated globs of changes that run the step, replacing the preset's globs, a step without any runs for the changes no other step's globs match), on-failure (stop or continue), "+
+		"signal (e.g. HUP) with process or pid-file to reload by signalling a process instead of calling url, whose health, without health urls, is that the process keeps running, "+
+		"and credentials (a secret reference such as keyring:service/account) sent as auth (bearer or basic) with the reload and health checks. May be repeated.")
+}
+
+// reloadStep is a single service notified as part of a reload sequence.
+type reloadStep struct {
+	name            string
+	url             string
+	health          []string
+	verify          time.Duration
+	files           []string
+	continueOnError bool
+	validators      []validator
+	noReload        bool
+
+	// signal reloads by signalling a process rather than posting to url
+	signal  syscall.Signal
+	process string
+	pidFile string
+
+	// credentials authenticate the reload and health check requests
+	credentials *stepCredentials
+}
+
+func parseReloadStep(spec string) (*reloadStep, error) {
+	pairs := [][2]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected key=value in %q", pair)
+		}
+		pairs = append(pairs, [2]string{kv[0], kv[1]})
+	}
+	return newReloadStep(spec, pairs)
+}
+
+// newReloadStep builds a step from the key value pairs of a --notify spec, or the equivalent
+// notifier in the config file. desc identifies the step in errors.
+func newReloadStep(desc string, pairs [][2]string) (*reloadStep, error) {
+	step := &reloadStep{}
+	presetName, auth, credentials := "", "", ""
+	for _, pair := range pairs {
+		key, value := pair[0], pair[1]
+
+		switch key {
+		case "name":
+			step.name = value
+		case "preset":
+			presetName = value
+		case "url":
+			step.url = value
+		case "health":
+			step.health = strings.Split(value, "|")
+		case "files":
+			step.files = strings.Split(value, "|")
+		case "verify":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				// allow verify=true to use the default verification window
+				enabled, boolErr := strconv.ParseBool(value)
+				if boolErr != nil {
+					return nil, fmt.Errorf("invalid verify value %q", value)
+				}
+				d = 0
+				if enabled {
+					d = defaultVerifyWindow()
+				}
+			}
+			step.verify = d
+		case "signal":
+			sig, err := parseSignal(value)
+			if err != nil {
+				return nil, err
+			}
+			step.signal = sig
+		case "process":
+			step.process = value
+		case "pid-file":
+			step.pidFile = value
+		case "auth":
+			auth = value
+		case "credentials":
+			credentials = value
+		case "on-failure":
+			switch value {
+			case "stop":
+				step.continueOnError = false
+			case "continue":
+				step.continueOnError = true
+			default:
+				return nil, fmt.Errorf("on-failure must be stop or continue, got %q", value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+
+	if auth != "" || credentials != "" {
+		c, err := parseStepCredentials(auth, credentials)
+		if err != nil {
+			return nil, fmt.Errorf("step %q: %v", desc, err)
+		}
+		step.credentials = c
+	}
+
+	if presetName != "" {
+		p, err := lookupPreset(presetName)
+		if err != nil {
+			return nil, err
+		}
+		p.apply(step)
+		if step.name == "" {
+			step.name = presetName
+		}
+	}
+
+	if step.signal != 0 {
+		if step.process == "" && step.pidFile == "" {
+			return nil, fmt.Errorf("step %q sends a signal but has no process or pid-file", desc)
+		}
+		if step.name == "" {
+			step.name = step.process
+		}
+	} else if step.url == "" {
+		return nil, fmt.Errorf("step %q has no url", desc)
+	}
+	if step.name == "" {
+		step.name = step.url
+	}
+	return step, nil
+}
+
+// parseReloadSteps builds the reload sequence from the --notify flags, falling back to a
+// single step for the --mode service when none are given.
+func parseReloadSteps(specs []string, prometheusURL string) ([]*reloadStep, error) {
+	if len(specs) == 0 {
+		p, err := lookupPreset(*mode)
+		if err != nil {
+			return nil, err
+		}
+		step := &reloadStep{name: *mode, verify: *verifyWindow}
+		if flagWasSet("prometheus-url") {
+			step.url = prometheusURL
+		}
+		p.apply(step)
+		// as the only service notified, every change concerns it, but the validators still
+		// only check the files the preset is about
+		step.validators = nil
+		for _, v := range p.validators {
+			if len(v.files) == 0 {
+				v.files = p.files
+			}
+			step.validators = append(step.validators, v)
+		}
+		step.files = nil
+		return []*reloadStep{step}, nil
+	}
+
+	steps := []*reloadStep{}
+	for _, spec := range specs {
+		step, err := parseReloadStep(spec)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func defaultVerifyWindow() time.Duration {
+	if *verifyWindow > 0 {
+		return *verifyWindow
+	}
+	return 30 * time.Second
+}
+
+// healthURLs returns the configured health checks, or ones derived from the reload url.
+func (s *reloadStep) healthURLs() ([]string, error) {
+	if len(s.health) > 0 {
+		return s.health, nil
+	}
+	if s.url == "" {
+		return nil, fmt.Errorf("%v has no health endpoints", s.name)
+	}
+	return healthEndpoints(s.url)
+}
+
+// checksProcess reports whether the step's health is whether its process is running, as for
+// signal steps without health endpoints.
+func (s *reloadStep) checksProcess() bool {
+	return s.signal != 0 && len(s.health) == 0
+}
+
+// run reloads the service, recording the attempt and any failure.
+func (s *reloadStep) run(ctx context.Context) error {
+	_, span := tracer.Start(ctx, "reload "+s.name, trace.WithAttributes(attribute.String("step", s.name)))
+	reloadAttempts.WithLabelValues(s.name).Inc()
+	start := time.Now()
+	err := s.reload()
+	reloadDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+	board.stepFinished(s.name, err)
+	switch {
+	case isDegraded(err):
+		stepDegraded.WithLabelValues(s.name).Set(1)
+	case err != nil:
+		reloadFailures.WithLabelValues(s.name).Inc()
+	default:
+		stepDegraded.WithLabelValues(s.name).Set(0)
+	}
+	endSpan(span, err)
+	return err
+}
+
+// reload notifies the service and, when configured, waits for it to become healthy.
+func (s *reloadStep) reload() error {
+	switch {
+	case s.noReload:
+		log.Debugf("%v picks up changes on its own, not sending a reload", s.name)
+	case s.signal != 0:
+		err := signalReload(s.name, s.signal, s.process, s.pidFile)
+		audit.record(auditEntry{Action: "reload", Step: s.name, Signal: s.signal.String(), Result: resultString(err), Error: errorString(err)})
+		if err != nil {
+			return err
+		}
+	default:
+		if err := postReload(s.name, s.url, s.credentials); err != nil {
+			return err
+		}
+	}
+	if s.verify <= 0 {
+		return nil
+	}
+	if s.checksProcess() {
+		return verifyRunning(s.name, s.process, s.pidFile, s.verify)
+	}
+	endpoints, err := s.healthURLs()
+	if err != nil {
+		return fmt.Errorf("unable to determine health endpoints for %v: %v", s.name, err)
+	}
+	return verifyHealthy(s.name, endpoints, s.verify, s.credentials)
+}
+
+// runSteps runs the reload sequence in order for the steps interested in the changes,
+// stopping at the first failure, including a service left degraded by its reload, unless the
+// step allows continuing. A degraded step that was continued past is returned once the rest
+// ran.
+func runSteps(ctx context.Context, steps []*reloadStep, changes changeSet) (*reloadStep, error) {
+	var degraded *reloadStep
+	var degradedErr error
+	// a step without globs runs for the changes no other step reloads, so a modules.yml
+	// claimed by an exporter doesn't also reload Prometheus
+	claimed := [][]string{}
+	for _, step := range steps {
+		if len(step.files) > 0 && !step.noReload {
+			claimed = append(claimed, step.files)
+		}
+	}
+	for _, step := range steps {
+		relevant := changes.matches(step.files)
+		if len(step.files) == 0 {
+			relevant = changes.matchesUnclaimed(claimed)
+		}
+		if !relevant {
+			log.Debugf("No changes relevant to %v, skipping", step.name)
+			continue
+		}
+
+		if *dryRun {
+			log.Infof("Dry run: would reload %v", step.name)
+			continue
+		}
+		log.Debugf("Reloading %v", step.name)
+		if err := step.run(ctx); err != nil {
+			if isDegraded(err) {
+				if !step.continueOnError {
+					err.(*degradedError).stopped = true
+					return step, err
+				}
+				log.WithError(err).Warnf("%v is degraded, continuing with the remaining steps", step.name)
+				if degraded == nil {
+					degraded, degradedErr = step, err
+				}
+				continue
+			}
+			if step.continueOnError {
+				log.WithError(err).Warnf("Reloading %v failed, continuing with the remaining steps", step.name)
+				continue
+			}
+			return step, fmt.Errorf("reloading %v failed: %v", step.name, err)
+		}
+	}
+	return degraded, degradedErr
+}
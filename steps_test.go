@@ -0,0 +1,190 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServices serves reload and health endpoints below /<name>/ for any service name,
+// recording the order reloads arrive in. Services named broken* reject the reload and
+// services named sick* take it but never become healthy.
+type testServices struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	reloaded []string
+}
+
+func newTestServices(t *testing.T) *testServices {
+	services := &testServices{}
+	services.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		name := parts[0]
+		switch {
+		case r.Method == http.MethodPost:
+			services.mu.Lock()
+			services.reloaded = append(services.reloaded, name)
+			services.mu.Unlock()
+			if strings.HasPrefix(name, "broken") {
+				http.Error(w, "bad config", http.StatusInternalServerError)
+			}
+		case strings.HasPrefix(name, "sick"):
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(services.server.Close)
+	reloadClient = services.server.Client()
+
+	interval := *verifyInterval
+	*verifyInterval = 10 * time.Millisecond
+	t.Cleanup(func() { *verifyInterval = interval })
+	return services
+}
+
+// step builds a step named name reloading through the test server, with any further
+// --notify keys.
+func (s *testServices) step(t *testing.T, name string, keys ...string) *reloadStep {
+	spec := "name=" + name + ",url=" + s.server.URL + "/" + name + "/-/reload"
+	if len(keys) > 0 {
+		spec += "," + strings.Join(keys, ",")
+	}
+	step, err := parseReloadStep(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return step
+}
+
+func TestRunSteps(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps [][]string
+		// changes are the changed files, every file when nil
+		changes  []string
+		reloaded []string
+		// failed is the step returned, if any
+		failed   string
+		degraded bool
+		stopped  bool
+	}{
+		{
+			name:     "in order",
+			steps:    [][]string{{"a"}, {"b"}, {"c"}},
+			reloaded: []string{"a", "b", "c"},
+		},
+		{
+			name:     "only steps whose files changed",
+			steps:    [][]string{{"a", "files=a*.yml"}, {"b", "files=b*.yml"}},
+			changes:  []string{"b.yml"},
+			reloaded: []string{"b"},
+		},
+		{
+			name:     "file claimed by a step with globs",
+			steps:    [][]string{{"prometheus"}, {"blackbox", "preset=blackbox-exporter"}},
+			changes:  []string{"modules.yml"},
+			reloaded: []string{"blackbox"},
+		},
+		{
+			name:     "unclaimed file",
+			steps:    [][]string{{"prometheus"}, {"blackbox", "preset=blackbox-exporter"}},
+			changes:  []string{"prometheus.yml"},
+			reloaded: []string{"prometheus"},
+		},
+		{
+			name:     "files of a step that doesn't reload aren't claimed",
+			steps:    [][]string{{"prometheus"}, {"query", "preset=thanos-query"}},
+			changes:  []string{"targets.json"},
+			reloaded: []string{"prometheus"},
+		},
+		{
+			name:     "failure stops the sequence",
+			steps:    [][]string{{"broken"}, {"b"}},
+			reloaded: []string{"broken"},
+			failed:   "broken",
+		},
+		{
+			name:     "failure continued past",
+			steps:    [][]string{{"broken", "on-failure=continue"}, {"b"}},
+			reloaded: []string{"broken", "b"},
+		},
+		{
+			name:     "degraded stops the sequence",
+			steps:    [][]string{{"sick", "verify=50ms"}, {"b"}},
+			reloaded: []string{"sick"},
+			failed:   "sick",
+			degraded: true,
+			stopped:  true,
+		},
+		{
+			name:     "degraded continued past",
+			steps:    [][]string{{"sick", "verify=50ms", "on-failure=continue"}, {"b"}},
+			reloaded: []string{"sick", "b"},
+			failed:   "sick",
+			degraded: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			services := newTestServices(t)
+			steps := []*reloadStep{}
+			for _, keys := range test.steps {
+				steps = append(steps, services.step(t, keys[0], keys[1:]...))
+			}
+			changes := changeSet{all: test.changes == nil}
+			for _, name := range test.changes {
+				changes.add("/config", "/config/"+name)
+			}
+
+			step, err := runSteps(context.Background(), steps, changes)
+			if !reflect.DeepEqual(services.reloaded, test.reloaded) {
+				t.Errorf("reloaded %v, want %v", services.reloaded, test.reloaded)
+			}
+			failed := ""
+			if step != nil {
+				failed = step.name
+			}
+			if failed != test.failed {
+				t.Errorf("returned step %q, want %q", failed, test.failed)
+			}
+			if (err != nil) != (test.failed != "" || test.degraded) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if isDegraded(err) != test.degraded {
+				t.Fatalf("degraded error %v, want degraded %v", err, test.degraded)
+			}
+			if test.degraded && err.(*degradedError).stopped != test.stopped {
+				t.Errorf("stopped %v, want %v", err.(*degradedError).stopped, test.stopped)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	tlsCertFile     = flag.String("tls-cert-file", "", "Certificate the HTTP server serves TLS with. The certificate and key are loaded again when they change on disk.")
+	tlsKeyFile      = flag.String("tls-key-file", "", "Private key for --tls-cert-file.")
+	tlsClientCAFile = flag.String("tls-client-ca-file", "", "CA bundle client certificates are verified against, requiring clients to present one.")
+)
+
+// certReloader serves the certificate in the cert and key files, loading them again when
+// their modification time changes, as when cert-manager renews a mounted secret.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu              sync.Mutex
+	cert            *tls.Certificate
+	certMod, keyMod time.Time
+	checked         time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) load() error {
+	certStat, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyStat, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && certStat.ModTime().Equal(c.certMod) && keyStat.ModTime().Equal(c.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		log.WithField("file", c.certFile).Info("Loaded renewed TLS certificate")
+	}
+	c.cert, c.certMod, c.keyMod = &cert, certStat.ModTime(), keyStat.ModTime()
+	return nil
+}
+
+// getCertificate is the tls.Config hook, checking the files at most once a second.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) > time.Second {
+		c.checked = time.Now()
+		if err := c.load(); err != nil {
+			// the files may be part way through being replaced, keep serving the old ones
+			log.WithField("file", c.certFile).WithError(err).Warn("Unable to load TLS certificate, serving the previous one")
+		}
+	}
+	return c.cert, nil
+}
+
+// serverTLSConfig is the TLS config for the HTTP server, nil when TLS isn't configured.
+func serverTLSConfig() (*tls.Config, error) {
+	if *tlsCertFile == "" && *tlsKeyFile == "" {
+		return nil, nil
+	}
+	if *tlsCertFile == "" || *tlsKeyFile == "" {
+		return nil, fmt.Errorf("--tls-cert-file and --tls-key-file are both needed")
+	}
+	certs, err := newCertReloader(*tlsCertFile, *tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %v", err)
+	}
+	config := &tls.Config{GetCertificate: certs.getCertificate, MinVersion: tls.VersionTLS12}
+	if *tlsClientCAFile != "" {
+		ca, err := ioutil.ReadFile(*tlsClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %v", *tlsClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// clientTLSConfig is the TLS config for connecting to a service, verifying it with the CA
+// certificates in caFile, or the system roots, and presenting certFile when set.
+func clientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %v", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
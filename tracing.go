@@ -0,0 +1,104 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	otlpEndpoint     = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint spans are exported to, such as http://otel-collector:4318. Tracing is disabled when unset. The standard OTEL_EXPORTER_OTLP_* variables are also honored.")
+	traceSampleRatio = flag.Float64("trace-sample-ratio", 1, "Fraction of config rollouts that are traced.")
+)
+
+// tracer is a no-op until configureTracing installs an exporting provider.
+var tracer = otel.Tracer("github.com/khaines/prom-config-watcher")
+
+// configureTracing sets up span export, returning a function that flushes pending spans.
+func configureTracing() (func(), error) {
+	if *otlpEndpoint == "" {
+		return func() {}, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(*otlpEndpoint))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*traceSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("prom-config-watcher"))),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("github.com/khaines/prom-config-watcher")
+	log.Infof("Exporting traces to %v", *otlpEndpoint)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.WithError(err).Warn("Error flushing traces")
+		}
+	}, nil
+}
+
+// endSpan records err on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// fileAttr is the attribute used for file names on spans and span events.
+func fileAttr(name string) attribute.KeyValue {
+	return attribute.String("file", name)
+}
+
+// startReloadSpan starts the span covering a reload sequence. Reloads coalesce changes from
+// several rollouts, so the span continues the trace of the newest and links the others.
+func startReloadSpan(rollouts []trace.SpanContext) (context.Context, trace.Span) {
+	ctx := context.Background()
+	var links []trace.Link
+	if n := len(rollouts); n > 0 {
+		ctx = trace.ContextWithSpanContext(ctx, rollouts[n-1])
+		for _, rollout := range rollouts[:n-1] {
+			links = append(links, trace.Link{SpanContext: rollout})
+		}
+	}
+	return tracer.Start(ctx, "reload", trace.WithLinks(links...))
+}
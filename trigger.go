@@ -0,0 +1,79 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// triggerRequest asks the watch loop to run a pipeline straight away with a full reload, or
+// every pipeline when pipeline is empty.
+type triggerRequest struct {
+	pipeline string
+	reply    chan error
+}
+
+// triggerHandler forces a re-render and reload on POST, of the pipeline named by ?pipeline=
+// or of them all.
+func triggerHandler(requests chan<- triggerRequest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		request := triggerRequest{pipeline: r.URL.Query().Get("pipeline"), reply: make(chan error, 1)}
+		requests <- request
+		if err := <-request.reply; err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		audit.record(auditEntry{Action: "trigger", Pipeline: request.pipeline, User: requester(r), Result: "ok"})
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "triggered")
+	}
+}
+
+func pipelineOrAll(name string) string {
+	if name == "" {
+		return "all pipelines"
+	}
+	return "pipeline " + name
+}
+
+// forceNamed forces the named pipeline, or all of them when name is empty.
+func (p *pipelineLoops) forceNamed(name string) error {
+	if name == "" {
+		p.force()
+		return nil
+	}
+	loop, found := p.loops[name]
+	if !found {
+		return fmt.Errorf("no pipeline named %q", name)
+	}
+	loop.force()
+	return nil
+}
@@ -0,0 +1,267 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	uploadURL      = flag.String("upload-url", "", "Object store prefix, as s3://bucket/prefix or gs://bucket/prefix, the rendered files are uploaded to after every successful run, along with a manifest listing them. Files no longer rendered are deleted. Pipelines from --config with remote_sinks upload to a prefix named after them below it, unless they set upload_url.")
+	uploadOnly     = flag.Bool("upload-only", false, "Deliver the rendered files only to --upload-url, writing nothing to the target path.")
+	uploadManifest = flag.String("upload-manifest", "manifest.json", "Name of the manifest uploaded with the rendered files. It is written last, so readers that follow it see a complete set.")
+)
+
+// objectStore is a bucket the rendered files are uploaded to.
+type objectStore interface {
+	put(key string, content []byte) error
+	// get returns nil for a missing object
+	get(key string) ([]byte, error)
+	delete(key string) error
+}
+
+// uploadedManifest lists the files of an upload.
+type uploadedManifest struct {
+	Generated time.Time      `json:"generated"`
+	Hash      string         `json:"hash"`
+	Files     []uploadedFile `json:"files"`
+}
+
+type uploadedFile struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Size   int    `json:"size"`
+}
+
+// uploadSink uploads the rendered files to an object store prefix.
+type uploadSink struct {
+	url    string
+	store  objectStore
+	prefix string
+	// uploaded is the manifest last written, nil until it has been read from the store
+	uploaded *uploadedManifest
+}
+
+// checkUploadURL checks an upload url up front, as sinks are built without returning errors.
+func checkUploadURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	scheme, bucket, _ := splitUploadURL(raw)
+	if bucket == "" || (scheme != "s3" && scheme != "gs") {
+		return fmt.Errorf("invalid upload url %q, expected s3://bucket/prefix or gs://bucket/prefix", raw)
+	}
+	if scheme == "s3" && *awsRegion == "" {
+		return fmt.Errorf("uploading to %v needs --aws-region or AWS_REGION", raw)
+	}
+	return nil
+}
+
+func splitUploadURL(raw string) (string, string, string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", ""
+	}
+	return u.Scheme, u.Host, strings.Trim(u.Path, "/")
+}
+
+// newUploadSink builds the sink for a url that passed checkUploadURL.
+func newUploadSink(raw string) *uploadSink {
+	scheme, bucket, prefix := splitUploadURL(raw)
+	u := &uploadSink{url: raw, prefix: prefix}
+	if scheme == "s3" {
+		aws, _ := newAWSClient()
+		u.store = &s3Store{aws: aws, bucket: bucket}
+	} else {
+		u.store = &gcsStore{gcp: newGCPClient(), endpoint: gcsEndpoint(), bucket: bucket}
+	}
+	return u
+}
+
+func (u *uploadSink) name() string {
+	return "upload " + u.url
+}
+
+func (u *uploadSink) files() []string {
+	return nil
+}
+
+// write uploads the files whose content differs from the last manifest, deletes those that
+// are no longer rendered and then replaces the manifest.
+func (u *uploadSink) write(logger *log.Entry, files []renderedFile) error {
+	if u.uploaded == nil {
+		previous, err := u.readManifest()
+		if err != nil {
+			return fmt.Errorf("reading the manifest: %v", err)
+		}
+		u.uploaded = previous
+	}
+	previous := map[string]string{}
+	for _, file := range u.uploaded.Files {
+		previous[file.Name] = file.SHA256
+	}
+
+	manifest := &uploadedManifest{Generated: time.Now().UTC(), Hash: renderHash(files)}
+	if manifest.Hash == u.uploaded.Hash {
+		logger.Debugf("Rendered files are already uploaded to %v", u.url)
+		return nil
+	}
+	current := map[string]bool{}
+	for _, file := range files {
+		if file.name == *uploadManifest {
+			return fmt.Errorf("rendered file %v has the name of the manifest", file.name)
+		}
+		sum := sha256Hex(file.content)
+		manifest.Files = append(manifest.Files, uploadedFile{Name: file.name, SHA256: sum, Size: len(file.content)})
+		current[file.name] = true
+		if previous[file.name] == sum {
+			continue
+		}
+		logger.WithField("file", file.name).Debugf("Uploading to %v", u.url)
+		if err := u.store.put(u.key(file.name), file.content); err != nil {
+			// read the manifest again next time, as the uploads are part way through
+			u.uploaded = nil
+			return fmt.Errorf("uploading %v: %v", file.name, err)
+		}
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Name < manifest.Files[j].Name })
+	for name := range previous {
+		if current[name] {
+			continue
+		}
+		logger.WithField("file", name).Debugf("Deleting from %v", u.url)
+		if err := u.store.delete(u.key(name)); err != nil {
+			u.uploaded = nil
+			return fmt.Errorf("deleting %v: %v", name, err)
+		}
+	}
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := u.store.put(u.key(*uploadManifest), body); err != nil {
+		u.uploaded = nil
+		return fmt.Errorf("uploading the manifest: %v", err)
+	}
+	u.uploaded = manifest
+	logger.Infof("Uploaded %d files to %v", len(manifest.Files), u.url)
+	return nil
+}
+
+// readManifest reads the manifest of an earlier upload, which is empty when there is none.
+func (u *uploadSink) readManifest() (*uploadedManifest, error) {
+	body, err := u.store.get(u.key(*uploadManifest))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &uploadedManifest{}
+	if body != nil {
+		if err := json.Unmarshal(body, manifest); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+func (u *uploadSink) key(name string) string {
+	return path.Join(u.prefix, name)
+}
+
+// s3Store is an S3 bucket, addressed as the s3 source does.
+type s3Store struct {
+	aws    *awsClient
+	bucket string
+}
+
+func (s *s3Store) put(key string, content []byte) error {
+	_, err := s.aws.rest(http.MethodPut, "s3", s3ObjectURL(s.aws.region, s.bucket, key), nil, content)
+	return err
+}
+
+func (s *s3Store) get(key string) ([]byte, error) {
+	body, err := s.aws.rest(http.MethodGet, "s3", s3ObjectURL(s.aws.region, s.bucket, key), nil, nil)
+	if failure, ok := err.(*awsStatusError); ok && failure.status == http.StatusNotFound {
+		return nil, nil
+	}
+	return body, err
+}
+
+func (s *s3Store) delete(key string) error {
+	_, err := s.aws.rest(http.MethodDelete, "s3", s3ObjectURL(s.aws.region, s.bucket, key), nil, nil)
+	return err
+}
+
+// gcsStore is a Cloud Storage bucket.
+type gcsStore struct {
+	gcp      *gcpClient
+	endpoint string
+	bucket   string
+}
+
+func (g *gcsStore) put(key string, content []byte) error {
+	query := url.Values{"uploadType": {"media"}, "name": {key}}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%v/upload/storage/v1/b/%v/o?%v", g.endpoint, url.PathEscape(g.bucket), query.Encode()), bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return g.gcp.do(req, nil)
+}
+
+func (g *gcsStore) get(key string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, g.objectURL(key)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	var content []byte
+	err = g.gcp.do(req, &content)
+	if failure, ok := err.(*gcpStatusError); ok && failure.status == http.StatusNotFound {
+		return nil, nil
+	}
+	return content, err
+}
+
+func (g *gcsStore) delete(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, g.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	return g.gcp.do(req, nil)
+}
+
+func (g *gcsStore) objectURL(key string) string {
+	return fmt.Sprintf("%v/storage/v1/b/%v/o/%v", g.endpoint, url.PathEscape(g.bucket), url.PathEscape(key))
+}
@@ -0,0 +1,134 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// validator checks rendered files before they are written to the target path. files
+// restricts which rendered file names it applies to, defaulting to the files of the step
+// using it. All rendered files are passed along for validators that need to resolve
+// references between files.
+type validator struct {
+	name     string
+	files    []string
+	validate func(file renderedFile, all []renderedFile) error
+	// validateStaged replaces validate for tools that only read config from disk. dir
+	// holds every rendered file, staged under the target path as the one place decrypted
+	// config may be written.
+	validateStaged func(file renderedFile, dir string) error
+}
+
+// validateFiles runs every validator against the rendered files it applies to, reporting
+// all failures rather than stopping at the first.
+func validateFiles(logger *log.Entry, targetPath string, files []renderedFile, validators []validator) error {
+	failures := []string{}
+	staged := ""
+	defer func() {
+		if staged != "" {
+			os.RemoveAll(staged)
+		}
+	}()
+	for _, v := range validators {
+		for _, file := range files {
+			if !matchesGlobs(file.name, v.files) {
+				continue
+			}
+			fileLogger := logger.WithField("file", file.name)
+			fileLogger.Debugf("Validating as %v config", v.name)
+			var err error
+			switch {
+			case v.validateStaged == nil:
+				err = v.validate(file, files)
+			case staged == "":
+				if staged, err = stageRendered(targetPath, files); err == nil {
+					err = v.validateStaged(file, staged)
+				}
+			default:
+				err = v.validateStaged(file, staged)
+			}
+			if err != nil {
+				fileLogger.WithError(err).Warnf("Failed %v validation", v.name)
+				validationFailures.WithLabelValues(v.name).Inc()
+				failures = append(failures, fmt.Sprintf("%v: %v", file.name, err))
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d validation failure(s): %v", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// stageRendered writes the rendered files to a private directory under the target path,
+// which the caller removes once they have been validated.
+func stageRendered(targetPath string, files []renderedFile) (string, error) {
+	if err := ensureDir(targetPath); err != nil {
+		return "", fmt.Errorf("unable to stage rendered config: %v", err)
+	}
+	dir, err := ioutil.TempDir(targetPath, ".validate-")
+	if err != nil {
+		return "", fmt.Errorf("unable to stage rendered config: %v", err)
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(path.Join(dir, f.name), f.content, 0600); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("unable to stage rendered config: %v", err)
+		}
+	}
+	return dir, nil
+}
+
+// stepValidators collects the validators for the presets used by the reload steps.
+func stepValidators(steps []*reloadStep) []validator {
+	seen := map[string]bool{}
+	validators := []validator{}
+	for _, step := range steps {
+		for _, v := range step.validators {
+			if len(v.files) == 0 {
+				v.files = step.files
+			}
+			if len(v.files) == 0 {
+				v.files = []string{"*.yml", "*.yaml"}
+			}
+
+			key := v.name + ":" + strings.Join(v.files, "|")
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			validators = append(validators, v)
+		}
+	}
+	return validators
+}
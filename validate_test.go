@@ -0,0 +1,132 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// validatorFiles lists the validators by name with the files each applies to.
+func validatorFiles(validators []validator) []string {
+	got := []string{}
+	for _, v := range validators {
+		got = append(got, v.name+"="+strings.Join(v.files, "|"))
+	}
+	return got
+}
+
+func TestStepValidators(t *testing.T) {
+	tests := []struct {
+		name       string
+		specs      []string
+		validators []string
+	}{
+		{
+			name:       "no validation",
+			specs:      []string{"preset=prometheus"},
+			validators: []string{},
+		},
+		{
+			name:       "preset files",
+			specs:      []string{"preset=alertmanager"},
+			validators: []string{"alertmanager=alertmanager*.yml|alertmanager*.yaml"},
+		},
+		{
+			name:       "step files",
+			specs:      []string{"preset=thanos-rule"},
+			validators: []string{"thanos-rule=*.rules.yml|*.rules.yaml"},
+		},
+		{
+			name:       "files given on the step",
+			specs:      []string{"preset=thanos-rule,files=rules/*.yml"},
+			validators: []string{"thanos-rule=rules/*.yml"},
+		},
+		{
+			name:       "validator's own files",
+			specs:      []string{"preset=alertmanager,files=am/*"},
+			validators: []string{"alertmanager=alertmanager*.yml|alertmanager*.yaml"},
+		},
+		{
+			name:       "in step order",
+			specs:      []string{"preset=prometheus", "preset=snmp-exporter", "preset=blackbox-exporter"},
+			validators: []string{"snmp-exporter=snmp*.yml|snmp*.yaml", "blackbox-exporter=blackbox*.yml|blackbox*.yaml|modules.yml|modules.yaml"},
+		},
+		{
+			name:       "shared by steps",
+			specs:      []string{"name=east,preset=vmalert,url=http://east:8880/-/reload", "name=west,preset=vmalert,url=http://west:8880/-/reload"},
+			validators: []string{"vmalert=*.rules.yml|*.rules.yaml"},
+		},
+		{
+			name:       "files differing between steps",
+			specs:      []string{"name=east,preset=vmalert,files=east/*.yml", "name=west,preset=vmalert,files=west/*.yml"},
+			validators: []string{"vmalert=east/*.yml", "vmalert=west/*.yml"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			steps, err := parseReloadSteps(test.specs, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := validatorFiles(stepValidators(steps)); !reflect.DeepEqual(got, test.validators) {
+				t.Errorf("validators %v, want %v", got, test.validators)
+			}
+		})
+	}
+}
+
+func TestModeValidators(t *testing.T) {
+	defer func(m string) { *mode = m }(*mode)
+	tests := []struct {
+		mode       string
+		validators []string
+	}{
+		{"prometheus", []string{}},
+		{"vmalert", []string{"vmalert=*.rules.yml|*.rules.yaml"}},
+		{"alertmanager", []string{"alertmanager=alertmanager*.yml|alertmanager*.yaml"}},
+		{"alloy", []string{"alloy=*.alloy|*.river"}},
+	}
+	for _, test := range tests {
+		*mode = test.mode
+		steps, err := parseReloadSteps(nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the only step reloads for every change, while validation keeps to the preset's files
+		if len(steps) != 1 || len(steps[0].files) != 0 {
+			t.Fatalf("--mode %v gave steps %+v, want a single step for every file", test.mode, steps)
+		}
+		if got := validatorFiles(stepValidators(steps)); !reflect.DeepEqual(got, test.validators) {
+			t.Errorf("--mode %v validators %v, want %v", test.mode, got, test.validators)
+		}
+	}
+
+	*mode = "unknown"
+	if _, err := parseReloadSteps(nil, ""); err == nil {
+		t.Error("expected an unknown --mode to be refused")
+	}
+}
@@ -0,0 +1,263 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	vaultAddress        = flag.String("vault-address", os.Getenv("VAULT_ADDR"), "Address of a Vault server, enabling ${vault:path#key} references in source files. Defaults to VAULT_ADDR.")
+	vaultNamespace      = flag.String("vault-namespace", os.Getenv("VAULT_NAMESPACE"), "Vault Enterprise namespace. Defaults to VAULT_NAMESPACE.")
+	vaultTokenFile      = flag.String("vault-token-file", "", "File holding a Vault token, read again whenever a new token is needed.")
+	vaultKubernetesRole = flag.String("vault-kubernetes-role", "", "Role to log in to Vault's Kubernetes auth method with, using the pod's service account token. Used instead of --vault-token-file.")
+	vaultKubernetesPath = flag.String("vault-kubernetes-mount", "kubernetes", "Mount path of Vault's Kubernetes auth method.")
+	vaultOnError        = flag.String("vault-on-error", "use-cached", "What to do when Vault can't be read: use-cached to keep rendering with the last values read, or fail the render. Either way the config already written stays in place.")
+)
+
+// vaultClient reads secrets from Vault, logging in with a token file or Kubernetes auth and
+// keeping its token renewed.
+type vaultClient struct {
+	address string
+	client  *http.Client
+
+	mu        sync.Mutex
+	token     string
+	renewable bool
+	expires   time.Time
+}
+
+func newVaultClient() (*vaultClient, error) {
+	if *vaultTokenFile == "" && *vaultKubernetesRole == "" {
+		return nil, fmt.Errorf("--vault-token-file or --vault-kubernetes-role is needed to authenticate")
+	}
+	if *vaultOnError != "fail" && *vaultOnError != "use-cached" {
+		return nil, fmt.Errorf("unknown --vault-on-error policy %q, expected fail or use-cached", *vaultOnError)
+	}
+	v := &vaultClient{address: strings.TrimSuffix(*vaultAddress, "/"), client: reloadClient}
+	// Vault being down at startup shouldn't stop the watcher, renders using it fail until
+	// the login succeeds in the background
+	if err := v.login(); err != nil {
+		log.WithError(err).Error("Unable to log in to Vault, retrying in the background")
+	}
+	go v.renewToken()
+	return v, nil
+}
+
+// vaultStatusError is an error response from Vault.
+type vaultStatusError struct {
+	status int
+	errors []string
+}
+
+func (e *vaultStatusError) Error() string {
+	if len(e.errors) > 0 {
+		return fmt.Sprintf("vault returned status %v: %v", e.status, strings.Join(e.errors, "; "))
+	}
+	return fmt.Sprintf("vault returned status %v", e.status)
+}
+
+// vaultResponse holds the parts of Vault's responses the watcher uses.
+type vaultResponse struct {
+	LeaseDuration int                    `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+func (v *vaultClient) request(method string, path string, token string, body interface{}) (*vaultResponse, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, v.address+"/v1/"+strings.TrimPrefix(path, "/"), reader)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if *vaultNamespace != "" {
+		req.Header.Set("X-Vault-Namespace", *vaultNamespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		vaultUp.Set(0)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	vaultUp.Set(float64(boolValue(resp.StatusCode < 500)))
+	decoded := &vaultResponse{}
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	json.Unmarshal(respBody, decoded)
+	if resp.StatusCode/100 != 2 {
+		return nil, &vaultStatusError{status: resp.StatusCode, errors: decoded.Errors}
+	}
+	return decoded, nil
+}
+
+// login gets a new token from the token file or through Kubernetes auth.
+func (v *vaultClient) login() error {
+	if *vaultKubernetesRole == "" {
+		token, err := readSecretFile(*vaultTokenFile)
+		if err != nil {
+			return err
+		}
+		self, err := v.request(http.MethodGet, "auth/token/lookup-self", token, nil)
+		if err != nil {
+			return fmt.Errorf("looking up token: %v", err)
+		}
+		ttl, _ := self.Data["ttl"].(float64)
+		renewable, _ := self.Data["renewable"].(bool)
+		v.setToken(token, time.Duration(ttl)*time.Second, renewable)
+		return nil
+	}
+
+	jwt, err := readSecretFile(serviceAccountDir + "/token")
+	if err != nil {
+		return err
+	}
+	resp, err := v.request(http.MethodPost, "auth/"+*vaultKubernetesPath+"/login", "", map[string]string{"role": *vaultKubernetesRole, "jwt": jwt})
+	if err != nil {
+		return fmt.Errorf("kubernetes login: %v", err)
+	}
+	if resp.Auth == nil {
+		return fmt.Errorf("kubernetes login returned no token")
+	}
+	v.setToken(resp.Auth.ClientToken, time.Duration(resp.Auth.LeaseDuration)*time.Second, resp.Auth.Renewable)
+	return nil
+}
+
+func (v *vaultClient) setToken(token string, ttl time.Duration, renewable bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.token = token
+	v.renewable = renewable
+	v.expires = time.Time{}
+	if ttl > 0 {
+		v.expires = time.Now().Add(ttl)
+	}
+	vaultTokenExpiry.Set(unixSeconds(v.expires))
+}
+
+func (v *vaultClient) currentToken() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.token
+}
+
+// renewToken renews the token when two thirds of its TTL have passed, logging in again when
+// it can't be renewed or has expired. Failed logins are retried with backoff.
+func (v *vaultClient) renewToken() {
+	retry := 5 * time.Second
+	for {
+		v.mu.Lock()
+		token, expires, renewable := v.token, v.expires, v.renewable
+		v.mu.Unlock()
+		if token != "" {
+			if expires.IsZero() {
+				// tokens without a TTL never expire
+				return
+			}
+			time.Sleep(time.Until(expires) * 2 / 3)
+			if renewable && time.Now().Before(expires) {
+				resp, err := v.request(http.MethodPost, "auth/token/renew-self", token, nil)
+				if err == nil && resp.Auth != nil {
+					v.setToken(resp.Auth.ClientToken, time.Duration(resp.Auth.LeaseDuration)*time.Second, resp.Auth.Renewable)
+					log.Debug("Renewed Vault token")
+					retry = 5 * time.Second
+					continue
+				}
+				log.WithError(err).Warn("Unable to renew Vault token, logging in again")
+			}
+		}
+		if err := v.login(); err != nil {
+			log.WithError(err).Errorf("Unable to log in to Vault, retrying in %v", retry)
+			time.Sleep(retry)
+			if retry < 5*time.Minute {
+				retry *= 2
+			}
+			continue
+		}
+		log.Info("Logged in to Vault")
+		secrets.recovered("vault")
+		retry = 5 * time.Second
+	}
+}
+
+// resolve reads path#key, taking the key from the data of KV version 2 secrets and from the
+// top level data of everything else.
+func (v *vaultClient) resolve(ref string) (secretValue, error) {
+	secretPath, key := ref, ""
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		secretPath, key = ref[:i], ref[i+1:]
+	}
+	if key == "" {
+		return secretValue{}, fmt.Errorf("expected path#key")
+	}
+	token := v.currentToken()
+	if token == "" {
+		return secretValue{}, fmt.Errorf("not logged in to Vault")
+	}
+	resp, err := v.request(http.MethodGet, secretPath, token, nil)
+	if statusErr, isStatus := err.(*vaultStatusError); isStatus && statusErr.status == http.StatusForbidden {
+		// the token may have been revoked or expired early, log in again and retry once
+		if loginErr := v.login(); loginErr == nil {
+			resp, err = v.request(http.MethodGet, secretPath, v.currentToken(), nil)
+		}
+	}
+	if err != nil {
+		return secretValue{}, err
+	}
+	data := resp.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	value, found := data[key]
+	if !found {
+		return secretValue{}, fmt.Errorf("secret has no key %q", key)
+	}
+	return secretValue{value: fmt.Sprint(value), lease: time.Duration(resp.LeaseDuration) * time.Second}, nil
+}
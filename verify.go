@@ -0,0 +1,147 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	verifyWindow   = flag.Duration("verify-window", 0, "How long to wait after a reload for Prometheus to report healthy and ready before flagging it as degraded. 0 disables verification.")
+	verifyInterval = flag.Duration("verify-interval", 2*time.Second, "How often the Prometheus health endpoints are polled while verifying a reload.")
+)
+
+// degradedError reports a service that took the reload but wasn't healthy afterwards. The
+// reload went through, so it is reported rather than retried or counted by the breaker.
+type degradedError struct {
+	step string
+	err  error
+	// stopped is set when the sequence stopped at the step, leaving later steps unreloaded
+	stopped bool
+}
+
+func (e *degradedError) Error() string {
+	if e.stopped {
+		return fmt.Sprintf("%v degraded after reload, not reloading the remaining steps: %v", e.step, e.err)
+	}
+	return fmt.Sprintf("%v degraded after reload: %v", e.step, e.err)
+}
+
+func isDegraded(err error) bool {
+	_, ok := err.(*degradedError)
+	return ok
+}
+
+// healthEndpoints derives the /-/healthy and /-/ready urls from the reload url.
+func healthEndpoints(reloadURL string) ([]string, error) {
+	u, err := url.Parse(reloadURL)
+	if err != nil {
+		return nil, err
+	}
+	base := strings.TrimSuffix(u.Path, "/reload")
+
+	endpoints := []string{}
+	for _, name := range []string{"/healthy", "/ready"} {
+		endpoint := *u
+		endpoint.Path = base + name
+		endpoint.RawQuery = ""
+		endpoints = append(endpoints, endpoint.String())
+	}
+	return endpoints, nil
+}
+
+// verifyRunning checks a signalled process keeps running through the verification window, as
+// a process that can't load its new config usually exits soon after being signalled.
+func verifyRunning(name string, process string, pidFile string, window time.Duration) error {
+	deadline := time.Now().Add(window)
+	for {
+		if err := processRunning(process, pidFile); err != nil {
+			log.WithError(err).Warnf("%v is degraded, not running after reload", name)
+			return &degradedError{step: name, err: err}
+		}
+		if !time.Now().Before(deadline) {
+			log.Debugf("%v is still running %v after reload", name, window)
+			return nil
+		}
+		wait := *verifyInterval
+		if remaining := time.Until(deadline); remaining < wait {
+			wait = remaining
+		}
+		time.Sleep(wait)
+	}
+}
+
+func checkEndpoint(endpoint string, credentials *stepCredentials) error {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if err := credentials.apply(req); err != nil {
+		return err
+	}
+	resp, err := reloadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v returned status %v", endpoint, resp.StatusCode)
+	}
+	return nil
+}
+
+// verifyHealthy polls the health endpoints until they all succeed or the verification
+// window expires, in which case the reload is considered degraded.
+func verifyHealthy(name string, endpoints []string, window time.Duration, credentials *stepCredentials) error {
+	deadline := time.Now().Add(window)
+	var err error
+	for {
+		err = nil
+		for _, endpoint := range endpoints {
+			if err = checkEndpoint(endpoint, credentials); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			log.Debugf("%v is healthy and ready after reload", name)
+			return nil
+		}
+		log.Debugf("%v not yet ready after reload: %v", name, err)
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(*verifyInterval)
+	}
+
+	log.WithError(err).Warnf("%v is degraded, not healthy and ready within %v of reload", name, window)
+	return &degradedError{step: name, err: err}
+}
@@ -0,0 +1,238 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var skipInitialRun = flag.Bool("skip-initial-run", false, "Don't process the config and reload at startup, only once something changes. The target path is assumed to be up to date, so the watcher is ready straight away.")
+
+// pipelineLoop runs a pipeline whenever its watched path changes, handing the changes that
+// need a reload to the reloader shared by all pipelines.
+type pipelineLoop struct {
+	pipe      *pipeline
+	reloads   *reloader
+	listeners []func(rendered []renderedFile, err error)
+	// skipInitialRun waits for a change before the first run
+	skipInitialRun bool
+
+	stop    chan struct{}
+	stopped chan struct{}
+	updates chan *pipeline
+	forced  chan struct{}
+
+	stateRequests chan chan loopState
+}
+
+// start watches the pipeline's path and runs the loop in the background.
+func (l *pipelineLoop) start() error {
+	l.stop = make(chan struct{})
+	l.stopped = make(chan struct{})
+	l.updates = make(chan *pipeline)
+	l.forced = make(chan struct{}, 1)
+	l.stateRequests = make(chan chan loopState)
+	fileChanges, err := startWatchingPath(l.pipe.watchPath, l.stop)
+	if err != nil {
+		return err
+	}
+	go l.run(fileChanges)
+	return nil
+}
+
+// update replaces the pipeline's settings, which must keep the same watch path, and runs it
+// again with a full reload.
+func (l *pipelineLoop) update(pipe *pipeline) {
+	l.updates <- pipe
+}
+
+// force runs the pipeline straight away with a full reload, without waiting for a change.
+func (l *pipelineLoop) force() {
+	select {
+	case l.forced <- struct{}{}:
+	default:
+	}
+}
+
+// close stops the loop and its watcher. A run in progress is finished first, stopped is
+// closed once the loop has exited.
+func (l *pipelineLoop) close() {
+	close(l.stop)
+}
+
+func (l *pipelineLoop) run(fileChanges chan fileChange) {
+	defer close(l.stopped)
+	watchPath := l.pipe.watchPath
+	lastConfigProcess := time.Time{}
+	// initializing config change to now will trigger an initial run to process the config files
+	lastConfigChange := time.Now()
+	// the initial run reloads everything
+	changes := changeSet{all: true}
+	delayTimer := time.NewTimer(0)
+	// timerDue is when the delay timer fires, kept for state dumps
+	timerDue := time.Now()
+	resetTimer := func(d time.Duration) {
+		delayTimer.Reset(d)
+		timerDue = time.Now().Add(d)
+	}
+	if l.skipInitialRun {
+		lastConfigChange = time.Time{}
+		changes = changeSet{}
+		markProcessed(l.pipe.name)
+	}
+	// rollout spans a batch of changes from the first event until the files are written,
+	// with debounce covering the wait for further changes
+	var rollout, debounce trace.Span
+	rolloutCtx := context.Background()
+	// start of the batch of changes waiting for the delay timer, zero when none are waiting
+	var batchStart time.Time
+	seen := map[string]bool{}
+	heartbeats := time.NewTicker(heartbeatInterval)
+	approved := approvals.approvedChannel(l.pipe.name)
+	loopHeartbeat.beat()
+
+	defer heartbeats.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			if rollout != nil {
+				rollout.End()
+			}
+			return
+		case <-heartbeats.C:
+			loopHeartbeat.beat()
+		case <-approved:
+			// run again to write the approved render
+			lastConfigChange = time.Now()
+			resetTimer(0)
+		case reply := <-l.stateRequests:
+			reply <- loopState{
+				Pipeline:      l.pipe.name,
+				WatchPath:     l.pipe.watchPath,
+				TargetPath:    l.pipe.targetPath,
+				Pending:       changes.state(),
+				BatchStart:    batchStart,
+				LastChange:    lastConfigChange,
+				LastProcess:   lastConfigProcess,
+				TimerDue:      timerDue,
+				RolloutActive: rollout != nil,
+			}
+		case <-l.forced:
+			changes.all = true
+			lastConfigChange = time.Now()
+			resetTimer(0)
+		case pipe := <-l.updates:
+			l.pipe = pipe
+			changes.all = true
+			lastConfigChange = time.Now()
+			resetTimer(0)
+		case change := <-fileChanges:
+			eventsReceived.Inc()
+			audit.record(auditEntry{Action: "event", Pipeline: l.pipe.name, File: change.name})
+			if batchStart.IsZero() {
+				batchStart = time.Now()
+			} else {
+				debounceResets.WithLabelValues(watchPath).Inc()
+			}
+			if seen[change.name] {
+				eventsCoalesced.WithLabelValues(watchPath).Inc()
+			}
+			seen[change.name] = true
+			lastConfigChange = change.modTime
+			if rollout == nil {
+				rolloutCtx, rollout = tracer.Start(context.Background(), "config rollout")
+				_, debounce = tracer.Start(rolloutCtx, "debounce")
+			}
+			rollout.AddEvent("file change", trace.WithAttributes(fileAttr(change.name)))
+			if matchesGlobs(relativeName(watchPath, change.name), l.pipe.reloadOn) {
+				changes.add(watchPath, change.name)
+			} else {
+				log.Debugf("%v does not match --reload-on, it will not trigger a reload", change.name)
+			}
+			// reset the delay timer in case other changes are triggered rapidly
+			resetTimer(*processDelayTime)
+
+		case <-delayTimer.C:
+			// process delay timer has tripped, process the config files.
+			if !batchStart.IsZero() {
+				debounceWindow.Observe(time.Since(batchStart).Seconds())
+				batchStart = time.Time{}
+				seen = map[string]bool{}
+			}
+			if !lastConfigProcess.Before(lastConfigChange) {
+				continue
+			}
+			if rollout == nil {
+				rolloutCtx, rollout = tracer.Start(context.Background(), "config rollout")
+			}
+			if debounce != nil {
+				debounce.End()
+			}
+			runID := newRunID()
+			rendered, err := l.pipe.process(rolloutCtx, runID)
+			lastConfigProcess = time.Now()
+			if err == errAwaitingApproval {
+				// the changes stay pending until the approved render is written
+				rollout.End()
+				rollout, debounce = nil, nil
+				continue
+			}
+			processingRuns.WithLabelValues(runResult(err)).Inc()
+			for _, listener := range l.listeners {
+				listener(rendered, err)
+			}
+			if !changes.empty() {
+				changes.rollouts = append(changes.rollouts, rollout.SpanContext())
+			}
+			endSpan(rollout, err)
+			rollout, debounce = nil, nil
+			if _, invalid := err.(*validationError); invalid {
+				// leave the changes pending so the next successful run reloads them
+				board.runHandedOn(l.pipe, runID, false)
+				runWebhooks.runFinished(l.pipe, runID, rendered, err, false)
+				continue
+			}
+			if err == nil {
+				markProcessed(l.pipe.name)
+				hash := renderHash(rendered)
+				generations.rendered(hash)
+				changes.generation = hash
+			}
+			board.runHandedOn(l.pipe, runID, !changes.empty())
+			runWebhooks.runFinished(l.pipe, runID, rendered, err, !changes.empty())
+			if !changes.empty() {
+				changes.runs = append(changes.runs, runID)
+				l.reloads.trigger(changes)
+				changes = changeSet{}
+			}
+		}
+	}
+}
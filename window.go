@@ -0,0 +1,199 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var maintenanceWindowSpecs stringList
+
+func init() {
+	flag.Var(&maintenanceWindowSpecs, "maintenance-window", "Window during which reloads are deferred, as a 5 field cron expression for the window start followed by its duration, e.g. \"0 2 * * 1-5 2h\". Times are in the local time zone. May be repeated.")
+}
+
+// cronSchedule matches times against a standard 5 field cron expression
+// (minute, hour, day of month, month, day of week).
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid range %q", part)
+				}
+			} else if step > 1 {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in cron expression %q", spec)
+	}
+
+	var err error
+	c := &cronSchedule{
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	// allow 7 as an alias for sunday
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 || c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	// as with cron, when both day fields are restricted either one may match
+	if !c.domAny && !c.dowAny {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+type maintenanceWindow struct {
+	spec     string
+	schedule *cronSchedule
+	duration time.Duration
+}
+
+func parseMaintenanceWindow(spec string) (*maintenanceWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("maintenance window %q must be a cron expression followed by a duration", spec)
+	}
+	schedule, err := parseCron(strings.Join(fields[:5], " "))
+	if err != nil {
+		return nil, fmt.Errorf("maintenance window %q: %v", spec, err)
+	}
+	duration, err := time.ParseDuration(fields[5])
+	if err != nil || duration <= 0 {
+		return nil, fmt.Errorf("maintenance window %q has an invalid duration", spec)
+	}
+	return &maintenanceWindow{spec: spec, schedule: schedule, duration: duration}, nil
+}
+
+// end returns when the window covering t closes, or the zero time if t is outside the window.
+func (w *maintenanceWindow) end(t time.Time) time.Time {
+	var end time.Time
+	start := t.Truncate(time.Minute)
+	for elapsed := time.Duration(0); elapsed < w.duration+time.Minute; elapsed += time.Minute {
+		candidate := start.Add(-elapsed)
+		if w.schedule.matches(candidate) && t.Before(candidate.Add(w.duration)) && candidate.Add(w.duration).After(end) {
+			end = candidate.Add(w.duration)
+		}
+	}
+	return end
+}
+
+func parseMaintenanceWindows(specs []string) ([]*maintenanceWindow, error) {
+	windows := []*maintenanceWindow{}
+	for _, spec := range specs {
+		w, err := parseMaintenanceWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// deferredUntil returns when reloads may resume if t falls within any maintenance window,
+// following overlapping or back to back windows. The zero time means reloads are allowed.
+func deferredUntil(windows []*maintenanceWindow, t time.Time) time.Time {
+	var until time.Time
+	for extended := true; extended; {
+		extended = false
+		check := t
+		if !until.IsZero() {
+			check = until
+		}
+		for _, w := range windows {
+			if end := w.end(check); end.After(until) {
+				until = end
+				extended = true
+			}
+		}
+	}
+	return until
+}
@@ -0,0 +1,260 @@
+/*
+MIT License
+
+Copyright (c) 2018 Ken Haines
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// zkWatchTimeout is how long to wait for a watch to fire before the tree is read again.
+	zkWatchTimeout = 5 * time.Minute
+	// zkSessionTimeout is the session timeout asked for, the server may choose another.
+	zkSessionTimeout = 30 * time.Second
+)
+
+var (
+	zkServers       = flag.String("zookeeper-servers", "127.0.0.1:2181", "Comma separated ZooKeeper servers, tried in turn.")
+	zkSource        = flag.String("zookeeper-source", "", "ZooKeeper path whose subtree is written to --zookeeper-source-dir: znodes without children become files holding their data. Changes are picked up straight away with watches.")
+	zkSourceDir     = flag.String("zookeeper-source-dir", "/var/lib/prom-config-watcher/zookeeper", "Directory the znodes of --zookeeper-source are written to.")
+	zkRetryInterval = flag.Duration("zookeeper-retry-interval", 10*time.Second, "How long to wait before reading --zookeeper-source again after a failure.")
+	zkDigestFile    = flag.String("zookeeper-digest-file", "", "File holding user:password to authenticate to ZooKeeper with the digest scheme.")
+)
+
+// zkSync mirrors a ZooKeeper subtree.
+type zkSync struct {
+	servers []string
+	root    string
+	// synced is set once the tree has been written, from then on fetch waits for watches
+	synced bool
+	mirror *sourceMirror
+}
+
+func configureZooKeeperSource() error {
+	if *zkSource == "" {
+		return nil
+	}
+	if !strings.HasPrefix(*zkSource, "/") {
+		return fmt.Errorf("--zookeeper-source %q must be an absolute znode path", *zkSource)
+	}
+	z := &zkSync{root: *zkSource}
+	if z.root != "/" {
+		z.root = strings.TrimSuffix(z.root, "/")
+	}
+	for _, server := range strings.Split(*zkServers, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			z.servers = append(z.servers, server)
+		}
+	}
+	if len(z.servers) == 0 {
+		return fmt.Errorf("--zookeeper-servers is empty")
+	}
+	mirror, err := addMirror("zookeeper", "zookeeper "+z.root, *zkSourceDir, *zkRetryInterval, z.fetch)
+	if err != nil {
+		return err
+	}
+	z.mirror = mirror
+	return nil
+}
+
+// fetch reads the tree and, once it has been written before, waits for a watch to fire if
+// it is unchanged. A session only lasts one fetch, so the watches are set again each time.
+func (z *zkSync) fetch() (bool, error) {
+	conn, err := z.connect()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	tree, err := readZKTree(conn, z.root, z.synced)
+	if err != nil {
+		return false, err
+	}
+	if z.synced {
+		if changed, err := mirrorFiles(z.mirror.dir, tree.files); err != nil || changed {
+			return changed, err
+		}
+		select {
+		case <-tree.fired():
+		case <-time.After(zkWatchTimeout):
+		}
+		if tree, err = readZKTree(conn, z.root, false); err != nil {
+			return false, err
+		}
+	}
+	changed, err := mirrorFiles(z.mirror.dir, tree.files)
+	if err == nil {
+		z.synced = true
+	}
+	return changed, err
+}
+
+// connect waits for the client to establish a session, authenticating it when
+// --zookeeper-digest-file is set.
+func (z *zkSync) connect() (*zk.Conn, error) {
+	conn, events, err := zk.Connect(z.servers, zkSessionTimeout, zk.WithLogger(zkLogger{}))
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.After(*reloadTimeout)
+	for {
+		select {
+		case event := <-events:
+			switch event.State {
+			case zk.StateHasSession:
+				if *zkDigestFile != "" {
+					digest, err := readSecretFile(*zkDigestFile)
+					if err == nil {
+						err = conn.AddAuth("digest", []byte(digest))
+					}
+					if err != nil {
+						conn.Close()
+						return nil, err
+					}
+				}
+				return conn, nil
+			case zk.StateAuthFailed:
+				conn.Close()
+				return nil, fmt.Errorf("zookeeper: authentication failed")
+			}
+		case <-timeout:
+			conn.Close()
+			return nil, fmt.Errorf("zookeeper %v: no session within %v", strings.Join(z.servers, ","), *reloadTimeout)
+		}
+	}
+}
+
+// zkLogger sends the ZooKeeper client's connection messages to the debug log.
+type zkLogger struct{}
+
+func (zkLogger) Printf(format string, args ...interface{}) {
+	log.Debugf("ZooKeeper: "+format, args...)
+}
+
+// zkTree is a subtree read from ZooKeeper, keyed by path relative to its root, along with the
+// watches left on it.
+type zkTree struct {
+	conn    *zk.Conn
+	watch   bool
+	files   map[string][]byte
+	watches []<-chan zk.Event
+}
+
+// readZKTree reads the znodes under root, optionally leaving watches on all of them. A
+// missing root is an empty tree, watched for its creation.
+func readZKTree(conn *zk.Conn, root string, watch bool) (*zkTree, error) {
+	t := &zkTree{conn: conn, watch: watch, files: map[string][]byte{}}
+	err := t.walk(root, "")
+	if err == zk.ErrNoNode {
+		if watch {
+			_, _, w, err := conn.ExistsW(root)
+			if err != nil {
+				return nil, err
+			}
+			t.watches = append(t.watches, w)
+		}
+		return t, nil
+	}
+	return t, err
+}
+
+func (t *zkTree) walk(path string, name string) error {
+	children, err := t.children(path)
+	if err != nil {
+		return err
+	}
+	if len(children) == 0 {
+		if name == "" {
+			return nil
+		}
+		data, err := t.data(path)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			data = []byte{}
+		}
+		t.files[name] = data
+		return nil
+	}
+	sort.Strings(children)
+	for _, child := range children {
+		childPath := strings.TrimSuffix(path, "/") + "/" + child
+		childName := child
+		if name != "" {
+			childName = name + "/" + child
+		}
+		// children deleted while walking are skipped, their parent's watch has fired
+		if err := t.walk(childPath, childName); err != nil && err != zk.ErrNoNode {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *zkTree) children(path string) ([]string, error) {
+	if !t.watch {
+		children, _, err := t.conn.Children(path)
+		return children, err
+	}
+	children, _, w, err := t.conn.ChildrenW(path)
+	if err == nil {
+		t.watches = append(t.watches, w)
+	}
+	return children, err
+}
+
+func (t *zkTree) data(path string) ([]byte, error) {
+	if !t.watch {
+		data, _, err := t.conn.Get(path)
+		return data, err
+	}
+	data, _, w, err := t.conn.GetW(path)
+	if err == nil {
+		t.watches = append(t.watches, w)
+	}
+	return data, err
+}
+
+// fired returns a channel that is closed once any of the watches fires. Closing the
+// connection fires them all.
+func (t *zkTree) fired() <-chan struct{} {
+	fired := make(chan struct{})
+	var once sync.Once
+	for _, w := range t.watches {
+		go func(w <-chan zk.Event) {
+			<-w
+			once.Do(func() { close(fired) })
+		}(w)
+	}
+	return fired
+}